@@ -13,13 +13,16 @@ pub struct DeletePayload {
     pub status: String,
 }
 
-pub fn delete(host: &str, token: &str, id: &str) -> Result<()> {
+pub fn delete(host: &str, token: &str, id: &str, recursive: bool) -> Result<()> {
     let client = build_client()?;
     let mut url = build_endpoint_url(host, "/delete")?;
     {
         let mut pairs = url.query_pairs_mut();
         pairs.clear();
         pairs.append_pair("id", id);
+        if recursive {
+            pairs.append_pair("recursive", "true");
+        }
     }
 
     let response = client
@@ -1,7 +1,7 @@
 use crate::cleanup::{TempCleanupGuard, track_temp_file, untrack_temp_file};
 use crate::constants::CLIENT_HEADER_VALUE;
 use crate::http::{build_client, build_endpoint_url, parse_json};
-use crate::list::ListResponse;
+use crate::list::{ListResponse, fetch_remaining_pages, listing_url};
 use crate::progress::{self, ActiveConnectionGuard, PARTIAL_STATE_UPDATE_THRESHOLD};
 use crate::retry::retry;
 use anyhow::{Context, Result, anyhow};
@@ -1411,12 +1411,7 @@ fn fetch_listing_optional(client: &Client, host: &str, id: &str) -> Result<Optio
     }
 
     fn try_fetch(client: &Client, host: &str, id: &str) -> Result<ListingProbe> {
-        let mut url = build_endpoint_url(host, "/list")?;
-        {
-            let mut pairs = url.query_pairs_mut();
-            pairs.clear();
-            pairs.append_pair("id", id);
-        }
+        let url = listing_url(host, id, 1)?;
         let response = client
             .get(url.clone())
             .header("X-Serve-Client", CLIENT_HEADER_VALUE)
@@ -1459,7 +1454,10 @@ fn fetch_listing_optional(client: &Client, host: &str, id: &str) -> Result<Optio
     }
 
     match try_fetch(client, host, id)? {
-        ListingProbe::Listing(listing) => Ok(Some(listing)),
+        ListingProbe::Listing(mut listing) => {
+            fetch_remaining_pages(client, host, id, &mut listing)?;
+            Ok(Some(listing))
+        }
         ListingProbe::NotDirectory | ListingProbe::NotFound => Ok(None),
     }
 }
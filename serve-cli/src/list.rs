@@ -1,6 +1,8 @@
 use crate::constants::CLIENT_HEADER_VALUE;
 use crate::http::{build_client, build_endpoint_url, parse_json};
 use anyhow::{Context, Result};
+use reqwest::Url;
+use reqwest::blocking::Client;
 use reqwest::header::ACCEPT;
 use serde::Deserialize;
 use tabled::{Table, Tabled, settings::Style};
@@ -9,10 +11,75 @@ use tabled::{Table, Tabled, settings::Style};
 pub struct ListResponse {
     pub path: String,
     pub entries: Vec<ListEntry>,
+    /// Page count of a paginated listing; absent from servers that send everything at once.
+    #[serde(default)]
+    pub pages: Option<usize>,
+    /// Token for the page after this one; absent from servers without cursor paging.
+    #[serde(default)]
+    pub next_cursor: Option<String>,
     #[serde(default)]
     pub powered_by: Option<String>,
 }
 
+/// Page size requested from the server, its upper limit, so large directories take as
+/// few requests as possible.
+const LIST_PAGE_SIZE: &str = "10000";
+
+/// Fetches the rest of a listing whose first page is `first` and appends the entries.
+/// Cursors are followed when the server sends them, so entries added or removed while
+/// paging are neither repeated nor skipped; older servers are paged by number.
+pub fn fetch_remaining_pages(
+    client: &Client,
+    host: &str,
+    id: &str,
+    first: &mut ListResponse,
+) -> Result<()> {
+    if first.next_cursor.is_some() {
+        while let Some(cursor) = first.next_cursor.take() {
+            let mut url = listing_url(host, id, 1)?;
+            url.query_pairs_mut().append_pair("cursor", &cursor);
+            let payload = fetch_page(client, url)?;
+            first.entries.extend(payload.entries);
+            first.next_cursor = payload.next_cursor;
+        }
+        return Ok(());
+    }
+
+    let pages = first.pages.unwrap_or(1);
+    for page in 2..=pages {
+        let payload = fetch_page(client, listing_url(host, id, page)?)?;
+        first.entries.extend(payload.entries);
+    }
+    Ok(())
+}
+
+fn fetch_page(client: &Client, url: Url) -> Result<ListResponse> {
+    let response = client
+        .get(url.clone())
+        .header("X-Serve-Client", CLIENT_HEADER_VALUE)
+        .header(ACCEPT, "application/json")
+        .send()
+        .with_context(|| format!("request failed for {}", url))?
+        .error_for_status()
+        .with_context(|| format!("server returned error for {}", url))?;
+    parse_json(response)
+}
+
+/// `/list` URL for one page of directory `id`.
+pub fn listing_url(host: &str, id: &str, page: usize) -> Result<Url> {
+    let mut url = build_endpoint_url(host, "/list")?;
+    {
+        let mut pairs = url.query_pairs_mut();
+        pairs.clear();
+        pairs.append_pair("id", id);
+        pairs.append_pair("per_page", LIST_PAGE_SIZE);
+        if page > 1 {
+            pairs.append_pair("page", &page.to_string());
+        }
+    }
+    Ok(url)
+}
+
 #[derive(Debug, Deserialize)]
 pub struct ListEntry {
     #[serde(default)]
@@ -55,12 +122,7 @@ struct TableEntry {
 
 pub fn list(host: &str, id: &str) -> Result<()> {
     let client = build_client()?;
-    let mut url = build_endpoint_url(host, "/list")?;
-    {
-        let mut pairs = url.query_pairs_mut();
-        pairs.clear();
-        pairs.append_pair("id", id);
-    }
+    let url = listing_url(host, id, 1)?;
 
     let response = client
         .get(url.clone())
@@ -71,7 +133,8 @@ pub fn list(host: &str, id: &str) -> Result<()> {
         .error_for_status()
         .with_context(|| format!("server returned error for {}", url))?;
 
-    let payload: ListResponse = parse_json(response)?;
+    let mut payload: ListResponse = parse_json(response)?;
+    fetch_remaining_pages(&client, host, id, &mut payload)?;
 
     if let Some(powered) = payload.powered_by {
         if !powered.is_empty() {
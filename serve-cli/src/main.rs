@@ -199,6 +199,12 @@ enum Command {
         bypass: bool,
         #[arg(long, default_value_t = false, help = "Use streaming upload")]
         stream: bool,
+        #[arg(
+            long,
+            value_parser = ["rename", "reject", "overwrite"],
+            help = "What to do when the name is taken (server default: rename)"
+        )]
+        conflict: Option<String>,
     },
     /// List directory contents from the server
     List {
@@ -226,6 +232,8 @@ enum Command {
         target: CatalogIdArg,
         #[arg(long, help = "Delete token (X-Serve-Token)")]
         token: Option<String>,
+        #[arg(long, help = "Delete directories that are not empty")]
+        recursive: bool,
     },
     /// Interactive configuration helper
     Setup,
@@ -285,6 +293,7 @@ fn main() -> Result<()> {
             allow_no_ext,
             bypass,
             stream,
+            conflict,
         } => {
             let resolved_host = resolve_host(host, &app_config);
             let resolved_token = resolve_token(token, &app_config)?;
@@ -298,6 +307,7 @@ fn main() -> Result<()> {
                 effective_allow,
                 bypass,
                 stream,
+                conflict.as_deref(),
                 retry_attempts,
             )
         }
@@ -315,11 +325,12 @@ fn main() -> Result<()> {
             host,
             target,
             token,
+            recursive,
         } => {
             let resolved_host = resolve_host(host, &app_config);
             let resolved_token = resolve_token(token, &app_config)?;
             let entry_id = target.required("delete ID")?;
-            delete::delete(&resolved_host, &resolved_token, &entry_id)
+            delete::delete(&resolved_host, &resolved_token, &entry_id, recursive)
         }
         Command::Setup => run_setup(config.as_deref(), &app_config),
         Command::Version => {
@@ -25,6 +25,8 @@ pub struct UploadResponse {
     pub download_url: String,
     pub list_url: String,
     #[serde(default)]
+    pub sha256: Option<String>,
+    #[serde(default)]
     pub powered_by: String,
 }
 
@@ -36,6 +38,7 @@ pub fn upload(
     allow_no_ext: bool,
     bypass_ext: bool,
     stream: bool,
+    conflict: Option<&str>,
     max_retries: usize,
 ) -> Result<()> {
     let client = build_client()?;
@@ -67,6 +70,7 @@ pub fn upload(
             allow_no_ext,
             bypass_ext,
             stream,
+            conflict,
             file_size,
             &file_name,
         )
@@ -82,6 +86,7 @@ fn perform_upload_attempt(
     allow_no_ext: bool,
     bypass_ext: bool,
     stream: bool,
+    conflict: Option<&str>,
     file_size: u64,
     file_name: &str,
 ) -> Result<()> {
@@ -115,6 +120,9 @@ fn perform_upload_attempt(
         if bypass_ext {
             request = request.header("X-Allow-All-Ext", "true");
         }
+        if let Some(conflict) = conflict {
+            request = request.header("X-Upload-Conflict", conflict);
+        }
 
         execute_request(request, &progress)?
     } else {
@@ -146,6 +154,9 @@ fn perform_upload_attempt(
         if bypass_ext {
             request = request.header("X-Allow-All-Ext", "true");
         }
+        if let Some(conflict) = conflict {
+            request = request.header("X-Upload-Conflict", conflict);
+        }
 
         execute_request(request, &progress)?
     };
@@ -165,6 +176,9 @@ fn perform_upload_attempt(
     println!("Download: {}", data.download_url);
     println!("List: {}", data.list_url);
     println!("Created: {}", data.created_date);
+    if let Some(sha256) = &data.sha256 {
+        println!("SHA-256: {}", sha256);
+    }
     if !data.powered_by.is_empty() {
         println!("Server: {}", data.powered_by);
     }
@@ -190,7 +204,7 @@ fn execute_request(request: RequestBuilder, progress: &ProgressBar) -> Result<Re
         .text()
         .unwrap_or_else(|err| format!("failed to read error body: {err}"));
     progress.finish_and_clear();
-    let detail = body.trim();
+    let detail = error_detail(&body);
     if detail.is_empty() {
         Err(anyhow!(
             "server returned error for upload (status {status})"
@@ -202,6 +216,20 @@ fn execute_request(request: RequestBuilder, progress: &ProgressBar) -> Result<Re
     }
 }
 
+/// JSON error bodies carry a stable `code` next to the message; show both.
+fn error_detail(body: &str) -> String {
+    #[derive(Deserialize)]
+    struct ErrorBody {
+        code: String,
+        message: String,
+    }
+
+    match serde_json::from_str::<ErrorBody>(body) {
+        Ok(error) => format!("{} [{}]", error.message, error.code),
+        Err(_) => body.trim().to_string(),
+    }
+}
+
 struct ProgressReader<R> {
     inner: R,
     progress: ProgressBar,
@@ -0,0 +1,235 @@
+//! Live activity feed for `GET /logtail`. A tracing layer republishes the tagged log lines
+//! (`[uploading]`, `[downloading]`, `[limit]`, ...) to server-sent-event subscribers, so a
+//! dashboard can follow activity without tailing a log file.
+
+use std::convert::Infallible;
+use std::fmt;
+use std::sync::LazyLock;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::time::Duration;
+
+use axum::extract::State;
+use axum::http::HeaderMap;
+use axum::response::sse::{Event, KeepAlive, Sse};
+use futures_util::Stream;
+use serde::Serialize;
+use tokio::sync::broadcast;
+use tracing::field::{Field, Visit};
+use tracing_subscriber::layer::{Context, Layer};
+
+use crate::http_utils::auth_token;
+use crate::{AppError, AppState};
+
+pub(crate) const LOGTAIL_PATH: &str = "/logtail";
+
+/// Events buffered per subscriber; one that falls further behind is disconnected rather
+/// than slowing down or growing memory for everyone else.
+const EVENT_BUFFER: usize = 256;
+const MAX_SUBSCRIBERS: usize = 16;
+const KEEP_ALIVE: Duration = Duration::from_secs(15);
+
+static HUB: LazyLock<ActivityHub> = LazyLock::new(ActivityHub::new);
+
+#[derive(Clone, Debug, Serialize)]
+pub(crate) struct ActivityEvent {
+    pub(crate) time: String,
+    pub(crate) level: String,
+    /// The bracketed tag without brackets, e.g. `uploading`.
+    pub(crate) kind: String,
+    pub(crate) message: String,
+}
+
+struct ActivityHub {
+    sender: broadcast::Sender<ActivityEvent>,
+    subscribers: AtomicUsize,
+}
+
+impl ActivityHub {
+    fn new() -> Self {
+        let (sender, _) = broadcast::channel(EVENT_BUFFER);
+        Self {
+            sender,
+            subscribers: AtomicUsize::new(0),
+        }
+    }
+
+    fn subscribe(&'static self) -> Option<Subscription> {
+        let claimed = self
+            .subscribers
+            .fetch_update(Ordering::AcqRel, Ordering::Acquire, |count| {
+                (count < MAX_SUBSCRIBERS).then_some(count + 1)
+            });
+        claimed.ok().map(|_| Subscription {
+            hub: self,
+            receiver: self.sender.subscribe(),
+        })
+    }
+}
+
+struct Subscription {
+    hub: &'static ActivityHub,
+    receiver: broadcast::Receiver<ActivityEvent>,
+}
+
+impl Drop for Subscription {
+    fn drop(&mut self) {
+        self.hub.subscribers.fetch_sub(1, Ordering::AcqRel);
+    }
+}
+
+/// Tracing layer feeding the hub. It only formats events while someone is subscribed.
+pub(crate) struct ActivityLayer;
+
+impl<S: tracing::Subscriber> Layer<S> for ActivityLayer {
+    fn on_event(&self, event: &tracing::Event<'_>, _ctx: Context<'_, S>) {
+        if HUB.sender.receiver_count() == 0 {
+            return;
+        }
+        let mut visitor = MessageVisitor(String::new());
+        event.record(&mut visitor);
+        let Some((kind, message)) = split_tag(&visitor.0) else {
+            return;
+        };
+        let _ = HUB.sender.send(ActivityEvent {
+            time: chrono::Utc::now().to_rfc3339_opts(chrono::SecondsFormat::Millis, true),
+            level: event.metadata().level().to_string(),
+            kind: kind.to_string(),
+            message: message.to_string(),
+        });
+    }
+}
+
+struct MessageVisitor(String);
+
+impl Visit for MessageVisitor {
+    fn record_debug(&mut self, field: &Field, value: &dyn fmt::Debug) {
+        if field.name() == "message" {
+            self.0 = format!("{value:?}");
+        }
+    }
+
+    fn record_str(&mut self, field: &Field, value: &str) {
+        if field.name() == "message" {
+            self.0 = value.to_string();
+        }
+    }
+}
+
+/// `"[uploading] 1.2.3.4 - a.txt"` -> `("uploading", "1.2.3.4 - a.txt")`.
+fn split_tag(message: &str) -> Option<(&str, &str)> {
+    let rest = message.strip_prefix('[')?;
+    let (kind, message) = rest.split_once(']')?;
+    if kind.is_empty() || kind.contains(char::is_whitespace) {
+        return None;
+    }
+    Some((kind, message.trim_start()))
+}
+
+/// `GET /logtail`: server-sent events, one JSON [`ActivityEvent`] per `data:` line.
+/// Requires the upload token; at most [`MAX_SUBSCRIBERS`] streams are open at once.
+pub(crate) async fn logtail(
+    State(state): State<AppState>,
+    headers: HeaderMap,
+) -> Result<Sse<impl Stream<Item = Result<Event, Infallible>>>, AppError> {
+    let provided_token = auth_token(&headers);
+    if provided_token.as_deref() != Some(state.config.upload_token.as_str()) {
+        return Err(AppError::Unauthorized("Unauthorized".to_string()));
+    }
+    let subscription = HUB
+        .subscribe()
+        .ok_or_else(|| AppError::TooManyRequests("Too many log subscribers".to_string()))?;
+
+    let stream = futures_util::stream::unfold(subscription, |mut subscription| async move {
+        match subscription.receiver.recv().await {
+            Ok(event) => {
+                let data = serde_json::to_string(&event).unwrap_or_default();
+                Some((Ok(Event::default().data(data)), subscription))
+            }
+            Err(broadcast::error::RecvError::Lagged(skipped)) => {
+                tracing::debug!(
+                    "Dropping log subscriber that fell {} events behind",
+                    skipped
+                );
+                None
+            }
+            Err(broadcast::error::RecvError::Closed) => None,
+        }
+    });
+
+    Ok(Sse::new(stream).keep_alive(KeepAlive::new().interval(KEEP_ALIVE)))
+}
+
+#[cfg(test)]
+mod tests {
+    use axum::body::Body;
+    use axum::extract::Query;
+    use axum::http::HeaderValue;
+    use axum::response::IntoResponse;
+    use http_body_util::BodyExt;
+    use tracing_subscriber::layer::SubscriberExt;
+
+    use super::*;
+    use crate::test_support::{TempDir, app_state};
+    use crate::uploads::{UploadStreamQuery, handle_upload_stream};
+
+    #[test]
+    fn only_tagged_lines_become_events() {
+        assert_eq!(
+            split_tag("[uploading] 1.2.3.4 - a.txt"),
+            Some(("uploading", "1.2.3.4 - a.txt"))
+        );
+        assert_eq!(split_tag("Listening on 0.0.0.0:8000"), None);
+        assert_eq!(split_tag("[not a tag] text"), None);
+        assert_eq!(split_tag("[] text"), None);
+    }
+
+    #[tokio::test]
+    async fn uploads_reach_logtail_subscribers() {
+        let _dispatch =
+            tracing::subscriber::set_default(tracing_subscriber::registry().with(ActivityLayer));
+        let dir = TempDir::new();
+        let state = app_state(&dir, "").await;
+        let mut headers = HeaderMap::new();
+        headers.insert("X-Serve-Token", HeaderValue::from_static("abogoboga"));
+
+        let denied = logtail(State(state.clone()), HeaderMap::new()).await;
+        assert!(matches!(denied, Err(AppError::Unauthorized(_))));
+        let mut feed = logtail(State(state.clone()), headers.clone())
+            .await
+            .unwrap()
+            .into_response()
+            .into_body();
+
+        let query = UploadStreamQuery {
+            dir: None,
+            name: Some("report.txt".to_string()),
+            allow_no_ext: None,
+            conflict: None,
+        };
+        handle_upload_stream(
+            State(state),
+            headers,
+            Query(query),
+            None,
+            None,
+            Body::from("report"),
+        )
+        .await
+        .unwrap();
+
+        loop {
+            let frame = feed.frame().await.unwrap().unwrap();
+            let data = String::from_utf8(frame.into_data().unwrap().to_vec()).unwrap();
+            let Some(json) = data.trim().strip_prefix("data:") else {
+                continue;
+            };
+            let event: serde_json::Value = serde_json::from_str(json.trim()).unwrap();
+            if event["kind"] != "uploading" {
+                continue;
+            }
+            assert_eq!(event["level"], "INFO");
+            assert!(event["message"].as_str().unwrap().contains("report.txt"));
+            break;
+        }
+    }
+}
@@ -0,0 +1,662 @@
+//! Directory downloads as archives (`/list?id=<dir>&download=zip|tar.gz`). The archive is
+//! written on a blocking thread while it is sent, so nothing is staged on disk and the
+//! response is chunked; a client that disconnects stops the walk.
+
+use std::collections::{HashSet, VecDeque};
+use std::fs::File;
+use std::io::{self, Write};
+use std::ops::ControlFlow;
+use std::path::{Path, PathBuf};
+use std::sync::{Mutex, PoisonError, mpsc as sync_mpsc};
+
+use axum::body::{Body, Bytes};
+use axum::http::{HeaderMap, StatusCode, header};
+use axum::response::Response;
+use chrono::{Datelike, Local, Timelike};
+use flate2::Compression;
+use flate2::write::GzEncoder;
+use tokio::sync::mpsc;
+use tokio_util::sync::CancellationToken;
+use zip::write::SimpleFileOptions;
+use zip::{CompressionMethod, ZipArchive, ZipWriter};
+
+use crate::config::{Config, ZipCompression};
+use crate::http_utils::{client_ip, client_user_agent, content_disposition};
+use crate::utils::mime_type_for;
+use crate::walk::{SymlinkPolicy, WalkOptions, WalkOutcome, walk_within};
+use crate::{AppError, AppState};
+
+/// Bytes collected before a chunk is handed to the response body.
+const CHUNK_BYTES: usize = 64 * 1024;
+/// Chunks in flight between the writer thread and the connection.
+const CHUNKS_IN_FLIGHT: usize = 8;
+/// Files up to this size are handed to the zip workers; larger ones are written in place,
+/// so the compressed copies held in memory stay small.
+const PARALLEL_ENTRY_MAX_BYTES: u64 = 8 * 1024 * 1024;
+/// Files queued or compressed ahead of the one being written, per worker.
+const ENTRIES_IN_FLIGHT_PER_WORKER: usize = 4;
+
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub(crate) enum ArchiveFormat {
+    Zip,
+    /// Gzipped tar; unlike zip it keeps Unix mode bits.
+    TarGz,
+}
+
+impl ArchiveFormat {
+    /// Parses the `?download=` value.
+    pub(crate) fn from_query(value: &str) -> Option<Self> {
+        match value.trim().to_ascii_lowercase().as_str() {
+            "zip" => Some(ArchiveFormat::Zip),
+            "tar.gz" | "tgz" => Some(ArchiveFormat::TarGz),
+            _ => None,
+        }
+    }
+
+    fn extension(self) -> &'static str {
+        match self {
+            ArchiveFormat::Zip => "zip",
+            ArchiveFormat::TarGz => "tar.gz",
+        }
+    }
+
+    fn content_type(self) -> &'static str {
+        match self {
+            ArchiveFormat::Zip => "application/zip",
+            ArchiveFormat::TarGz => "application/gzip",
+        }
+    }
+}
+
+/// Streams `full_path` (a directory under the root) as an archive named after it.
+/// Blacklisted entries are left out and symlinks are only followed while they stay inside
+/// the root.
+pub(crate) fn archive_directory(
+    state: &AppState,
+    headers: &HeaderMap,
+    relative_path: &str,
+    full_path: PathBuf,
+    format: ArchiveFormat,
+) -> Result<Response, AppError> {
+    let base_name = archive_base_name(relative_path);
+    let file_name = format!("{base_name}.{}", format.extension());
+    let root = state.canonical_root.as_ref().clone();
+    let blacklist = state.config.blacklisted_files.clone();
+    let settings = ZipSettings::from_config(&state.config);
+    stream_archive(
+        headers,
+        relative_path,
+        &file_name,
+        format,
+        move |writer, cancel| {
+            let walk = Walk {
+                root: &root,
+                blacklist: &blacklist,
+                cancel,
+            };
+            match format {
+                ArchiveFormat::Zip => write_zip(&walk, &[(full_path, base_name)], settings, writer),
+                ArchiveFormat::TarGz => write_tar_gz(&walk, &full_path, &base_name, writer),
+            }
+        },
+    )
+}
+
+/// Streams a zip of some entries of one directory, for "Download selected" in the
+/// listing. `members` pairs each checked path with its name in the archive; directories
+/// among them are added whole, under the same rules as [`archive_directory`].
+pub(crate) fn zip_selection(
+    state: &AppState,
+    headers: &HeaderMap,
+    relative_dir: &str,
+    members: Vec<(PathBuf, String)>,
+) -> Result<Response, AppError> {
+    let file_name = format!("{}.zip", archive_base_name(relative_dir));
+    let root = state.canonical_root.as_ref().clone();
+    let blacklist = state.config.blacklisted_files.clone();
+    let settings = ZipSettings::from_config(&state.config);
+    stream_archive(
+        headers,
+        relative_dir,
+        &file_name,
+        ArchiveFormat::Zip,
+        move |writer, cancel| {
+            let walk = Walk {
+                root: &root,
+                blacklist: &blacklist,
+                cancel,
+            };
+            write_zip(&walk, &members, settings, writer)
+        },
+    )
+}
+
+/// Runs `build` on a blocking thread and streams what it writes as the response body.
+/// The archive is built anew for every request, so the response has no `Content-Length`,
+/// refuses ranges (a resume would get different bytes) and must not be cached.
+fn stream_archive<F>(
+    headers: &HeaderMap,
+    relative_path: &str,
+    file_name: &str,
+    format: ArchiveFormat,
+    build: F,
+) -> Result<Response, AppError>
+where
+    F: FnOnce(&mut ChannelWriter, &CancellationToken) -> io::Result<()> + Send + 'static,
+{
+    let body = blocking_body(file_name.to_string(), build);
+
+    tracing::info!(
+        "[downloading] {} - {} - /{} - {}",
+        client_ip(headers),
+        file_name,
+        relative_path,
+        client_user_agent(headers)
+    );
+
+    Response::builder()
+        .status(StatusCode::OK)
+        .header(header::CONTENT_TYPE, format.content_type())
+        .header(
+            header::CONTENT_DISPOSITION,
+            content_disposition("attachment", file_name),
+        )
+        .header(header::ACCEPT_RANGES, "none")
+        .header(header::CACHE_CONTROL, "no-store")
+        .body(body)
+        .map_err(|err| AppError::Internal(err.to_string()))
+}
+
+/// Runs `build` on a blocking thread and returns what it writes as a chunked body. The
+/// token is cancelled as soon as the body is dropped, so a walk can stop between writes
+/// when the client goes away; `log_name` only labels build failures in the log.
+pub(crate) fn blocking_body<F>(log_name: String, build: F) -> Body
+where
+    F: FnOnce(&mut ChannelWriter, &CancellationToken) -> io::Result<()> + Send + 'static,
+{
+    let (sender, receiver) = mpsc::channel::<io::Result<Bytes>>(CHUNKS_IN_FLIGHT);
+    let cancel = CancellationToken::new();
+    let guard = cancel.clone().drop_guard();
+
+    tokio::task::spawn_blocking(move || {
+        let mut writer = ChannelWriter::new(sender);
+        if let Err(err) = build(&mut writer, &cancel) {
+            if err.kind() != io::ErrorKind::BrokenPipe {
+                tracing::error!("Failed to build {}: {}", log_name, err);
+                writer.fail(err);
+            }
+        }
+    });
+
+    let body =
+        futures_util::stream::unfold((receiver, guard), |(mut receiver, guard)| async move {
+            receiver
+                .recv()
+                .await
+                .map(|chunk| (chunk, (receiver, guard)))
+        });
+    Body::from_stream(body)
+}
+
+/// Last path component, or `root` for the served root itself.
+fn archive_base_name(relative_path: &str) -> String {
+    relative_path
+        .trim_matches('/')
+        .rsplit('/')
+        .next()
+        .filter(|name| !name.is_empty())
+        .unwrap_or("root")
+        .to_string()
+}
+
+/// `zip_workers` and `zip_compression`, read once per archive.
+#[derive(Clone, Copy, Debug)]
+struct ZipSettings {
+    workers: usize,
+    compression: ZipCompression,
+}
+
+impl ZipSettings {
+    fn from_config(config: &Config) -> Self {
+        let workers = match config.zip_workers {
+            0 => std::thread::available_parallelism().map_or(1, |count| count.get()),
+            workers => workers,
+        };
+        Self {
+            workers,
+            compression: config.zip_compression,
+        }
+    }
+}
+
+/// Root, blacklist and cancellation shared by every walk one archive makes.
+struct Walk<'a> {
+    root: &'a Path,
+    blacklist: &'a HashSet<String>,
+    cancel: &'a CancellationToken,
+}
+
+/// Calls `add(path, name, is_dir)` for `start` and everything below it, named
+/// `prefix/<path below start>`. Stops at the first error `add` returns, or with
+/// `BrokenPipe` once the client has gone.
+fn for_each_member<F>(walk: &Walk<'_>, start: &Path, prefix: &str, mut add: F) -> io::Result<()>
+where
+    F: FnMut(&Path, &str, bool) -> io::Result<()>,
+{
+    let options = WalkOptions {
+        blacklist: walk.blacklist,
+        max_depth: 0,
+        symlinks: SymlinkPolicy::Follow,
+        cancel: Some(walk.cancel),
+    };
+
+    let mut failure = None;
+    let outcome = walk_within(walk.root, start, &options, |walked| {
+        let path = walked.entry.path();
+        let Ok(inner) = path.strip_prefix(start) else {
+            return ControlFlow::Continue(());
+        };
+        let inner = inner
+            .to_string_lossy()
+            .replace(std::path::MAIN_SEPARATOR, "/");
+        let name = if inner.is_empty() {
+            prefix.to_string()
+        } else {
+            format!("{prefix}/{inner}")
+        };
+        match add(path, &name, walked.entry.file_type().is_dir()) {
+            Ok(()) => ControlFlow::Continue(()),
+            Err(err) => {
+                failure = Some(err);
+                ControlFlow::Break(())
+            }
+        }
+    });
+    match failure {
+        Some(err) => Err(err),
+        None if outcome == WalkOutcome::Cancelled => Err(io::ErrorKind::BrokenPipe.into()),
+        None => Ok(()),
+    }
+}
+
+/// Zips each `(path, name)` member and everything below it.
+fn write_zip(
+    walk: &Walk<'_>,
+    members: &[(PathBuf, String)],
+    settings: ZipSettings,
+    writer: &mut ChannelWriter,
+) -> io::Result<()> {
+    let mut zip = ZipWriter::new_stream(&mut *writer);
+    if settings.workers > 1 {
+        write_zip_parallel(walk, members, settings, &mut zip)?;
+    } else {
+        for (path, name) in members {
+            for_each_member(walk, path, name, |path, name, is_dir| {
+                add_zip_entry(&mut zip, path, name, is_dir, settings.compression)
+            })?;
+        }
+    }
+    zip.finish()?;
+    writer.flush()
+}
+
+/// A file for a zip worker: compressed into a one-entry zip in memory and sent back.
+struct ZipJob {
+    path: PathBuf,
+    name: String,
+    compression: ZipCompression,
+    done: sync_mpsc::Sender<io::Result<Vec<u8>>>,
+}
+
+/// Like the sequential loop in [`write_zip`], but small files are compressed by
+/// `settings.workers` threads and copied into `zip` without recompressing, in walk order.
+/// A directory or larger file waits for everything queued before it, then is written in
+/// place; a bounded window of queued files keeps memory flat.
+fn write_zip_parallel<W: Write + io::Seek>(
+    walk: &Walk<'_>,
+    members: &[(PathBuf, String)],
+    settings: ZipSettings,
+    zip: &mut ZipWriter<W>,
+) -> io::Result<()> {
+    let (jobs, queue) = sync_mpsc::channel::<ZipJob>();
+    let queue = Mutex::new(queue);
+    let window = settings.workers * ENTRIES_IN_FLIGHT_PER_WORKER;
+
+    std::thread::scope(|scope| {
+        for _ in 0..settings.workers {
+            scope.spawn(|| {
+                loop {
+                    let job = queue.lock().unwrap_or_else(PoisonError::into_inner).recv();
+                    let Ok(job) = job else { break };
+                    let compressed = compress_entry(&job.path, &job.name, job.compression);
+                    // The archive may have failed meanwhile; nobody is waiting then.
+                    let _ = job.done.send(compressed);
+                }
+            });
+        }
+
+        let mut pending = VecDeque::new();
+        let mut write_all = || -> io::Result<()> {
+            for (path, name) in members {
+                for_each_member(walk, path, name, |path, name, is_dir| {
+                    let small = !is_dir
+                        && std::fs::metadata(path)
+                            .is_ok_and(|metadata| metadata.len() <= PARALLEL_ENTRY_MAX_BYTES);
+                    if !small {
+                        while let Some(done) = pending.pop_front() {
+                            copy_compressed(zip, done)?;
+                        }
+                        return add_zip_entry(zip, path, name, is_dir, settings.compression);
+                    }
+                    if pending.len() >= window {
+                        if let Some(done) = pending.pop_front() {
+                            copy_compressed(zip, done)?;
+                        }
+                    }
+                    let (done, receiver) = sync_mpsc::channel();
+                    jobs.send(ZipJob {
+                        path: path.to_path_buf(),
+                        name: name.to_string(),
+                        compression: settings.compression,
+                        done,
+                    })
+                    .map_err(|_| io::Error::other("zip workers stopped"))?;
+                    pending.push_back(receiver);
+                    Ok(())
+                })?;
+            }
+            while let Some(done) = pending.pop_front() {
+                copy_compressed(zip, done)?;
+            }
+            Ok(())
+        };
+        let result = write_all();
+        // Closing the queue lets the workers exit so the scope can end.
+        drop(jobs);
+        result
+    })
+}
+
+/// `name` as the only entry of an in-memory zip; empty when the file was skipped.
+fn compress_entry(path: &Path, name: &str, compression: ZipCompression) -> io::Result<Vec<u8>> {
+    let mut single = ZipWriter::new(io::Cursor::new(Vec::new()));
+    add_zip_entry(&mut single, path, name, false, compression)?;
+    Ok(single.finish()?.into_inner())
+}
+
+/// Waits for a worker's result and copies its entry into `zip` as compressed.
+fn copy_compressed<W: Write + io::Seek>(
+    zip: &mut ZipWriter<W>,
+    done: sync_mpsc::Receiver<io::Result<Vec<u8>>>,
+) -> io::Result<()> {
+    let compressed = done
+        .recv()
+        .map_err(|_| io::Error::other("zip worker exited"))??;
+    let mut single = ZipArchive::new(io::Cursor::new(compressed))?;
+    if single.is_empty() {
+        return Ok(());
+    }
+    zip.raw_copy_file(single.by_index_raw(0)?)?;
+    Ok(())
+}
+
+fn write_tar_gz(
+    walk: &Walk<'_>,
+    directory: &Path,
+    prefix: &str,
+    writer: &mut ChannelWriter,
+) -> io::Result<()> {
+    let mut tar = tar::Builder::new(GzEncoder::new(&mut *writer, Compression::default()));
+    // Headers are filled from each entry's metadata, keeping mode bits and mtimes.
+    tar.mode(tar::HeaderMode::Complete);
+    // Symlinks were already resolved (and checked) by the walk; store their targets.
+    tar.follow_symlinks(true);
+    for_each_member(walk, directory, prefix, |path, name, is_dir| {
+        if is_dir {
+            return tar.append_dir(name, path);
+        }
+        let mut file = match File::open(path) {
+            Ok(file) => file,
+            Err(err) => {
+                tracing::warn!("Skipping {} in tar: {}", path.display(), err);
+                return Ok(());
+            }
+        };
+        tar.append_file(name, &mut file)
+    })?;
+    tar.into_inner()?.finish()?;
+    writer.flush()
+}
+
+fn add_zip_entry<W: Write + io::Seek>(
+    zip: &mut ZipWriter<W>,
+    path: &Path,
+    name: &str,
+    is_dir: bool,
+    compression: ZipCompression,
+) -> io::Result<()> {
+    let metadata = std::fs::metadata(path)?;
+    let mut options = SimpleFileOptions::default().large_file(metadata.len() >= u32::MAX as u64);
+    if let Some(modified) = metadata.modified().ok().and_then(zip_time) {
+        options = options.last_modified_time(modified);
+    }
+
+    if is_dir {
+        zip.add_directory(format!("{name}/"), options)?;
+        return Ok(());
+    }
+
+    let (method, level) = match compression {
+        // Media and archives do not shrink; only spend CPU deflating text-like files.
+        ZipCompression::Auto if deflate_worthwhile(&mime_type_for(path)) => {
+            (CompressionMethod::Deflated, None)
+        }
+        ZipCompression::Auto | ZipCompression::Store => (CompressionMethod::Stored, None),
+        ZipCompression::Deflate(level) => (CompressionMethod::Deflated, level),
+    };
+    let mut file = match File::open(path) {
+        Ok(file) => file,
+        Err(err) => {
+            tracing::warn!("Skipping {} in zip: {}", path.display(), err);
+            return Ok(());
+        }
+    };
+    zip.start_file(
+        name,
+        options.compression_method(method).compression_level(level),
+    )?;
+    io::copy(&mut file, zip)?;
+    Ok(())
+}
+
+fn deflate_worthwhile(mime: &str) -> bool {
+    mime.starts_with("text/")
+        || mime.contains("json")
+        || mime.contains("xml")
+        || mime.contains("javascript")
+}
+
+/// Zip timestamps are local DOS times from 1980 on; anything else is left unset.
+fn zip_time(time: std::time::SystemTime) -> Option<zip::DateTime> {
+    let local = chrono::DateTime::<Local>::from(time);
+    zip::DateTime::from_date_and_time(
+        u16::try_from(local.year()).ok()?,
+        local.month() as u8,
+        local.day() as u8,
+        local.hour() as u8,
+        local.minute() as u8,
+        local.second() as u8,
+    )
+    .ok()
+}
+
+/// `Write` end of the response body: buffers into chunks and blocks while the client is
+/// slower than the disk. Once the response is dropped, writes fail with `BrokenPipe`.
+pub(crate) struct ChannelWriter {
+    sender: mpsc::Sender<io::Result<Bytes>>,
+    buffer: Vec<u8>,
+}
+
+impl ChannelWriter {
+    fn new(sender: mpsc::Sender<io::Result<Bytes>>) -> Self {
+        Self {
+            sender,
+            buffer: Vec::with_capacity(CHUNK_BYTES),
+        }
+    }
+
+    /// Ends the body with an error so the client sees a broken transfer rather than a
+    /// truncated archive that looks complete.
+    fn fail(&mut self, err: io::Error) {
+        let _ = self.sender.blocking_send(Err(err));
+    }
+}
+
+impl Write for ChannelWriter {
+    fn write(&mut self, data: &[u8]) -> io::Result<usize> {
+        self.buffer.extend_from_slice(data);
+        if self.buffer.len() >= CHUNK_BYTES {
+            self.flush()?;
+        }
+        Ok(data.len())
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        if self.buffer.is_empty() {
+            return Ok(());
+        }
+        let chunk = Bytes::from(std::mem::replace(
+            &mut self.buffer,
+            Vec::with_capacity(CHUNK_BYTES),
+        ));
+        self.sender
+            .blocking_send(Ok(chunk))
+            .map_err(|_| io::Error::from(io::ErrorKind::BrokenPipe))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::io::{Cursor, Read};
+
+    use super::*;
+    use crate::test_support::{TempDir, app_state};
+
+    /// `docs/` with twenty small text files, a nested one and a blacklisted `utils/`.
+    fn docs_tree(root: &Path) -> PathBuf {
+        let docs = root.join("docs");
+        std::fs::create_dir_all(docs.join("nested")).unwrap();
+        std::fs::create_dir_all(docs.join("utils")).unwrap();
+        for index in 0..20 {
+            std::fs::write(docs.join(format!("{index}.txt")), format!("file {index}\n")).unwrap();
+        }
+        std::fs::write(docs.join("nested/deep.txt"), "deep").unwrap();
+        std::fs::write(docs.join("utils/secret.txt"), "secret").unwrap();
+        docs
+    }
+
+    async fn zip_of_docs(config: &str) -> (Response, Vec<u8>) {
+        let dir = TempDir::new();
+        let state = app_state(&dir, config).await;
+        let docs = docs_tree(&state.canonical_root);
+        let response =
+            archive_directory(&state, &HeaderMap::new(), "docs", docs, ArchiveFormat::Zip).unwrap();
+        let (parts, body) = response.into_parts();
+        let bytes = axum::body::to_bytes(body, usize::MAX).await.unwrap();
+        (Response::from_parts(parts, Body::empty()), bytes.to_vec())
+    }
+
+    #[tokio::test]
+    async fn zips_extract_whatever_the_workers_and_compression() {
+        for config in [
+            "zip_workers = 1\nzip_compression = \"store\"\n",
+            "zip_workers = 4\nzip_compression = \"deflate:6\"\n",
+            "zip_workers = 4\nzip_compression = \"auto\"\n",
+        ] {
+            let (_, bytes) = zip_of_docs(config).await;
+            let mut archive = ZipArchive::new(Cursor::new(bytes)).unwrap();
+            let mut names: Vec<String> = archive.file_names().map(str::to_string).collect();
+            names.sort();
+            assert_eq!(names.len(), 23, "{config}: {names:?}");
+            assert!(names.contains(&"docs/nested/".to_string()));
+            assert!(!names.iter().any(|name| name.contains("utils")), "{config}");
+
+            for index in 0..20 {
+                let mut content = String::new();
+                archive
+                    .by_name(&format!("docs/{index}.txt"))
+                    .unwrap()
+                    .read_to_string(&mut content)
+                    .unwrap();
+                assert_eq!(content, format!("file {index}\n"), "{config}");
+            }
+            let deep = archive.by_name("docs/nested/deep.txt").unwrap();
+            let expected = if config.contains("store") {
+                CompressionMethod::Stored
+            } else {
+                CompressionMethod::Deflated
+            };
+            assert_eq!(deep.compression(), expected, "{config}");
+        }
+    }
+
+    #[tokio::test]
+    async fn archives_are_neither_resumable_nor_cached() {
+        let (response, bytes) = zip_of_docs("").await;
+        assert_eq!(response.status(), StatusCode::OK);
+        let headers = response.headers();
+        assert_eq!(headers[header::CONTENT_TYPE], "application/zip");
+        assert_eq!(headers[header::ACCEPT_RANGES], "none");
+        assert_eq!(headers[header::CACHE_CONTROL], "no-store");
+        assert!(!headers.contains_key(header::CONTENT_LENGTH));
+        assert!(!headers.contains_key(header::ETAG));
+        assert!(
+            headers[header::CONTENT_DISPOSITION]
+                .to_str()
+                .unwrap()
+                .starts_with("attachment; filename=\"docs.zip\"")
+        );
+        assert!(!bytes.is_empty());
+    }
+
+    /// Rough benchmark: `cargo test -p serve --release zip_workers_timing -- --ignored
+    /// --nocapture`. Ignored by default because it writes ~30 MB and takes seconds.
+    #[tokio::test(flavor = "multi_thread")]
+    #[ignore]
+    async fn zip_workers_timing() {
+        let workers = std::thread::available_parallelism().map_or(4, |count| count.get());
+        let mut timings = Vec::new();
+        for config in [
+            "zip_workers = 1\nzip_compression = \"deflate\"\n".to_string(),
+            format!("zip_workers = {workers}\nzip_compression = \"deflate\"\n"),
+        ] {
+            let dir = TempDir::new();
+            let state = app_state(&dir, &config).await;
+            let logs = state.canonical_root.join("logs");
+            std::fs::create_dir(&logs).unwrap();
+            for index in 0..2_000 {
+                let line = format!("{index:05} GET /download?id={index} 200 - serve-cli\n");
+                std::fs::write(logs.join(format!("{index}.log.txt")), line.repeat(256)).unwrap();
+            }
+
+            let started = std::time::Instant::now();
+            let response =
+                archive_directory(&state, &HeaderMap::new(), "logs", logs, ArchiveFormat::Zip)
+                    .unwrap();
+            let bytes = axum::body::to_bytes(response.into_body(), usize::MAX)
+                .await
+                .unwrap();
+            let elapsed = started.elapsed();
+            let archive = ZipArchive::new(Cursor::new(bytes.to_vec())).unwrap();
+            assert_eq!(archive.len(), 2_001);
+            println!("{}: {elapsed:?}", config.lines().next().unwrap());
+            timings.push(elapsed);
+        }
+        if workers > 1 {
+            assert!(
+                timings[1] < timings[0],
+                "{workers} workers were not faster: {timings:?}"
+            );
+        }
+    }
+}
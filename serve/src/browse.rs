@@ -1,29 +1,44 @@
 use axum::Json;
 use axum::body::Body;
-use axum::extract::{Query, State};
-use axum::http::{HeaderMap, HeaderValue, StatusCode, header};
-use axum::response::Response;
-use chrono::{Datelike, Local, TimeZone};
-use html_escape::encode_text;
-use mime_guess::MimeGuess;
+use axum::extract::rejection::JsonRejection;
+use axum::extract::{Form, Query, State};
+use axum::http::{HeaderMap, HeaderValue, Method, StatusCode, Uri, header};
+use axum::response::{IntoResponse, Response};
+use chrono::{DateTime, Datelike, Local, TimeZone, Utc};
+use html_escape::{encode_double_quoted_attribute, encode_text};
+use percent_encoding::{NON_ALPHANUMERIC, percent_decode_str, utf8_percent_encode};
 use serde::{Deserialize, Serialize};
 use tokio::fs;
 use tokio::io::{AsyncReadExt, AsyncSeekExt};
 use tokio_util::io::ReaderStream;
 
+use std::cmp::Ordering;
+use std::collections::HashSet;
 use std::io;
 use std::path::{Component, Path, PathBuf};
 
+use crate::archive::{self, ArchiveFormat};
 use crate::catalog::{CatalogCommand, CatalogEntry, CatalogEntryDetail, EntryInfo};
-use crate::http_utils::{auth_token, build_base_url, client_ip, client_user_agent, host_header};
+use crate::config::Config;
+use crate::error_codes;
+use crate::http_utils::{
+    accepts_encoding, auth_token, build_base_url, client_ip, client_user_agent,
+    content_disposition, file_etag, host_header, http_date, if_none_match, if_range,
+};
 use crate::map_io_error;
+use crate::sort::{ListSort, ListingCursor, ListingOrder, SortKey, SortOrder};
 use crate::template;
+use crate::uploads::create_upload_dir;
 use crate::utils::{
-    format_modified_time, format_size, is_blacklisted, parent_relative_path, relative_path_string,
-    resolve_within_root, unix_timestamp,
+    format_modified_time, format_size, glob_match, is_allowed_file, is_blacklisted, is_valid_glob,
+    matches_type_list, mime_type_for, parent_relative_path, parse_duration, path_id,
+    relative_path_string, resolve_within_root, secure_filename, truncate_middle, unix_timestamp,
 };
 use crate::{AppError, AppState, NOT_FOUND_MESSAGE, POWERED_BY, STREAM_BUFFER_BYTES};
 
+/// Upper bound for `?per_page=`, so one request cannot ask for an unbounded page.
+const MAX_PER_PAGE: usize = 10_000;
+
 const PREVIEW_AGENTS: [&str; 6] = [
     "TelegramBot",
     "Slackbot-LinkExpanding",
@@ -33,10 +48,124 @@ const PREVIEW_AGENTS: [&str; 6] = [
     "WhatsApp",
 ];
 
-#[derive(Debug, Deserialize)]
+#[derive(Debug, Default)]
 pub(crate) struct ViewQuery {
-    #[serde(default, deserialize_with = "deserialize_boolish_option")]
     pub(crate) view: Option<bool>,
+    /// Order of directory listings; ignored for files.
+    pub(crate) order: ListingOrder,
+    /// Slice of a directory listing to send; ignored for files.
+    pub(crate) page: ListingPage,
+    /// Entries of a directory listing to keep; ignored for files.
+    pub(crate) filter: ListingFilter,
+    /// Show the generated listing even where `auto_index` would serve `index.html`.
+    pub(crate) force_listing: bool,
+}
+
+/// `?page=` (from 1) and `?per_page=` of a directory listing, or `?cursor=` in place of
+/// the page number.
+#[derive(Clone, Debug)]
+pub(crate) struct ListingPage {
+    pub(crate) number: usize,
+    pub(crate) requested_per_page: Option<usize>,
+    /// Start after this entry instead of at `number`; already checked against the order.
+    pub(crate) cursor: Option<ListingCursor>,
+}
+
+impl Default for ListingPage {
+    fn default() -> Self {
+        Self {
+            number: 1,
+            requested_per_page: None,
+            cursor: None,
+        }
+    }
+}
+
+impl ListingPage {
+    /// Entries per page: `?per_page=` capped at [`MAX_PER_PAGE`], else `listing_page_size`.
+    /// `None` sends the whole directory.
+    fn per_page(&self, config: &Config) -> Option<usize> {
+        match self.requested_per_page {
+            Some(per_page) => Some(per_page.clamp(1, MAX_PER_PAGE)),
+            None => (config.listing_page_size > 0).then_some(config.listing_page_size),
+        }
+    }
+}
+
+/// `?q=` (name contains it, ignoring case), `?glob=` (shell pattern on the name) and
+/// `?modified_since=` (own mtime within a window) of a directory listing. An entry must
+/// pass all of them.
+#[derive(Clone, Debug, Default)]
+pub(crate) struct ListingFilter {
+    pub(crate) query: Option<String>,
+    pub(crate) glob: Option<String>,
+    /// As given (`24h` or a time), for links and the JSON echo.
+    pub(crate) modified_since: Option<String>,
+    /// `modified_since` resolved to Unix seconds.
+    modified_after: Option<i64>,
+}
+
+impl ListingFilter {
+    /// Blank values count as absent; a malformed glob or time is rejected rather than
+    /// matching nothing, so a typo does not look like an empty directory.
+    fn new(
+        query: Option<String>,
+        glob: Option<String>,
+        modified_since: Option<String>,
+    ) -> Result<Self, AppError> {
+        let query = query.filter(|value| !value.trim().is_empty());
+        let glob = glob.filter(|value| !value.trim().is_empty());
+        if let Some(glob) = &glob {
+            if !is_valid_glob(glob) {
+                return Err(
+                    AppError::BadRequest(format!("Invalid glob pattern: {glob}"))
+                        .with_code(error_codes::INVALID_GLOB),
+                );
+            }
+        }
+        let modified_since = modified_since
+            .map(|value| value.trim().to_string())
+            .filter(|value| !value.is_empty());
+        let modified_after = match &modified_since {
+            Some(value) => Some(parse_modified_since(value, Utc::now()).ok_or_else(|| {
+                AppError::BadRequest(format!(
+                    "Invalid modified_since: {value} (use a duration like 24h, a Unix time or an RFC 3339 date)"
+                ))
+            })?),
+            None => None,
+        };
+        Ok(Self {
+            query,
+            glob,
+            modified_since,
+            modified_after,
+        })
+    }
+
+    fn matches(&self, name: &str) -> bool {
+        let query_matches = self
+            .query
+            .as_ref()
+            .is_none_or(|query| name.to_lowercase().contains(&query.to_lowercase()));
+        query_matches && self.glob.as_ref().is_none_or(|glob| glob_match(glob, name))
+    }
+
+    fn modified_within(&self, modified: i64) -> bool {
+        self.modified_after.is_none_or(|after| modified >= after)
+    }
+}
+
+/// `?modified_since=`: a duration back from `now` (`24h`, `7d`, `1h30m`), Unix seconds or
+/// an RFC 3339 date.
+fn parse_modified_since(value: &str, now: DateTime<Utc>) -> Option<i64> {
+    if let Ok(seconds) = value.parse::<i64>() {
+        return Some(seconds);
+    }
+    if let Ok(date) = DateTime::parse_from_rfc3339(value) {
+        return Some(date.timestamp());
+    }
+    let window = chrono::Duration::from_std(parse_duration(value)?).ok()?;
+    Some((now - window).timestamp())
 }
 
 #[derive(Debug, Deserialize)]
@@ -46,6 +175,17 @@ pub(crate) struct DownloadIdQuery {
     pub(crate) view: Option<bool>,
     #[serde(default, deserialize_with = "deserialize_boolish_option")]
     pub(crate) raw: Option<bool>,
+    /// `?download=true` forces an attachment, overriding `view` and the inline defaults.
+    #[serde(default, deserialize_with = "deserialize_boolish_option")]
+    pub(crate) download: Option<bool>,
+}
+
+/// Body of `POST /download`: entries of `dir` (root-relative) to zip together.
+#[derive(Debug, Deserialize)]
+pub(crate) struct DownloadSelection {
+    #[serde(default)]
+    pub(crate) dir: String,
+    pub(crate) names: Vec<String>,
 }
 
 #[derive(Debug, Deserialize)]
@@ -53,6 +193,34 @@ pub(crate) struct ListIdQuery {
     pub(crate) id: String,
     #[serde(default, deserialize_with = "deserialize_boolish_option")]
     pub(crate) view: Option<bool>,
+    #[serde(default)]
+    pub(crate) sort: Option<ListSort>,
+    #[serde(default)]
+    pub(crate) order: Option<SortOrder>,
+    /// List directories before files.
+    #[serde(default, deserialize_with = "deserialize_boolish_option")]
+    pub(crate) group_dirs: Option<bool>,
+    #[serde(default)]
+    pub(crate) page: Option<usize>,
+    #[serde(default)]
+    pub(crate) per_page: Option<usize>,
+    /// `next_cursor` of the previous JSON page; takes the place of `page`.
+    #[serde(default)]
+    pub(crate) cursor: Option<String>,
+    #[serde(default)]
+    pub(crate) q: Option<String>,
+    #[serde(default)]
+    pub(crate) glob: Option<String>,
+    /// Only entries changed within this window; the order then defaults to newest first.
+    #[serde(default)]
+    pub(crate) modified_since: Option<String>,
+    /// `?list=true` shows the generated listing of a directory that has an `index.html`.
+    #[serde(default, deserialize_with = "deserialize_boolish_option")]
+    pub(crate) list: Option<bool>,
+    /// `?download=zip` or `?download=tar.gz` streams the directory as an archive instead
+    /// of listing it.
+    #[serde(default)]
+    pub(crate) download: Option<String>,
 }
 
 #[derive(Debug, Deserialize)]
@@ -60,9 +228,16 @@ pub(crate) struct InfoQuery {
     pub(crate) id: String,
 }
 
-#[derive(Debug, Deserialize)]
+#[derive(Debug, Default, Deserialize)]
 pub(crate) struct DeleteQuery {
-    pub(crate) id: String,
+    #[serde(default)]
+    pub(crate) id: Option<String>,
+    /// Root-relative path, as an alternative to `id`; also read from `X-Upload-Path`.
+    #[serde(default)]
+    pub(crate) path: Option<String>,
+    /// Required to remove a directory that is not empty.
+    #[serde(default, deserialize_with = "deserialize_boolish_option")]
+    pub(crate) recursive: Option<bool>,
 }
 
 #[derive(Debug, Serialize)]
@@ -84,10 +259,14 @@ pub(crate) struct InfoPayload {
 
 #[derive(Debug, Serialize)]
 pub(crate) struct DeleteResponse {
+    pub(crate) status: String,
+    pub(crate) name: String,
     pub(crate) id: String,
+    pub(crate) dir_id: String,
     pub(crate) path: String,
     pub(crate) is_dir: bool,
-    pub(crate) status: String,
+    pub(crate) size_bytes: u64,
+    pub(crate) powered_by: &'static str,
 }
 
 pub(crate) async fn get_root() -> Result<Response, AppError> {
@@ -131,10 +310,7 @@ async fn serve_path(
     let mime_type = if metadata.is_dir() {
         "inode/directory".to_string()
     } else {
-        MimeGuess::from_path(&full_path)
-            .first_raw()
-            .unwrap_or("application/octet-stream")
-            .to_string()
+        mime_type_for(&full_path)
     };
     let modified_ts = metadata.modified().ok().map(unix_timestamp).unwrap_or(0);
     let size_bytes = if metadata.is_dir() { 0 } else { metadata.len() };
@@ -154,21 +330,49 @@ async fn serve_path(
         .map_err(|err| AppError::Internal(err.to_string()))?;
 
     if metadata.is_dir() {
+        // Without listings the index page is the only view a directory has, so it is
+        // served whether or not auto_index is on and whatever ?list= says.
+        let index_wanted = if state.config.disable_listing {
+            true
+        } else {
+            state.config.auto_index && !query.force_listing
+        };
+        if index_wanted && !is_serve_cli(&headers) {
+            if let Some((index_path, index_metadata)) = site_index(&state, &full_path).await {
+                let index_relative = format!("{}/index.html", requested_path.trim_matches('/'));
+                return serve_file(
+                    &state,
+                    &headers,
+                    index_relative.trim_start_matches('/'),
+                    index_path,
+                    index_metadata,
+                    FileView::SitePage,
+                )
+                .await;
+            }
+        }
+        if state.config.disable_listing {
+            return Err(listing_disabled());
+        }
         render_directory(
             &state,
             &headers,
             requested_path,
             full_path,
             query.view.unwrap_or(false),
+            query.order,
+            query.page,
+            &query.filter,
         )
         .await
-    } else if metadata.is_file() {
+    } else if is_downloadable(&metadata) {
         serve_file(
+            &state,
             &headers,
             requested_path,
             full_path,
             metadata,
-            query.view.unwrap_or(false),
+            FileView::Requested(query.view),
         )
         .await
     } else {
@@ -176,10 +380,118 @@ async fn serve_path(
     }
 }
 
+/// Answer to anything that would reveal a directory's contents while `disable_listing` is
+/// set.
+pub(crate) fn listing_disabled() -> AppError {
+    AppError::Forbidden("Directory listing is disabled".to_string())
+        .with_code(error_codes::LISTING_DISABLED)
+}
+
+/// The `index.html` that `auto_index` serves for `directory`, if it is a regular,
+/// non-blacklisted file.
+async fn site_index(state: &AppState, directory: &Path) -> Option<(PathBuf, std::fs::Metadata)> {
+    let index_path = directory.join("index.html");
+    if is_blacklisted(
+        &index_path,
+        &state.canonical_root,
+        &state.config.blacklisted_files,
+    ) {
+        return None;
+    }
+    let metadata = fs::metadata(&index_path).await.ok()?;
+    is_downloadable(&metadata).then_some((index_path, metadata))
+}
+
+/// Router fallback for paths no route handles. With `spa_fallback` off, or for anything
+/// but GET/HEAD, it is a plain 404. Otherwise a regular file at that path under the root
+/// is served (the app's bundles and images), and an extensionless path gets the root
+/// `index.html` so client-side routes load the app. A missing `.js` or `.css` still answers
+/// 404, so a broken build is visible rather than masked by the index page.
+///
+/// Only that root `index.html` is a site page. Every other file goes through the usual
+/// view rules, so an uploaded `.html` or `.svg` is still a sandboxed download rather than
+/// same-origin script.
+pub(crate) async fn spa_fallback(
+    State(state): State<AppState>,
+    method: Method,
+    uri: Uri,
+    headers: HeaderMap,
+) -> Result<Response, AppError> {
+    let not_found = || AppError::NotFound(NOT_FOUND_MESSAGE.to_string());
+    if !state.config.spa_fallback || (method != Method::GET && method != Method::HEAD) {
+        return Err(not_found());
+    }
+    let decoded = percent_decode_str(uri.path())
+        .decode_utf8()
+        .map_err(|_| not_found())?;
+    let relative = decoded.trim_matches('/');
+    let first_segment = relative.split('/').next().unwrap_or_default();
+    if first_segment == "upload" || first_segment == "upload-stream" {
+        return Err(not_found());
+    }
+
+    if let Some((full_path, metadata)) = spa_asset(&state, relative).await {
+        let view = if relative == "index.html" {
+            FileView::SitePage
+        } else {
+            FileView::Requested(None)
+        };
+        return serve_file(&state, &headers, relative, full_path, metadata, view).await;
+    }
+    if Path::new(relative).extension().is_some() {
+        return Err(not_found());
+    }
+    let (index_path, index_metadata) = site_index(&state, &state.canonical_root)
+        .await
+        .ok_or_else(not_found)?;
+    serve_file(
+        &state,
+        &headers,
+        "index.html",
+        index_path,
+        index_metadata,
+        FileView::SitePage,
+    )
+    .await
+}
+
+/// A regular, non-blacklisted file at `relative` whose real path stays inside the root.
+async fn spa_asset(state: &AppState, relative: &str) -> Option<(PathBuf, std::fs::Metadata)> {
+    if relative.is_empty() {
+        return None;
+    }
+    let full_path = resolve_within_root(&state.canonical_root, relative)?;
+    if is_blacklisted(
+        &full_path,
+        &state.canonical_root,
+        &state.config.blacklisted_files,
+    ) {
+        return None;
+    }
+    let real_path = fs::canonicalize(&full_path).await.ok()?;
+    if !real_path.starts_with(state.canonical_root.as_path()) {
+        return None;
+    }
+    let metadata = fs::metadata(&real_path).await.ok()?;
+    is_downloadable(&metadata).then_some((full_path, metadata))
+}
+
+/// How [`serve_file`] presents a file.
+#[derive(Clone, Copy, Debug)]
+enum FileView {
+    /// `?view=` as the client sent it; see [`serve_file`] for how it is honoured.
+    Requested(Option<bool>),
+    /// An `index.html` served by `auto_index` or as the `spa_fallback` entry point: the
+    /// operator opted in to it rendering as a page, so it is always inline and never turned
+    /// into a sandboxed download.
+    SitePage,
+}
+
 async fn resolve_entry_by_id(state: &AppState, raw_id: &str) -> Result<CatalogEntry, AppError> {
     let id = raw_id.trim();
     if id.is_empty() {
-        return Err(AppError::BadRequest("Missing id parameter".to_string()));
+        return Err(AppError::BadRequest("Missing id parameter".to_string())
+            .with_code(error_codes::MISSING_ID));
     }
     if id.eq_ignore_ascii_case("root") {
         return Ok(CatalogEntry {
@@ -210,22 +522,30 @@ pub(crate) async fn download_by_id(
     headers: HeaderMap,
     Query(query): Query<DownloadIdQuery>,
 ) -> Result<Response, AppError> {
-    let wants_view = query.view.unwrap_or(false);
+    let view = if query.download == Some(true) {
+        Some(false)
+    } else {
+        query.view
+    };
+    let wants_view = view.unwrap_or(false);
     let wants_raw = query.raw.unwrap_or(false);
     let id = query.id.trim();
     if id.is_empty() {
-        return Err(AppError::BadRequest("Missing id parameter".to_string()));
+        return Err(AppError::BadRequest("Missing id parameter".to_string())
+            .with_code(error_codes::MISSING_ID));
     }
 
     let entry = resolve_entry_by_id(&state, id).await?;
 
     if entry.is_dir {
         return Err(AppError::BadRequest(
-            "ID refers to a directory; download directories via path".to_string(),
-        ));
+            "ID refers to a directory; download it with /list?id=<id>&download=zip or tar.gz"
+                .to_string(),
+        )
+        .with_code(error_codes::IS_A_DIRECTORY));
     }
 
-    if should_render_preview(&headers) && query.view != Some(false) {
+    if should_render_preview(&headers) && view != Some(false) {
         let detail = state
             .catalog
             .entry_detail(id)
@@ -255,11 +575,82 @@ pub(crate) async fn download_by_id(
         state,
         headers,
         &entry.relative_path,
-        ViewQuery { view: query.view },
+        ViewQuery {
+            view,
+            ..ViewQuery::default()
+        },
     )
     .await
 }
 
+/// Zips the selected entries of one directory. Every name must be a direct child that
+/// exists, stays inside the root and is not blacklisted; otherwise nothing is sent.
+pub(crate) async fn download_selection(
+    State(state): State<AppState>,
+    headers: HeaderMap,
+    payload: Result<Json<DownloadSelection>, JsonRejection>,
+) -> Result<Response, AppError> {
+    if state.config.disable_listing {
+        return Err(listing_disabled());
+    }
+    let Json(selection) = payload.map_err(|rejection| {
+        AppError::BadRequest(format!("Invalid selection: {}", rejection.body_text()))
+    })?;
+    if selection.names.is_empty() {
+        return Err(AppError::BadRequest("No entries selected".to_string()));
+    }
+
+    let relative_dir = selection.dir.trim_matches('/');
+    let invalid_path = || {
+        AppError::BadRequest("Invalid directory path".to_string())
+            .with_code(error_codes::INVALID_PATH)
+    };
+    let directory =
+        resolve_within_root(&state.canonical_root, relative_dir).ok_or_else(invalid_path)?;
+    if is_blacklisted(
+        &directory,
+        &state.canonical_root,
+        &state.config.blacklisted_files,
+    ) || !fs::metadata(&directory)
+        .await
+        .map(|metadata| metadata.is_dir())
+        .unwrap_or(false)
+    {
+        return Err(invalid_path());
+    }
+
+    let mut members: Vec<(PathBuf, String)> = Vec::with_capacity(selection.names.len());
+    for name in &selection.names {
+        let invalid = || {
+            AppError::BadRequest(format!("Invalid selection: {name}"))
+                .with_code(error_codes::INVALID_PATH)
+        };
+        let plain = !name.is_empty() && name != "." && name != ".." && !name.contains(['/', '\\']);
+        if !plain {
+            return Err(invalid());
+        }
+        let path = directory.join(name);
+        // Resolving links catches a member that points outside the root.
+        let inside = fs::canonicalize(&path)
+            .await
+            .is_ok_and(|target| target.starts_with(&*state.canonical_root));
+        if !inside
+            || is_blacklisted(
+                &path,
+                &state.canonical_root,
+                &state.config.blacklisted_files,
+            )
+        {
+            return Err(invalid());
+        }
+        if !members.iter().any(|(_, existing)| existing == name) {
+            members.push((path, name.clone()));
+        }
+    }
+
+    archive::zip_selection(&state, &headers, relative_dir, members)
+}
+
 pub(crate) async fn list_by_id(
     State(state): State<AppState>,
     headers: HeaderMap,
@@ -278,11 +669,84 @@ pub(crate) async fn list_by_id(
             .body(Body::empty())
             .map_err(|err| AppError::Internal(err.to_string()));
     }
+    if let Some(requested) = query.download.as_deref() {
+        if state.config.disable_listing {
+            return Err(listing_disabled());
+        }
+        let format = ArchiveFormat::from_query(requested).ok_or_else(|| {
+            AppError::BadRequest(format!("Unsupported archive format: {requested}"))
+        })?;
+        let full_path = resolve_within_root(&state.canonical_root, &entry.relative_path)
+            .ok_or_else(|| AppError::NotFound(NOT_FOUND_MESSAGE.to_string()))?;
+        if is_blacklisted(
+            &full_path,
+            &state.canonical_root,
+            &state.config.blacklisted_files,
+        ) {
+            return Err(AppError::NotFound(NOT_FOUND_MESSAGE.to_string()));
+        }
+        return archive::archive_directory(
+            &state,
+            &headers,
+            &entry.relative_path,
+            full_path,
+            format,
+        );
+    }
+    let filter = ListingFilter::new(query.q, query.glob, query.modified_since)?;
+    // A "recent files" view reads best newest first unless the client says otherwise.
+    let (default_sort, default_order) = if filter.modified_after.is_some() {
+        (ListSort::Modified, None)
+    } else {
+        (state.config.default_sort, state.config.default_order)
+    };
+    let (sort, order) = match query.sort {
+        // An explicit sort keeps its direction in links, so pages and header links do not
+        // fall back to a configured default that differs from it.
+        Some(sort) => (sort, Some(query.order.unwrap_or(sort.default_order()))),
+        None => (default_sort, query.order.or(default_order)),
+    };
+    let order = ListingOrder {
+        sort,
+        order,
+        group_dirs: query.group_dirs.unwrap_or(false),
+    };
+    let cursor = match query
+        .cursor
+        .as_deref()
+        .filter(|token| !token.trim().is_empty())
+    {
+        Some(token) => {
+            let cursor = ListingCursor::decode(token).ok_or_else(|| {
+                AppError::BadRequest("Invalid cursor".to_string())
+                    .with_code(error_codes::INVALID_CURSOR)
+            })?;
+            if !cursor.fits(&order) {
+                return Err(AppError::BadRequest(
+                    "Cursor belongs to a listing with a different sort, order or group_dirs"
+                        .to_string(),
+                )
+                .with_code(error_codes::INVALID_CURSOR));
+            }
+            Some(cursor)
+        }
+        None => None,
+    };
     serve_entry_by_relative_path(
         state,
         headers,
         &entry.relative_path,
-        ViewQuery { view: query.view },
+        ViewQuery {
+            view: query.view,
+            order,
+            page: ListingPage {
+                number: query.page.unwrap_or(1).max(1),
+                requested_per_page: query.per_page,
+                cursor,
+            },
+            filter,
+            force_listing: query.list.unwrap_or(false),
+        },
     )
     .await
 }
@@ -290,10 +754,11 @@ pub(crate) async fn list_by_id(
 pub(crate) async fn get_info(
     State(state): State<AppState>,
     Query(query): Query<InfoQuery>,
-) -> Result<Json<InfoPayload>, AppError> {
+) -> Result<JsonUtf8<InfoPayload>, AppError> {
     let id = query.id.trim();
     if id.is_empty() {
-        return Err(AppError::BadRequest("Missing id parameter".to_string()));
+        return Err(AppError::BadRequest("Missing id parameter".to_string())
+            .with_code(error_codes::MISSING_ID));
     }
 
     let detail = state
@@ -334,7 +799,7 @@ pub(crate) async fn get_info(
         Some(format!("/download?id={}&view=true", detail.id))
     };
 
-    Ok(Json(InfoPayload {
+    Ok(JsonUtf8(InfoPayload {
         id: detail.id,
         name: detail.name,
         path,
@@ -351,63 +816,478 @@ pub(crate) async fn get_info(
     }))
 }
 
-pub(crate) async fn delete_by_id(
+/// `DELETE /delete`, or `POST /delete` with a form body for clients that cannot send
+/// DELETE. The target is a catalog `id` or a root-relative `path` (query, form or
+/// `X-Upload-Path`); directories that still hold entries need `recursive=true`.
+pub(crate) async fn delete_entry(
     State(state): State<AppState>,
     headers: HeaderMap,
     Query(query): Query<DeleteQuery>,
-) -> Result<Json<DeleteResponse>, AppError> {
-    let provided_token = auth_token(&headers);
-    if provided_token.as_deref() != Some(state.config.upload_token.as_str()) {
-        return Err(AppError::Unauthorized("Unauthorized".to_string()));
+    form: Option<Form<DeleteQuery>>,
+) -> Result<JsonUtf8<DeleteResponse>, AppError> {
+    require_token(&state, &headers)?;
+
+    let form = form.map(|Form(form)| form).unwrap_or_default();
+    let id = query.id.or(form.id).and_then(non_empty);
+    let path = query
+        .path
+        .or(form.path)
+        .or_else(|| {
+            headers
+                .get("X-Upload-Path")
+                .and_then(|value| value.to_str().ok())
+                .map(str::to_string)
+        })
+        .and_then(non_empty);
+    let recursive = query.recursive.or(form.recursive).unwrap_or(false);
+
+    let relative = match (&id, path) {
+        (Some(id), _) => resolve_entry_by_id(&state, id).await?.relative_path,
+        (None, Some(path)) => path,
+        (None, None) => {
+            return Err(
+                AppError::BadRequest("Missing id or path parameter".to_string())
+                    .with_code(error_codes::MISSING_ID),
+            );
+        }
+    };
+    let relative = relative.trim_matches('/').to_string();
+    if relative.is_empty() {
+        return Err(
+            AppError::BadRequest("Cannot delete the root directory".to_string())
+                .with_code(error_codes::ROOT_NOT_DELETABLE),
+        );
     }
 
-    let id = query.id.trim();
-    if id.is_empty() {
-        return Err(AppError::BadRequest("Missing id parameter".to_string()));
+    let full_path = entry_path_within_root(&state, &relative).await?;
+    if is_blacklisted(
+        &full_path,
+        &state.canonical_root,
+        &state.config.blacklisted_files,
+    ) {
+        return Err(AppError::NotFound(NOT_FOUND_MESSAGE.to_string()));
     }
 
-    let entry = resolve_entry_by_id(&state, id).await?;
-    if entry.relative_path.trim().is_empty() {
+    let metadata = fs::symlink_metadata(&full_path)
+        .await
+        .map_err(map_io_error)?;
+    let id = match id {
+        Some(id) => id,
+        None => catalog_id(&state, &relative).await?,
+    };
+    let dir_id = match parent_relative_path(&relative) {
+        Some(parent) => catalog_id(&state, &parent).await?,
+        None => "root".to_string(),
+    };
+
+    if metadata.is_dir() {
+        if recursive {
+            let (dir, state) = (full_path.clone(), state.clone());
+            let protected = tokio::task::spawn_blocking(move || {
+                holds_blacklisted(&dir, &state.canonical_root, &state.config.blacklisted_files)
+            })
+            .await
+            .map_err(|err| AppError::Internal(err.to_string()))?
+            .map_err(map_io_error)?;
+            if protected {
+                return Err(AppError::Conflict(
+                    "Directory holds entries that cannot be deleted".to_string(),
+                )
+                .with_code(error_codes::PROTECTED_ENTRIES));
+            }
+        }
+        let removed = if recursive {
+            fs::remove_dir_all(&full_path).await
+        } else {
+            fs::remove_dir(&full_path).await
+        };
+        removed.map_err(|err| match err.kind() {
+            io::ErrorKind::DirectoryNotEmpty => AppError::BadRequest(
+                "Directory is not empty; pass recursive=true to delete it".to_string(),
+            )
+            .with_code(error_codes::DIRECTORY_NOT_EMPTY),
+            _ => map_io_error(err),
+        })?;
+    } else {
+        fs::remove_file(&full_path).await.map_err(map_io_error)?;
+    }
+
+    tracing::info!(
+        "[deleting] {} - /{} - {}",
+        client_ip(&headers),
+        relative,
+        client_user_agent(&headers)
+    );
+    let _ = state.catalog_events.try_send(CatalogCommand::RefreshAll);
+
+    let name = relative.rsplit('/').next().unwrap_or_default().to_string();
+    Ok(JsonUtf8(DeleteResponse {
+        status: "deleted".to_string(),
+        name,
+        id,
+        dir_id,
+        path: format!("/{}", relative),
+        is_dir: metadata.is_dir(),
+        size_bytes: if metadata.is_dir() { 0 } else { metadata.len() },
+        powered_by: POWERED_BY,
+    }))
+}
+
+#[derive(Debug, Default, Deserialize)]
+pub(crate) struct MoveQuery {
+    #[serde(default)]
+    pub(crate) from: Option<String>,
+    #[serde(default)]
+    pub(crate) to: Option<String>,
+    /// Replace an existing file at `to`; directories are never replaced.
+    #[serde(default, deserialize_with = "deserialize_boolish_option")]
+    pub(crate) overwrite: Option<bool>,
+}
+
+#[derive(Debug, Serialize)]
+pub(crate) struct MoveResponse {
+    pub(crate) status: String,
+    pub(crate) from: String,
+    pub(crate) to: String,
+}
+
+/// `POST /move` renames `from` to `to`, both root-relative and taken from the query or a
+/// form body. The new name is sanitised like an upload's, its directory must already exist,
+/// and an existing entry at `to` is kept unless `overwrite=true` (files only).
+pub(crate) async fn move_entry(
+    State(state): State<AppState>,
+    headers: HeaderMap,
+    Query(query): Query<MoveQuery>,
+    form: Option<Form<MoveQuery>>,
+) -> Result<JsonUtf8<MoveResponse>, AppError> {
+    require_token(&state, &headers)?;
+
+    let form = form.map(|Form(form)| form).unwrap_or_default();
+    let (Some(from), Some(to)) = (
+        query.from.or(form.from).and_then(non_empty),
+        query.to.or(form.to).and_then(non_empty),
+    ) else {
         return Err(AppError::BadRequest(
-            "Cannot delete the root directory".to_string(),
+            "Missing from or to parameter".to_string(),
         ));
+    };
+    let overwrite = query.overwrite.or(form.overwrite).unwrap_or(false);
+
+    let from = from.trim_matches('/').to_string();
+    if from.is_empty() {
+        return Err(
+            AppError::BadRequest("Cannot move the root directory".to_string())
+                .with_code(error_codes::INVALID_PATH),
+        );
     }
+    let source = entry_path_within_root(&state, &from).await?;
+    if is_blacklisted(
+        &source,
+        &state.canonical_root,
+        &state.config.blacklisted_files,
+    ) {
+        return Err(AppError::NotFound(NOT_FOUND_MESSAGE.to_string()));
+    }
+    let source_metadata = fs::symlink_metadata(&source).await.map_err(map_io_error)?;
 
-    let relative = entry.relative_path.trim_matches('/').to_string();
-    let full_path = state.canonical_root.join(&relative);
-    if !full_path.starts_with(&*state.canonical_root) {
-        return Err(AppError::BadRequest("Invalid path".to_string()));
+    let to = to.trim_matches('/');
+    let (to_parent, to_name) = match to.rsplit_once('/') {
+        Some((parent, name)) => (parent, name),
+        None => ("", to),
+    };
+    let safe_name = secure_filename(to_name).ok_or_else(|| {
+        AppError::BadRequest("Invalid destination name".to_string())
+            .with_code(error_codes::INVALID_FILENAME)
+    })?;
+    let to = match to_parent.trim_matches('/') {
+        "" => safe_name,
+        parent => format!("{parent}/{safe_name}"),
+    };
+    let destination = entry_path_within_root(&state, &to).await?;
+    if is_blacklisted(
+        &destination,
+        &state.canonical_root,
+        &state.config.blacklisted_files,
+    ) {
+        return Err(AppError::BadRequest("Invalid destination path".to_string())
+            .with_code(error_codes::INVALID_PATH));
+    }
+    let parent_is_dir = match destination.parent() {
+        Some(parent) => fs::metadata(parent).await.is_ok_and(|meta| meta.is_dir()),
+        None => false,
+    };
+    if !parent_is_dir {
+        return Err(
+            AppError::BadRequest("Destination directory does not exist".to_string())
+                .with_code(error_codes::NOT_A_DIRECTORY),
+        );
+    }
+    // A directory cannot move below itself.
+    if source_metadata.is_dir() && destination.starts_with(&source) && destination != source {
+        return Err(
+            AppError::BadRequest("Cannot move a directory into itself".to_string())
+                .with_code(error_codes::INVALID_PATH),
+        );
     }
 
-    let metadata = fs::metadata(&full_path).await.map_err(map_io_error)?;
-    if metadata.is_dir() {
-        fs::remove_dir_all(&full_path).await.map_err(map_io_error)?;
-    } else {
-        fs::remove_file(&full_path).await.map_err(map_io_error)?;
+    if let Ok(existing) = fs::symlink_metadata(&destination).await {
+        if destination != source {
+            if !overwrite || existing.is_dir() {
+                return Err(AppError::Conflict(format!("/{to} already exists"))
+                    .with_code(error_codes::DESTINATION_EXISTS));
+            }
+            // rename(2) replaces a file with a file but not with a directory.
+            if source_metadata.is_dir() {
+                fs::remove_file(&destination).await.map_err(map_io_error)?;
+            }
+        }
     }
 
+    fs::rename(&source, &destination)
+        .await
+        .map_err(map_io_error)?;
+
+    tracing::info!(
+        "[moving] {} - /{} -> /{} - {}",
+        client_ip(&headers),
+        from,
+        to,
+        client_user_agent(&headers)
+    );
     let _ = state.catalog_events.try_send(CatalogCommand::RefreshAll);
 
-    let display_path = if relative.is_empty() {
-        "/".to_string()
-    } else {
-        format!("/{}", relative)
+    Ok(JsonUtf8(MoveResponse {
+        status: "moved".to_string(),
+        from: format!("/{from}"),
+        to: format!("/{to}"),
+    }))
+}
+
+#[derive(Debug, Default, Deserialize)]
+pub(crate) struct MkdirQuery {
+    /// Root-relative directory to create; also read from `X-Upload-Path`.
+    #[serde(default)]
+    pub(crate) path: Option<String>,
+}
+
+#[derive(Debug, Serialize)]
+pub(crate) struct MkdirResponse {
+    pub(crate) status: String,
+    /// False when the directory was already there.
+    pub(crate) created: bool,
+    pub(crate) id: String,
+    pub(crate) path: String,
+    pub(crate) list_url: String,
+    pub(crate) powered_by: &'static str,
+}
+
+/// `POST /mkdir` creates a directory and any missing parents, like `mkdir -p`. An existing
+/// directory is not an error, so clients can call it before every upload.
+pub(crate) async fn make_directory(
+    State(state): State<AppState>,
+    headers: HeaderMap,
+    Query(query): Query<MkdirQuery>,
+    form: Option<Form<MkdirQuery>>,
+) -> Result<JsonUtf8<MkdirResponse>, AppError> {
+    require_token(&state, &headers)?;
+
+    let form = form.map(|Form(form)| form).unwrap_or_default();
+    let relative = query
+        .path
+        .or(form.path)
+        .or_else(|| {
+            headers
+                .get("X-Upload-Path")
+                .and_then(|value| value.to_str().ok())
+                .map(str::to_string)
+        })
+        .and_then(non_empty)
+        .ok_or_else(|| AppError::BadRequest("Missing path parameter".to_string()))?;
+    let invalid_path =
+        || AppError::BadRequest("Invalid path".to_string()).with_code(error_codes::INVALID_PATH);
+    let full_path =
+        resolve_within_root(&state.canonical_root, &relative).ok_or_else(invalid_path)?;
+    if full_path == *state.canonical_root {
+        return Err(invalid_path());
+    }
+    // Hidden names may not be created at any level, and the deepest part that already
+    // exists must not lead out of the root through a link.
+    let mut existing = None;
+    for ancestor in full_path.ancestors() {
+        if ancestor == state.canonical_root.as_path() {
+            break;
+        }
+        if is_blacklisted(
+            ancestor,
+            &state.canonical_root,
+            &state.config.blacklisted_files,
+        ) {
+            return Err(invalid_path());
+        }
+        if existing.is_none() && fs::symlink_metadata(ancestor).await.is_ok() {
+            existing = Some(ancestor.to_path_buf());
+        }
+    }
+    if let Some(existing) = &existing {
+        let inside = fs::canonicalize(existing)
+            .await
+            .is_ok_and(|target| target.starts_with(&*state.canonical_root));
+        if !inside {
+            return Err(invalid_path());
+        }
+    }
+
+    let created = match fs::metadata(&full_path).await {
+        Ok(metadata) if metadata.is_dir() => false,
+        Ok(_) => {
+            return Err(
+                AppError::Conflict("A file with that name already exists".to_string())
+                    .with_code(error_codes::DESTINATION_EXISTS),
+            );
+        }
+        Err(_) => {
+            create_upload_dir(&full_path, state.config.upload_dir_mode).await?;
+            true
+        }
     };
 
-    Ok(Json(DeleteResponse {
-        id: id.to_string(),
-        path: display_path,
-        is_dir: metadata.is_dir(),
-        status: "deleted".to_string(),
+    let relative = relative_path_string(&state.canonical_root, &full_path).unwrap_or_default();
+    let modified = fs::metadata(&full_path)
+        .await
+        .ok()
+        .and_then(|metadata| metadata.modified().ok())
+        .map(unix_timestamp)
+        .unwrap_or(0);
+    let id = state
+        .catalog
+        .sync_entry(EntryInfo::new(
+            relative.clone(),
+            full_path
+                .file_name()
+                .map(|name| name.to_string_lossy().into_owned())
+                .unwrap_or_default(),
+            parent_relative_path(&relative),
+            true,
+            0,
+            "inode/directory".to_string(),
+            modified,
+        ))
+        .await
+        .map_err(|err| AppError::Internal(err.to_string()))?;
+
+    if created {
+        tracing::info!(
+            "[mkdir] {} - /{} - {}",
+            client_ip(&headers),
+            relative,
+            client_user_agent(&headers)
+        );
+        let _ = state.catalog_events.try_send(CatalogCommand::RefreshAll);
+    }
+
+    let base_url = build_base_url(&headers);
+    Ok(JsonUtf8(MkdirResponse {
+        status: if created { "created" } else { "exists" }.to_string(),
+        created,
+        list_url: format!("{}/list?id={}", base_url.trim_end_matches('/'), id),
+        id,
+        path: format!("/{relative}"),
+        powered_by: POWERED_BY,
     }))
 }
 
+/// Delete, move and mkdir act on the upload token; there is no open mode for them.
+fn require_token(state: &AppState, headers: &HeaderMap) -> Result<(), AppError> {
+    let provided_token = auth_token(headers);
+    if provided_token.as_deref() != Some(state.config.upload_token.as_str()) {
+        return Err(AppError::Unauthorized("Unauthorized".to_string()));
+    }
+    Ok(())
+}
+
+/// Whether anything below `dir` is blacklisted, so a recursive delete would remove entries
+/// the server otherwise keeps out of reach. Links are not followed, as in `remove_dir_all`.
+fn holds_blacklisted(dir: &Path, root: &Path, blacklist: &HashSet<String>) -> io::Result<bool> {
+    for entry in std::fs::read_dir(dir)? {
+        let entry = entry?;
+        let path = entry.path();
+        if is_blacklisted(&path, root, blacklist) {
+            return Ok(true);
+        }
+        if entry.file_type()?.is_dir() && holds_blacklisted(&path, root, blacklist)? {
+            return Ok(true);
+        }
+    }
+    Ok(false)
+}
+
+/// Resolves a root-relative path for delete or move. The path is checked lexically;
+/// resolving the parent catches a linked directory that leads out of the root. A link as
+/// the entry itself is acted on, not followed.
+async fn entry_path_within_root(state: &AppState, relative: &str) -> Result<PathBuf, AppError> {
+    let invalid_path =
+        || AppError::BadRequest("Invalid path".to_string()).with_code(error_codes::INVALID_PATH);
+    let full_path =
+        resolve_within_root(&state.canonical_root, relative).ok_or_else(invalid_path)?;
+    if full_path == *state.canonical_root {
+        return Err(invalid_path());
+    }
+    let parent_inside = match full_path.parent() {
+        Some(parent) => fs::canonicalize(parent)
+            .await
+            .is_ok_and(|parent| parent.starts_with(&*state.canonical_root)),
+        None => false,
+    };
+    if !parent_inside {
+        return Err(invalid_path());
+    }
+    Ok(full_path)
+}
+
+fn non_empty(value: String) -> Option<String> {
+    let trimmed = value.trim();
+    (!trimmed.is_empty()).then(|| trimmed.to_string())
+}
+
+/// Catalog id for a root-relative path, or an empty string if it was never indexed.
+async fn catalog_id(state: &AppState, relative_path: &str) -> Result<String, AppError> {
+    state
+        .catalog
+        .id_for_path(relative_path)
+        .await
+        .map(Option::unwrap_or_default)
+        .map_err(|err| AppError::Internal(err.to_string()))
+}
+
+/// `axum::Json` with the charset spelled out, matching the listing and upload responses.
+pub(crate) struct JsonUtf8<T>(pub(crate) T);
+
+impl<T: Serialize> IntoResponse for JsonUtf8<T> {
+    fn into_response(self) -> Response {
+        let mut response = Json(self.0).into_response();
+        let is_json = response
+            .headers()
+            .get(header::CONTENT_TYPE)
+            .is_some_and(|value| value.as_bytes() == b"application/json");
+        if is_json {
+            response.headers_mut().insert(
+                header::CONTENT_TYPE,
+                HeaderValue::from_static("application/json; charset=utf-8"),
+            );
+        }
+        response
+    }
+}
+
 async fn render_directory(
     state: &AppState,
     headers: &HeaderMap,
     requested_path: &str,
     directory_path: PathBuf,
     view_mode: bool,
+    order: ListingOrder,
+    page: ListingPage,
+    filter: &ListingFilter,
 ) -> Result<Response, AppError> {
     let mut entries = Vec::new();
     let mut read_dir = fs::read_dir(&directory_path).await.map_err(map_io_error)?;
@@ -424,7 +1304,8 @@ async fn render_directory(
             &child_path,
             &state.canonical_root,
             &state.config.blacklisted_files,
-        ) {
+        ) || !filter.matches(&file_name)
+        {
             continue;
         }
 
@@ -444,14 +1325,16 @@ async fn render_directory(
             }
         };
         let is_dir = child_metadata.is_dir();
+        let downloadable = is_downloadable(&child_metadata);
         let relative_path = match relative_path_string(&state.canonical_root, &child_path) {
             Some(path) => path,
             None => continue,
         };
+        let short_name = truncate_middle(&file_name, state.config.name_max_display);
         let display_name = if is_dir {
-            format!("{}/", file_name)
+            format!("{}/", short_name)
         } else {
-            file_name.clone()
+            short_name
         };
         let size_bytes = if is_dir { 0 } else { child_metadata.len() };
         let size_display = if is_dir {
@@ -460,66 +1343,94 @@ async fn render_directory(
             format_size(size_bytes)
         };
         let modified_epoch = unix_timestamp(modified);
+        if !filter.modified_within(modified_epoch) {
+            continue;
+        }
         let modified_local: chrono::DateTime<Local> = modified.into();
         let modified_display = format_modified_time(modified_local);
         let mime_type = if is_dir {
             "inode/directory".to_string()
         } else {
-            MimeGuess::from_path(&child_path)
-                .first_raw()
-                .unwrap_or("application/octet-stream")
-                .to_string()
+            mime_type_for(&child_path)
         };
-        let parent_path = parent_relative_path(&relative_path);
-        let entry_info = EntryInfo::new(
-            relative_path.clone(),
-            file_name.clone(),
-            parent_path,
-            is_dir,
+
+        entries.push(DirectoryEntry {
+            name: file_name,
+            display_name,
+            relative_url: String::new(),
             size_bytes,
-            mime_type.clone(),
-            modified_epoch,
+            size_display,
+            modified_display,
+            modified_ts: modified_epoch,
+            is_dir,
+            mime_type,
+            id: String::new(),
+            relative_path,
+            browse_link: String::new(),
+            download_link: String::new(),
+            downloadable,
+        });
+    }
+
+    // Sort the whole directory before slicing so every page comes from the same order;
+    // only the entries on the page are looked up in the catalog.
+    order.apply(&mut entries);
+    let total_entries = entries.len();
+    let total_bytes: u64 = entries.iter().map(|entry| entry.size_bytes).sum();
+    let per_page = page.per_page(&state.config);
+    let page_count = match per_page {
+        Some(per_page) => total_entries.div_ceil(per_page).max(1),
+        None => 1,
+    };
+    let offset = match &page.cursor {
+        Some(cursor) => {
+            entries.partition_point(|entry| order.compare(entry, cursor) != Ordering::Greater)
+        }
+        None => per_page.map_or(0, |per_page| (page.number - 1).saturating_mul(per_page)),
+    };
+    let mut entries: Vec<DirectoryEntry> = entries
+        .into_iter()
+        .skip(offset)
+        .take(per_page.unwrap_or(usize::MAX))
+        .collect();
+    let next_cursor = entries
+        .last()
+        .filter(|_| offset + entries.len() < total_entries)
+        .map(|last| ListingCursor::after(&order, last).encode());
+
+    for entry in &mut entries {
+        let entry_info = EntryInfo::new(
+            entry.relative_path.clone(),
+            entry.name.clone(),
+            parent_relative_path(&entry.relative_path),
+            entry.is_dir,
+            entry.size_bytes,
+            entry.mime_type.clone(),
+            entry.modified_ts,
         );
-        let entry_id = state
+        entry.id = state
             .catalog
             .sync_entry(entry_info)
             .await
             .map_err(|err| AppError::Internal(err.to_string()))?;
 
-        let browse_link = if view_mode {
-            format!("/list?id={}&view=true", entry_id)
+        entry.browse_link = if view_mode {
+            format!("/list?id={}&view=true", entry.id)
         } else {
-            format!("/list?id={}", entry_id)
+            format!("/list?id={}", entry.id)
         };
-        let download_link = if view_mode {
-            format!("/download?id={}&view=true", entry_id)
+        entry.download_link = if view_mode {
+            format!("/download?id={}&view=true", entry.id)
         } else {
-            format!("/download?id={}", entry_id)
+            format!("/download?id={}", entry.id)
         };
-        let relative_url = if is_dir {
-            browse_link.clone()
+        entry.relative_url = if entry.is_dir {
+            entry.browse_link.clone()
         } else {
-            download_link.clone()
+            entry.download_link.clone()
         };
-
-        entries.push(DirectoryEntry {
-            name: file_name,
-            display_name,
-            relative_url,
-            size_bytes,
-            size_display,
-            modified_display,
-            is_dir,
-            mime_type,
-            id: entry_id,
-            relative_path,
-            browse_link,
-            download_link,
-        });
     }
 
-    entries.sort_by(|a, b| a.name.to_lowercase().cmp(&b.name.to_lowercase()));
-
     if headers
         .get("X-Serve-Client")
         .and_then(|value| value.to_str().ok())
@@ -540,8 +1451,9 @@ async fn render_directory(
                     download_absolute.clone()
                 };
                 serde_json::json!({
-                    "index": idx + 1,
+                    "index": offset + idx + 1,
                     "id": entry.id,
+                    "path_id": path_id(&entry.relative_path),
                     "name": entry.name,
                     "size": entry.size_display,
                     "size_bytes": entry.size_bytes,
@@ -552,6 +1464,8 @@ async fn render_directory(
                     "download_url": download_absolute,
                     "is_dir": entry.is_dir,
                     "mime_type": entry.mime_type,
+                    "downloadable": entry.downloadable,
+                    "requires_auth": download_requires_auth(state),
                 })
             })
             .collect();
@@ -569,16 +1483,35 @@ async fn render_directory(
             normalized_path = "/".to_string();
         }
 
+        // Same target as the HTML ".." row, absolute like the entry URLs; empty at the root.
+        let parent = parent_link(state, requested_path, false)
+            .await?
+            .map(|link| format!("{}{}", base_trimmed, link))
+            .unwrap_or_default();
+
         let payload = serde_json::json!({
             "path": normalized_path,
+            "parent": parent,
             "entries": entries_json,
+            "sort": order.sort.as_str(),
+            "order": order.order().as_str(),
+            "group_dirs": order.group_dirs,
+            "q": filter.query,
+            "glob": filter.glob,
+            "modified_since": filter.modified_since,
+            "page": page.cursor.is_none().then_some(page.number),
+            "per_page": per_page.unwrap_or(total_entries),
+            "pages": page_count,
+            "total": total_entries,
+            "next_cursor": next_cursor,
+            "banner": state.config.banner,
             "powered_by": POWERED_BY,
         });
 
         let body =
             serde_json::to_vec(&payload).map_err(|err| AppError::Internal(err.to_string()))?;
 
-        return Ok(Response::builder()
+        let mut response = Response::builder()
             .status(StatusCode::OK)
             .header(
                 axum::http::header::CONTENT_TYPE,
@@ -586,7 +1519,9 @@ async fn render_directory(
             )
             .header("X-Powered-By", POWERED_BY)
             .body(Body::from(body))
-            .unwrap());
+            .unwrap();
+        set_listing_cache_control(state, &mut response);
+        return Ok(response);
     }
 
     let mut rows = String::new();
@@ -594,8 +1529,9 @@ async fn render_directory(
         rows.push_str(&format!(
             r#"
                 <tr>
+                    <td class="select"></td>
                     <td class="index"></td>
-                    <td class="file-name"><a href="{link}">..</a></td>
+                    <th scope="row" class="file-name"><a href="{link}" aria-label="Parent directory">..</a></th>
                     <td class="file-size"></td>
                     <td class="mime"></td>
                     <td class="date"></td>
@@ -608,8 +1544,9 @@ async fn render_directory(
 
     for (idx, entry) in entries.iter().enumerate() {
         let copy_btn = format!(
-            r##"<a class="copy" href="#" data-copy-id="{id}">Copy ID</a>"##,
-            id = encode_text(&entry.id)
+            r##"<a class="copy" href="#" role="button" data-copy-id="{id}" aria-label="Copy ID of {name}">Copy ID</a>"##,
+            id = encode_text(&entry.id),
+            name = encode_double_quoted_attribute(&entry.name)
         );
         let play_link = if !entry.is_dir && is_media_mime(&entry.mime_type) {
             let mut href = entry.download_link.clone();
@@ -620,7 +1557,11 @@ async fn render_directory(
                     href.push_str("?view=true");
                 }
             }
-            format!(r#"<a class="play" href="{href}">Play</a>"#, href = href)
+            format!(
+                r#"<a class="play" href="{href}" aria-label="Play {name}">Play</a>"#,
+                href = href,
+                name = encode_double_quoted_attribute(&entry.name)
+            )
         } else {
             String::new()
         };
@@ -632,16 +1573,18 @@ async fn render_directory(
         rows.push_str(&format!(
             r#"
                 <tr>
+                    <td class="select"><input type="checkbox" value="{title}" aria-label="Select {title}" /></td>
                     <td class="index">{index}</td>
-                    <td class="file-name"><a href="{link}">{display}</a></td>
+                    <th scope="row" class="file-name"><a href="{link}" title="{title}">{display}</a></th>
                     <td class="file-size">{size}</td>
                     <td class="mime">{mime}</td>
                     <td class="date">{modified}</td>
                     <td class="actions">{actions}</td>
                 </tr>
             "#,
-            index = idx + 1,
+            index = offset + idx + 1,
             link = entry.relative_url,
+            title = encode_double_quoted_attribute(&entry.name),
             display = encode_text(&entry.display_name),
             size = entry.size_display,
             mime = encode_text(&entry.mime_type),
@@ -653,39 +1596,310 @@ async fn render_directory(
     let host = host_header(headers);
     let directory_label = directory_label(requested_path, &host);
     let current_year = Local::now().year();
-    let total_files = entries.len();
-    let total_bytes: u64 = entries.iter().map(|entry| entry.size_bytes).sum();
     let disk_usage = format_size(total_bytes);
+    let self_id = if requested_path.trim_matches('/').is_empty() {
+        "root".to_string()
+    } else {
+        catalog_id(state, requested_path.trim_matches('/')).await?
+    };
+    let columns = sort_columns(&order, |order| {
+        listing_link(
+            &self_id,
+            view_mode,
+            order,
+            filter,
+            page.requested_per_page,
+            1,
+        )
+    });
+    let filter_form =
+        filter_form_html(&self_id, view_mode, &order, filter, page.requested_per_page);
+    let pager = if page_count > 1 || page.number > 1 {
+        let link = |number: usize| {
+            listing_link(
+                &self_id,
+                view_mode,
+                &order,
+                filter,
+                page.requested_per_page,
+                number,
+            )
+        };
+        pager_html(page.number, page_count, link)
+    } else {
+        String::new()
+    };
     let body = template::render_directory_page(
         &directory_label,
+        requested_path,
         &rows,
+        &filter_form,
+        &pager,
+        &columns,
         current_year,
         &host,
         &disk_usage,
-        total_files,
+        total_entries,
+        &template::Branding::from_config(&state.config),
     );
 
-    Ok(Response::builder()
-        .status(StatusCode::OK)
-        .header(axum::http::header::CONTENT_TYPE, "text/html; charset=utf-8")
-        .body(Body::from(body))
-        .unwrap())
+    let mut response = html_response(body)?;
+    set_listing_cache_control(state, &mut response);
+    Ok(response)
+}
+
+/// What [`serve_path`] sends once the blacklist has passed: regular files only.
+/// Directories are fetched through `/list?download=` instead, and sockets, FIFOs and
+/// devices are never served.
+fn is_downloadable(metadata: &std::fs::Metadata) -> bool {
+    metadata.is_file()
+}
+
+/// Whether fetching a file needs credentials beyond the URL: Basic Auth when it is
+/// configured. Listings report it per entry so clients need not change when that does.
+fn download_requires_auth(state: &AppState) -> bool {
+    state.config.basic_auth_user.is_some()
+}
+
+/// `/list` URL for page `page` of directory `id`, keeping the view, order, filter and page
+/// size the current listing was asked for.
+fn listing_link(
+    id: &str,
+    view: bool,
+    order: &ListingOrder,
+    filter: &ListingFilter,
+    per_page: Option<usize>,
+    page: usize,
+) -> String {
+    let mut link = format!("/list?id={id}");
+    let mut params = listing_params(view, order, per_page);
+    if let Some(query) = &filter.query {
+        params.push(("q", query.clone()));
+    }
+    if let Some(glob) = &filter.glob {
+        params.push(("glob", glob.clone()));
+    }
+    if let Some(modified_since) = &filter.modified_since {
+        params.push(("modified_since", modified_since.clone()));
+    }
+    for (name, value) in params {
+        link.push_str(&format!(
+            "&{name}={}",
+            utf8_percent_encode(&value, NON_ALPHANUMERIC)
+        ));
+    }
+    if page > 1 {
+        link.push_str(&format!("&page={page}"));
+    }
+    link
+}
+
+/// Query parameters other than `id`, the filter and `page` that a listing link carries.
+fn listing_params(
+    view: bool,
+    order: &ListingOrder,
+    per_page: Option<usize>,
+) -> Vec<(&'static str, String)> {
+    let mut params = Vec::new();
+    if view {
+        params.push(("view", "true".to_string()));
+    }
+    if order.sort != ListSort::default() || order.order.is_some() {
+        params.push(("sort", order.sort.as_str().to_string()));
+        params.push(("order", order.order().as_str().to_string()));
+    }
+    if order.group_dirs {
+        params.push(("group_dirs", "true".to_string()));
+    }
+    if let Some(per_page) = per_page {
+        params.push(("per_page", per_page.to_string()));
+    }
+    params
+}
+
+/// Filter box above the listing. Scripts refresh the rows as it is typed into; without
+/// them it submits to `/list` with the same id, order and page size, keeping `glob` and
+/// `modified_since`.
+fn filter_form_html(
+    id: &str,
+    view: bool,
+    order: &ListingOrder,
+    filter: &ListingFilter,
+    per_page: Option<usize>,
+) -> String {
+    let mut hidden = vec![("id", id.to_string())];
+    hidden.extend(listing_params(view, order, per_page));
+    if let Some(glob) = &filter.glob {
+        hidden.push(("glob", glob.clone()));
+    }
+    if let Some(modified_since) = &filter.modified_since {
+        hidden.push(("modified_since", modified_since.clone()));
+    }
+    let hidden: String = hidden
+        .into_iter()
+        .map(|(name, value)| {
+            format!(
+                r#"<input type="hidden" name="{name}" value="{}" />"#,
+                encode_double_quoted_attribute(&value)
+            )
+        })
+        .collect();
+    format!(
+        r#"<form class="filter" role="search" action="/list" method="get">{hidden}<label for="filter">Filter</label> <input type="search" id="filter" name="q" value="{query}" autocomplete="off" /></form>"#,
+        query = encode_double_quoted_attribute(filter.query.as_deref().unwrap_or_default()),
+    )
+}
+
+/// Name, size and date headers as links: the current column flips its direction, the
+/// others switch to themselves in their default direction. Each goes back to page one.
+fn sort_columns(
+    current: &ListingOrder,
+    link: impl Fn(&ListingOrder) -> String,
+) -> template::SortColumns {
+    let active_order = current.order();
+    let column = |sort: ListSort, class: &str, label: &str| {
+        let (aria_sort, arrow, next) = if current.sort == sort {
+            match active_order {
+                SortOrder::Asc => (r#" aria-sort="ascending""#, " &uarr;", SortOrder::Desc),
+                SortOrder::Desc => (r#" aria-sort="descending""#, " &darr;", SortOrder::Asc),
+            }
+        } else {
+            ("", "", sort.default_order())
+        };
+        let target = ListingOrder {
+            sort,
+            order: Some(next),
+            group_dirs: current.group_dirs,
+        };
+        format!(
+            r#"<th scope="col" class="{class}"{aria_sort}><a href="{href}">{label}<span aria-hidden="true">{arrow}</span></a></th>"#,
+            href = link(&target),
+        )
+    };
+    let direction = match active_order {
+        SortOrder::Asc => "ascending",
+        SortOrder::Desc => "descending",
+    };
+    let sorted_by = match current.sort {
+        ListSort::Name => "name",
+        ListSort::Size => "size",
+        ListSort::Modified => "last modified date",
+    };
+
+    template::SortColumns {
+        name: column(ListSort::Name, "file-name", "Name"),
+        size: column(ListSort::Size, "file-size", "Size"),
+        modified: column(ListSort::Modified, "date", "Last Modified"),
+        description: format!("{sorted_by}, {direction}"),
+    }
+}
+
+/// Previous/next links under a paginated listing.
+fn pager_html(page: usize, pages: usize, link: impl Fn(usize) -> String) -> String {
+    let previous = if page > 1 {
+        format!(
+            r#"<a href="{}" rel="prev">&laquo; Previous</a>"#,
+            link((page - 1).min(pages))
+        )
+    } else {
+        String::new()
+    };
+    let next = if page < pages {
+        format!(
+            r#"<a href="{}" rel="next">Next &raquo;</a>"#,
+            link(page + 1)
+        )
+    } else {
+        String::new()
+    };
+    format!(
+        r#"<nav class="pager" aria-label="Pages">{previous} <span>Page {page} of {pages}</span> {next}</nav>"#
+    )
+}
+
+/// Listings change with every upload or delete, so they get their own cache policy
+/// instead of the validators files rely on.
+fn set_listing_cache_control(state: &AppState, response: &mut Response) {
+    if let Ok(value) = HeaderValue::from_str(&state.config.listing_cache_control) {
+        if !value.is_empty() {
+            response.headers_mut().insert(header::CACHE_CONTROL, value);
+        }
+    }
 }
 
 async fn serve_file(
+    state: &AppState,
     headers: &HeaderMap,
     requested_path: &str,
     full_path: PathBuf,
     metadata: std::fs::Metadata,
-    view: bool,
+    view: FileView,
 ) -> Result<Response, AppError> {
-    let mut file = fs::File::open(&full_path).await.map_err(map_io_error)?;
+    let config = state.config.as_ref();
+    // A precompressed sibling is sent in place of the file; its validators and length
+    // describe the encoded bytes actually on the wire.
+    let (variant, has_variants) = precompressed_variant(headers, &full_path).await;
+    let (body_path, metadata, encoding) = match variant {
+        Some(variant) if is_current(&variant.metadata, &metadata) => {
+            (variant.path, variant.metadata, Some(variant.encoding))
+        }
+        _ => (full_path.clone(), metadata, None),
+    };
+
+    // Validators go on every response, including 206 and 304, so range requests and
+    // revalidation agree on the same version of the file.
+    let etag = match state.file_etags.etag(&body_path, &metadata).await {
+        Some(tag) => tag,
+        None => file_etag(&metadata),
+    };
+    let last_modified = metadata
+        .modified()
+        .ok()
+        .map(|time| http_date(chrono::DateTime::<chrono::Utc>::from(time)));
+    let with_validators = |mut response: Response| {
+        if let Ok(value) = HeaderValue::from_str(&etag) {
+            response.headers_mut().insert(header::ETAG, value);
+        }
+        if let Some(value) = last_modified
+            .as_deref()
+            .and_then(|value| HeaderValue::from_str(value).ok())
+        {
+            response.headers_mut().insert(header::LAST_MODIFIED, value);
+        }
+        // Also on 304s, so the encoding-specific ETag matches the one the client cached.
+        if let Some(encoding) = encoding {
+            response
+                .headers_mut()
+                .insert(header::CONTENT_ENCODING, HeaderValue::from_static(encoding));
+        }
+        if has_variants {
+            response
+                .headers_mut()
+                .insert(header::VARY, HeaderValue::from_static("accept-encoding"));
+        }
+        response
+    };
+    if if_none_match(headers, &etag) {
+        return Ok(with_validators(
+            Response::builder()
+                .status(StatusCode::NOT_MODIFIED)
+                .body(Body::empty())
+                .unwrap(),
+        ));
+    }
+
+    let mut file = fs::File::open(&body_path).await.map_err(map_io_error)?;
     let file_size = metadata.len();
     let mut status = StatusCode::OK;
     let mut content_length = file_size;
     let mut content_range: Option<HeaderValue> = None;
 
-    let body = if let Some(range_value) = headers.get(axum::http::header::RANGE) {
+    // A stale `If-Range` turns the resume into a fresh full download. Precompressed variants
+    // are always sent whole: a byte range of one encoding cannot be stitched onto another.
+    let range = headers
+        .get(axum::http::header::RANGE)
+        .filter(|_| encoding.is_none() && if_range(headers, &etag, last_modified.as_deref()));
+    let body = if let Some(range_value) = range {
         let range_str = range_value.to_str().unwrap_or("");
         match parse_range_header(range_str, file_size) {
             Ok(Some((start, end))) => {
@@ -722,22 +1936,35 @@ async fn serve_file(
         Body::from_stream(ReaderStream::with_capacity(file, STREAM_BUFFER_BYTES))
     };
 
-    let mime = MimeGuess::from_path(&full_path)
-        .first_or_octet_stream()
-        .to_string();
+    let mime = mime_type_for(&full_path);
 
-    let disposition_type = if view { "inline" } else { "attachment" };
     let filename = full_path
         .file_name()
         .and_then(|name| name.to_str())
         .unwrap_or("download");
+    // An explicit `?view=` wins; otherwise `inline_default_extensions` picks what opens in
+    // the browser. Viewing is still only a request: types outside `inline_extensions` are
+    // downloaded so uploaded markup never renders in this origin, and scriptable types
+    // never view inline.
+    let (inline, forced_download) = match view {
+        FileView::Requested(view) => {
+            let view = view
+                .unwrap_or_else(|| matches_type_list(filename, &config.inline_default_extensions));
+            let forced_download = matches_type_list(filename, &config.force_download_extensions);
+            let inline =
+                view && !forced_download && is_allowed_file(filename, &config.inline_extensions);
+            (inline, forced_download)
+        }
+        FileView::SitePage => (true, false),
+    };
+    let disposition_type = if inline { "inline" } else { "attachment" };
 
     let mut response = Response::builder()
         .status(status)
         .header(axum::http::header::CONTENT_TYPE, mime)
         .header(
             axum::http::header::CONTENT_DISPOSITION,
-            format!(r#"{disposition_type}; filename="{filename}""#),
+            content_disposition(disposition_type, filename),
         )
         .body(body)
         .unwrap();
@@ -748,8 +1975,22 @@ async fn serve_file(
     );
     response.headers_mut().insert(
         axum::http::header::ACCEPT_RANGES,
-        HeaderValue::from_static("bytes"),
+        HeaderValue::from_static(if encoding.is_some() { "none" } else { "bytes" }),
     );
+    // Even a misidentified file must not run script or load anything from elsewhere; forced
+    // downloads are additionally sandboxed for browsers that ignore the disposition.
+    let csp = match (forced_download, config.file_csp.is_empty()) {
+        (true, true) => "sandbox".to_string(),
+        (true, false) => format!("sandbox; {}", config.file_csp),
+        (false, _) => config.file_csp.clone(),
+    };
+    if !csp.is_empty() {
+        if let Ok(value) = HeaderValue::from_str(&csp) {
+            response
+                .headers_mut()
+                .insert(axum::http::header::CONTENT_SECURITY_POLICY, value);
+        }
+    }
     if let Some(value) = content_range {
         response
             .headers_mut()
@@ -769,7 +2010,62 @@ async fn serve_file(
         client_user_agent(headers)
     );
 
-    Ok(response)
+    Ok(with_validators(response))
+}
+
+/// Encodings with precompressed siblings, most preferred first: `app.js.br`, `app.js.gz`.
+const PRECOMPRESSED: [(&str, &str); 2] = [("br", "br"), ("gzip", "gz")];
+
+/// A `<file>.br` / `<file>.gz` sibling.
+struct Precompressed {
+    path: PathBuf,
+    metadata: std::fs::Metadata,
+    encoding: &'static str,
+}
+
+/// Looks for precompressed siblings of `full_path`. Returns the first one the client
+/// accepts, and whether any sibling exists at all (the response then varies by
+/// `Accept-Encoding` even when the raw file is sent). Symlinked siblings are ignored so a
+/// variant can never point outside the served tree.
+async fn precompressed_variant(
+    headers: &HeaderMap,
+    full_path: &Path,
+) -> (Option<Precompressed>, bool) {
+    let Some(file_name) = full_path.file_name() else {
+        return (None, false);
+    };
+    let mut found = false;
+    for (encoding, suffix) in PRECOMPRESSED {
+        let mut name = file_name.to_os_string();
+        name.push(".");
+        name.push(suffix);
+        let path = full_path.with_file_name(name);
+        let Ok(metadata) = fs::symlink_metadata(&path).await else {
+            continue;
+        };
+        if !metadata.is_file() {
+            continue;
+        }
+        found = true;
+        if accepts_encoding(headers, encoding) {
+            let variant = Precompressed {
+                path,
+                metadata,
+                encoding,
+            };
+            return (Some(variant), true);
+        }
+    }
+    (None, found)
+}
+
+/// A variant older than its source is stale (the source was edited after compressing), so
+/// the raw file is served instead.
+fn is_current(variant: &std::fs::Metadata, source: &std::fs::Metadata) -> bool {
+    match (variant.modified(), source.modified()) {
+        (Ok(variant), Ok(source)) => variant >= source,
+        _ => false,
+    }
 }
 
 fn parse_range_header(value: &str, size: u64) -> Result<Option<(u64, u64)>, ()> {
@@ -965,12 +2261,33 @@ struct DirectoryEntry {
     size_bytes: u64,
     size_display: String,
     modified_display: String,
+    modified_ts: i64,
     is_dir: bool,
     mime_type: String,
     id: String,
     relative_path: String,
     browse_link: String,
     download_link: String,
+    /// `download_url` would send the entry's content; see [`is_downloadable`].
+    downloadable: bool,
+}
+
+impl SortKey for DirectoryEntry {
+    fn sort_name(&self) -> &str {
+        &self.name
+    }
+
+    fn sort_size(&self) -> u64 {
+        self.size_bytes
+    }
+
+    fn sort_modified(&self) -> i64 {
+        self.modified_ts
+    }
+
+    fn sort_is_dir(&self) -> bool {
+        self.is_dir
+    }
 }
 
 fn format_timestamp(timestamp: i64) -> String {
@@ -994,6 +2311,18 @@ fn should_render_preview(headers: &HeaderMap) -> bool {
         .unwrap_or(false)
 }
 
+/// Response for any page generated here rather than read from disk. The body is fully
+/// rendered first, so the length is exact; `Accept-Ranges` is never sent because byte
+/// ranges of generated markup are meaningless, and a `Range` header is simply ignored.
+fn html_response(html: String) -> Result<Response, AppError> {
+    Response::builder()
+        .status(StatusCode::OK)
+        .header(header::CONTENT_TYPE, "text/html; charset=utf-8")
+        .header(header::CONTENT_LENGTH, html.len())
+        .body(Body::from(html))
+        .map_err(|err| AppError::Internal(err.to_string()))
+}
+
 fn render_file_preview(
     detail: &CatalogEntryDetail,
     headers: &HeaderMap,
@@ -1023,11 +2352,7 @@ fn render_file_preview(
         download = download_url
     );
 
-    Response::builder()
-        .status(StatusCode::OK)
-        .header(axum::http::header::CONTENT_TYPE, "text/html; charset=utf-8")
-        .body(Body::from(html))
-        .map_err(|err| AppError::Internal(err.to_string()))
+    html_response(html)
 }
 
 fn render_media_player(
@@ -1074,9 +2399,625 @@ fn render_media_player(
         media = media_tag
     );
 
-    Response::builder()
-        .status(StatusCode::OK)
-        .header(axum::http::header::CONTENT_TYPE, "text/html; charset=utf-8")
-        .body(Body::from(html))
-        .map_err(|err| AppError::Internal(err.to_string()))
+    html_response(html)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::test_support::{TempDir, app_state};
+
+    #[tokio::test]
+    async fn spa_fallback_sandboxes_uploaded_html() {
+        let dir = TempDir::new();
+        let state = app_state(&dir, "spa_fallback = true\n").await;
+        std::fs::write(state.canonical_root.join("index.html"), "<html>app</html>").unwrap();
+        std::fs::write(
+            state.canonical_root.join("evil.html"),
+            "<script>alert(document.cookie)</script>",
+        )
+        .unwrap();
+
+        let response = spa_fallback(
+            State(state.clone()),
+            Method::GET,
+            Uri::from_static("/evil.html"),
+            HeaderMap::new(),
+        )
+        .await
+        .unwrap();
+        let csp = response.headers()[header::CONTENT_SECURITY_POLICY]
+            .to_str()
+            .unwrap();
+        assert!(csp.starts_with("sandbox"), "unexpected CSP {csp:?}");
+        let disposition = response.headers()[header::CONTENT_DISPOSITION]
+            .to_str()
+            .unwrap();
+        assert!(disposition.starts_with("attachment"), "{disposition:?}");
+
+        // The app's own entry point still renders as a page.
+        let response = spa_fallback(
+            State(state),
+            Method::GET,
+            Uri::from_static("/some/client/route"),
+            HeaderMap::new(),
+        )
+        .await
+        .unwrap();
+        let disposition = response.headers()[header::CONTENT_DISPOSITION]
+            .to_str()
+            .unwrap();
+        assert!(disposition.starts_with("inline"), "{disposition:?}");
+        let csp = response
+            .headers()
+            .get(header::CONTENT_SECURITY_POLICY)
+            .and_then(|value| value.to_str().ok())
+            .unwrap_or_default();
+        assert!(!csp.starts_with("sandbox"), "unexpected CSP {csp:?}");
+    }
+
+    #[tokio::test]
+    async fn recursive_delete_keeps_blacklisted_entries() {
+        let dir = TempDir::new();
+        let state = app_state(&dir, "blacklisted_files = [\"secret.key\"]\n").await;
+        let nested = state.canonical_root.join("photos/raw");
+        std::fs::create_dir_all(&nested).unwrap();
+        std::fs::write(nested.join("secret.key"), "key").unwrap();
+        let mut headers = HeaderMap::new();
+        headers.insert("X-Serve-Token", HeaderValue::from_static("abogoboga"));
+
+        let delete = |state: AppState, path: &str| {
+            delete_entry(
+                State(state),
+                headers.clone(),
+                Query(DeleteQuery {
+                    path: Some(path.to_string()),
+                    recursive: Some(true),
+                    ..DeleteQuery::default()
+                }),
+                None,
+            )
+        };
+        let err = delete(state.clone(), "photos").await.err().unwrap();
+        assert!(matches!(
+            err,
+            AppError::Coded(error_codes::PROTECTED_ENTRIES, _)
+        ));
+        assert!(nested.join("secret.key").exists());
+
+        std::fs::remove_file(nested.join("secret.key")).unwrap();
+        delete(state.clone(), "photos").await.unwrap();
+        assert!(!state.canonical_root.join("photos").exists());
+    }
+
+    #[test]
+    fn modified_since_accepts_durations_and_dates() {
+        let now = Utc.with_ymd_and_hms(2024, 5, 2, 12, 0, 0).unwrap();
+        let day_before = now.timestamp() - 86_400;
+        assert_eq!(parse_modified_since("24h", now), Some(day_before));
+        assert_eq!(parse_modified_since("1d", now), Some(day_before));
+        assert_eq!(
+            parse_modified_since("1h30m", now),
+            Some(now.timestamp() - 5_400)
+        );
+        assert_eq!(
+            parse_modified_since("2024-05-01T12:00:00Z", now),
+            Some(day_before)
+        );
+        assert_eq!(
+            parse_modified_since("2024-05-01T14:00:00+02:00", now),
+            Some(day_before)
+        );
+        assert_eq!(parse_modified_since("1714564800", now), Some(1_714_564_800));
+        assert_eq!(parse_modified_since("yesterday", now), None);
+    }
+
+    async fn json_listing(state: &AppState, path: &str, page: ListingPage) -> serde_json::Value {
+        let mut headers = HeaderMap::new();
+        headers.insert("X-Serve-Client", HeaderValue::from_static("serve-cli"));
+        let query = ViewQuery {
+            page,
+            ..ViewQuery::default()
+        };
+        let response = serve_path(state.clone(), headers, path, query)
+            .await
+            .unwrap();
+        let body = axum::body::to_bytes(response.into_body(), usize::MAX)
+            .await
+            .unwrap();
+        serde_json::from_slice(&body).unwrap()
+    }
+
+    fn names(listing: &serde_json::Value) -> Vec<String> {
+        listing["entries"]
+            .as_array()
+            .unwrap()
+            .iter()
+            .map(|entry| entry["name"].as_str().unwrap().to_string())
+            .collect()
+    }
+
+    #[tokio::test]
+    async fn cursor_pages_survive_insertions() {
+        let dir = TempDir::new();
+        let state = app_state(&dir, "").await;
+        for name in ["b.txt", "d.txt", "f.txt", "h.txt"] {
+            std::fs::write(state.canonical_root.join(name), name).unwrap();
+        }
+        let page = |cursor: Option<&serde_json::Value>| ListingPage {
+            requested_per_page: Some(2),
+            cursor: cursor.map(|token| ListingCursor::decode(token.as_str().unwrap()).unwrap()),
+            ..ListingPage::default()
+        };
+
+        let first = json_listing(&state, "", page(None)).await;
+        assert_eq!(names(&first), ["b.txt", "d.txt"]);
+        assert!(first["page"].is_number());
+
+        // Entries added before and after the cursor: only the later one shows up.
+        std::fs::write(state.canonical_root.join("a.txt"), "a").unwrap();
+        std::fs::write(state.canonical_root.join("e.txt"), "e").unwrap();
+        let second = json_listing(&state, "", page(Some(&first["next_cursor"]))).await;
+        assert_eq!(names(&second), ["e.txt", "f.txt"]);
+        assert!(second["page"].is_null());
+
+        std::fs::remove_file(state.canonical_root.join("b.txt")).unwrap();
+        let third = json_listing(&state, "", page(Some(&second["next_cursor"]))).await;
+        assert_eq!(names(&third), ["h.txt"]);
+        assert!(third["next_cursor"].is_null());
+    }
+
+    #[tokio::test]
+    async fn json_listing_links_the_parent() {
+        let dir = TempDir::new();
+        let state = app_state(&dir, "").await;
+        std::fs::create_dir_all(state.canonical_root.join("photos/2024")).unwrap();
+
+        let root = json_listing(&state, "", ListingPage::default()).await;
+        assert_eq!(root["parent"], "");
+        let photos_id = root["entries"][0]["id"].as_str().unwrap().to_string();
+
+        let photos = json_listing(&state, "photos", ListingPage::default()).await;
+        assert_eq!(photos["parent"], "http://localhost/list?id=root");
+
+        let year = json_listing(&state, "photos/2024", ListingPage::default()).await;
+        assert_eq!(
+            year["parent"],
+            format!("http://localhost/list?id={photos_id}")
+        );
+    }
+
+    #[tokio::test]
+    async fn json_responses_declare_utf8() {
+        let dir = TempDir::new();
+        let state = app_state(&dir, "").await;
+        let mut headers = HeaderMap::new();
+        headers.insert("X-Serve-Client", HeaderValue::from_static("serve-cli"));
+        let listing = serve_path(state, headers, "", ViewQuery::default())
+            .await
+            .unwrap();
+        assert_eq!(
+            listing.headers()[header::CONTENT_TYPE],
+            "application/json; charset=utf-8"
+        );
+
+        let info = JsonUtf8(serde_json::json!({ "name": "ü" })).into_response();
+        assert_eq!(
+            info.headers()[header::CONTENT_TYPE],
+            "application/json; charset=utf-8"
+        );
+    }
+
+    async fn fetch_file(state: &AppState, name: &str, view: Option<bool>) -> Response {
+        std::fs::write(state.canonical_root.join(name), "content").unwrap();
+        let query = ViewQuery {
+            view,
+            ..ViewQuery::default()
+        };
+        serve_path(state.clone(), HeaderMap::new(), name, query)
+            .await
+            .unwrap()
+    }
+
+    fn header_str(response: &Response, name: header::HeaderName) -> &str {
+        response
+            .headers()
+            .get(name)
+            .map_or("", |value| value.to_str().unwrap())
+    }
+
+    #[tokio::test]
+    async fn viewed_files_name_themselves_inline() {
+        let dir = TempDir::new();
+        let state = app_state(&dir, "").await;
+        let response = fetch_file(&state, "résumé.pdf", Some(true)).await;
+        assert_eq!(
+            header_str(&response, header::CONTENT_DISPOSITION),
+            "inline; filename=\"r_sum_.pdf\"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf"
+        );
+
+        let response = fetch_file(&state, "résumé.pdf", None).await;
+        let disposition = header_str(&response, header::CONTENT_DISPOSITION);
+        assert!(disposition.starts_with("attachment;"), "{disposition:?}");
+    }
+
+    #[tokio::test]
+    async fn view_is_limited_to_inline_extensions() {
+        let dir = TempDir::new();
+        let state = app_state(&dir, "inline_extensions = [\"png\", \"image/*\"]\n").await;
+        for (name, expected) in [
+            ("a.png", "inline"),
+            ("a.jpg", "inline"),
+            ("a.txt", "attachment"),
+        ] {
+            let response = fetch_file(&state, name, Some(true)).await;
+            let disposition = header_str(&response, header::CONTENT_DISPOSITION);
+            assert!(disposition.starts_with(expected), "{name}: {disposition:?}");
+        }
+    }
+
+    #[tokio::test]
+    async fn uploaded_markup_cannot_be_viewed_inline() {
+        let dir = TempDir::new();
+        let state = app_state(&dir, "").await;
+        for name in ["page.html", "logo.svg"] {
+            let response = fetch_file(&state, name, Some(true)).await;
+            let disposition = header_str(&response, header::CONTENT_DISPOSITION);
+            assert!(
+                disposition.starts_with("attachment"),
+                "{name}: {disposition:?}"
+            );
+            let csp = header_str(&response, header::CONTENT_SECURITY_POLICY);
+            assert!(csp.starts_with("sandbox; "), "{name}: {csp:?}");
+        }
+    }
+
+    #[tokio::test]
+    async fn file_responses_carry_the_file_csp() {
+        let dir = TempDir::new();
+        let state = app_state(&dir, "").await;
+        let response = fetch_file(&state, "photo.png", Some(true)).await;
+        assert!(header_str(&response, header::CONTENT_DISPOSITION).starts_with("inline"));
+        assert_eq!(
+            header_str(&response, header::CONTENT_SECURITY_POLICY),
+            "default-src 'none'; img-src 'self'; media-src 'self'"
+        );
+
+        let state = app_state(&dir, "file_csp = \"default-src 'none'\"\n").await;
+        let response = fetch_file(&state, "photo.png", Some(true)).await;
+        assert_eq!(
+            header_str(&response, header::CONTENT_SECURITY_POLICY),
+            "default-src 'none'"
+        );
+
+        let state = app_state(&dir, "file_csp = \"\"\n").await;
+        let response = fetch_file(&state, "photo.png", Some(true)).await;
+        assert!(
+            !response
+                .headers()
+                .contains_key(header::CONTENT_SECURITY_POLICY)
+        );
+    }
+
+    #[tokio::test]
+    async fn inline_default_extensions_open_without_view() {
+        let dir = TempDir::new();
+        let state = app_state(&dir, "inline_default_extensions = [\"png\"]\n").await;
+        for (name, view, expected) in [
+            ("a.png", None, "inline"),
+            ("a.zip", None, "attachment"),
+            ("a.png", Some(false), "attachment"),
+            ("a.zip", Some(true), "inline"),
+        ] {
+            let response = fetch_file(&state, name, view).await;
+            let disposition = header_str(&response, header::CONTENT_DISPOSITION);
+            assert!(
+                disposition.starts_with(expected),
+                "{name} {view:?}: {disposition:?}"
+            );
+        }
+    }
+
+    async fn html_listing(state: &AppState) -> String {
+        let response = serve_path(state.clone(), HeaderMap::new(), "", ViewQuery::default())
+            .await
+            .unwrap();
+        let body = axum::body::to_bytes(response.into_body(), usize::MAX)
+            .await
+            .unwrap();
+        String::from_utf8(body.to_vec()).unwrap()
+    }
+
+    #[tokio::test]
+    async fn banner_reaches_json_and_html_listings() {
+        let dir = TempDir::new();
+        let state = app_state(&dir, "banner = \"Moving to <new host> on Friday\"\n").await;
+        let listing = json_listing(&state, "", ListingPage::default()).await;
+        assert_eq!(listing["banner"], "Moving to <new host> on Friday");
+        assert!(
+            html_listing(&state).await.contains(
+                r#"<p class="banner" role="note">Moving to &lt;new host&gt; on Friday</p>"#
+            )
+        );
+
+        let dir = TempDir::new();
+        let state = app_state(&dir, "").await;
+        let listing = json_listing(&state, "", ListingPage::default()).await;
+        assert!(listing["banner"].is_null());
+        assert!(!html_listing(&state).await.contains("class=\"banner\""));
+    }
+
+    #[tokio::test]
+    async fn site_text_is_escaped_unless_raw() {
+        let dir = TempDir::new();
+        let state = app_state(&dir, "").await;
+        let page = html_listing(&state).await;
+        assert!(page.contains("Index of "), "default heading missing");
+        assert!(!page.contains("class=\"site-header\""));
+
+        let dir = TempDir::new();
+        let state = app_state(
+            &dir,
+            "site_title = \"Team <share>\"\nsite_header = \"<b>hi</b>\"\nsite_footer = \"Ask ops\"\n",
+        )
+        .await;
+        let page = html_listing(&state).await;
+        assert!(page.contains("Team &lt;share&gt;"));
+        assert!(!page.contains("Index of "));
+        assert!(page.contains(r#"<p class="site-header">&lt;b&gt;hi&lt;/b&gt;</p>"#));
+        assert!(page.contains(r#"<p class="site-footer">Ask ops</p>"#));
+
+        let dir = TempDir::new();
+        let state = app_state(&dir, "site_header_html = \"<b>hi</b>\"\n").await;
+        let page = html_listing(&state).await;
+        assert!(page.contains(r#"<div class="site-header"><b>hi</b></div>"#));
+    }
+
+    #[tokio::test]
+    async fn listings_are_not_cached_like_files() {
+        let dir = TempDir::new();
+        let state = app_state(&dir, "").await;
+        let listing = serve_path(state.clone(), HeaderMap::new(), "", ViewQuery::default())
+            .await
+            .unwrap();
+        assert_eq!(header_str(&listing, header::CACHE_CONTROL), "no-cache");
+        let file = fetch_file(&state, "a.txt", None).await;
+        assert_ne!(header_str(&file, header::CACHE_CONTROL), "no-cache");
+
+        let dir = TempDir::new();
+        let state = app_state(&dir, "listing_cache_control = \"private, max-age=5\"\n").await;
+        let mut headers = HeaderMap::new();
+        headers.insert("X-Serve-Client", HeaderValue::from_static("serve-cli"));
+        let listing = serve_path(state, headers, "", ViewQuery::default())
+            .await
+            .unwrap();
+        assert_eq!(
+            header_str(&listing, header::CACHE_CONTROL),
+            "private, max-age=5"
+        );
+    }
+
+    #[tokio::test]
+    async fn listing_flags_follow_the_download_policy() {
+        let flags = |listing: &serde_json::Value, name: &str| {
+            let entry = listing["entries"]
+                .as_array()
+                .unwrap()
+                .iter()
+                .find(|entry| entry["name"] == name)
+                .unwrap_or_else(|| panic!("{name} not listed"))
+                .clone();
+            (
+                entry["downloadable"].clone(),
+                entry["requires_auth"].clone(),
+            )
+        };
+
+        let dir = TempDir::new();
+        let state = app_state(&dir, "").await;
+        std::fs::write(state.canonical_root.join("a.txt"), "a").unwrap();
+        std::fs::create_dir(state.canonical_root.join("docs")).unwrap();
+        #[cfg(unix)]
+        let _socket =
+            std::os::unix::net::UnixListener::bind(state.canonical_root.join("app.sock")).unwrap();
+        let listing = json_listing(&state, "", ListingPage::default()).await;
+        assert_eq!(flags(&listing, "a.txt"), (true.into(), false.into()));
+        assert_eq!(flags(&listing, "docs"), (false.into(), false.into()));
+        #[cfg(unix)]
+        assert_eq!(flags(&listing, "app.sock"), (false.into(), false.into()));
+
+        let dir = TempDir::new();
+        let state = app_state(
+            &dir,
+            "basic_auth_user = \"ops\"\nbasic_auth_pass = \"pw\"\n",
+        )
+        .await;
+        std::fs::write(state.canonical_root.join("a.txt"), "a").unwrap();
+        let listing = json_listing(&state, "", ListingPage::default()).await;
+        assert_eq!(flags(&listing, "a.txt"), (true.into(), true.into()));
+    }
+
+    /// `a.txt` (3 bytes), `B.txt` (1 byte, newest file), `c.txt` (2 bytes, oldest) and the
+    /// directory `d`, which is empty but modified now.
+    fn sortable_tree(state: &AppState) {
+        let root = state.canonical_root.as_path();
+        for (name, content, modified) in [
+            ("a.txt", "aaa", 2_000),
+            ("B.txt", "b", 3_000),
+            ("c.txt", "cc", 1_000),
+        ] {
+            std::fs::write(root.join(name), content).unwrap();
+            let file = std::fs::File::options()
+                .write(true)
+                .open(root.join(name))
+                .unwrap();
+            file.set_modified(std::time::UNIX_EPOCH + std::time::Duration::from_secs(modified))
+                .unwrap();
+        }
+        std::fs::create_dir(root.join("d")).unwrap();
+    }
+
+    async fn listed_order(state: &AppState, params: &str) -> Vec<String> {
+        let mut headers = HeaderMap::new();
+        headers.insert("X-Serve-Client", HeaderValue::from_static("serve-cli"));
+        let uri: Uri = format!("/list?id=root{params}").parse().unwrap();
+        let query = Query::try_from_uri(&uri).unwrap();
+        let response = list_by_id(State(state.clone()), headers, query)
+            .await
+            .unwrap();
+        let body = axum::body::to_bytes(response.into_body(), usize::MAX)
+            .await
+            .unwrap();
+        names(&serde_json::from_slice(&body).unwrap())
+    }
+
+    #[tokio::test]
+    async fn json_listing_follows_each_sort_key() {
+        let dir = TempDir::new();
+        let state = app_state(&dir, "").await;
+        sortable_tree(&state);
+        for (params, expected) in [
+            ("", ["a.txt", "B.txt", "c.txt", "d"]),
+            ("&sort=name&order=desc", ["d", "c.txt", "B.txt", "a.txt"]),
+            ("&sort=size", ["a.txt", "c.txt", "B.txt", "d"]),
+            ("&sort=size&order=asc", ["d", "B.txt", "c.txt", "a.txt"]),
+            ("&sort=modified", ["d", "B.txt", "a.txt", "c.txt"]),
+            ("&group_dirs=true", ["d", "a.txt", "B.txt", "c.txt"]),
+        ] {
+            assert_eq!(listed_order(&state, params).await, expected, "{params}");
+        }
+    }
+
+    #[tokio::test]
+    async fn configured_default_order_yields_to_the_query() {
+        let dir = TempDir::new();
+        let state = app_state(&dir, "default_sort = \"size\"\ndefault_order = \"asc\"\n").await;
+        sortable_tree(&state);
+        for (params, expected) in [
+            ("", ["d", "B.txt", "c.txt", "a.txt"]),
+            ("&order=desc", ["a.txt", "c.txt", "B.txt", "d"]),
+            ("&sort=name", ["a.txt", "B.txt", "c.txt", "d"]),
+        ] {
+            assert_eq!(listed_order(&state, params).await, expected, "{params}");
+        }
+
+        let dir = TempDir::new();
+        let state = app_state(&dir, "default_sort = \"modified\"\n").await;
+        sortable_tree(&state);
+        assert_eq!(
+            listed_order(&state, "").await,
+            ["d", "B.txt", "a.txt", "c.txt"]
+        );
+    }
+
+    #[tokio::test]
+    async fn listing_page_carries_the_accessibility_hooks() {
+        let dir = TempDir::new();
+        let state = app_state(&dir, "").await;
+        std::fs::write(state.canonical_root.join("a.txt"), "a").unwrap();
+        let page = html_listing(&state).await;
+        for expected in [
+            r##"<a class="skip-link" href="#listing">"##,
+            r#"<main id="listing" tabindex="-1""#,
+            r#"<th scope="col" class="file-name" aria-sort="ascending">"#,
+            r#"aria-label="Select a.txt""#,
+            r#"<th scope="row" class="file-name">"#,
+            r#"aria-label="Copy ID of a.txt""#,
+            r#"role="status" aria-live="polite""#,
+        ] {
+            assert!(page.contains(expected), "missing {expected}");
+        }
+    }
+
+    #[tokio::test]
+    async fn generated_pages_ignore_ranges() {
+        let dir = TempDir::new();
+        let state = app_state(&dir, "").await;
+        let mut headers = HeaderMap::new();
+        headers.insert(header::RANGE, HeaderValue::from_static("bytes=0-9"));
+        let response = serve_path(state, headers, "", ViewQuery::default())
+            .await
+            .unwrap();
+        assert_eq!(response.status(), StatusCode::OK);
+        assert_eq!(
+            header_str(&response, header::CONTENT_TYPE),
+            "text/html; charset=utf-8"
+        );
+        assert!(!response.headers().contains_key(header::ACCEPT_RANGES));
+        assert!(!response.headers().contains_key(header::CONTENT_RANGE));
+        let length: usize = header_str(&response, header::CONTENT_LENGTH)
+            .parse()
+            .unwrap();
+        let body = axum::body::to_bytes(response.into_body(), usize::MAX)
+            .await
+            .unwrap();
+        assert_eq!(body.len(), length);
+    }
+
+    #[tokio::test]
+    async fn precompressed_variants_vary_and_tag_per_encoding() {
+        let dir = TempDir::new();
+        let state = app_state(&dir, "").await;
+        let root = state.canonical_root.as_path();
+        std::fs::write(root.join("app.css"), "body { color: red }").unwrap();
+        let source = std::fs::File::options()
+            .write(true)
+            .open(root.join("app.css"))
+            .unwrap();
+        source
+            .set_modified(std::time::UNIX_EPOCH + std::time::Duration::from_secs(1_000))
+            .unwrap();
+        std::fs::write(root.join("app.css.gz"), "gzipped").unwrap();
+
+        let fetch = |encoding: &'static str| {
+            let mut headers = HeaderMap::new();
+            headers.insert(header::ACCEPT_ENCODING, HeaderValue::from_static(encoding));
+            serve_path(state.clone(), headers, "app.css", ViewQuery::default())
+        };
+        let gzip = fetch("gzip, deflate").await.unwrap();
+        let identity = fetch("identity").await.unwrap();
+        assert_eq!(header_str(&gzip, header::CONTENT_ENCODING), "gzip");
+        assert!(!identity.headers().contains_key(header::CONTENT_ENCODING));
+        for response in [&gzip, &identity] {
+            assert_eq!(header_str(response, header::VARY), "accept-encoding");
+        }
+        assert_ne!(
+            header_str(&gzip, header::ETAG),
+            header_str(&identity, header::ETAG)
+        );
+    }
+
+    #[tokio::test]
+    async fn listing_links_do_not_depend_on_a_trailing_slash() {
+        let dir = TempDir::new();
+        let state = app_state(&dir, "").await;
+        std::fs::create_dir_all(state.canonical_root.join("docs/guides")).unwrap();
+        std::fs::write(state.canonical_root.join("docs/readme.txt"), "hi").unwrap();
+
+        for path in ["docs", "docs/"] {
+            let response = serve_path(state.clone(), HeaderMap::new(), path, ViewQuery::default())
+                .await
+                .unwrap();
+            let body = axum::body::to_bytes(response.into_body(), usize::MAX)
+                .await
+                .unwrap();
+            let page = String::from_utf8(body.to_vec()).unwrap();
+            let hrefs: Vec<&str> = page
+                .split("href=\"")
+                .skip(1)
+                .map(|rest| &rest[..rest.find('"').unwrap()])
+                .collect();
+            assert!(hrefs.contains(&"/list?id=root"), "{path}: no parent link");
+            assert!(
+                hrefs.iter().any(|href| href.starts_with("/download?id=")),
+                "{path}: no file link"
+            );
+            for href in hrefs {
+                assert!(
+                    href.starts_with('/') || href.starts_with('#'),
+                    "{path}: {href}"
+                );
+            }
+        }
+    }
 }
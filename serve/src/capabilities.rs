@@ -0,0 +1,202 @@
+use axum::{
+    body::Body,
+    extract::State,
+    http::{HeaderMap, StatusCode, header},
+    response::Response,
+};
+
+use crate::http_utils::wants_json;
+use crate::{AppError, AppState, POWERED_BY};
+
+const ROOT_ALLOW: &str = "GET, HEAD, OPTIONS";
+const UPLOAD_ALLOW: &str = "POST, HEAD, OPTIONS";
+const UPLOAD_STREAM_ALLOW: &str = "PUT, POST, OPTIONS";
+
+const UPLOAD_ENABLED_HEADER: &str = "X-Upload-Enabled";
+const TOKEN_REQUIRED_HEADER: &str = "X-Upload-Token-Required";
+const MAX_FILE_SIZE_HEADER: &str = "X-Upload-Max-File-Size";
+const MIN_FILE_SIZE_HEADER: &str = "X-Upload-Min-File-Size";
+const ALLOWED_EXTENSIONS_HEADER: &str = "X-Upload-Allowed-Extensions";
+const NO_EXTENSION_HEADER: &str = "X-Upload-Allow-No-Ext";
+
+/// `OPTIONS /`; never requires a token so clients can probe before authenticating.
+pub(crate) async fn options_root(
+    State(state): State<AppState>,
+    headers: HeaderMap,
+) -> Result<Response, AppError> {
+    options_response(&state, &headers, ROOT_ALLOW)
+}
+
+pub(crate) async fn options_upload(
+    State(state): State<AppState>,
+    headers: HeaderMap,
+) -> Result<Response, AppError> {
+    options_response(&state, &headers, UPLOAD_ALLOW)
+}
+
+/// `HEAD /upload`: the upload limits as `X-Upload-*` headers, so a client can check a file
+/// locally before sending it. Like `OPTIONS`, no token is needed.
+pub(crate) async fn head_upload(State(state): State<AppState>) -> Result<Response, AppError> {
+    upload_limit_headers(
+        &state,
+        Response::builder().header(header::ALLOW, UPLOAD_ALLOW),
+    )
+    .status(StatusCode::NO_CONTENT)
+    .body(Body::empty())
+    .map_err(|err| AppError::Internal(err.to_string()))
+}
+
+pub(crate) async fn options_upload_stream(
+    State(state): State<AppState>,
+    headers: HeaderMap,
+) -> Result<Response, AppError> {
+    options_response(&state, &headers, UPLOAD_STREAM_ALLOW)
+}
+
+/// Plain clients get `204` with `Allow`; API clients (`Accept: application/json` or
+/// `serve-cli`) additionally get the capabilities document, which needs a `200`.
+fn options_response(
+    state: &AppState,
+    headers: &HeaderMap,
+    allow: &'static str,
+) -> Result<Response, AppError> {
+    let builder = upload_limit_headers(state, Response::builder().header(header::ALLOW, allow));
+    if !wants_json(headers) {
+        return builder
+            .status(StatusCode::NO_CONTENT)
+            .body(Body::empty())
+            .map_err(|err| AppError::Internal(err.to_string()));
+    }
+
+    let uploads_enabled = !state.config.upload_token.is_empty() || state.config.open_upload;
+    // Delete, move, mkdir and the manifest only accept the upload token; open uploads
+    // do not extend to them.
+    let token_endpoints = !state.config.upload_token.is_empty();
+    let payload = serde_json::json!({
+        "uploads_enabled": uploads_enabled,
+        "token_required": uploads_enabled && !state.config.open_upload,
+        "open_upload": state.config.open_upload,
+        "basic_auth": state.config.basic_auth_user.is_some(),
+        "max_file_size": state.config.max_file_size,
+        "min_file_size": state.config.min_file_size,
+        "reject_empty_uploads": state.config.reject_empty_uploads,
+        "allowed_extensions": sorted_extensions(state),
+        "allow_all_extensions": state.config.allow_all_extensions,
+        "allow_no_extension": allows_no_extension(state),
+        "upload_endpoints": ["/upload", "/upload-stream"],
+        "delete": token_endpoints,
+        "move": token_endpoints,
+        "mkdir": token_endpoints,
+        "manifest": token_endpoints,
+        "search": !state.config.disable_listing,
+        "listing": !state.config.disable_listing,
+        "powered_by": POWERED_BY,
+    });
+    let body = serde_json::to_string_pretty(&payload)
+        .map_err(|err| AppError::Internal(err.to_string()))?;
+
+    builder
+        .status(StatusCode::OK)
+        .header(header::CONTENT_TYPE, "application/json; charset=utf-8")
+        .body(Body::from(body))
+        .map_err(|err| AppError::Internal(err.to_string()))
+}
+
+/// Same limits the upload handlers enforce, read from the active config.
+fn upload_limit_headers(
+    state: &AppState,
+    builder: axum::http::response::Builder,
+) -> axum::http::response::Builder {
+    let config = &state.config;
+    let uploads_enabled = !config.upload_token.is_empty() || config.open_upload;
+    let allowed_extensions = if config.allow_all_extensions || config.allowed_extensions.is_empty()
+    {
+        "*".to_string()
+    } else {
+        sorted_extensions(state).join(",")
+    };
+    builder
+        .header(UPLOAD_ENABLED_HEADER, uploads_enabled.to_string())
+        .header(
+            TOKEN_REQUIRED_HEADER,
+            (uploads_enabled && !config.open_upload).to_string(),
+        )
+        .header(MAX_FILE_SIZE_HEADER, config.max_file_size.to_string())
+        .header(MIN_FILE_SIZE_HEADER, config.min_file_size.to_string())
+        .header(ALLOWED_EXTENSIONS_HEADER, allowed_extensions)
+        .header(NO_EXTENSION_HEADER, allows_no_extension(state).to_string())
+}
+
+fn sorted_extensions(state: &AppState) -> Vec<String> {
+    let mut extensions: Vec<_> = state.config.allowed_extensions.iter().cloned().collect();
+    extensions.sort();
+    extensions
+}
+
+/// Whether files without an extension are accepted as-is. When this is false a client can
+/// still opt in per request with `X-Allow-No-Ext`.
+fn allows_no_extension(state: &AppState) -> bool {
+    state.config.allow_all_extensions || state.config.allowed_extensions.is_empty()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::test_support::{TempDir, app_state};
+
+    async fn capabilities(config: &str) -> serde_json::Value {
+        let dir = TempDir::new();
+        let state = app_state(&dir, config).await;
+        let mut headers = HeaderMap::new();
+        headers.insert(header::ACCEPT, "application/json".parse().unwrap());
+        let response = options_root(State(state), headers).await.unwrap();
+        let body = http_body_util::BodyExt::collect(response.into_body())
+            .await
+            .unwrap()
+            .to_bytes();
+        serde_json::from_slice(&body).unwrap()
+    }
+
+    #[tokio::test]
+    async fn token_endpoints_follow_the_upload_token() {
+        let open = capabilities("upload_token = \"\"\nopen_upload = true\n").await;
+        assert_eq!(open["uploads_enabled"], true);
+        for name in ["delete", "move", "mkdir", "manifest"] {
+            assert_eq!(open[name], false, "{name} without a token");
+        }
+
+        let token = capabilities("upload_token = \"secret\"\n").await;
+        for name in ["delete", "move", "mkdir", "manifest"] {
+            assert_eq!(token[name], true, "{name} with a token");
+        }
+    }
+
+    #[tokio::test]
+    async fn head_upload_advertises_the_active_limits() {
+        let dir = TempDir::new();
+        let state = app_state(
+            &dir,
+            "max_file_size = 1024\nmin_file_size = 2\nallowed_extensions = [\"txt\", \"pdf\"]\n",
+        )
+        .await;
+        let response = head_upload(State(state)).await.unwrap();
+        assert_eq!(response.status(), StatusCode::NO_CONTENT);
+        let headers = response.headers();
+        assert_eq!(headers[header::ALLOW], UPLOAD_ALLOW);
+        assert_eq!(headers[UPLOAD_ENABLED_HEADER], "true");
+        assert_eq!(headers[TOKEN_REQUIRED_HEADER], "true");
+        assert_eq!(headers[MAX_FILE_SIZE_HEADER], "1024");
+        assert_eq!(headers[MIN_FILE_SIZE_HEADER], "2");
+        assert_eq!(headers[ALLOWED_EXTENSIONS_HEADER], "pdf,txt");
+        assert_eq!(headers[NO_EXTENSION_HEADER], "false");
+
+        let dir = TempDir::new();
+        let state = app_state(&dir, "upload_token = \"\"\nallow_all_extensions = true\n").await;
+        let response = head_upload(State(state)).await.unwrap();
+        let headers = response.headers();
+        assert_eq!(headers[UPLOAD_ENABLED_HEADER], "false");
+        assert_eq!(headers[TOKEN_REQUIRED_HEADER], "false");
+        assert_eq!(headers[ALLOWED_EXTENSIONS_HEADER], "*");
+        assert_eq!(headers[NO_EXTENSION_HEADER], "true");
+    }
+}
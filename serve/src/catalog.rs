@@ -1,8 +1,10 @@
-use crate::utils::{parent_relative_path, relative_path_string};
+use crate::utils::{mime_type_for, parent_relative_path};
+use crate::walk::{SymlinkPolicy, WalkOptions, walk_within};
 use rusqlite::{OptionalExtension, params};
 use std::collections::{HashMap, HashSet};
 use std::fmt;
 use std::fs;
+use std::ops::ControlFlow;
 use std::path::{Path, PathBuf};
 use std::sync::Arc;
 use std::time::{Duration, SystemTime, UNIX_EPOCH};
@@ -11,7 +13,6 @@ use tokio::task::JoinError;
 use tokio::time;
 use tokio_rusqlite::Connection;
 use ulid::Ulid;
-use walkdir::WalkDir;
 
 #[derive(Debug)]
 pub enum CatalogError {
@@ -373,29 +374,17 @@ fn scan_root(
     blacklist: &HashSet<String>,
 ) -> Result<Vec<ScannedEntry>, std::io::Error> {
     let mut entries = Vec::new();
-
-    let mut iter = WalkDir::new(root).into_iter();
-    while let Some(entry) = iter.next() {
-        let entry = match entry {
-            Ok(e) => e,
-            Err(err) => {
-                tracing::warn!("Metadata scan error: {}", err);
-                continue;
-            }
-        };
-
+    let options = WalkOptions {
+        blacklist,
+        max_depth: 0,
+        symlinks: SymlinkPolicy::Include,
+        cancel: None,
+    };
+
+    walk_within(root, root, &options, |walked| {
+        let entry = walked.entry;
         let full_path = entry.path();
-        if crate::utils::is_blacklisted(full_path, root, blacklist) {
-            if entry.file_type().is_dir() {
-                iter.skip_current_dir();
-            }
-            continue;
-        }
-
-        let relative = match relative_path_string(root, full_path) {
-            Some(path) => path,
-            None => continue,
-        };
+        let relative = walked.relative_path;
 
         let metadata = match entry.metadata() {
             Ok(meta) => meta,
@@ -405,7 +394,7 @@ fn scan_root(
                     full_path.display(),
                     err
                 );
-                continue;
+                return ControlFlow::Continue(());
             }
         };
 
@@ -421,10 +410,7 @@ fn scan_root(
         let mime_type = if is_dir {
             "inode/directory".to_string()
         } else {
-            mime_guess::MimeGuess::from_path(full_path)
-                .first_raw()
-                .unwrap_or("application/octet-stream")
-                .to_string()
+            mime_type_for(full_path)
         };
         let modified = metadata
             .modified()
@@ -447,7 +433,8 @@ fn scan_root(
             modified,
             depth,
         });
-    }
+        ControlFlow::Continue(())
+    });
 
     Ok(entries)
 }
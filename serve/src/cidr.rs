@@ -0,0 +1,72 @@
+//! Address blocks for the access lists: `192.168.1.0/24`, `fd00::/8`, or a bare address
+//! for a single host.
+
+use std::fmt;
+use std::net::IpAddr;
+use std::str::FromStr;
+
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub struct IpCidr {
+    network: IpAddr,
+    prefix: u8,
+}
+
+impl IpCidr {
+    pub fn contains(&self, ip: IpAddr) -> bool {
+        // Dual-stack sockets report IPv4 peers as ::ffff:a.b.c.d; match them as IPv4.
+        let ip = match ip {
+            IpAddr::V6(v6) => v6.to_ipv4_mapped().map_or(ip, IpAddr::V4),
+            IpAddr::V4(_) => ip,
+        };
+        match (self.network, ip) {
+            (IpAddr::V4(network), IpAddr::V4(ip)) => same_prefix(
+                u32::from(network).into(),
+                u32::from(ip).into(),
+                self.prefix,
+                32,
+            ),
+            (IpAddr::V6(network), IpAddr::V6(ip)) => {
+                same_prefix(network.into(), ip.into(), self.prefix, 128)
+            }
+            _ => false,
+        }
+    }
+}
+
+fn same_prefix(network: u128, ip: u128, prefix: u8, bits: u32) -> bool {
+    let shift = bits - u32::from(prefix);
+    shift >= 128 || network >> shift == ip >> shift
+}
+
+impl FromStr for IpCidr {
+    type Err = String;
+
+    fn from_str(value: &str) -> Result<Self, Self::Err> {
+        let value = value.trim();
+        let (address, prefix) = match value.split_once('/') {
+            Some((address, prefix)) => (address, Some(prefix)),
+            None => (value, None),
+        };
+        let network: IpAddr = address
+            .trim()
+            .parse()
+            .map_err(|_| format!("{value:?} is not an IP address or CIDR block"))?;
+        let max_prefix = if network.is_ipv4() { 32 } else { 128 };
+        let prefix = match prefix {
+            Some(prefix) => prefix
+                .trim()
+                .parse::<u8>()
+                .ok()
+                .filter(|prefix| *prefix <= max_prefix)
+                .ok_or_else(|| format!("{value:?} has a prefix outside 0-{max_prefix}"))?,
+            None => max_prefix,
+        };
+        Ok(Self { network, prefix })
+    }
+}
+
+impl fmt::Display for IpCidr {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}/{}", self.network, self.prefix)
+    }
+}
@@ -1,22 +1,219 @@
 use serde::Deserialize;
-use std::collections::HashSet;
+use std::collections::{BTreeMap, HashSet};
 use std::env;
 use std::fmt;
 use std::fs;
 use std::path::{Path, PathBuf};
+use std::time::Duration;
+
+use crate::cidr::IpCidr;
+use crate::sort::{ListSort, SortOrder};
+use crate::utils;
+
+const DEFAULT_UPLOAD_TMP_DIR: &str = ".tmp";
+const DEFAULT_IDEMPOTENCY_TTL_SECS: u64 = 600;
+const DEFAULT_MAINTENANCE_FILE: &str = "maintenance";
+const DEFAULT_MAINTENANCE_RETRY_AFTER: u64 = 300;
+const DEFAULT_SHUTDOWN_GRACE_SECS: u64 = 30;
+const DEFAULT_READ_HEADER_TIMEOUT: Duration = Duration::from_secs(15);
+const DEFAULT_READ_TIMEOUT: Duration = Duration::from_secs(15);
+const DEFAULT_WRITE_TIMEOUT: Duration = Duration::ZERO;
+const DEFAULT_IDLE_TIMEOUT: Duration = Duration::from_secs(120);
+const DEFAULT_HEALTH_PATH: &str = "/healthz";
+const DEFAULT_LISTING_CACHE_CONTROL: &str = "no-cache";
+const DEFAULT_LISTING_PAGE_SIZE: usize = 200;
+const DEFAULT_ZIP_WORKERS: usize = 1;
+const DEFAULT_STRONG_ETAG_MAX_SIZE: u64 = 256 * 1024 * 1024;
+const DEFAULT_COMPRESS_MAX_SIZE: u64 = 16 * 1024 * 1024;
+const DEFAULT_OPEN_UPLOAD_RATE: u32 = 10;
+const DEFAULT_UPLOAD_PATH_FIELD: &str = "dir";
+const DEFAULT_OPEN_UPLOAD_QUOTA: u64 = 1024 * 1024 * 1024;
+const DEFAULT_FILE_CSP: &str = "default-src 'none'; img-src 'self'; media-src 'self'";
+/// `SERVE_BLACKLIST=-` / `SERVE_ALLOWED_EXT=-` set the list to empty (and `SERVE_FILE_CSP=-`
+/// turns the policy off, `SERVE_SITE_*=-` drops the text), since an empty variable means
+/// "not set".
+const CLEAR_LIST_SENTINEL: &str = "-";
 
 /// Application configuration values.
 #[derive(Clone, Debug)]
 pub struct Config {
     pub port: u16,
+    pub ports: Vec<u16>,
+    /// Host or IP address to listen on; `None` listens on all interfaces.
+    pub bind: Option<String>,
+    /// Bind to the address this interface has at startup instead of all interfaces.
+    pub interface: Option<String>,
+    /// PEM certificate chain and private key; HTTPS is served when both are set.
+    pub tls_cert: Option<PathBuf>,
+    pub tls_key: Option<PathBuf>,
+    /// Listen on this Unix domain socket instead of TCP ports.
+    pub unix_socket: Option<PathBuf>,
     pub upload_token: String,
+    /// HTTP Basic credentials required for browsing and downloads; both or neither must be
+    /// set. The password may be a bcrypt hash (`$2b$...`).
+    pub basic_auth_user: Option<String>,
+    pub basic_auth_pass: Option<String>,
     pub max_file_size: u64,
+    pub min_file_size: u64,
+    pub reject_empty_uploads: bool,
+    pub upload_sidecar: bool,
+    /// Multipart field of `/upload` naming the target directory when neither `?dir` nor
+    /// `X-Upload-Dir` is given. It must come before the file part.
+    pub upload_path_field: String,
+    /// Glob patterns (see [`crate::utils::glob_match`]) limiting where uploads may be
+    /// stored, token or not. A pattern matching the file's root-relative path or one of
+    /// its directories allows it; empty allows anywhere under the root.
+    pub upload_allowed_paths: Vec<String>,
+    /// Recreate a missing upload target directory. When off, an upload whose directory is
+    /// gone is refused with `DIR_NOT_FOUND` instead.
+    pub create_missing_dirs: bool,
+    /// Accept uploads without the token (a public drop-box). Such uploads are limited to
+    /// `open_upload_rate` per minute and `open_upload_quota` bytes per day per client
+    /// address, and may not widen the extension list per request.
+    pub open_upload: bool,
+    pub open_upload_rate: u32,
+    pub open_upload_quota: u64,
+    /// Uploads, deletes and moves each client address may make per minute; 0 disables.
+    pub upload_rate_limit: u32,
+    /// Requests a client may make at once before `upload_rate_limit` applies; 0 means one
+    /// minute's worth.
+    pub upload_burst: u32,
     pub blacklisted_files: HashSet<String>,
     pub allowed_extensions: HashSet<String>,
+    pub allow_all_extensions: bool,
+    /// Types `?view=true` may render inline (same syntax as `allowed_extensions`); others
+    /// are downloaded instead. Empty means no restriction.
+    pub inline_extensions: HashSet<String>,
+    /// Types shown inline without `?view=true` (e.g. images and PDFs); everything else
+    /// downloads unless viewing is requested. Empty keeps downloads as the default.
+    pub inline_default_extensions: HashSet<String>,
+    /// Types always sent as sandboxed attachments, even with `?view=true`, because they can
+    /// run script in this origin.
+    pub force_download_extensions: HashSet<String>,
+    /// `Content-Security-Policy` sent with every file response; empty disables it.
+    pub file_csp: String,
+    /// Send a content-hash ETag (cached per path, size and mtime) instead of the weak
+    /// size+mtime one, so `If-Range` resumes survive timestamp churn. Files larger than
+    /// `strong_etag_max_size` keep the weak tag.
+    pub strong_etags: bool,
+    pub strong_etag_max_size: u64,
+    /// Text-like responses (listings, JSON, text downloads) are gzip/br-encoded on the fly
+    /// up to this many bytes; larger ones are sent as-is. 0 removes the cap.
+    pub compress_max_size: u64,
+    /// Listing page branding: a title replacing the "Index of" heading, and text shown
+    /// under it and in the footer. `site_header_html` is inserted unescaped.
+    pub site_title: Option<String>,
+    pub site_header: Option<String>,
+    pub site_header_html: Option<String>,
+    pub site_footer: Option<String>,
+    /// Operator notice shown at the top of the listing pages and sent as `banner` in JSON
+    /// listings and upload responses.
+    pub banner: Option<String>,
     pub root_override: Option<PathBuf>,
     pub config_dir: Option<PathBuf>,
     pub root_source: RootSource,
     pub catalog_refresh_secs: u64,
+    pub upload_tmp_dir: Option<PathBuf>,
+    pub user: Option<String>,
+    pub group: Option<String>,
+    pub chroot: bool,
+    pub max_conns_per_ip: usize,
+    /// Requests served at once across all clients; 0 means unlimited.
+    pub max_connections: usize,
+    /// Clients allowed to reach the server; empty allows everyone not denied.
+    pub allow_cidrs: Vec<IpCidr>,
+    /// Clients refused even when `allow_cidrs` matches them.
+    pub deny_cidrs: Vec<IpCidr>,
+    /// Believe `X-Forwarded-For`, `X-Forwarded-Proto` and friends from a trusted peer.
+    /// Off, the socket peer and the server's own TLS state are used instead.
+    pub trust_proxy: bool,
+    /// Peers whose forwarded headers `trust_proxy` accepts; empty trusts any peer.
+    pub trusted_proxies: Vec<IpCidr>,
+    pub name_max_display: usize,
+    pub idempotency_ttl_secs: u64,
+    pub maintenance: bool,
+    pub maintenance_file: Option<PathBuf>,
+    pub maintenance_retry_after: u64,
+    /// Connection timeouts; zero disables one. `read_header_timeout` bounds receiving a
+    /// request's headers, `read_timeout` the longest pause in a request body,
+    /// `write_timeout` how long a client may stall reading the response, and
+    /// `idle_timeout` how long a connection may carry no data at all.
+    pub read_header_timeout: Duration,
+    pub read_timeout: Duration,
+    pub write_timeout: Duration,
+    pub idle_timeout: Duration,
+    /// Path of the liveness probe (`/healthz` by default).
+    pub health_path: String,
+    /// `Cache-Control` for directory listings (HTML and JSON), so a listing never outlives
+    /// an upload or delete in a cache. Empty sends no header. Files are not affected.
+    pub listing_cache_control: String,
+    /// Entries per page of a directory listing unless `?per_page=` says otherwise; 0 lists
+    /// every entry on one page.
+    pub listing_page_size: usize,
+    /// Column a listing is sorted by when the request has no `?sort=`.
+    pub default_sort: ListSort,
+    /// Direction for `default_sort` when the request has neither `?sort=` nor `?order=`;
+    /// `None` keeps the column's own default (names A-Z, sizes and times largest first).
+    pub default_order: Option<SortOrder>,
+    /// Serve a directory's `index.html` in place of its generated listing.
+    pub auto_index: bool,
+    /// Refuse generated listings, directory archives and search, so files are reachable
+    /// only by a known id; a directory's `index.html` is still served.
+    pub disable_listing: bool,
+    /// Answer unknown extensionless paths with the root `index.html` and serve files under
+    /// the root by path, for single-page apps with client-side routes.
+    pub spa_fallback: bool,
+    /// HTML sent with 404 to browsers instead of the plain-text message; relative paths
+    /// resolve against the root. `None` uses `404.html` in the root when it exists.
+    pub not_found_page: Option<PathBuf>,
+    /// Threads compressing zip entries ahead of the one streaming the archive; 1 keeps it
+    /// all on that thread, 0 uses one per CPU.
+    pub zip_workers: usize,
+    /// How zip entries are stored; see [`ZipCompression`].
+    pub zip_compression: ZipCompression,
+    /// `host[:port]` every request is redirected to when its `Host` differs, so links and
+    /// cookies always use one name. The health path is never redirected.
+    pub canonical_host: Option<String>,
+    /// Leave requests addressed to `localhost` or a loopback IP alone, for local testing.
+    pub canonical_host_exempt_loopback: bool,
+    /// Origins (`https://app.example.com`) browser pages may call the API from, or `*` for
+    /// any; empty sends no CORS headers.
+    pub cors_origins: Vec<String>,
+    /// How long in-flight requests may run after SIGINT/SIGTERM before they are dropped.
+    pub shutdown_grace_secs: u64,
+    /// Write the log here instead of stderr; reopened on SIGHUP.
+    pub log_file: Option<PathBuf>,
+    /// Rotate `log_file` to `<name>.1` once it would grow past this many MiB; 0 never does.
+    pub log_max_size_mb: u64,
+    /// Permission bits applied to uploaded files and the directories created for them,
+    /// regardless of the process umask. `None` leaves the umask in charge.
+    pub upload_file_mode: Option<u32>,
+    pub upload_dir_mode: Option<u32>,
+    /// Where each setting came from, keyed by its config-file name.
+    pub sources: BTreeMap<&'static str, ValueSource>,
+}
+
+/// `zip_compression`: what directory zips do with each file.
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq)]
+pub enum ZipCompression {
+    /// Deflate text-like files and store the rest, which rarely shrinks.
+    #[default]
+    Auto,
+    /// Store every file as-is.
+    Store,
+    /// Deflate every file, at the given level (0-9) or the default one.
+    Deflate(Option<i64>),
+}
+
+impl fmt::Display for ZipCompression {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            ZipCompression::Auto => f.write_str("auto"),
+            ZipCompression::Store => f.write_str("store"),
+            ZipCompression::Deflate(None) => f.write_str("deflate"),
+            ZipCompression::Deflate(Some(level)) => write!(f, "deflate:{level}"),
+        }
+    }
 }
 
 #[derive(Clone, Copy, Debug, PartialEq, Eq)]
@@ -27,19 +224,109 @@ pub enum RootSource {
     Cli,
 }
 
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum ValueSource {
+    Default,
+    File,
+    Env(&'static str),
+    Cli,
+}
+
+impl fmt::Display for ValueSource {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            ValueSource::Default => write!(f, "default"),
+            ValueSource::File => write!(f, "config file"),
+            ValueSource::Env(name) => write!(f, "env {name}"),
+            ValueSource::Cli => write!(f, "command line"),
+        }
+    }
+}
+
 impl Config {
     pub fn load(config_path: Option<&Path>) -> Result<Self, ConfigError> {
         let defaults = default_values();
 
         let mut port = defaults.port;
+        let mut ports: Vec<u16> = Vec::new();
         let mut upload_token = defaults.upload_token;
+        let mut basic_auth_user: Option<String> = None;
+        let mut basic_auth_pass: Option<String> = None;
         let mut max_file_size = defaults.max_file_size;
+        let mut min_file_size = 0u64;
+        let mut reject_empty_uploads = false;
+        let mut upload_sidecar = false;
+        let mut upload_path_field = DEFAULT_UPLOAD_PATH_FIELD.to_string();
+        let mut upload_allowed_paths = Vec::new();
+        let mut create_missing_dirs = true;
+        let mut open_upload = false;
+        let mut open_upload_rate = DEFAULT_OPEN_UPLOAD_RATE;
+        let mut open_upload_quota = DEFAULT_OPEN_UPLOAD_QUOTA;
+        let mut upload_rate_limit = 0;
+        let mut upload_burst = 0;
         let mut blacklisted_files = defaults.blacklisted_files;
         let mut allowed_extensions = defaults.allowed_extensions;
+        let mut allow_all_extensions = false;
         let mut root_override: Option<PathBuf> = None;
         let mut config_dir: Option<PathBuf> = None;
         let mut root_source = RootSource::Default;
         let mut catalog_refresh_secs = defaults.catalog_refresh_secs;
+        let mut upload_tmp_dir: Option<PathBuf> = None;
+        let mut user: Option<String> = None;
+        let mut group: Option<String> = None;
+        let mut chroot = false;
+        let mut max_conns_per_ip = 0usize;
+        let mut max_connections = 0usize;
+        let mut allow_cidrs: Vec<IpCidr> = Vec::new();
+        let mut deny_cidrs: Vec<IpCidr> = Vec::new();
+        let mut trust_proxy = false;
+        let mut trusted_proxies: Vec<IpCidr> = Vec::new();
+        let mut name_max_display = 0usize;
+        let mut idempotency_ttl_secs = DEFAULT_IDEMPOTENCY_TTL_SECS;
+        let mut bind: Option<String> = None;
+        let mut interface: Option<String> = None;
+        let mut tls_cert: Option<PathBuf> = None;
+        let mut unix_socket: Option<PathBuf> = None;
+        let mut tls_key: Option<PathBuf> = None;
+        let mut maintenance = false;
+        let mut maintenance_file: Option<PathBuf> = None;
+        let mut maintenance_retry_after = DEFAULT_MAINTENANCE_RETRY_AFTER;
+        let mut shutdown_grace_secs = DEFAULT_SHUTDOWN_GRACE_SECS;
+        let mut log_file: Option<PathBuf> = None;
+        let mut log_max_size_mb = 0u64;
+        let mut health_path = DEFAULT_HEALTH_PATH.to_string();
+        let mut listing_cache_control = DEFAULT_LISTING_CACHE_CONTROL.to_string();
+        let mut listing_page_size = DEFAULT_LISTING_PAGE_SIZE;
+        let mut default_sort = ListSort::default();
+        let mut default_order: Option<SortOrder> = None;
+        let mut auto_index = false;
+        let mut disable_listing = false;
+        let mut spa_fallback = false;
+        let mut not_found_page: Option<PathBuf> = None;
+        let mut zip_workers = DEFAULT_ZIP_WORKERS;
+        let mut zip_compression = ZipCompression::default();
+        let mut canonical_host: Option<String> = None;
+        let mut canonical_host_exempt_loopback = true;
+        let mut cors_origins: Vec<String> = Vec::new();
+        let mut read_header_timeout = DEFAULT_READ_HEADER_TIMEOUT;
+        let mut read_timeout = DEFAULT_READ_TIMEOUT;
+        let mut write_timeout = DEFAULT_WRITE_TIMEOUT;
+        let mut idle_timeout = DEFAULT_IDLE_TIMEOUT;
+        let mut inline_extensions: HashSet<String> = HashSet::new();
+        let mut inline_default_extensions: HashSet<String> = HashSet::new();
+        let mut force_download_extensions = default_force_download_extensions();
+        let mut file_csp = DEFAULT_FILE_CSP.to_string();
+        let mut strong_etags = false;
+        let mut strong_etag_max_size = DEFAULT_STRONG_ETAG_MAX_SIZE;
+        let mut compress_max_size = DEFAULT_COMPRESS_MAX_SIZE;
+        let mut site_title: Option<String> = None;
+        let mut site_header: Option<String> = None;
+        let mut site_header_html: Option<String> = None;
+        let mut site_footer: Option<String> = None;
+        let mut banner: Option<String> = None;
+        let mut upload_file_mode: Option<u32> = None;
+        let mut upload_dir_mode: Option<u32> = None;
+        let mut sources = default_sources();
 
         let candidates = resolve_config_candidates(config_path)?;
 
@@ -50,14 +337,88 @@ impl Config {
 
                 if let Some(value) = parsed.port {
                     port = value;
+                    sources.insert("port", ValueSource::File);
+                }
+
+                if let Some(list) = parsed.ports {
+                    ports = list;
+                    sources.insert("ports", ValueSource::File);
                 }
 
                 if let Some(value) = parsed.upload_token {
                     upload_token = value;
+                    sources.insert("upload_token", ValueSource::File);
+                }
+
+                if let Some(value) = parsed.basic_auth_user {
+                    basic_auth_user = non_empty(&value);
+                    sources.insert("basic_auth_user", ValueSource::File);
+                }
+
+                if let Some(value) = parsed.basic_auth_pass {
+                    // Not trimmed: spaces may be part of the password.
+                    basic_auth_pass = (!value.is_empty()).then_some(value);
+                    sources.insert("basic_auth_pass", ValueSource::File);
                 }
 
                 if let Some(value) = parsed.max_file_size {
                     max_file_size = value;
+                    sources.insert("max_file_size", ValueSource::File);
+                }
+
+                if let Some(value) = parsed.min_file_size {
+                    min_file_size = value;
+                    sources.insert("min_file_size", ValueSource::File);
+                }
+
+                if let Some(value) = parsed.reject_empty_uploads {
+                    reject_empty_uploads = value;
+                    sources.insert("reject_empty_uploads", ValueSource::File);
+                }
+
+                if let Some(value) = parsed.upload_sidecar {
+                    upload_sidecar = value;
+                    sources.insert("upload_sidecar", ValueSource::File);
+                }
+
+                if let Some(value) = parsed.upload_path_field {
+                    upload_path_field = parse_form_field("upload_path_field", &value)?;
+                    sources.insert("upload_path_field", ValueSource::File);
+                }
+
+                if let Some(values) = parsed.upload_allowed_paths {
+                    upload_allowed_paths = parse_path_patterns("upload_allowed_paths", values)?;
+                    sources.insert("upload_allowed_paths", ValueSource::File);
+                }
+
+                if let Some(value) = parsed.create_missing_dirs {
+                    create_missing_dirs = value;
+                    sources.insert("create_missing_dirs", ValueSource::File);
+                }
+
+                if let Some(value) = parsed.open_upload {
+                    open_upload = value;
+                    sources.insert("open_upload", ValueSource::File);
+                }
+
+                if let Some(value) = parsed.open_upload_rate {
+                    open_upload_rate = value;
+                    sources.insert("open_upload_rate", ValueSource::File);
+                }
+
+                if let Some(value) = parsed.open_upload_quota {
+                    open_upload_quota = value;
+                    sources.insert("open_upload_quota", ValueSource::File);
+                }
+
+                if let Some(value) = parsed.upload_rate_limit {
+                    upload_rate_limit = value;
+                    sources.insert("upload_rate_limit", ValueSource::File);
+                }
+
+                if let Some(value) = parsed.upload_burst {
+                    upload_burst = value;
+                    sources.insert("upload_burst", ValueSource::File);
                 }
 
                 if let Some(values) = parsed.blacklisted_files {
@@ -68,6 +429,7 @@ impl Config {
                         .collect::<HashSet<_>>();
                     if !set.is_empty() {
                         blacklisted_files = set;
+                        sources.insert("blacklisted_files", ValueSource::File);
                     }
                 }
 
@@ -79,12 +441,86 @@ impl Config {
                         .collect::<HashSet<_>>();
                     if !set.is_empty() {
                         allowed_extensions = set;
+                        sources.insert("allowed_extensions", ValueSource::File);
                     }
                 }
 
+                if let Some(values) = parsed.inline_extensions {
+                    inline_extensions = values
+                        .into_iter()
+                        .map(|s| s.trim().to_ascii_lowercase())
+                        .filter(|s| !s.is_empty())
+                        .collect();
+                    sources.insert("inline_extensions", ValueSource::File);
+                }
+
+                if let Some(values) = parsed.inline_default_extensions {
+                    inline_default_extensions = values
+                        .into_iter()
+                        .map(|s| s.trim().to_ascii_lowercase())
+                        .filter(|s| !s.is_empty())
+                        .collect();
+                    sources.insert("inline_default_extensions", ValueSource::File);
+                }
+
+                if let Some(values) = parsed.force_download_extensions {
+                    let set = values
+                        .into_iter()
+                        .map(|s| s.trim().to_ascii_lowercase())
+                        .filter(|s| !s.is_empty())
+                        .collect::<HashSet<_>>();
+                    if !set.is_empty() {
+                        force_download_extensions = set;
+                        sources.insert("force_download_extensions", ValueSource::File);
+                    }
+                }
+
+                if let Some(value) = parsed.file_csp {
+                    file_csp = value.trim().to_string();
+                    sources.insert("file_csp", ValueSource::File);
+                }
+
+                if let Some(value) = parsed.strong_etags {
+                    strong_etags = value;
+                    sources.insert("strong_etags", ValueSource::File);
+                }
+
+                if let Some(value) = parsed.strong_etag_max_size {
+                    strong_etag_max_size = value;
+                    sources.insert("strong_etag_max_size", ValueSource::File);
+                }
+
+                if let Some(value) = parsed.compress_max_size {
+                    compress_max_size = value;
+                    sources.insert("compress_max_size", ValueSource::File);
+                }
+
+                for (name, value, target) in [
+                    ("site_title", parsed.site_title, &mut site_title),
+                    ("site_header", parsed.site_header, &mut site_header),
+                    (
+                        "site_header_html",
+                        parsed.site_header_html,
+                        &mut site_header_html,
+                    ),
+                    ("site_footer", parsed.site_footer, &mut site_footer),
+                    ("banner", parsed.banner, &mut banner),
+                ] {
+                    if let Some(value) = value {
+                        *target = non_empty(&value);
+                        sources.insert(name, ValueSource::File);
+                    }
+                }
+
+                if let Some(value) = parsed.allow_all_extensions {
+                    allow_all_extensions = value;
+                    sources.insert("allow_all_extensions", ValueSource::File);
+                }
+
                 if let Some(root) = parsed.root {
                     if !root.trim().is_empty() {
                         root_override = Some(PathBuf::from(&root));
+                        sources.insert("root", ValueSource::File);
                         root_source = RootSource::ConfigFile;
                     }
                 }
@@ -92,29 +528,390 @@ impl Config {
                 if let Some(interval) = parsed.catalog_refresh_secs {
                     if interval > 0 {
                         catalog_refresh_secs = interval;
+                        sources.insert("catalog_refresh_secs", ValueSource::File);
+                    }
+                }
+
+                if let Some(dir) = parsed.upload_tmp_dir {
+                    if !dir.trim().is_empty() {
+                        upload_tmp_dir = Some(PathBuf::from(dir));
+                        sources.insert("upload_tmp_dir", ValueSource::File);
+                    }
+                }
+
+                if let Some(value) = parsed.user {
+                    if !value.trim().is_empty() {
+                        user = Some(value.trim().to_string());
+                        sources.insert("user", ValueSource::File);
+                    }
+                }
+
+                if let Some(value) = parsed.group {
+                    if !value.trim().is_empty() {
+                        group = Some(value.trim().to_string());
+                        sources.insert("group", ValueSource::File);
+                    }
+                }
+
+                if let Some(value) = parsed.chroot {
+                    chroot = value;
+                    sources.insert("chroot", ValueSource::File);
+                }
+
+                if let Some(value) = parsed.max_conns_per_ip {
+                    max_conns_per_ip = value;
+                    sources.insert("max_conns_per_ip", ValueSource::File);
+                }
+
+                if let Some(value) = parsed.max_connections {
+                    max_connections = value;
+                    sources.insert("max_connections", ValueSource::File);
+                }
+
+                if let Some(values) = parsed.allow_cidrs {
+                    allow_cidrs = parse_cidrs("allow_cidrs", values.iter().map(String::as_str))?;
+                    sources.insert("allow_cidrs", ValueSource::File);
+                }
+
+                if let Some(values) = parsed.deny_cidrs {
+                    deny_cidrs = parse_cidrs("deny_cidrs", values.iter().map(String::as_str))?;
+                    sources.insert("deny_cidrs", ValueSource::File);
+                }
+
+                if let Some(value) = parsed.trust_proxy {
+                    trust_proxy = value;
+                    sources.insert("trust_proxy", ValueSource::File);
+                }
+
+                if let Some(values) = parsed.trusted_proxies {
+                    trusted_proxies =
+                        parse_cidrs("trusted_proxies", values.iter().map(String::as_str))?;
+                    sources.insert("trusted_proxies", ValueSource::File);
+                }
+
+                if let Some(value) = parsed.name_max_display {
+                    name_max_display = value;
+                    sources.insert("name_max_display", ValueSource::File);
+                }
+
+                if let Some(value) = parsed.idempotency_ttl_secs {
+                    idempotency_ttl_secs = value;
+                    sources.insert("idempotency_ttl_secs", ValueSource::File);
+                }
+
+                if let Some(value) = parsed.bind {
+                    bind = normalize_bind(&value);
+                    sources.insert("bind", ValueSource::File);
+                }
+
+                if let Some(value) = parsed.interface {
+                    if !value.trim().is_empty() {
+                        interface = Some(value.trim().to_string());
+                        sources.insert("interface", ValueSource::File);
+                    }
+                }
+
+                if let Some(value) = parsed.maintenance {
+                    maintenance = value;
+                    sources.insert("maintenance", ValueSource::File);
+                }
+
+                if let Some(path) = parsed.maintenance_file {
+                    if !path.trim().is_empty() {
+                        maintenance_file = Some(PathBuf::from(path));
+                        sources.insert("maintenance_file", ValueSource::File);
+                    }
+                }
+
+                if let Some(value) = parsed.maintenance_retry_after {
+                    maintenance_retry_after = value;
+                    sources.insert("maintenance_retry_after", ValueSource::File);
+                }
+
+                if let Some(value) = parsed.health_path {
+                    health_path = parse_health_path("health_path", &value)?;
+                    sources.insert("health_path", ValueSource::File);
+                }
+
+                if let Some(value) = parsed.listing_cache_control {
+                    listing_cache_control = parse_header_value("listing_cache_control", &value)?;
+                    sources.insert("listing_cache_control", ValueSource::File);
+                }
+
+                if let Some(value) = parsed.listing_page_size {
+                    listing_page_size = value;
+                    sources.insert("listing_page_size", ValueSource::File);
+                }
+                if let Some(value) = parsed.default_sort {
+                    default_sort = parse_list_sort("default_sort", &value)?;
+                    sources.insert("default_sort", ValueSource::File);
+                }
+                if let Some(value) = parsed.default_order {
+                    default_order = parse_sort_order("default_order", &value)?;
+                    sources.insert("default_order", ValueSource::File);
+                }
+
+                if let Some(value) = parsed.auto_index {
+                    auto_index = value;
+                    sources.insert("auto_index", ValueSource::File);
+                }
+                if let Some(value) = parsed.disable_listing {
+                    disable_listing = value;
+                    sources.insert("disable_listing", ValueSource::File);
+                }
+
+                if let Some(value) = parsed.spa_fallback {
+                    spa_fallback = value;
+                    sources.insert("spa_fallback", ValueSource::File);
+                }
+
+                if let Some(path) = parsed.not_found_page {
+                    if !path.trim().is_empty() {
+                        not_found_page = Some(PathBuf::from(path));
+                        sources.insert("not_found_page", ValueSource::File);
+                    }
+                }
+
+                if let Some(value) = parsed.zip_workers {
+                    zip_workers = value;
+                    sources.insert("zip_workers", ValueSource::File);
+                }
+
+                if let Some(value) = parsed.zip_compression {
+                    zip_compression = parse_zip_compression("zip_compression", &value)?;
+                    sources.insert("zip_compression", ValueSource::File);
+                }
+
+                if let Some(value) = parsed.canonical_host {
+                    canonical_host = parse_canonical_host("canonical_host", &value)?;
+                    sources.insert("canonical_host", ValueSource::File);
+                }
+
+                if let Some(value) = parsed.canonical_host_exempt_loopback {
+                    canonical_host_exempt_loopback = value;
+                    sources.insert("canonical_host_exempt_loopback", ValueSource::File);
+                }
+
+                if let Some(values) = parsed.cors_origins {
+                    cors_origins =
+                        parse_cors_origins("cors_origins", values.iter().map(String::as_str))?;
+                    sources.insert("cors_origins", ValueSource::File);
+                }
+
+                if let Some(value) = parsed.shutdown_grace_secs {
+                    shutdown_grace_secs = value;
+                    sources.insert("shutdown_grace_secs", ValueSource::File);
+                }
+
+                if let Some(path) = parsed.log_file {
+                    if !path.trim().is_empty() {
+                        log_file = Some(PathBuf::from(path));
+                        sources.insert("log_file", ValueSource::File);
                     }
                 }
 
+                if let Some(value) = parsed.log_max_size_mb {
+                    log_max_size_mb = value;
+                    sources.insert("log_max_size_mb", ValueSource::File);
+                }
+
+                if let Some(value) = parsed.read_header_timeout {
+                    read_header_timeout = parse_duration("read_header_timeout", &value)?;
+                    sources.insert("read_header_timeout", ValueSource::File);
+                }
+                if let Some(value) = parsed.read_timeout {
+                    read_timeout = parse_duration("read_timeout", &value)?;
+                    sources.insert("read_timeout", ValueSource::File);
+                }
+                if let Some(value) = parsed.write_timeout {
+                    write_timeout = parse_duration("write_timeout", &value)?;
+                    sources.insert("write_timeout", ValueSource::File);
+                }
+                if let Some(value) = parsed.idle_timeout {
+                    idle_timeout = parse_duration("idle_timeout", &value)?;
+                    sources.insert("idle_timeout", ValueSource::File);
+                }
+
+                if let Some(value) = parsed.upload_file_mode {
+                    upload_file_mode = Some(parse_mode("upload_file_mode", &value)?);
+                    sources.insert("upload_file_mode", ValueSource::File);
+                }
+
+                if let Some(value) = parsed.upload_dir_mode {
+                    upload_dir_mode = Some(parse_mode("upload_dir_mode", &value)?);
+                    sources.insert("upload_dir_mode", ValueSource::File);
+                }
+
+                // Relative certificate and socket paths are resolved next to the config file.
+                let file_dir = candidate.parent().unwrap_or(Path::new("."));
+                if let Some(path) = parsed.tls_cert.filter(|path| !path.trim().is_empty()) {
+                    tls_cert = Some(file_dir.join(path.trim()));
+                    sources.insert("tls_cert", ValueSource::File);
+                }
+                if let Some(path) = parsed.tls_key.filter(|path| !path.trim().is_empty()) {
+                    tls_key = Some(file_dir.join(path.trim()));
+                    sources.insert("tls_key", ValueSource::File);
+                }
+                if let Some(path) = parsed.unix_socket.filter(|path| !path.trim().is_empty()) {
+                    unix_socket = Some(file_dir.join(path.trim()));
+                    sources.insert("unix_socket", ValueSource::File);
+                }
+
                 config_dir = candidate.parent().map(|p| p.to_path_buf());
                 break;
             }
         }
+        if config_dir.is_none() {
+            tracing::info!("No configuration file found; using built-in defaults");
+        }
 
         if let Ok(value) = env::var("SERVE_PORT") {
             if let Ok(parsed) = value.parse() {
                 port = parsed;
+                sources.insert("port", ValueSource::Env("SERVE_PORT"));
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_PORTS") {
+            let list = parse_ports("SERVE_PORTS", &value)?;
+            if !list.is_empty() {
+                ports = list;
+                sources.insert("ports", ValueSource::Env("SERVE_PORTS"));
             }
         }
 
         if let Ok(value) = env::var("SERVE_UPLOAD_TOKEN") {
             if !value.is_empty() {
                 upload_token = value;
+                sources.insert("upload_token", ValueSource::Env("SERVE_UPLOAD_TOKEN"));
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_BASIC_AUTH_USER") {
+            if !value.trim().is_empty() {
+                basic_auth_user = non_empty(&value);
+                sources.insert("basic_auth_user", ValueSource::Env("SERVE_BASIC_AUTH_USER"));
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_BASIC_AUTH_PASS") {
+            if !value.is_empty() {
+                basic_auth_pass = Some(value);
+                sources.insert("basic_auth_pass", ValueSource::Env("SERVE_BASIC_AUTH_PASS"));
             }
         }
 
         if let Ok(value) = env::var("SERVE_MAX_FILE_SIZE") {
             if let Ok(parsed) = value.parse() {
                 max_file_size = parsed;
+                sources.insert("max_file_size", ValueSource::Env("SERVE_MAX_FILE_SIZE"));
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_MIN_FILE_SIZE") {
+            if let Ok(parsed) = value.trim().parse() {
+                min_file_size = parsed;
+                sources.insert("min_file_size", ValueSource::Env("SERVE_MIN_FILE_SIZE"));
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_REJECT_EMPTY_UPLOADS") {
+            if let Some(parsed) = parse_bool(&value) {
+                reject_empty_uploads = parsed;
+                sources.insert(
+                    "reject_empty_uploads",
+                    ValueSource::Env("SERVE_REJECT_EMPTY_UPLOADS"),
+                );
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_UPLOAD_SIDECAR") {
+            if let Some(parsed) = parse_bool(&value) {
+                upload_sidecar = parsed;
+                sources.insert("upload_sidecar", ValueSource::Env("SERVE_UPLOAD_SIDECAR"));
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_UPLOAD_PATH_FIELD") {
+            if !value.trim().is_empty() {
+                upload_path_field = parse_form_field("SERVE_UPLOAD_PATH_FIELD", &value)?;
+                sources.insert(
+                    "upload_path_field",
+                    ValueSource::Env("SERVE_UPLOAD_PATH_FIELD"),
+                );
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_UPLOAD_ALLOWED_PATHS") {
+            if value.trim() == CLEAR_LIST_SENTINEL {
+                upload_allowed_paths.clear();
+                sources.insert(
+                    "upload_allowed_paths",
+                    ValueSource::Env("SERVE_UPLOAD_ALLOWED_PATHS"),
+                );
+            } else if !value.trim().is_empty() {
+                upload_allowed_paths = parse_path_patterns(
+                    "SERVE_UPLOAD_ALLOWED_PATHS",
+                    value.split(',').map(str::to_string).collect(),
+                )?;
+                sources.insert(
+                    "upload_allowed_paths",
+                    ValueSource::Env("SERVE_UPLOAD_ALLOWED_PATHS"),
+                );
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_CREATE_MISSING_DIRS") {
+            if let Some(parsed) = parse_bool(&value) {
+                create_missing_dirs = parsed;
+                sources.insert(
+                    "create_missing_dirs",
+                    ValueSource::Env("SERVE_CREATE_MISSING_DIRS"),
+                );
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_OPEN_UPLOAD") {
+            if let Some(parsed) = parse_bool(&value) {
+                open_upload = parsed;
+                sources.insert("open_upload", ValueSource::Env("SERVE_OPEN_UPLOAD"));
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_OPEN_UPLOAD_RATE") {
+            if let Ok(parsed) = value.trim().parse::<u32>() {
+                open_upload_rate = parsed;
+                sources.insert(
+                    "open_upload_rate",
+                    ValueSource::Env("SERVE_OPEN_UPLOAD_RATE"),
+                );
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_OPEN_UPLOAD_QUOTA") {
+            if let Ok(parsed) = value.trim().parse::<u64>() {
+                open_upload_quota = parsed;
+                sources.insert(
+                    "open_upload_quota",
+                    ValueSource::Env("SERVE_OPEN_UPLOAD_QUOTA"),
+                );
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_UPLOAD_RATE_LIMIT") {
+            if let Ok(parsed) = value.trim().parse::<u32>() {
+                upload_rate_limit = parsed;
+                sources.insert(
+                    "upload_rate_limit",
+                    ValueSource::Env("SERVE_UPLOAD_RATE_LIMIT"),
+                );
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_UPLOAD_BURST") {
+            if let Ok(parsed) = value.trim().parse::<u32>() {
+                upload_burst = parsed;
+                sources.insert("upload_burst", ValueSource::Env("SERVE_UPLOAD_BURST"));
             }
         }
 
@@ -125,8 +922,12 @@ impl Config {
                 .filter(|s| !s.is_empty())
                 .map(|s| s.to_string())
                 .collect::<HashSet<_>>();
-            if !set.is_empty() {
+            if value.trim() == CLEAR_LIST_SENTINEL {
+                blacklisted_files.clear();
+                sources.insert("blacklisted_files", ValueSource::Env("SERVE_BLACKLIST"));
+            } else if !set.is_empty() {
                 blacklisted_files = set;
+                sources.insert("blacklisted_files", ValueSource::Env("SERVE_BLACKLIST"));
             }
         }
 
@@ -137,14 +938,150 @@ impl Config {
                 .filter(|s| !s.is_empty())
                 .map(|s| s.to_ascii_lowercase())
                 .collect::<HashSet<_>>();
-            if !set.is_empty() {
+            if value.trim() == CLEAR_LIST_SENTINEL {
+                allowed_extensions.clear();
+                sources.insert("allowed_extensions", ValueSource::Env("SERVE_ALLOWED_EXT"));
+            } else if !set.is_empty() {
                 allowed_extensions = set;
+                sources.insert("allowed_extensions", ValueSource::Env("SERVE_ALLOWED_EXT"));
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_INLINE_EXT") {
+            let set = value
+                .split(',')
+                .map(str::trim)
+                .filter(|s| !s.is_empty())
+                .map(|s| s.to_ascii_lowercase())
+                .collect::<HashSet<_>>();
+            if value.trim() == CLEAR_LIST_SENTINEL {
+                inline_extensions.clear();
+                sources.insert("inline_extensions", ValueSource::Env("SERVE_INLINE_EXT"));
+            } else if !set.is_empty() {
+                inline_extensions = set;
+                sources.insert("inline_extensions", ValueSource::Env("SERVE_INLINE_EXT"));
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_INLINE_DEFAULT_EXT") {
+            let set = value
+                .split(',')
+                .map(str::trim)
+                .filter(|s| !s.is_empty())
+                .map(|s| s.to_ascii_lowercase())
+                .collect::<HashSet<_>>();
+            if value.trim() == CLEAR_LIST_SENTINEL {
+                inline_default_extensions.clear();
+                sources.insert(
+                    "inline_default_extensions",
+                    ValueSource::Env("SERVE_INLINE_DEFAULT_EXT"),
+                );
+            } else if !set.is_empty() {
+                inline_default_extensions = set;
+                sources.insert(
+                    "inline_default_extensions",
+                    ValueSource::Env("SERVE_INLINE_DEFAULT_EXT"),
+                );
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_FORCE_DOWNLOAD_EXT") {
+            let set = value
+                .split(',')
+                .map(str::trim)
+                .filter(|s| !s.is_empty())
+                .map(|s| s.to_ascii_lowercase())
+                .collect::<HashSet<_>>();
+            if value.trim() == CLEAR_LIST_SENTINEL {
+                force_download_extensions.clear();
+                sources.insert(
+                    "force_download_extensions",
+                    ValueSource::Env("SERVE_FORCE_DOWNLOAD_EXT"),
+                );
+            } else if !set.is_empty() {
+                force_download_extensions = set;
+                sources.insert(
+                    "force_download_extensions",
+                    ValueSource::Env("SERVE_FORCE_DOWNLOAD_EXT"),
+                );
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_FILE_CSP") {
+            let trimmed = value.trim();
+            if trimmed == CLEAR_LIST_SENTINEL {
+                file_csp.clear();
+                sources.insert("file_csp", ValueSource::Env("SERVE_FILE_CSP"));
+            } else if !trimmed.is_empty() {
+                file_csp = trimmed.to_string();
+                sources.insert("file_csp", ValueSource::Env("SERVE_FILE_CSP"));
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_STRONG_ETAGS") {
+            if let Some(parsed) = parse_bool(&value) {
+                strong_etags = parsed;
+                sources.insert("strong_etags", ValueSource::Env("SERVE_STRONG_ETAGS"));
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_STRONG_ETAG_MAX_SIZE") {
+            if let Ok(parsed) = value.trim().parse::<u64>() {
+                strong_etag_max_size = parsed;
+                sources.insert(
+                    "strong_etag_max_size",
+                    ValueSource::Env("SERVE_STRONG_ETAG_MAX_SIZE"),
+                );
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_COMPRESS_MAX_SIZE") {
+            if let Ok(parsed) = value.trim().parse::<u64>() {
+                compress_max_size = parsed;
+                sources.insert(
+                    "compress_max_size",
+                    ValueSource::Env("SERVE_COMPRESS_MAX_SIZE"),
+                );
+            }
+        }
+
+        for (var, name, target) in [
+            ("SERVE_SITE_TITLE", "site_title", &mut site_title),
+            ("SERVE_SITE_HEADER", "site_header", &mut site_header),
+            (
+                "SERVE_SITE_HEADER_HTML",
+                "site_header_html",
+                &mut site_header_html,
+            ),
+            ("SERVE_SITE_FOOTER", "site_footer", &mut site_footer),
+            ("SERVE_BANNER", "banner", &mut banner),
+        ] {
+            if let Ok(value) = env::var(var) {
+                let trimmed = value.trim();
+                if trimmed == CLEAR_LIST_SENTINEL {
+                    *target = None;
+                    sources.insert(name, ValueSource::Env(var));
+                } else if !trimmed.is_empty() {
+                    *target = Some(trimmed.to_string());
+                    sources.insert(name, ValueSource::Env(var));
+                }
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_ALLOW_ALL_EXT") {
+            if let Some(parsed) = parse_bool(&value) {
+                allow_all_extensions = parsed;
+                sources.insert(
+                    "allow_all_extensions",
+                    ValueSource::Env("SERVE_ALLOW_ALL_EXT"),
+                );
             }
         }
 
         if let Ok(value) = env::var("SERVE_ROOT") {
             if !value.trim().is_empty() {
                 root_override = Some(PathBuf::from(value));
+                sources.insert("root", ValueSource::Env("SERVE_ROOT"));
                 root_source = RootSource::EnvVar;
             }
         }
@@ -153,26 +1090,608 @@ impl Config {
             if let Ok(parsed) = value.parse::<u64>() {
                 if parsed > 0 {
                     catalog_refresh_secs = parsed;
+                    sources.insert(
+                        "catalog_refresh_secs",
+                        ValueSource::Env("SERVE_CATALOG_REFRESH_SECS"),
+                    );
+                }
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_UPLOAD_TMP_DIR") {
+            if !value.trim().is_empty() {
+                upload_tmp_dir = Some(PathBuf::from(value));
+                sources.insert("upload_tmp_dir", ValueSource::Env("SERVE_UPLOAD_TMP_DIR"));
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_USER") {
+            if !value.trim().is_empty() {
+                user = Some(value.trim().to_string());
+                sources.insert("user", ValueSource::Env("SERVE_USER"));
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_GROUP") {
+            if !value.trim().is_empty() {
+                group = Some(value.trim().to_string());
+                sources.insert("group", ValueSource::Env("SERVE_GROUP"));
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_CHROOT") {
+            if let Some(parsed) = parse_bool(&value) {
+                chroot = parsed;
+                sources.insert("chroot", ValueSource::Env("SERVE_CHROOT"));
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_MAX_CONNS_PER_IP") {
+            if let Ok(parsed) = value.trim().parse::<usize>() {
+                max_conns_per_ip = parsed;
+                sources.insert(
+                    "max_conns_per_ip",
+                    ValueSource::Env("SERVE_MAX_CONNS_PER_IP"),
+                );
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_MAX_CONNECTIONS") {
+            if let Ok(parsed) = value.trim().parse::<usize>() {
+                max_connections = parsed;
+                sources.insert("max_connections", ValueSource::Env("SERVE_MAX_CONNECTIONS"));
+            }
+        }
+
+        for (var, name, target) in [
+            ("SERVE_ALLOW_CIDRS", "allow_cidrs", &mut allow_cidrs),
+            ("SERVE_DENY_CIDRS", "deny_cidrs", &mut deny_cidrs),
+            (
+                "SERVE_TRUSTED_PROXIES",
+                "trusted_proxies",
+                &mut trusted_proxies,
+            ),
+        ] {
+            if let Ok(value) = env::var(var) {
+                if value.trim() == CLEAR_LIST_SENTINEL {
+                    target.clear();
+                    sources.insert(name, ValueSource::Env(var));
+                } else if !value.trim().is_empty() {
+                    *target = parse_cidrs(var, value.split(','))?;
+                    sources.insert(name, ValueSource::Env(var));
+                }
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_TRUST_PROXY") {
+            if let Some(parsed) = parse_bool(&value) {
+                trust_proxy = parsed;
+                sources.insert("trust_proxy", ValueSource::Env("SERVE_TRUST_PROXY"));
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_NAME_MAX_DISPLAY") {
+            if let Ok(parsed) = value.trim().parse::<usize>() {
+                name_max_display = parsed;
+                sources.insert(
+                    "name_max_display",
+                    ValueSource::Env("SERVE_NAME_MAX_DISPLAY"),
+                );
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_IDEMPOTENCY_TTL_SECS") {
+            if let Ok(parsed) = value.trim().parse::<u64>() {
+                idempotency_ttl_secs = parsed;
+                sources.insert(
+                    "idempotency_ttl_secs",
+                    ValueSource::Env("SERVE_IDEMPOTENCY_TTL_SECS"),
+                );
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_TLS_CERT") {
+            if !value.trim().is_empty() {
+                tls_cert = Some(PathBuf::from(value.trim()));
+                sources.insert("tls_cert", ValueSource::Env("SERVE_TLS_CERT"));
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_UNIX_SOCKET") {
+            if !value.trim().is_empty() {
+                unix_socket = Some(PathBuf::from(value.trim()));
+                sources.insert("unix_socket", ValueSource::Env("SERVE_UNIX_SOCKET"));
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_TLS_KEY") {
+            if !value.trim().is_empty() {
+                tls_key = Some(PathBuf::from(value.trim()));
+                sources.insert("tls_key", ValueSource::Env("SERVE_TLS_KEY"));
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_BIND") {
+            bind = normalize_bind(&value);
+            sources.insert("bind", ValueSource::Env("SERVE_BIND"));
+        }
+
+        if let Ok(value) = env::var("SERVE_INTERFACE") {
+            if !value.trim().is_empty() {
+                interface = Some(value.trim().to_string());
+                sources.insert("interface", ValueSource::Env("SERVE_INTERFACE"));
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_MAINTENANCE") {
+            if let Some(parsed) = parse_bool(&value) {
+                maintenance = parsed;
+                sources.insert("maintenance", ValueSource::Env("SERVE_MAINTENANCE"));
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_MAINTENANCE_FILE") {
+            if !value.trim().is_empty() {
+                maintenance_file = Some(PathBuf::from(value));
+                sources.insert(
+                    "maintenance_file",
+                    ValueSource::Env("SERVE_MAINTENANCE_FILE"),
+                );
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_MAINTENANCE_RETRY_AFTER") {
+            if let Ok(parsed) = value.trim().parse::<u64>() {
+                maintenance_retry_after = parsed;
+                sources.insert(
+                    "maintenance_retry_after",
+                    ValueSource::Env("SERVE_MAINTENANCE_RETRY_AFTER"),
+                );
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_HEALTH_PATH") {
+            if !value.trim().is_empty() {
+                health_path = parse_health_path("SERVE_HEALTH_PATH", &value)?;
+                sources.insert("health_path", ValueSource::Env("SERVE_HEALTH_PATH"));
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_LISTING_CACHE_CONTROL") {
+            listing_cache_control = parse_header_value("SERVE_LISTING_CACHE_CONTROL", &value)?;
+            sources.insert(
+                "listing_cache_control",
+                ValueSource::Env("SERVE_LISTING_CACHE_CONTROL"),
+            );
+        }
+
+        if let Ok(value) = env::var("SERVE_LISTING_PAGE_SIZE") {
+            if let Ok(parsed) = value.trim().parse::<usize>() {
+                listing_page_size = parsed;
+                sources.insert(
+                    "listing_page_size",
+                    ValueSource::Env("SERVE_LISTING_PAGE_SIZE"),
+                );
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_DEFAULT_SORT") {
+            default_sort = parse_list_sort("SERVE_DEFAULT_SORT", &value)?;
+            sources.insert("default_sort", ValueSource::Env("SERVE_DEFAULT_SORT"));
+        }
+
+        if let Ok(value) = env::var("SERVE_DEFAULT_ORDER") {
+            default_order = parse_sort_order("SERVE_DEFAULT_ORDER", &value)?;
+            sources.insert("default_order", ValueSource::Env("SERVE_DEFAULT_ORDER"));
+        }
+
+        if let Ok(value) = env::var("SERVE_AUTO_INDEX") {
+            if let Some(parsed) = parse_bool(&value) {
+                auto_index = parsed;
+                sources.insert("auto_index", ValueSource::Env("SERVE_AUTO_INDEX"));
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_DISABLE_LISTING") {
+            if let Some(parsed) = parse_bool(&value) {
+                disable_listing = parsed;
+                sources.insert("disable_listing", ValueSource::Env("SERVE_DISABLE_LISTING"));
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_SPA_FALLBACK") {
+            if let Some(parsed) = parse_bool(&value) {
+                spa_fallback = parsed;
+                sources.insert("spa_fallback", ValueSource::Env("SERVE_SPA_FALLBACK"));
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_NOT_FOUND_PAGE") {
+            if !value.trim().is_empty() {
+                not_found_page = Some(PathBuf::from(value));
+                sources.insert("not_found_page", ValueSource::Env("SERVE_NOT_FOUND_PAGE"));
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_ZIP_WORKERS") {
+            if let Ok(parsed) = value.trim().parse::<usize>() {
+                zip_workers = parsed;
+                sources.insert("zip_workers", ValueSource::Env("SERVE_ZIP_WORKERS"));
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_ZIP_COMPRESSION") {
+            zip_compression = parse_zip_compression("SERVE_ZIP_COMPRESSION", &value)?;
+            sources.insert("zip_compression", ValueSource::Env("SERVE_ZIP_COMPRESSION"));
+        }
+
+        if let Ok(value) = env::var("SERVE_CANONICAL_HOST") {
+            canonical_host = parse_canonical_host("SERVE_CANONICAL_HOST", &value)?;
+            sources.insert("canonical_host", ValueSource::Env("SERVE_CANONICAL_HOST"));
+        }
+
+        if let Ok(value) = env::var("SERVE_CANONICAL_HOST_EXEMPT_LOOPBACK") {
+            if let Some(parsed) = parse_bool(&value) {
+                canonical_host_exempt_loopback = parsed;
+                sources.insert(
+                    "canonical_host_exempt_loopback",
+                    ValueSource::Env("SERVE_CANONICAL_HOST_EXEMPT_LOOPBACK"),
+                );
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_CORS_ORIGINS") {
+            if value.trim() == CLEAR_LIST_SENTINEL {
+                cors_origins.clear();
+                sources.insert("cors_origins", ValueSource::Env("SERVE_CORS_ORIGINS"));
+            } else if !value.trim().is_empty() {
+                cors_origins = parse_cors_origins("SERVE_CORS_ORIGINS", value.split(','))?;
+                sources.insert("cors_origins", ValueSource::Env("SERVE_CORS_ORIGINS"));
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_SHUTDOWN_GRACE_SECS") {
+            if let Ok(parsed) = value.trim().parse::<u64>() {
+                shutdown_grace_secs = parsed;
+                sources.insert(
+                    "shutdown_grace_secs",
+                    ValueSource::Env("SERVE_SHUTDOWN_GRACE_SECS"),
+                );
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_LOG_FILE") {
+            if !value.trim().is_empty() {
+                log_file = Some(PathBuf::from(value.trim()));
+                sources.insert("log_file", ValueSource::Env("SERVE_LOG_FILE"));
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_LOG_MAX_SIZE_MB") {
+            if let Ok(parsed) = value.trim().parse::<u64>() {
+                log_max_size_mb = parsed;
+                sources.insert("log_max_size_mb", ValueSource::Env("SERVE_LOG_MAX_SIZE_MB"));
+            }
+        }
+
+        for (var, name, target) in [
+            (
+                "SERVE_READ_HEADER_TIMEOUT",
+                "read_header_timeout",
+                &mut read_header_timeout,
+            ),
+            ("SERVE_READ_TIMEOUT", "read_timeout", &mut read_timeout),
+            ("SERVE_WRITE_TIMEOUT", "write_timeout", &mut write_timeout),
+            ("SERVE_IDLE_TIMEOUT", "idle_timeout", &mut idle_timeout),
+        ] {
+            if let Ok(value) = env::var(var) {
+                if !value.trim().is_empty() {
+                    *target = parse_duration(var, &value)?;
+                    sources.insert(name, ValueSource::Env(var));
                 }
             }
         }
 
+        if let Ok(value) = env::var("SERVE_UPLOAD_FILE_MODE") {
+            if !value.trim().is_empty() {
+                upload_file_mode = Some(parse_mode("SERVE_UPLOAD_FILE_MODE", &value)?);
+                sources.insert(
+                    "upload_file_mode",
+                    ValueSource::Env("SERVE_UPLOAD_FILE_MODE"),
+                );
+            }
+        }
+
+        if let Ok(value) = env::var("SERVE_UPLOAD_DIR_MODE") {
+            if !value.trim().is_empty() {
+                upload_dir_mode = Some(parse_mode("SERVE_UPLOAD_DIR_MODE", &value)?);
+                sources.insert("upload_dir_mode", ValueSource::Env("SERVE_UPLOAD_DIR_MODE"));
+            }
+        }
+
         Ok(Self {
             port,
+            ports,
+            bind,
+            interface,
+            tls_cert,
+            tls_key,
+            unix_socket,
             upload_token,
+            basic_auth_user,
+            basic_auth_pass,
             max_file_size,
+            min_file_size,
+            reject_empty_uploads,
+            upload_sidecar,
+            upload_path_field,
+            upload_allowed_paths,
+            create_missing_dirs,
+            open_upload,
+            open_upload_rate,
+            open_upload_quota,
+            upload_rate_limit,
+            upload_burst,
             blacklisted_files,
             allowed_extensions,
+            inline_extensions,
+            inline_default_extensions,
+            force_download_extensions,
+            file_csp,
+            strong_etags,
+            strong_etag_max_size,
+            compress_max_size,
+            site_title,
+            site_header,
+            site_header_html,
+            site_footer,
+            banner,
+            allow_all_extensions,
             root_override,
             config_dir,
             root_source,
             catalog_refresh_secs,
+            upload_tmp_dir,
+            user,
+            group,
+            chroot,
+            max_conns_per_ip,
+            max_connections,
+            allow_cidrs,
+            deny_cidrs,
+            trust_proxy,
+            trusted_proxies,
+            name_max_display,
+            idempotency_ttl_secs,
+            maintenance,
+            maintenance_file,
+            maintenance_retry_after,
+            health_path,
+            listing_cache_control,
+            listing_page_size,
+            default_sort,
+            default_order,
+            auto_index,
+            disable_listing,
+            spa_fallback,
+            not_found_page,
+            zip_workers,
+            zip_compression,
+            canonical_host,
+            canonical_host_exempt_loopback,
+            cors_origins,
+            shutdown_grace_secs,
+            log_file,
+            log_max_size_mb,
+            read_header_timeout,
+            read_timeout,
+            write_timeout,
+            idle_timeout,
+            upload_file_mode,
+            upload_dir_mode,
+            sources,
         })
     }
 
+    /// Every port to listen on: the primary `port` followed by any additional `ports`,
+    /// without duplicates.
+    pub fn listen_ports(&self) -> Vec<u16> {
+        let mut listen = vec![self.port];
+        for port in &self.ports {
+            if !listen.contains(port) {
+                listen.push(*port);
+            }
+        }
+        listen
+    }
+
+    /// Sentinel whose presence switches maintenance mode on; relative paths are resolved
+    /// against the config directory.
+    pub fn maintenance_file(&self) -> PathBuf {
+        match &self.maintenance_file {
+            Some(path) if path.is_absolute() => path.clone(),
+            Some(path) => self.storage_dir().join(path),
+            None => self.storage_dir().join(DEFAULT_MAINTENANCE_FILE),
+        }
+    }
+
+    /// Certificate and key when TLS is configured; setting only one of them is an error so a
+    /// typo never silently falls back to plain HTTP.
+    pub fn tls_paths(&self) -> Result<Option<(&Path, &Path)>, ConfigError> {
+        match (&self.tls_cert, &self.tls_key) {
+            (Some(cert), Some(key)) => Ok(Some((cert.as_path(), key.as_path()))),
+            (None, None) => Ok(None),
+            (Some(_), None) => Err(ConfigError::Invalid {
+                name: "tls_key",
+                message: "tls_cert is set but tls_key is missing".to_string(),
+            }),
+            (None, Some(_)) => Err(ConfigError::Invalid {
+                name: "tls_cert",
+                message: "tls_key is set but tls_cert is missing".to_string(),
+            }),
+        }
+    }
+
+    /// Basic Auth user and password when configured. Setting only one of them is an error,
+    /// so a typo never leaves the server open, and a `:` in the user name could never match.
+    pub fn basic_auth(&self) -> Result<Option<(&str, &str)>, ConfigError> {
+        match (&self.basic_auth_user, &self.basic_auth_pass) {
+            (Some(user), _) if user.contains(':') => Err(ConfigError::Invalid {
+                name: "basic_auth_user",
+                message: "must not contain ':'".to_string(),
+            }),
+            (Some(user), Some(pass)) => Ok(Some((user.as_str(), pass.as_str()))),
+            (None, None) => Ok(None),
+            (Some(_), None) => Err(ConfigError::Invalid {
+                name: "basic_auth_pass",
+                message: "basic_auth_user is set but basic_auth_pass is missing".to_string(),
+            }),
+            (None, Some(_)) => Err(ConfigError::Invalid {
+                name: "basic_auth_user",
+                message: "basic_auth_pass is set but basic_auth_user is missing".to_string(),
+            }),
+        }
+    }
+
+    /// `open_upload` is refused unless every safeguard is active: a rate limit, a daily
+    /// quota and an explicit extension list (`max_file_size` always applies).
+    pub fn open_upload_safeguards(&self) -> Result<(), ConfigError> {
+        if !self.open_upload {
+            return Ok(());
+        }
+        let missing = if self.open_upload_rate == 0 {
+            Some(("open_upload_rate", "must be greater than 0"))
+        } else if self.open_upload_quota == 0 {
+            Some(("open_upload_quota", "must be greater than 0"))
+        } else if self.allow_all_extensions || self.allowed_extensions.is_empty() {
+            Some((
+                "allowed_extensions",
+                "must list the accepted types and allow_all_extensions must be off",
+            ))
+        } else {
+            None
+        };
+        match missing {
+            Some((name, requirement)) => Err(ConfigError::Invalid {
+                name,
+                message: format!("{requirement} when open_upload is enabled"),
+            }),
+            None => Ok(()),
+        }
+    }
+
     pub fn storage_dir(&self) -> PathBuf {
         self.config_dir.clone().unwrap_or_else(default_config_dir)
     }
+
+    /// Directory holding in-flight uploads; relative paths are resolved against the served root
+    /// so the final rename stays on the same filesystem.
+    pub fn upload_tmp_dir(&self, root: &Path) -> PathBuf {
+        match &self.upload_tmp_dir {
+            Some(dir) if dir.is_absolute() => dir.clone(),
+            Some(dir) => root.join(dir),
+            None => root.join(DEFAULT_UPLOAD_TMP_DIR),
+        }
+    }
+}
+
+/// `""` (and `*`) mean all interfaces; IPv6 literals may be written with brackets.
+pub(crate) fn normalize_bind(value: &str) -> Option<String> {
+    let value = value.trim();
+    let value = value
+        .strip_prefix('[')
+        .and_then(|rest| rest.strip_suffix(']'))
+        .unwrap_or(value);
+    if value.is_empty() || value == "*" {
+        None
+    } else {
+        Some(value.to_string())
+    }
+}
+
+fn default_sources() -> BTreeMap<&'static str, ValueSource> {
+    [
+        "port",
+        "ports",
+        "bind",
+        "interface",
+        "tls_cert",
+        "tls_key",
+        "unix_socket",
+        "upload_token",
+        "basic_auth_user",
+        "basic_auth_pass",
+        "max_file_size",
+        "min_file_size",
+        "reject_empty_uploads",
+        "upload_sidecar",
+        "upload_path_field",
+        "upload_allowed_paths",
+        "create_missing_dirs",
+        "open_upload",
+        "open_upload_rate",
+        "open_upload_quota",
+        "upload_rate_limit",
+        "upload_burst",
+        "blacklisted_files",
+        "allowed_extensions",
+        "inline_extensions",
+        "inline_default_extensions",
+        "force_download_extensions",
+        "file_csp",
+        "strong_etags",
+        "strong_etag_max_size",
+        "compress_max_size",
+        "site_title",
+        "site_header",
+        "site_header_html",
+        "site_footer",
+        "banner",
+        "allow_all_extensions",
+        "root",
+        "catalog_refresh_secs",
+        "upload_tmp_dir",
+        "user",
+        "group",
+        "chroot",
+        "max_conns_per_ip",
+        "max_connections",
+        "allow_cidrs",
+        "deny_cidrs",
+        "trust_proxy",
+        "trusted_proxies",
+        "name_max_display",
+        "idempotency_ttl_secs",
+        "maintenance",
+        "maintenance_file",
+        "maintenance_retry_after",
+        "health_path",
+        "listing_cache_control",
+        "listing_page_size",
+        "default_sort",
+        "default_order",
+        "auto_index",
+        "disable_listing",
+        "spa_fallback",
+        "not_found_page",
+        "zip_workers",
+        "zip_compression",
+        "canonical_host",
+        "canonical_host_exempt_loopback",
+        "cors_origins",
+        "shutdown_grace_secs",
+        "log_file",
+        "log_max_size_mb",
+        "read_header_timeout",
+        "read_timeout",
+        "write_timeout",
+        "idle_timeout",
+        "upload_file_mode",
+        "upload_dir_mode",
+    ]
+    .into_iter()
+    .map(|field| (field, ValueSource::Default))
+    .collect()
 }
 
 struct DefaultValues {
@@ -198,6 +1717,13 @@ fn default_values() -> DefaultValues {
     }
 }
 
+fn default_force_download_extensions() -> HashSet<String> {
+    ["html", "htm", "svg", "xml", "js"]
+        .into_iter()
+        .map(str::to_string)
+        .collect()
+}
+
 fn default_allowed_extensions() -> HashSet<String> {
     [
         "mp3", "wav", "aac", "ogg", "flac", "m4a", "mp4", "avi", "mov", "wmv", "mkv", "flv",
@@ -272,18 +1798,323 @@ pub fn default_config_dir() -> PathBuf {
 #[derive(Debug, Deserialize)]
 struct FileConfig {
     port: Option<u16>,
+    ports: Option<Vec<u16>>,
+    bind: Option<String>,
+    interface: Option<String>,
+    tls_cert: Option<String>,
+    tls_key: Option<String>,
+    unix_socket: Option<String>,
     upload_token: Option<String>,
+    basic_auth_user: Option<String>,
+    basic_auth_pass: Option<String>,
     max_file_size: Option<u64>,
+    min_file_size: Option<u64>,
+    reject_empty_uploads: Option<bool>,
+    upload_sidecar: Option<bool>,
+    upload_path_field: Option<String>,
+    upload_allowed_paths: Option<Vec<String>>,
+    create_missing_dirs: Option<bool>,
+    open_upload: Option<bool>,
+    open_upload_rate: Option<u32>,
+    open_upload_quota: Option<u64>,
+    upload_rate_limit: Option<u32>,
+    upload_burst: Option<u32>,
     blacklisted_files: Option<Vec<String>>,
     allowed_extensions: Option<Vec<String>>,
+    inline_extensions: Option<Vec<String>>,
+    inline_default_extensions: Option<Vec<String>>,
+    force_download_extensions: Option<Vec<String>>,
+    file_csp: Option<String>,
+    strong_etags: Option<bool>,
+    strong_etag_max_size: Option<u64>,
+    compress_max_size: Option<u64>,
+    site_title: Option<String>,
+    site_header: Option<String>,
+    site_header_html: Option<String>,
+    site_footer: Option<String>,
+    banner: Option<String>,
+    allow_all_extensions: Option<bool>,
     root: Option<String>,
     catalog_refresh_secs: Option<u64>,
+    upload_tmp_dir: Option<String>,
+    user: Option<String>,
+    group: Option<String>,
+    chroot: Option<bool>,
+    max_conns_per_ip: Option<usize>,
+    max_connections: Option<usize>,
+    allow_cidrs: Option<Vec<String>>,
+    deny_cidrs: Option<Vec<String>>,
+    trust_proxy: Option<bool>,
+    trusted_proxies: Option<Vec<String>>,
+    name_max_display: Option<usize>,
+    idempotency_ttl_secs: Option<u64>,
+    maintenance: Option<bool>,
+    maintenance_file: Option<String>,
+    maintenance_retry_after: Option<u64>,
+    health_path: Option<String>,
+    listing_cache_control: Option<String>,
+    listing_page_size: Option<usize>,
+    default_sort: Option<String>,
+    default_order: Option<String>,
+    auto_index: Option<bool>,
+    disable_listing: Option<bool>,
+    spa_fallback: Option<bool>,
+    not_found_page: Option<String>,
+    zip_workers: Option<usize>,
+    zip_compression: Option<String>,
+    canonical_host: Option<String>,
+    canonical_host_exempt_loopback: Option<bool>,
+    cors_origins: Option<Vec<String>>,
+    shutdown_grace_secs: Option<u64>,
+    log_file: Option<String>,
+    log_max_size_mb: Option<u64>,
+    read_header_timeout: Option<String>,
+    read_timeout: Option<String>,
+    write_timeout: Option<String>,
+    idle_timeout: Option<String>,
+    upload_file_mode: Option<String>,
+    upload_dir_mode: Option<String>,
+}
+
+fn parse_bool(value: &str) -> Option<bool> {
+    match value.trim().to_ascii_lowercase().as_str() {
+        "1" | "true" | "yes" | "on" => Some(true),
+        "0" | "false" | "no" | "off" => Some(false),
+        _ => None,
+    }
+}
+
+/// Parses an octal permission string such as `"0640"`, `"2775"` or `"0o750"`.
+fn parse_mode(name: &'static str, value: &str) -> Result<u32, ConfigError> {
+    let trimmed = value.trim();
+    let digits = trimmed
+        .strip_prefix("0o")
+        .or_else(|| trimmed.strip_prefix("0O"))
+        .unwrap_or(trimmed);
+    match u32::from_str_radix(digits, 8) {
+        Ok(mode) if !digits.is_empty() && mode <= 0o7777 => Ok(mode),
+        _ => Err(ConfigError::Invalid {
+            name,
+            message: format!("{value:?} is not an octal file mode like \"0644\""),
+        }),
+    }
+}
+
+/// Comma-separated port numbers; empty entries are skipped, anything else must parse.
+fn parse_ports(name: &'static str, value: &str) -> Result<Vec<u16>, ConfigError> {
+    value
+        .split(',')
+        .map(str::trim)
+        .filter(|entry| !entry.is_empty())
+        .map(|entry| {
+            entry.parse::<u16>().map_err(|_| ConfigError::Invalid {
+                name,
+                message: format!("{entry:?} is not a port number"),
+            })
+        })
+        .collect()
+}
+
+/// A literal route like `/healthz` or `/_/health`; the leading slash is optional.
+fn parse_health_path(name: &'static str, value: &str) -> Result<String, ConfigError> {
+    let trimmed = value.trim();
+    let path = format!("/{}", trimmed.trim_start_matches('/'));
+    let invalid = |message: String| ConfigError::Invalid { name, message };
+    if path == "/" || path.ends_with('/') {
+        return Err(invalid(format!(
+            "{value:?} must name a path like \"/healthz\""
+        )));
+    }
+    if path
+        .chars()
+        .any(|c| c.is_whitespace() || matches!(c, '?' | '#' | ':' | '*' | '{' | '}' | '"' | '\\'))
+    {
+        return Err(invalid(format!(
+            "{value:?} may not contain whitespace, query, fragment or route patterns"
+        )));
+    }
+    if crate::ROUTE_PATHS.contains(&path.as_str()) {
+        return Err(invalid(format!("{path} is already used by the API")));
+    }
+    Ok(path)
+}
+
+/// Root-relative glob patterns; a leading `/` is dropped so `/incoming/*` works too.
+fn parse_path_patterns(
+    name: &'static str,
+    values: Vec<String>,
+) -> Result<Vec<String>, ConfigError> {
+    let mut patterns = Vec::new();
+    for value in values {
+        let pattern = value.trim().trim_start_matches('/').to_string();
+        if pattern.is_empty() {
+            continue;
+        }
+        if !utils::is_valid_glob(&pattern) {
+            return Err(ConfigError::Invalid {
+                name,
+                message: format!("{value:?} is not a valid glob pattern"),
+            });
+        }
+        patterns.push(pattern);
+    }
+    Ok(patterns)
+}
+
+/// A multipart field name other than `file`, which always carries the upload itself.
+fn parse_form_field(name: &'static str, value: &str) -> Result<String, ConfigError> {
+    let trimmed = value.trim();
+    let invalid = |message: String| ConfigError::Invalid { name, message };
+    if trimmed.is_empty() || trimmed == "file" {
+        return Err(invalid(format!(
+            "{value:?} must be a field name other than \"file\""
+        )));
+    }
+    if !trimmed.chars().all(|c| c.is_ascii_graphic() && c != '"') {
+        return Err(invalid(format!("{value:?} is not a valid field name")));
+    }
+    Ok(trimmed.to_string())
+}
+
+/// Text that can go out as an HTTP header value as written; may be empty.
+fn parse_header_value(name: &'static str, value: &str) -> Result<String, ConfigError> {
+    let trimmed = value.trim();
+    if !trimmed.chars().all(|c| c == ' ' || c.is_ascii_graphic()) {
+        return Err(ConfigError::Invalid {
+            name,
+            message: format!("{value:?} is not a valid header value"),
+        });
+    }
+    Ok(trimmed.to_string())
+}
+
+/// `auto`, `store`, `deflate` or `deflate:<0-9>`.
+fn parse_zip_compression(name: &'static str, value: &str) -> Result<ZipCompression, ConfigError> {
+    let value = value.trim().to_ascii_lowercase();
+    let parsed = match value.split_once(':') {
+        None if value == "auto" => Some(ZipCompression::Auto),
+        None if value == "store" => Some(ZipCompression::Store),
+        None if value == "deflate" => Some(ZipCompression::Deflate(None)),
+        Some(("deflate", level)) => level
+            .trim()
+            .parse::<i64>()
+            .ok()
+            .filter(|level| (0..=9).contains(level))
+            .map(|level| ZipCompression::Deflate(Some(level))),
+        _ => None,
+    };
+    parsed.ok_or_else(|| ConfigError::Invalid {
+        name,
+        message: format!("{value:?} is not auto, store, deflate or deflate:<0-9>"),
+    })
+}
+
+/// Every non-empty entry as a CIDR block; the first malformed one fails the whole list.
+fn parse_cidrs<'a>(
+    name: &'static str,
+    values: impl Iterator<Item = &'a str>,
+) -> Result<Vec<IpCidr>, ConfigError> {
+    values
+        .map(str::trim)
+        .filter(|value| !value.is_empty())
+        .map(|value| {
+            value
+                .parse::<IpCidr>()
+                .map_err(|message| ConfigError::Invalid { name, message })
+        })
+        .collect()
+}
+
+/// `*` or `scheme://host[:port]`, lowercased and without a trailing slash so it compares
+/// equal to a browser's `Origin` header.
+fn parse_cors_origins<'a>(
+    name: &'static str,
+    values: impl Iterator<Item = &'a str>,
+) -> Result<Vec<String>, ConfigError> {
+    values
+        .map(|value| value.trim().trim_end_matches('/').to_ascii_lowercase())
+        .filter(|value| !value.is_empty())
+        .map(|value| {
+            let valid = value == "*"
+                || value.split_once("://").is_some_and(|(scheme, host)| {
+                    matches!(scheme, "http" | "https") && !host.is_empty() && !host.contains('/')
+                });
+            if valid {
+                Ok(value)
+            } else {
+                Err(ConfigError::Invalid {
+                    name,
+                    message: format!(
+                        "{value:?} is not \"*\" or an origin like https://example.com"
+                    ),
+                })
+            }
+        })
+        .collect()
+}
+
+fn parse_list_sort(name: &'static str, value: &str) -> Result<ListSort, ConfigError> {
+    match value.trim().to_ascii_lowercase().as_str() {
+        "name" => Ok(ListSort::Name),
+        "size" => Ok(ListSort::Size),
+        "modified" => Ok(ListSort::Modified),
+        other => Err(ConfigError::Invalid {
+            name,
+            message: format!("{other:?} is not name, size or modified"),
+        }),
+    }
+}
+
+/// `asc` or `desc`; empty means the sort column's own default.
+fn parse_sort_order(name: &'static str, value: &str) -> Result<Option<SortOrder>, ConfigError> {
+    match value.trim().to_ascii_lowercase().as_str() {
+        "" => Ok(None),
+        "asc" => Ok(Some(SortOrder::Asc)),
+        "desc" => Ok(Some(SortOrder::Desc)),
+        other => Err(ConfigError::Invalid {
+            name,
+            message: format!("{other:?} is not asc or desc"),
+        }),
+    }
+}
+
+/// A bare authority such as `files.example.com` or `files.example.com:8443`, lowercased.
+/// Empty unsets it.
+fn parse_canonical_host(name: &'static str, value: &str) -> Result<Option<String>, ConfigError> {
+    let trimmed = value.trim();
+    if trimmed.is_empty() {
+        return Ok(None);
+    }
+    let valid = !trimmed.contains(['/', '@', '?', '#'])
+        && trimmed.parse::<axum::http::uri::Authority>().is_ok();
+    if !valid {
+        return Err(ConfigError::Invalid {
+            name,
+            message: format!("{value:?} is not a host name with an optional port"),
+        });
+    }
+    Ok(Some(trimmed.to_ascii_lowercase()))
+}
+
+fn non_empty(value: &str) -> Option<String> {
+    let trimmed = value.trim();
+    (!trimmed.is_empty()).then(|| trimmed.to_string())
+}
+
+/// Durations are written like Go's: `"0"`, `"500ms"`, `"30s"`, `"2m"`, `"1h30m"`.
+fn parse_duration(name: &'static str, value: &str) -> Result<Duration, ConfigError> {
+    let invalid = || ConfigError::Invalid {
+        name,
+        message: format!("{value:?} is not a duration like \"30s\" or \"2m\""),
+    };
+    utils::parse_duration(value).ok_or_else(invalid)
 }
 
 #[derive(Debug)]
 pub enum ConfigError {
     Io(std::io::Error),
     ParseToml(toml::de::Error),
+    Invalid { name: &'static str, message: String },
 }
 
 impl fmt::Display for ConfigError {
@@ -291,6 +2122,7 @@ impl fmt::Display for ConfigError {
         match self {
             ConfigError::Io(err) => write!(f, "Failed to read config file: {err}"),
             ConfigError::ParseToml(err) => write!(f, "Failed to parse config file: {err}"),
+            ConfigError::Invalid { name, message } => write!(f, "Invalid {name}: {message}"),
         }
     }
 }
@@ -308,3 +2140,76 @@ impl From<toml::de::Error> for ConfigError {
         ConfigError::ParseToml(err)
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::test_support::{ENV_LOCK, TempDir};
+
+    #[test]
+    fn health_path_may_not_shadow_a_route() {
+        for route in crate::ROUTE_PATHS.iter().filter(|route| **route != "/") {
+            assert!(
+                parse_health_path("health_path", route).is_err(),
+                "{route} was accepted"
+            );
+        }
+        assert!(parse_health_path("health_path", "logtail").is_err());
+        assert_eq!(
+            parse_health_path("health_path", "status/live").unwrap(),
+            "/status/live"
+        );
+    }
+
+    #[test]
+    fn ports_reject_bad_entries() {
+        assert_eq!(
+            parse_ports("SERVE_PORTS", "8080, 8443,").unwrap(),
+            vec![8080, 8443]
+        );
+        assert!(parse_ports("SERVE_PORTS", "8080,http").is_err());
+        assert!(parse_ports("SERVE_PORTS", "70000").is_err());
+    }
+
+    #[test]
+    fn list_sentinel_clears_file_lists() {
+        let dir = TempDir::new();
+        let config_path = dir.path().join("config.toml");
+        fs::write(
+            &config_path,
+            format!(
+                "root = {:?}\nblacklisted_files = [\"secret.key\"]\nallowed_extensions = [\"txt\"]\n",
+                dir.path().display().to_string()
+            ),
+        )
+        .unwrap();
+        let load_with = |blacklist: &str, extensions: &str| {
+            let _env = ENV_LOCK.lock().unwrap_or_else(|err| err.into_inner());
+            // SAFETY: every test that touches or reads SERVE_* holds ENV_LOCK.
+            unsafe {
+                env::set_var("SERVE_BLACKLIST", blacklist);
+                env::set_var("SERVE_ALLOWED_EXT", extensions);
+            }
+            let config = Config::load(Some(&config_path));
+            unsafe {
+                env::remove_var("SERVE_BLACKLIST");
+                env::remove_var("SERVE_ALLOWED_EXT");
+            }
+            config.unwrap()
+        };
+
+        let cleared = load_with(CLEAR_LIST_SENTINEL, CLEAR_LIST_SENTINEL);
+        assert!(cleared.blacklisted_files.is_empty());
+        assert!(cleared.allowed_extensions.is_empty());
+
+        let replaced = load_with("a.key, b.key", "PDF,md");
+        assert_eq!(
+            replaced.blacklisted_files,
+            HashSet::from(["a.key".to_string(), "b.key".to_string()])
+        );
+        assert_eq!(
+            replaced.allowed_extensions,
+            HashSet::from(["pdf".to_string(), "md".to_string()])
+        );
+    }
+}
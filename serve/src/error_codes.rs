@@ -0,0 +1,41 @@
+//! Stable, machine-readable error codes. They are sent in the `X-Error-Code` header on every
+//! error response and as `code` in JSON error bodies; clients may branch on them, so never
+//! rename or reuse one.
+
+pub(crate) const HEADER: &str = "X-Error-Code";
+
+// Defaults, one per `AppError` kind.
+pub(crate) const NOT_FOUND: &str = "NOT_FOUND";
+pub(crate) const UNAUTHORIZED: &str = "UNAUTHORIZED";
+pub(crate) const FORBIDDEN: &str = "FORBIDDEN";
+pub(crate) const BAD_REQUEST: &str = "BAD_REQUEST";
+pub(crate) const FILE_TOO_LARGE: &str = "FILE_TOO_LARGE";
+pub(crate) const TOO_MANY_REQUESTS: &str = "TOO_MANY_REQUESTS";
+pub(crate) const CONFLICT: &str = "CONFLICT";
+pub(crate) const INTERNAL: &str = "INTERNAL";
+
+// Specific failures.
+pub(crate) const MISSING_ID: &str = "MISSING_ID";
+pub(crate) const MISSING_FILE: &str = "MISSING_FILE";
+pub(crate) const INVALID_FILENAME: &str = "INVALID_FILENAME";
+pub(crate) const EXT_NOT_ALLOWED: &str = "EXT_NOT_ALLOWED";
+pub(crate) const INVALID_MULTIPART: &str = "INVALID_MULTIPART";
+pub(crate) const INVALID_PATH: &str = "INVALID_PATH";
+pub(crate) const PATH_NOT_ALLOWED: &str = "PATH_NOT_ALLOWED";
+pub(crate) const DIR_NOT_FOUND: &str = "DIR_NOT_FOUND";
+pub(crate) const NOT_A_DIRECTORY: &str = "NOT_A_DIRECTORY";
+pub(crate) const IS_A_DIRECTORY: &str = "IS_A_DIRECTORY";
+pub(crate) const ROOT_NOT_DELETABLE: &str = "ROOT_NOT_DELETABLE";
+pub(crate) const DIRECTORY_NOT_EMPTY: &str = "DIRECTORY_NOT_EMPTY";
+pub(crate) const PROTECTED_ENTRIES: &str = "PROTECTED_ENTRIES";
+pub(crate) const DESTINATION_EXISTS: &str = "DESTINATION_EXISTS";
+pub(crate) const FILE_TOO_SMALL: &str = "FILE_TOO_SMALL";
+pub(crate) const EMPTY_FILE: &str = "EMPTY_FILE";
+pub(crate) const COMPRESSION_RATIO: &str = "COMPRESSION_RATIO";
+pub(crate) const MAINTENANCE: &str = "MAINTENANCE";
+pub(crate) const SERVER_BUSY: &str = "SERVER_BUSY";
+pub(crate) const TARGET_NOT_WRITABLE: &str = "TARGET_NOT_WRITABLE";
+pub(crate) const UPLOAD_QUOTA_EXCEEDED: &str = "UPLOAD_QUOTA_EXCEEDED";
+pub(crate) const INVALID_GLOB: &str = "INVALID_GLOB";
+pub(crate) const INVALID_CURSOR: &str = "INVALID_CURSOR";
+pub(crate) const LISTING_DISABLED: &str = "LISTING_DISABLED";
@@ -0,0 +1,128 @@
+//! Content-hash ETags for `strong_etags`. The size+mtime validator churns on filesystems
+//! with coarse or unstable timestamps, which breaks `If-Range` resumes; hashing the content
+//! gives a tag that changes only when the bytes do.
+
+use std::collections::HashMap;
+use std::io::Read;
+use std::path::{Path, PathBuf};
+use std::sync::Mutex;
+
+use sha2::{Digest, Sha256};
+
+/// Hashes are cheap to keep, but the cache is reset once it holds this many files.
+const MAX_ENTRIES: usize = 4096;
+
+pub(crate) struct ContentEtags {
+    enabled: bool,
+    max_size: u64,
+    /// Path -> (size, mtime in nanoseconds, tag); a hit only counts while both still match.
+    entries: Mutex<HashMap<PathBuf, (u64, u128, String)>>,
+}
+
+impl ContentEtags {
+    pub(crate) fn new(enabled: bool, max_size: u64) -> Self {
+        Self {
+            enabled,
+            max_size,
+            entries: Mutex::new(HashMap::new()),
+        }
+    }
+
+    /// Strong ETag for `path`, or `None` when disabled, the file is larger than the cap, or
+    /// it cannot be read; callers then fall back to the weak size+mtime tag.
+    pub(crate) async fn etag(&self, path: &Path, metadata: &std::fs::Metadata) -> Option<String> {
+        if !self.enabled || metadata.len() > self.max_size {
+            return None;
+        }
+        let size = metadata.len();
+        let modified = metadata
+            .modified()
+            .ok()
+            .and_then(|time| time.duration_since(std::time::UNIX_EPOCH).ok())
+            .map(|elapsed| elapsed.as_nanos())?;
+
+        {
+            let entries = self.entries.lock().unwrap_or_else(|err| err.into_inner());
+            if let Some((cached_size, cached_modified, tag)) = entries.get(path) {
+                if *cached_size == size && *cached_modified == modified {
+                    return Some(tag.clone());
+                }
+            }
+        }
+
+        let owned = path.to_path_buf();
+        let tag = tokio::task::spawn_blocking(move || hash_file(&owned))
+            .await
+            .ok()?
+            .map_err(|err| {
+                tracing::warn!("Failed to hash {} for ETag: {}", path.display(), err);
+            })
+            .ok()?;
+
+        let mut entries = self.entries.lock().unwrap_or_else(|err| err.into_inner());
+        if entries.len() >= MAX_ENTRIES {
+            entries.clear();
+        }
+        entries.insert(path.to_path_buf(), (size, modified, tag.clone()));
+        Some(tag)
+    }
+}
+
+fn hash_file(path: &Path) -> std::io::Result<String> {
+    let mut file = std::fs::File::open(path)?;
+    let mut hasher = Sha256::new();
+    let mut buffer = vec![0u8; 64 * 1024];
+    loop {
+        let read = file.read(&mut buffer)?;
+        if read == 0 {
+            break;
+        }
+        hasher.update(&buffer[..read]);
+    }
+    let digest = hasher.finalize();
+    let hex: String = digest[..16]
+        .iter()
+        .map(|byte| format!("{byte:02x}"))
+        .collect();
+    Ok(format!("\"{hex}\""))
+}
+
+#[cfg(test)]
+mod tests {
+    use std::time::{Duration, UNIX_EPOCH};
+
+    use super::*;
+    use crate::test_support::TempDir;
+
+    async fn tag(etags: &ContentEtags, path: &Path) -> Option<String> {
+        etags.etag(path, &std::fs::metadata(path).unwrap()).await
+    }
+
+    #[tokio::test]
+    async fn tag_is_stable_until_the_content_changes() {
+        let dir = TempDir::new();
+        let path = dir.path().join("video.bin");
+        std::fs::write(&path, "frames").unwrap();
+        let etags = ContentEtags::new(true, 1024);
+
+        let first = tag(&etags, &path).await.unwrap();
+        assert_eq!(tag(&etags, &path).await.unwrap(), first);
+        // A new mtime alone (a touch, a coarse clock) keeps the tag.
+        let file = std::fs::File::options().write(true).open(&path).unwrap();
+        file.set_modified(UNIX_EPOCH + Duration::from_secs(1_000))
+            .unwrap();
+        assert_eq!(tag(&etags, &path).await.unwrap(), first);
+
+        std::fs::write(&path, "edited").unwrap();
+        assert_ne!(tag(&etags, &path).await.unwrap(), first);
+    }
+
+    #[tokio::test]
+    async fn disabled_or_oversized_files_keep_the_weak_tag() {
+        let dir = TempDir::new();
+        let path = dir.path().join("video.bin");
+        std::fs::write(&path, "frames").unwrap();
+        assert_eq!(tag(&ContentEtags::new(false, 1024), &path).await, None);
+        assert_eq!(tag(&ContentEtags::new(true, 4), &path).await, None);
+    }
+}
@@ -0,0 +1,44 @@
+use axum::{
+    body::Body,
+    extract::State,
+    http::{HeaderMap, StatusCode, header},
+    response::Response,
+};
+
+use crate::http_utils::wants_json;
+use crate::{AppError, AppState, POWERED_BY};
+
+/// Liveness probe for load balancers and Kubernetes, served at `health_path`. Touches no
+/// files; reports 503 while maintenance mode is on so the instance is drained. The route
+/// sits outside the middleware stack, so probes are neither logged nor gated.
+pub(crate) async fn healthz(
+    State(state): State<AppState>,
+    headers: HeaderMap,
+) -> Result<Response, AppError> {
+    let maintenance = state.maintenance.active().await;
+    let (status, label) = if maintenance {
+        (StatusCode::SERVICE_UNAVAILABLE, "maintenance")
+    } else {
+        (StatusCode::OK, "ok")
+    };
+
+    let (content_type, body) = if wants_json(&headers) {
+        let payload = serde_json::json!({
+            "status": label,
+            "maintenance": maintenance,
+            "powered_by": POWERED_BY,
+        });
+        let body = serde_json::to_string_pretty(&payload)
+            .map_err(|err| AppError::Internal(err.to_string()))?;
+        ("application/json; charset=utf-8", body)
+    } else {
+        ("text/plain; charset=utf-8", label.to_string())
+    };
+
+    Response::builder()
+        .status(status)
+        .header(header::CONTENT_TYPE, content_type)
+        .header(header::CACHE_CONTROL, "no-store")
+        .body(Body::from(body))
+        .map_err(|err| AppError::Internal(err.to_string()))
+}
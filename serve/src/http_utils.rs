@@ -1,4 +1,9 @@
-use axum::http::{HeaderMap, header};
+use std::net::SocketAddr;
+use std::sync::OnceLock;
+
+use axum::http::{HeaderMap, HeaderValue, header};
+use chrono::{DateTime, Utc};
+use percent_encoding::{AsciiSet, NON_ALPHANUMERIC, utf8_percent_encode};
 
 pub(crate) fn host_header(headers: &HeaderMap) -> String {
     headers
@@ -8,12 +13,23 @@ pub(crate) fn host_header(headers: &HeaderMap) -> String {
         .to_string()
 }
 
-pub(crate) fn build_base_url(headers: &HeaderMap) -> String {
-    let scheme = headers
+/// Scheme the server itself speaks, used when no proxy reports one; set once at startup.
+static DEFAULT_SCHEME: OnceLock<&'static str> = OnceLock::new();
+
+pub(crate) fn set_default_scheme(scheme: &'static str) {
+    let _ = DEFAULT_SCHEME.set(scheme);
+}
+
+/// Scheme the client used: the proxy's `X-Forwarded-Proto`, else the server's own.
+pub(crate) fn request_scheme(headers: &HeaderMap) -> &str {
+    headers
         .get("X-Forwarded-Proto")
         .and_then(|value| value.to_str().ok())
-        .unwrap_or("http");
+        .unwrap_or_else(|| DEFAULT_SCHEME.get().copied().unwrap_or("http"))
+}
 
+pub(crate) fn build_base_url(headers: &HeaderMap) -> String {
+    let scheme = request_scheme(headers);
     let host = host_header(headers);
     format!("{scheme}://{host}/")
 }
@@ -36,6 +52,16 @@ pub(crate) fn client_ip(headers: &HeaderMap) -> String {
     "unknown".to_string()
 }
 
+/// Address used for per-client accounting: the forwarded client IP when a proxy supplied
+/// one, otherwise the socket peer.
+pub(crate) fn remote_ip(headers: &HeaderMap, peer: Option<SocketAddr>) -> String {
+    let forwarded = client_ip(headers);
+    if forwarded != "unknown" {
+        return forwarded;
+    }
+    peer.map(|addr| addr.ip().to_string()).unwrap_or(forwarded)
+}
+
 pub(crate) fn client_user_agent(headers: &HeaderMap) -> String {
     headers
         .get(header::USER_AGENT)
@@ -52,3 +78,186 @@ pub(crate) fn auth_token(headers: &HeaderMap) -> Option<String> {
         .filter(|value| !value.is_empty())
         .map(|value| value.to_string())
 }
+
+pub(crate) fn wants_json(headers: &HeaderMap) -> bool {
+    let serve_cli = headers
+        .get("X-Serve-Client")
+        .and_then(|value| value.to_str().ok())
+        .map(|value| value.eq_ignore_ascii_case("serve-cli"))
+        .unwrap_or(false);
+    serve_cli
+        || headers
+            .get(header::ACCEPT)
+            .and_then(|value| value.to_str().ok())
+            .map(|value| value.to_ascii_lowercase().contains("application/json"))
+            .unwrap_or(false)
+}
+
+/// Content types the compression layer may encode on the fly.
+pub(crate) fn is_compressible(headers: &HeaderMap) -> bool {
+    headers
+        .get(header::CONTENT_TYPE)
+        .and_then(|value| value.to_str().ok())
+        .map(|content_type| {
+            // Event streams must reach the client event by event, not in compressed blocks.
+            !content_type.starts_with("text/event-stream")
+                && (content_type.starts_with("text/")
+                    || content_type.contains("json")
+                    || content_type.contains("xml")
+                    || content_type.contains("javascript"))
+        })
+        .unwrap_or(false)
+}
+
+/// Whether the compression layer encodes this response: a compressible type, never a
+/// `206` slice (its offsets refer to the raw bytes), and no larger than `max_size` when the
+/// length is known, so big text downloads are not squeezed through the CPU. 0 means no cap.
+pub(crate) fn should_compress(headers: &HeaderMap, max_size: u64) -> bool {
+    if headers.contains_key(header::CONTENT_RANGE) || !is_compressible(headers) {
+        return false;
+    }
+    max_size == 0
+        || headers
+            .get(header::CONTENT_LENGTH)
+            .and_then(|value| value.to_str().ok())
+            .and_then(|value| value.parse::<u64>().ok())
+            .is_none_or(|length| length <= max_size)
+}
+
+/// Whether `Accept-Encoding` allows `encoding`, either by name or through `*`. A `q=0`
+/// entry rules it out.
+pub(crate) fn accepts_encoding(headers: &HeaderMap, encoding: &str) -> bool {
+    let mut named = None;
+    let mut wildcard = None;
+    for value in headers
+        .get_all(header::ACCEPT_ENCODING)
+        .iter()
+        .filter_map(|value| value.to_str().ok())
+    {
+        for item in value.split(',') {
+            let mut parts = item.split(';').map(str::trim);
+            let coding = parts.next().unwrap_or_default();
+            let allowed = parts
+                .filter_map(|param| param.strip_prefix("q="))
+                .next()
+                .and_then(|q| q.parse::<f32>().ok())
+                .is_none_or(|q| q > 0.0);
+            if coding.eq_ignore_ascii_case(encoding) {
+                named = Some(allowed);
+            } else if coding == "*" {
+                wildcard = Some(allowed);
+            }
+        }
+    }
+    named.or(wildcard).unwrap_or(false)
+}
+
+/// RFC 5987 `attr-char`: everything else in a `filename*` value is percent-encoded.
+const FILENAME_STAR_ENCODE: &AsciiSet = &NON_ALPHANUMERIC
+    .remove(b'!')
+    .remove(b'#')
+    .remove(b'$')
+    .remove(b'&')
+    .remove(b'+')
+    .remove(b'-')
+    .remove(b'.')
+    .remove(b'^')
+    .remove(b'_')
+    .remove(b'`')
+    .remove(b'|')
+    .remove(b'~');
+
+/// `Content-Disposition` for a download (`attachment`) or an inline view (`inline`). The
+/// plain `filename` is an ASCII fallback for old clients; `filename*` carries the exact
+/// UTF-8 name so saving from the browser or the viewer keeps it intact. Both parts are
+/// printable ASCII, so the header value is always valid.
+pub(crate) fn content_disposition(disposition: &str, filename: &str) -> HeaderValue {
+    let fallback: String = filename
+        .chars()
+        .map(|ch| match ch {
+            '"' | '\\' => '_',
+            ch if ch.is_ascii() && !ch.is_ascii_control() => ch,
+            _ => '_',
+        })
+        .collect();
+    let encoded = utf8_percent_encode(filename, FILENAME_STAR_ENCODE);
+    HeaderValue::from_str(&format!(
+        "{disposition}; filename=\"{fallback}\"; filename*=UTF-8''{encoded}"
+    ))
+    .unwrap()
+}
+
+/// Weak validator for a file on disk: size and modification time in nanoseconds, in hex.
+pub(crate) fn file_etag(metadata: &std::fs::Metadata) -> String {
+    let modified_nanos = metadata
+        .modified()
+        .ok()
+        .and_then(|time| time.duration_since(std::time::UNIX_EPOCH).ok())
+        .map(|elapsed| elapsed.as_nanos())
+        .unwrap_or(0);
+    format!("W/\"{:x}-{:x}\"", metadata.len(), modified_nanos)
+}
+
+/// `If-None-Match` check with weak comparison, as RFC 9110 requires for it. Tags that the
+/// compression layer suffixed with its encoding (`"abc-gzip"`) still match `"abc"`.
+pub(crate) fn if_none_match(headers: &HeaderMap, etag: &str) -> bool {
+    let Some(value) = headers
+        .get(header::IF_NONE_MATCH)
+        .and_then(|value| value.to_str().ok())
+    else {
+        return false;
+    };
+    let opaque = |tag: &str| {
+        let tag = tag.trim();
+        let tag = tag.strip_prefix("W/").unwrap_or(tag);
+        tag.trim_matches('"').to_string()
+    };
+    let current = opaque(etag);
+    value.split(',').any(|candidate| {
+        let candidate = candidate.trim();
+        if candidate == "*" {
+            return true;
+        }
+        let candidate = opaque(candidate);
+        candidate == current
+            || ["gzip", "br", "deflate", "zstd"].iter().any(|encoding| {
+                candidate
+                    .strip_suffix(encoding)
+                    .and_then(|rest| rest.strip_suffix('-'))
+                    == Some(current.as_str())
+            })
+    })
+}
+
+/// `If-Range` check: whether a `Range` header may be honoured. Entity tags use strong
+/// comparison, so a weak current tag never matches and the full file is sent instead;
+/// a date must equal `Last-Modified` exactly.
+pub(crate) fn if_range(headers: &HeaderMap, etag: &str, last_modified: Option<&str>) -> bool {
+    let Some(value) = headers
+        .get(header::IF_RANGE)
+        .and_then(|value| value.to_str().ok())
+        .map(str::trim)
+    else {
+        return true;
+    };
+    if value.starts_with('"') || value.starts_with("W/") {
+        return !etag.starts_with("W/") && value == etag;
+    }
+    last_modified == Some(value)
+}
+
+/// `If-Modified-Since` check: true when the client's copy is at least as new as
+/// `last_modified`, so a `304` may be sent. Dates compare at whole-second precision, as
+/// `Last-Modified` carries no more; an unparseable header counts as absent.
+pub(crate) fn not_modified_since(headers: &HeaderMap, last_modified: DateTime<Utc>) -> bool {
+    headers
+        .get(header::IF_MODIFIED_SINCE)
+        .and_then(|value| value.to_str().ok())
+        .and_then(|value| DateTime::parse_from_rfc2822(value.trim()).ok())
+        .is_some_and(|since| last_modified.timestamp() <= since.timestamp())
+}
+
+/// IMF-fixdate as used by `Last-Modified` and friends.
+pub(crate) fn http_date(time: DateTime<Utc>) -> String {
+    time.format("%a, %d %b %Y %H:%M:%S GMT").to_string()
+}
@@ -0,0 +1,65 @@
+use std::collections::HashMap;
+use std::sync::Mutex;
+use std::time::{Duration, Instant};
+
+use axum::http::HeaderMap;
+
+const IDEMPOTENCY_KEY_HEADER: &str = "Idempotency-Key";
+const MAX_KEY_LEN: usize = 255;
+
+/// Completed upload responses keyed per uploader (the token holder, or an open-upload
+/// client's address) + `Idempotency-Key`, so a client that retries after a timeout gets
+/// the original result instead of writing the file again.
+/// Entries live in memory only and expire after the configured window.
+pub(crate) struct IdempotencyCache {
+    ttl: Duration,
+    entries: Mutex<HashMap<String, (Instant, String)>>,
+}
+
+impl IdempotencyCache {
+    pub(crate) fn new(ttl_secs: u64) -> Self {
+        Self {
+            ttl: Duration::from_secs(ttl_secs),
+            entries: Mutex::new(HashMap::new()),
+        }
+    }
+
+    pub(crate) fn enabled(&self) -> bool {
+        !self.ttl.is_zero()
+    }
+
+    /// Returns the stored response body for a key that completed within the window.
+    pub(crate) fn get(&self, scope: &str, key: &str) -> Option<String> {
+        if !self.enabled() {
+            return None;
+        }
+        let entries = self.entries.lock().unwrap_or_else(|err| err.into_inner());
+        entries
+            .get(&cache_key(scope, key))
+            .filter(|(stored_at, _)| stored_at.elapsed() < self.ttl)
+            .map(|(_, body)| body.clone())
+    }
+
+    pub(crate) fn insert(&self, scope: &str, key: &str, body: String) {
+        if !self.enabled() {
+            return;
+        }
+        let mut entries = self.entries.lock().unwrap_or_else(|err| err.into_inner());
+        entries.retain(|_, (stored_at, _)| stored_at.elapsed() < self.ttl);
+        entries.insert(cache_key(scope, key), (Instant::now(), body));
+    }
+}
+
+/// Reads a usable `Idempotency-Key`; blank or oversized values are ignored.
+pub(crate) fn idempotency_key(headers: &HeaderMap) -> Option<String> {
+    headers
+        .get(IDEMPOTENCY_KEY_HEADER)
+        .and_then(|value| value.to_str().ok())
+        .map(str::trim)
+        .filter(|value| !value.is_empty() && value.len() <= MAX_KEY_LEN)
+        .map(|value| value.to_string())
+}
+
+fn cache_key(scope: &str, key: &str) -> String {
+    format!("{scope}\u{0}{key}")
+}
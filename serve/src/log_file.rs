@@ -0,0 +1,140 @@
+//! Log output for `log_file`: stderr until a file is opened, then that file. With
+//! `log_max_size_mb` the file is renamed to `<name>.1` and started afresh once it would
+//! grow past the limit; SIGHUP reopens it by name so external logrotate setups work too.
+//!
+//! The subscriber is installed before the config is read, so it always writes through
+//! [`LogWriter`] and the destination is switched underneath it.
+
+use std::borrow::Cow;
+use std::ffi::OsString;
+use std::fs::{self, File, OpenOptions};
+use std::io::{self, Write};
+use std::path::{Path, PathBuf};
+use std::sync::Mutex;
+
+static LOG_FILE: Mutex<Option<LogFile>> = Mutex::new(None);
+
+struct LogFile {
+    /// `None` once the path is out of reach (after a chroot); the open handle is kept.
+    path: Option<PathBuf>,
+    file: File,
+    written: u64,
+    /// 0 never rotates.
+    max_bytes: u64,
+}
+
+impl LogFile {
+    fn open(path: &Path) -> io::Result<(File, u64)> {
+        let file = OpenOptions::new().create(true).append(true).open(path)?;
+        let written = file.metadata()?.len();
+        Ok((file, written))
+    }
+
+    fn rotate(&mut self) -> io::Result<()> {
+        let Some(path) = &self.path else {
+            return Ok(());
+        };
+        let mut rotated = OsString::from(path.as_os_str());
+        rotated.push(".1");
+        fs::rename(path, rotated)?;
+        let (file, written) = Self::open(path)?;
+        self.file = file;
+        self.written = written;
+        Ok(())
+    }
+}
+
+fn lock() -> std::sync::MutexGuard<'static, Option<LogFile>> {
+    LOG_FILE.lock().unwrap_or_else(|err| err.into_inner())
+}
+
+/// Sends everything logged from now on to `path`, appending to what is already there.
+pub(crate) fn open(path: &Path, max_size_mb: u64) -> io::Result<()> {
+    let (file, written) = LogFile::open(path)?;
+    *lock() = Some(LogFile {
+        path: Some(path.to_path_buf()),
+        file,
+        written,
+        max_bytes: max_size_mb.saturating_mul(1024 * 1024),
+    });
+    Ok(())
+}
+
+/// Reopens the log file by name, for SIGHUP after an external tool moved it away.
+pub(crate) fn reopen() -> io::Result<()> {
+    let mut guard = lock();
+    let Some(log) = guard.as_mut() else {
+        return Ok(());
+    };
+    let Some(path) = &log.path else {
+        return Err(io::Error::other("the log file is outside the chroot"));
+    };
+    let (file, written) = LogFile::open(path)?;
+    log.file = file;
+    log.written = written;
+    Ok(())
+}
+
+/// Keeps writing to the open file but stops rotating and reopening it, because its path
+/// no longer resolves inside the chroot.
+pub(crate) fn confine() {
+    if let Some(log) = lock().as_mut() {
+        log.path = None;
+    }
+}
+
+/// `MakeWriter` target for the fmt layer: one call per formatted event.
+pub(crate) struct LogWriter;
+
+impl Write for LogWriter {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        let mut guard = lock();
+        let Some(log) = guard.as_mut() else {
+            return io::stderr().write(buf);
+        };
+
+        let line = strip_ansi(buf);
+        let len = line.len() as u64;
+        if log.max_bytes > 0 && log.written > 0 && log.written + len > log.max_bytes {
+            if let Err(err) = log.rotate() {
+                // Logging about the log would recurse; stderr is all that is left.
+                let _ = writeln!(io::stderr(), "Failed to rotate log file: {err}");
+                log.max_bytes = 0;
+            }
+        }
+        log.file.write_all(&line)?;
+        log.written += len;
+        Ok(buf.len())
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        match lock().as_mut() {
+            Some(log) => log.file.flush(),
+            None => io::stderr().flush(),
+        }
+    }
+}
+
+/// Drops terminal colour sequences (`ESC [ ... m`), which the fmt layer adds because it is
+/// set up before anyone knows the output will be a file.
+fn strip_ansi(buf: &[u8]) -> Cow<'_, [u8]> {
+    if !buf.contains(&0x1b) {
+        return Cow::Borrowed(buf);
+    }
+    let mut out = Vec::with_capacity(buf.len());
+    let mut bytes = buf.iter().copied().peekable();
+    while let Some(byte) = bytes.next() {
+        if byte == 0x1b && bytes.peek() == Some(&b'[') {
+            bytes.next();
+            // Parameters and intermediates up to the final byte in 0x40..=0x7e.
+            for byte in bytes.by_ref() {
+                if (0x40..=0x7e).contains(&byte) {
+                    break;
+                }
+            }
+            continue;
+        }
+        out.push(byte);
+    }
+    Cow::Owned(out)
+}
@@ -1,38 +1,83 @@
+mod activity;
+mod archive;
 mod browse;
+mod capabilities;
 mod catalog;
+mod cidr;
 mod config;
+mod error_codes;
+mod etags;
+mod health;
 mod http_utils;
+mod idempotency;
+mod log_file;
+mod manifest;
+mod middleware;
+mod netif;
+mod open_upload;
+mod openapi;
+mod privileges;
+mod rate_limit;
+mod search;
+mod selfsigned;
+mod sort;
+mod stat;
 mod template;
+#[cfg(test)]
+mod test_support;
+mod timeouts;
+#[cfg(unix)]
+mod unix_socket;
 mod uploads;
 mod utils;
+mod walk;
 
 use axum::{
     Router,
     extract::DefaultBodyLimit,
     http::{Extensions, HeaderMap, HeaderValue, StatusCode, Version, header},
+    middleware::{from_fn, from_fn_with_state},
     response::{IntoResponse, Response},
     routing::{delete, get, post, put},
 };
+use axum_server::tls_rustls::{RustlsAcceptor, RustlsConfig};
 use catalog::{Catalog, CatalogCommand, CatalogWorker};
 use clap::{Args, Parser, Subcommand};
-use config::{Config, RootSource};
+use config::{Config, RootSource, ValueSource};
+use etags::ContentEtags;
+use futures_util::FutureExt;
+use futures_util::future::{BoxFuture, try_join_all};
+use idempotency::IdempotencyCache;
+use middleware::{
+    AccessList, BasicAuth, CanonicalHost, ConnectionLimiter, Cors, ForwardedHeaders, GlobalLimiter,
+    Maintenance, NotFoundPage,
+};
+use open_upload::OpenUploadGuard;
 use rand::{Rng, distributions::Alphanumeric, rngs::OsRng};
+use rate_limit::RateLimiter;
 #[cfg(unix)]
 use std::os::unix::fs::OpenOptionsExt;
 use std::{
     env, fmt, fs,
     io::{self, Write},
-    net::SocketAddr,
+    net::{IpAddr, SocketAddr},
     path::PathBuf,
     sync::Arc,
+    time::Duration,
 };
+use timeouts::{TimedAcceptor, Timeouts};
 use tokio::sync::mpsc;
+use tokio_util::sync::CancellationToken;
 use tower::ServiceBuilder;
 use tower_http::{
-    compression::CompressionLayer, set_header::SetResponseHeaderLayer, trace::TraceLayer,
+    compression::CompressionLayer, map_request_body::MapRequestBodyLayer,
+    set_header::SetResponseHeaderLayer, timeout::RequestBodyTimeoutLayer, trace::TraceLayer,
 };
-use tracing::{error, info};
+use tracing::Level;
+use tracing::{error, info, warn};
 use tracing_subscriber::EnvFilter;
+use tracing_subscriber::filter::Targets;
+use tracing_subscriber::prelude::*;
 
 const NOT_FOUND_MESSAGE: &str = "Files or Directory not found or missing";
 const DEFAULT_CONFIG_BODY_TEMPLATE: &str = r#"# Generated by serve
@@ -92,6 +137,31 @@ catalog_refresh_secs = 300
 const POWERED_BY: &str = concat!("serve/", env!("CARGO_PKG_VERSION"));
 // Smaller chunk keeps initial response snappy while still streaming efficiently.
 const STREAM_BUFFER_BYTES: usize = 256 * 1024;
+const DOWNLOAD_PATH: &str = "/download";
+const LIST_PATH: &str = "/list";
+const INFO_PATH: &str = "/info";
+const DELETE_PATH: &str = "/delete";
+const MOVE_PATH: &str = "/move";
+const MKDIR_PATH: &str = "/mkdir";
+const UPLOAD_PATH: &str = "/upload";
+const UPLOAD_STREAM_PATH: &str = "/upload-stream";
+/// Every fixed route the router serves, so `health_path` cannot shadow one. The router is
+/// built from the same constants.
+pub(crate) const ROUTE_PATHS: &[&str] = &[
+    "/",
+    DOWNLOAD_PATH,
+    LIST_PATH,
+    INFO_PATH,
+    DELETE_PATH,
+    MOVE_PATH,
+    MKDIR_PATH,
+    UPLOAD_PATH,
+    UPLOAD_STREAM_PATH,
+    openapi::OPENAPI_PATH,
+    activity::LOGTAIL_PATH,
+    manifest::MANIFEST_PATH,
+    search::SEARCH_PATH,
+];
 const GENERATED_TOKEN_LEN: usize = 32;
 const VERSION_SUMMARY: &str = concat!(
     "serve: ",
@@ -128,6 +198,12 @@ fn generate_upload_token() -> String {
     disable_version_flag = true
 )]
 struct Cli {
+    /// Only log errors (also SERVE_QUIET=1); overrides RUST_LOG
+    #[arg(long, short, global = true, conflicts_with = "verbose")]
+    quiet: bool,
+    /// Log debug details, including where each setting came from; overrides RUST_LOG
+    #[arg(long, short, global = true)]
+    verbose: bool,
     #[command(subcommand)]
     command: Command,
 }
@@ -137,9 +213,9 @@ struct RunArgs {
     /// Path to configuration file (TOML format)
     #[arg(long, value_name = "FILE")]
     config: Option<PathBuf>,
-    /// Override listening port (defaults to env/config)
+    /// Override listening port (defaults to env/config); repeat to listen on several ports
     #[arg(long, value_name = "PORT")]
-    port: Option<u16>,
+    port: Vec<u16>,
     /// Override upload token
     #[arg(long, value_name = "TOKEN")]
     upload_token: Option<String>,
@@ -149,6 +225,24 @@ struct RunArgs {
     /// Override root directory to serve
     #[arg(long, value_name = "PATH")]
     root: Option<PathBuf>,
+    /// Host or IP address to listen on (e.g. 127.0.0.1); all interfaces by default
+    #[arg(long, value_name = "HOST")]
+    bind: Option<String>,
+    /// PEM certificate chain; serve HTTPS together with --tls-key
+    #[arg(long, value_name = "FILE")]
+    tls_cert: Option<PathBuf>,
+    /// PEM private key for --tls-cert
+    #[arg(long, value_name = "FILE")]
+    tls_key: Option<PathBuf>,
+    /// Listen on this Unix domain socket instead of TCP (port and bind are ignored)
+    #[arg(long, value_name = "PATH")]
+    unix_socket: Option<PathBuf>,
+    /// Serve HTTPS with a throwaway certificate generated at startup (valid 24 hours)
+    #[arg(long, conflicts_with_all = ["tls_cert", "tls_key"])]
+    self_signed: bool,
+    /// Refuse directory listings, archives and search; files stay reachable by id
+    #[arg(long)]
+    no_listing: bool,
 }
 
 #[derive(Args, Clone)]
@@ -160,6 +254,36 @@ struct ShowConfigArgs {
     show_token: bool,
 }
 
+#[derive(Args, Clone)]
+struct StatArgs {
+    #[command(flatten)]
+    run: RunArgs,
+    /// Path relative to the served root
+    #[arg(value_name = "PATH")]
+    path: String,
+    /// Include the SHA-256 of the file contents
+    #[arg(long)]
+    checksum: bool,
+}
+
+#[derive(Args, Clone)]
+struct LsArgs {
+    #[command(flatten)]
+    run: RunArgs,
+    /// Directory relative to the served root
+    #[arg(value_name = "PATH", default_value = "/")]
+    path: String,
+    /// Print the listing as JSON
+    #[arg(long)]
+    json: bool,
+    /// Sort order (size and modified list largest/newest first)
+    #[arg(long, value_enum, default_value = "name")]
+    sort: sort::ListSort,
+    /// Include blacklisted entries, marked as hidden
+    #[arg(long)]
+    all: bool,
+}
+
 #[derive(Subcommand)]
 enum Command {
     /// Run the HTTP file server
@@ -168,6 +292,10 @@ enum Command {
     InitConfig,
     /// Print the effective configuration and exit
     ShowConfig(ShowConfigArgs),
+    /// Print metadata for a path under the root as JSON, without starting the server
+    Stat(StatArgs),
+    /// List a directory under the root the way the server would expose it
+    Ls(LsArgs),
     /// Print version/build information
     Version,
 }
@@ -178,23 +306,34 @@ pub(crate) struct AppState {
     pub(crate) canonical_root: Arc<PathBuf>,
     pub(crate) catalog: Arc<Catalog>,
     pub(crate) catalog_events: mpsc::Sender<CatalogCommand>,
+    pub(crate) upload_keys: Arc<IdempotencyCache>,
+    pub(crate) file_etags: Arc<ContentEtags>,
+    /// Limits for token-less uploads; `None` unless `open_upload` is on.
+    pub(crate) open_uploads: Option<Arc<OpenUploadGuard>>,
+    pub(crate) maintenance: Maintenance,
 }
 
 #[tokio::main(flavor = "multi_thread", worker_threads = 4)]
 async fn main() -> Result<(), Box<dyn std::error::Error>> {
-    tracing_subscriber::fmt()
-        .with_env_filter(
-            EnvFilter::try_from_default_env()
-                .unwrap_or_else(|_| EnvFilter::new("serve=info,tower_http=info")),
+    let cli = Cli::parse();
+    // The activity feed has its own filter so /logtail still sees uploads under --quiet.
+    tracing_subscriber::registry()
+        .with(
+            tracing_subscriber::fmt::layer()
+                .with_writer(|| log_file::LogWriter)
+                .with_filter(log_filter(cli.quiet, cli.verbose)),
         )
+        .with(activity::ActivityLayer.with_filter(Targets::new().with_target("serve", Level::INFO)))
         .init();
 
-    match Cli::parse().command {
+    match cli.command {
         Command::Run(args) => run_server(args)
             .await
             .map_err(|err| -> Box<dyn std::error::Error> { Box::new(err) })?,
         Command::InitConfig => init_config_file()?,
         Command::ShowConfig(args) => show_config(args)?,
+        Command::Stat(args) => stat_command(args)?,
+        Command::Ls(args) => ls_command(args)?,
         Command::Version => {
             println!("{VERSION_SUMMARY}");
         }
@@ -207,18 +346,78 @@ fn effective_config(args: &RunArgs) -> Result<(Config, PathBuf), AppError> {
     let mut config =
         Config::load(args.config.as_deref()).map_err(|err| AppError::Config(err.to_string()))?;
 
-    if let Some(port) = args.port {
+    if let Some((&port, extra)) = args.port.split_first() {
         config.port = port;
+        config.ports = extra.to_vec();
+        config.sources.insert("port", ValueSource::Cli);
+        config.sources.insert("ports", ValueSource::Cli);
     }
     if let Some(token) = args.upload_token.clone() {
         config.upload_token = token;
+        config.sources.insert("upload_token", ValueSource::Cli);
     }
     if let Some(size) = args.max_file_size {
         config.max_file_size = size;
+        config.sources.insert("max_file_size", ValueSource::Cli);
     }
     if let Some(root) = args.root.clone() {
         config.root_override = Some(root);
         config.root_source = RootSource::Cli;
+        config.sources.insert("root", ValueSource::Cli);
+    }
+    if let Some(host) = args.bind.as_deref() {
+        config.bind = config::normalize_bind(host);
+        config.sources.insert("bind", ValueSource::Cli);
+    }
+    if config.bind.is_some() && config.interface.is_some() {
+        return Err(AppError::Config(
+            "bind and interface are mutually exclusive; set only one".to_string(),
+        ));
+    }
+    if args.no_listing {
+        config.disable_listing = true;
+        config.sources.insert("disable_listing", ValueSource::Cli);
+    }
+    if let Some(path) = args.tls_cert.clone() {
+        config.tls_cert = Some(path);
+        config.sources.insert("tls_cert", ValueSource::Cli);
+    }
+    if let Some(path) = args.tls_key.clone() {
+        config.tls_key = Some(path);
+        config.sources.insert("tls_key", ValueSource::Cli);
+    }
+    config
+        .tls_paths()
+        .map_err(|err| AppError::Config(err.to_string()))?;
+    config
+        .basic_auth()
+        .map_err(|err| AppError::Config(err.to_string()))?;
+    config
+        .open_upload_safeguards()
+        .map_err(|err| AppError::Config(err.to_string()))?;
+    if let Some(path) = args.unix_socket.clone() {
+        config.unix_socket = Some(path);
+        config.sources.insert("unix_socket", ValueSource::Cli);
+    }
+    if config.unix_socket.is_some() {
+        if cfg!(not(unix)) {
+            return Err(AppError::Config(
+                "unix_socket is only supported on Unix platforms".to_string(),
+            ));
+        }
+        if args.self_signed || config.tls_cert.is_some() || config.tls_key.is_some() {
+            return Err(AppError::Config(
+                "TLS cannot be combined with unix_socket; terminate TLS at the proxy".to_string(),
+            ));
+        }
+    }
+    if args.self_signed && (config.tls_cert.is_some() || config.tls_key.is_some()) {
+        return Err(AppError::Config(
+            "--self-signed cannot be combined with tls_cert/tls_key".to_string(),
+        ));
+    }
+    for (field, source) in &config.sources {
+        tracing::debug!("config {} <- {}", field, source);
     }
 
     let current_dir = || env::current_dir().unwrap_or_else(|_| PathBuf::from("."));
@@ -238,11 +437,62 @@ fn effective_config(args: &RunArgs) -> Result<(Config, PathBuf), AppError> {
         .canonicalize()
         .map_err(|_| AppError::Internal("Failed to resolve root directory".to_string()))?;
 
+    // Keep in-flight uploads out of listings and the catalog when they live under the root.
+    let upload_tmp_dir = config.upload_tmp_dir(&canonical_root);
+    if let Some(relative) = utils::relative_path_string(&canonical_root, &upload_tmp_dir) {
+        if !relative.is_empty() {
+            config.blacklisted_files.insert(relative);
+        }
+    }
+
+    // Sidecars are bookkeeping, never content.
+    if config.upload_sidecar {
+        config
+            .blacklisted_files
+            .insert(format!("*{}", uploads::SIDECAR_SUFFIX));
+    }
+
     Ok((config, canonical_root))
 }
 
+/// `--quiet`/`--verbose` win over `RUST_LOG`; `SERVE_QUIET` only applies when neither flag
+/// nor `RUST_LOG` is given, so an explicit filter is never silently narrowed.
+fn log_filter(quiet: bool, verbose: bool) -> EnvFilter {
+    if quiet {
+        return EnvFilter::new("error");
+    }
+    if verbose {
+        return EnvFilter::new("serve=debug,tower_http=debug");
+    }
+    if let Ok(filter) = EnvFilter::try_from_default_env() {
+        return filter;
+    }
+    let env_quiet = env::var("SERVE_QUIET")
+        .map(|value| {
+            matches!(
+                value.trim().to_ascii_lowercase().as_str(),
+                "1" | "true" | "yes" | "on"
+            )
+        })
+        .unwrap_or(false);
+    if env_quiet {
+        EnvFilter::new("error")
+    } else {
+        EnvFilter::new("serve=info,tower_http=info")
+    }
+}
+
 async fn run_server(args: RunArgs) -> Result<(), AppError> {
-    let (config, canonical_root) = effective_config(&args)?;
+    let (mut config, mut canonical_root) = effective_config(&args)?;
+    if let Some(path) = &config.log_file {
+        log_file::open(path, config.log_max_size_mb).map_err(|err| {
+            AppError::Config(format!("Failed to open log file {}: {err}", path.display()))
+        })?;
+        #[cfg(unix)]
+        tokio::spawn(reopen_log_on_hangup());
+    }
+    let identity = privileges::resolve(config.user.as_deref(), config.group.as_deref())
+        .map_err(|err| AppError::Config(err.to_string()))?;
 
     let body_limit = config
         .max_file_size
@@ -250,19 +500,202 @@ async fn run_server(args: RunArgs) -> Result<(), AppError> {
         .try_into()
         .unwrap_or(usize::MAX);
 
-    let config = Arc::new(config);
-    let canonical_root = Arc::new(canonical_root);
+    let upload_tmp_dir = config.upload_tmp_dir(&canonical_root);
+    fs::create_dir_all(&upload_tmp_dir).map_err(|err| {
+        AppError::Internal(format!(
+            "Failed to prepare upload temp dir {}: {err}",
+            upload_tmp_dir.display()
+        ))
+    })?;
+    // Inside the jail the temp dir is only reachable through its root-relative path.
+    let chroot_tmp_dir = if config.chroot {
+        let relative =
+            utils::relative_path_string(&canonical_root, &upload_tmp_dir).ok_or_else(|| {
+                AppError::Config(format!(
+                    "upload_tmp_dir {} must be inside the root when chroot is enabled",
+                    upload_tmp_dir.display()
+                ))
+            })?;
+        Some(PathBuf::from(relative))
+    } else {
+        None
+    };
 
     let storage_dir = config.storage_dir();
     fs::create_dir_all(&storage_dir)
         .map_err(|err| AppError::Internal(format!("Failed to prepare config dir: {err}")))?;
     let catalog_path = storage_dir.join("catalog.db");
+    let mut maintenance_file = Some(config.maintenance_file());
     let catalog = Arc::new(
         Catalog::new(&catalog_path)
             .await
             .map_err(|err| AppError::Internal(format!("Failed to initialize catalog: {err:?}")))?,
     );
 
+    let socket_path = config.unix_socket.clone();
+    let addrs: Vec<SocketAddr> = if let Some(path) = &socket_path {
+        let ignored: Vec<_> = ["port", "ports", "bind", "interface"]
+            .into_iter()
+            .filter(|name| !matches!(config.sources.get(name), None | Some(ValueSource::Default)))
+            .collect();
+        if !ignored.is_empty() {
+            info!(
+                "Listening on Unix socket {}; ignoring {}",
+                path.display(),
+                ignored.join(", ")
+            );
+        }
+        Vec::new()
+    } else {
+        let bind_ip = match (config.bind.as_deref(), config.interface.as_deref()) {
+            (Some(host), _) => resolve_bind_host(host).await?,
+            (None, Some(name)) => {
+                let ip = netif::resolve_interface_ip(name).await.map_err(|err| {
+                    error!("{}", err);
+                    AppError::Config(err.to_string())
+                })?;
+                info!("Interface {} resolved to {}", name, ip);
+                ip
+            }
+            (None, None) => IpAddr::from([0, 0, 0, 0]),
+        };
+        config
+            .listen_ports()
+            .into_iter()
+            .map(|port| SocketAddr::new(bind_ip, port))
+            .collect()
+    };
+    info!(
+        "Config loaded: port={} token_set={} max_file_size={} allowed_ext={} hidden={}",
+        config.port,
+        !config.upload_token.is_empty(),
+        config.max_file_size,
+        config.allowed_extensions.len(),
+        config.blacklisted_files.len()
+    );
+    // Certificates live outside the root, so they are read before any chroot.
+    let tls =
+        match config
+            .tls_paths()
+            .map_err(|err| AppError::Config(err.to_string()))?
+        {
+            Some((cert, key)) => Some(RustlsConfig::from_pem_file(cert, key).await.map_err(
+                |err| {
+                    error!("Failed to load TLS certificate/key: {}", err);
+                    AppError::Config(format!(
+                        "Failed to load TLS certificate {} / key {}: {err}",
+                        cert.display(),
+                        key.display()
+                    ))
+                },
+            )?),
+            None if args.self_signed => {
+                let generated =
+                    selfsigned::generate().map_err(|err| AppError::Config(err.to_string()))?;
+                info!(
+                    "Generated self-signed certificate for {} (valid 24 hours)",
+                    generated.names.join(", ")
+                );
+                info!("Certificate SHA-256 fingerprint: {}", generated.fingerprint);
+                Some(
+                    RustlsConfig::from_pem(
+                        generated.cert_pem.into_bytes(),
+                        generated.key_pem.into_bytes(),
+                    )
+                    .await
+                    .map_err(|err| {
+                        AppError::Config(format!("Failed to load self-signed certificate: {err}"))
+                    })?,
+                )
+            }
+            None => None,
+        };
+    http_utils::set_default_scheme(if tls.is_some() { "https" } else { "http" });
+
+    let mut listeners = Vec::with_capacity(addrs.len());
+    for addr in addrs {
+        listeners.push(bind_listener(addr).await?);
+        info!(
+            "Starting server on {}://{} serving {}",
+            if tls.is_some() { "https" } else { "http" },
+            addr,
+            canonical_root.display()
+        );
+    }
+    #[cfg(unix)]
+    let unix_listener = match &socket_path {
+        Some(path) => {
+            let listener = unix_socket::bind(path, identity.as_ref()).map_err(|err| {
+                error!("Failed to bind Unix socket {}: {}", path.display(), err);
+                AppError::Config(format!(
+                    "Failed to bind Unix socket {}: {err}",
+                    path.display()
+                ))
+            })?;
+            info!(
+                "Starting server on unix:{} serving {}",
+                path.display(),
+                canonical_root.display()
+            );
+            Some(listener)
+        }
+        None => None,
+    };
+
+    // Everything outside the root (config dir, catalog database) must already be open here.
+    if let Some(relative_tmp_dir) = chroot_tmp_dir {
+        let confined = privileges::chroot_into(&canonical_root).map_err(|err| {
+            error!("{}", err);
+            AppError::Config(err.to_string())
+        })?;
+        if confined {
+            info!("Confined to {} via chroot", canonical_root.display());
+            config.upload_tmp_dir = Some(PathBuf::from(relative_tmp_dir));
+            canonical_root = PathBuf::from("/");
+            // The sentinel lives in the config dir, which is outside the jail now.
+            maintenance_file = None;
+            if config.log_file.is_some() {
+                log_file::confine();
+                warn!("log_file cannot be rotated or reopened inside the chroot");
+            }
+        } else {
+            warn!("chroot is not supported on this platform; serving without confinement");
+        }
+    }
+
+    if let Some(identity) = identity {
+        privileges::drop_to(identity).map_err(|err| {
+            error!("{}", err);
+            AppError::Config(err.to_string())
+        })?;
+        info!(
+            "Dropped privileges to uid={} gid={}",
+            identity.uid(),
+            identity.gid()
+        );
+    }
+
+    let config = Arc::new(config);
+    let canonical_root = Arc::new(canonical_root);
+
+    // Checked as the identity that will serve, inside any chroot, so the answer holds.
+    if !config.upload_token.is_empty() || config.open_upload {
+        let tmp_dir = config.upload_tmp_dir(&canonical_root);
+        let mut dirs = vec![canonical_root.to_path_buf()];
+        if tmp_dir != *canonical_root {
+            dirs.push(tmp_dir);
+        }
+        for dir in dirs {
+            if let Err(err) = uploads::probe_writable(&dir) {
+                warn!(
+                    "Uploads are enabled but {} is not writable ({}); uploads will fail with TARGET_NOT_WRITABLE",
+                    dir.display(),
+                    err
+                );
+            }
+        }
+    }
+
     let (catalog_tx, catalog_rx) = mpsc::channel(8);
     let worker = CatalogWorker::new(
         catalog.clone(),
@@ -276,25 +709,37 @@ async fn run_server(args: RunArgs) -> Result<(), AppError> {
     });
     let _ = catalog_tx.try_send(CatalogCommand::RefreshAll);
 
+    let maintenance = Maintenance::new(
+        config.maintenance,
+        maintenance_file,
+        config.maintenance_retry_after,
+    );
     let state = AppState {
         config: config.clone(),
         canonical_root: canonical_root.clone(),
         catalog: catalog.clone(),
         catalog_events: catalog_tx.clone(),
+        upload_keys: Arc::new(IdempotencyCache::new(config.idempotency_ttl_secs)),
+        file_etags: Arc::new(ContentEtags::new(
+            config.strong_etags,
+            config.strong_etag_max_size,
+        )),
+        open_uploads: config.open_upload.then(|| {
+            Arc::new(OpenUploadGuard::new(
+                config.open_upload_rate,
+                config.open_upload_quota,
+            ))
+        }),
+        maintenance: maintenance.clone(),
     };
 
+    let compress_max_size = config.compress_max_size;
     let compression = CompressionLayer::new().compress_when(
-        |_status: StatusCode, _version: Version, headers: &HeaderMap, _extensions: &Extensions| {
-            headers
-                .get(header::CONTENT_TYPE)
-                .and_then(|value| value.to_str().ok())
-                .map(|content_type| {
-                    content_type.starts_with("text/")
-                        || content_type.contains("json")
-                        || content_type.contains("xml")
-                        || content_type.contains("javascript")
-                })
-                .unwrap_or(false)
+        move |_status: StatusCode,
+              _version: Version,
+              headers: &HeaderMap,
+              _extensions: &Extensions| {
+            http_utils::should_compress(headers, compress_max_size)
         },
     );
 
@@ -303,53 +748,309 @@ async fn run_server(args: RunArgs) -> Result<(), AppError> {
         HeaderValue::from_static(POWERED_BY),
     );
 
+    let upload_rate = RateLimiter::new(config.upload_rate_limit, config.upload_burst);
     let router = Router::new()
-        .route("/", get(browse::get_root))
-        .route("/download", get(browse::download_by_id))
-        .route("/list", get(browse::list_by_id))
-        .route("/info", get(browse::get_info))
-        .route("/delete", delete(browse::delete_by_id))
-        .route("/upload", post(uploads::handle_upload))
         .route(
-            "/upload-stream",
-            put(uploads::handle_upload_stream).post(uploads::handle_upload_stream),
+            "/",
+            get(browse::get_root).options(capabilities::options_root),
+        )
+        .route(
+            DOWNLOAD_PATH,
+            get(browse::download_by_id).post(browse::download_selection),
+        )
+        .route(LIST_PATH, get(browse::list_by_id))
+        .route(INFO_PATH, get(browse::get_info))
+        .route(openapi::OPENAPI_PATH, get(openapi::get_openapi))
+        .route(activity::LOGTAIL_PATH, get(activity::logtail))
+        .route(manifest::MANIFEST_PATH, get(manifest::get_manifest))
+        .route(search::SEARCH_PATH, get(search::search))
+        .route(
+            DELETE_PATH,
+            delete(browse::delete_entry)
+                .post(browse::delete_entry)
+                .layer(from_fn_with_state(
+                    upload_rate.clone(),
+                    middleware::limit_upload_rate,
+                )),
+        )
+        .route(
+            MOVE_PATH,
+            post(browse::move_entry).layer(from_fn_with_state(
+                upload_rate.clone(),
+                middleware::limit_upload_rate,
+            )),
+        )
+        .route(MKDIR_PATH, post(browse::make_directory))
+        .fallback(browse::spa_fallback)
+        .route(
+            UPLOAD_PATH,
+            post(uploads::handle_upload)
+                .head(capabilities::head_upload)
+                .options(capabilities::options_upload)
+                .layer(uploads::request_decompression())
+                .layer(from_fn(uploads::count_wire_bytes))
+                .layer(from_fn_with_state(
+                    upload_rate.clone(),
+                    middleware::limit_upload_rate,
+                )),
+        )
+        .route(
+            UPLOAD_STREAM_PATH,
+            put(uploads::handle_upload_stream)
+                .post(uploads::handle_upload_stream)
+                .options(capabilities::options_upload_stream)
+                .layer(uploads::request_decompression())
+                .layer(from_fn(uploads::count_wire_bytes))
+                .layer(from_fn_with_state(
+                    upload_rate.clone(),
+                    middleware::limit_upload_rate,
+                )),
         )
         .layer(DefaultBodyLimit::max(body_limit))
         .layer(
             ServiceBuilder::new()
                 .layer(TraceLayer::new_for_http())
+                .layer(from_fn_with_state(
+                    ForwardedHeaders::from_config(&config),
+                    middleware::trust_forwarded_headers,
+                ))
+                .layer(from_fn_with_state(
+                    Cors::from_config(&config),
+                    middleware::cors,
+                ))
+                .layer(from_fn_with_state(
+                    AccessList::from_config(&config),
+                    middleware::restrict_client_ips,
+                ))
+                .layer(from_fn_with_state(
+                    ConnectionLimiter::new(config.max_conns_per_ip),
+                    middleware::limit_connections_per_ip,
+                ))
+                .layer(from_fn_with_state(
+                    GlobalLimiter::new(config.max_connections),
+                    middleware::limit_connections,
+                ))
+                .layer(from_fn_with_state(
+                    CanonicalHost::from_config(&config),
+                    middleware::redirect_to_canonical_host,
+                ))
+                .layer(from_fn_with_state(
+                    maintenance,
+                    middleware::maintenance_gate,
+                ))
+                .layer(from_fn(middleware::vary_by_encoding))
                 .layer(compression)
-                .layer(powered_layer),
+                .layer(powered_layer)
+                .layer(from_fn(middleware::json_errors))
+                .layer(from_fn_with_state(
+                    BasicAuth::from_config(&config),
+                    middleware::require_basic_auth,
+                ))
+                .layer(from_fn_with_state(
+                    NotFoundPage::new(
+                        &canonical_root,
+                        config.not_found_page.as_deref(),
+                        &config.file_csp,
+                    ),
+                    middleware::not_found_page,
+                ))
+                .layer(from_fn(middleware::recover_panics)),
         )
+        // Added after the middleware stack so probes skip access logging and maintenance.
+        .route(&config.health_path, get(health::healthz))
         .with_state(state.clone());
+    let timeouts = Timeouts::from_config(&config);
+    let router = match timeouts.read {
+        Some(read) => router.layer(
+            ServiceBuilder::new()
+                .layer(RequestBodyTimeoutLayer::new(read))
+                .layer(MapRequestBodyLayer::new(axum::body::Body::new)),
+        ),
+        None => router,
+    };
 
-    let addr = SocketAddr::from(([0, 0, 0, 0], state.config.port));
-    info!(
-        "Config loaded: port={} token_set={} max_file_size={} allowed_ext={} hidden={}",
-        state.config.port,
-        !state.config.upload_token.is_empty(),
-        state.config.max_file_size,
-        state.config.allowed_extensions.len(),
-        state.config.blacklisted_files.len()
-    );
-    info!(
-        "Starting server on {} serving {}",
-        addr,
-        state.canonical_root.display()
-    );
-    let listener = tokio::net::TcpListener::bind(addr).await.map_err(|err| {
+    let shutdown = CancellationToken::new();
+    tokio::spawn({
+        let shutdown = shutdown.clone();
+        async move {
+            shutdown_signal().await;
+            info!("Shutdown requested; finishing in-flight requests");
+            shutdown.cancel();
+        }
+    });
+
+    let mut servers: Vec<BoxFuture<'static, io::Result<()>>> = Vec::with_capacity(listeners.len());
+    #[cfg(unix)]
+    if let Some(listener) = unix_listener {
+        servers
+            .push(unix_socket::serve(listener, router.clone(), timeouts, shutdown.clone()).boxed());
+    }
+    let service = router.into_make_service_with_connect_info::<SocketAddr>();
+    for listener in listeners {
+        let handle = axum_server::Handle::new();
+        tokio::spawn({
+            let handle = handle.clone();
+            let shutdown = shutdown.clone();
+            async move {
+                shutdown.cancelled().await;
+                handle.graceful_shutdown(None);
+            }
+        });
+        let listener = listener.into_std().map_err(|err| {
+            error!("Failed to prepare listener: {}", err);
+            AppError::Internal("Server error".to_string())
+        })?;
+        let mut server = axum_server::from_tcp(listener).handle(handle);
+        timeouts.configure(server.http_builder());
+        let acceptor = TimedAcceptor(timeouts);
+        servers.push(match tls.clone() {
+            Some(tls) => server
+                .acceptor(RustlsAcceptor::new(tls).acceptor(acceptor))
+                .serve(service.clone())
+                .boxed(),
+            None => server.acceptor(acceptor).serve(service.clone()).boxed(),
+        });
+    }
+    let serving = try_join_all(servers);
+    let grace = Duration::from_secs(config.shutdown_grace_secs);
+    tokio::select! {
+        result = serving => {
+            result.map_err(|err| {
+                error!("Server error: {}", err);
+                AppError::Internal("Server error".to_string())
+            })?;
+            info!("Server stopped");
+        }
+        _ = async {
+            shutdown.cancelled().await;
+            tokio::time::sleep(grace).await;
+        } => {
+            warn!(
+                "Shutdown grace period of {}s elapsed; dropping remaining connections",
+                grace.as_secs()
+            );
+        }
+    }
+    #[cfg(unix)]
+    if let Some(path) = &socket_path {
+        unix_socket::remove(path);
+    }
+    Ok(())
+}
+
+/// Resolves on Ctrl-C, or SIGTERM on Unix (what systemd and container runtimes send).
+async fn shutdown_signal() {
+    let ctrl_c = async {
+        if let Err(err) = tokio::signal::ctrl_c().await {
+            error!("Failed to listen for Ctrl-C: {}", err);
+            std::future::pending::<()>().await;
+        }
+    };
+
+    #[cfg(unix)]
+    let terminate = async {
+        match tokio::signal::unix::signal(tokio::signal::unix::SignalKind::terminate()) {
+            Ok(mut signal) => {
+                signal.recv().await;
+            }
+            Err(err) => {
+                error!("Failed to listen for SIGTERM: {}", err);
+                std::future::pending::<()>().await;
+            }
+        }
+    };
+    #[cfg(not(unix))]
+    let terminate = std::future::pending::<()>();
+
+    tokio::select! {
+        _ = ctrl_c => {}
+        _ = terminate => {}
+    }
+}
+
+/// Reopens `log_file` on every SIGHUP, after logrotate or similar has moved it away.
+#[cfg(unix)]
+async fn reopen_log_on_hangup() {
+    let mut hangup = match tokio::signal::unix::signal(tokio::signal::unix::SignalKind::hangup()) {
+        Ok(signal) => signal,
+        Err(err) => {
+            error!("Failed to listen for SIGHUP: {}", err);
+            return;
+        }
+    };
+    while hangup.recv().await.is_some() {
+        match log_file::reopen() {
+            Ok(()) => info!("Reopened log file on SIGHUP"),
+            Err(err) => error!("Failed to reopen log file: {}", err),
+        }
+    }
+}
+
+/// IP literal or hostname from `bind`; a hostname is resolved once and its first address
+/// used, so a typo fails at startup rather than on the first request.
+async fn resolve_bind_host(host: &str) -> Result<IpAddr, AppError> {
+    if let Ok(ip) = host.parse::<IpAddr>() {
+        return Ok(ip);
+    }
+    let resolved = tokio::net::lookup_host((host, 0))
+        .await
+        .map_err(|err| {
+            error!("Invalid bind address {}: {}", host, err);
+            AppError::Config(format!("Invalid bind address `{host}`: {err}"))
+        })?
+        .next()
+        .ok_or_else(|| AppError::Config(format!("Bind address `{host}` resolved to nothing")))?;
+    info!("Bind address {} resolved to {}", host, resolved.ip());
+    Ok(resolved.ip())
+}
+
+async fn bind_listener(addr: SocketAddr) -> Result<tokio::net::TcpListener, AppError> {
+    tokio::net::TcpListener::bind(addr).await.map_err(|err| {
         error!("Failed to bind to {}: {}", addr, err);
         AppError::Config(format!(
             "Failed to bind to {addr}. Ensure the port is free and you have permission."
         ))
-    })?;
-
-    axum::serve(listener, router).await.map_err(|err| {
-        error!("Server error: {}", err);
-        AppError::Internal("Server error".to_string())
     })
 }
 
+fn stat_command(args: StatArgs) -> Result<(), AppError> {
+    let (config, canonical_root) = effective_config(&args.run)?;
+    let payload = stat::stat_path(&config, &canonical_root, &args.path, args.checksum)?;
+    let json = serde_json::to_string_pretty(&payload)
+        .map_err(|err| AppError::Internal(err.to_string()))?;
+    println!("{json}");
+    Ok(())
+}
+
+fn ls_command(args: LsArgs) -> Result<(), AppError> {
+    let (config, canonical_root) = effective_config(&args.run)?;
+    let listing = stat::list_path(&config, &canonical_root, &args.path, args.sort, args.all)?;
+
+    if args.json {
+        let json = serde_json::to_string_pretty(&listing)
+            .map_err(|err| AppError::Internal(err.to_string()))?;
+        println!("{json}");
+        return Ok(());
+    }
+
+    println!("{}", listing.path);
+    for entry in &listing.entries {
+        let name = if entry.is_dir {
+            format!("{}/", entry.name)
+        } else {
+            entry.name.clone()
+        };
+        println!(
+            "{:>10}  {}  {}{}",
+            entry.size,
+            entry.modified,
+            name,
+            if entry.hidden { "  (hidden)" } else { "" }
+        );
+    }
+    Ok(())
+}
+
 fn show_config(args: ShowConfigArgs) -> Result<(), AppError> {
     let (config, canonical_root) = effective_config(&args.run)?;
 
@@ -362,7 +1063,15 @@ fn show_config(args: ShowConfigArgs) -> Result<(), AppError> {
             .map(|p| p.display().to_string())
             .unwrap_or_else(|| "<auto-discovery>".to_string())
     );
-    println!("Port           : {}", config.port);
+    println!(
+        "Port           : {}",
+        config
+            .listen_ports()
+            .iter()
+            .map(|port| port.to_string())
+            .collect::<Vec<_>>()
+            .join(", ")
+    );
     println!("Root (effective): {}", canonical_root.display());
     println!(
         "Root override  : {}",
@@ -382,8 +1091,259 @@ fn show_config(args: ShowConfigArgs) -> Result<(), AppError> {
             "<hidden>".to_string()
         }
     );
+    println!(
+        "Basic auth     : {}",
+        match (&config.basic_auth_user, &config.basic_auth_pass) {
+            (Some(user), Some(pass)) if pass.starts_with("$2") => format!("{user} (bcrypt)"),
+            (Some(user), Some(_)) => user.clone(),
+            _ => "off".to_string(),
+        }
+    );
+    if config.open_upload {
+        println!(
+            "Open upload    : on ({} per minute, {} bytes per day per client)",
+            config.open_upload_rate, config.open_upload_quota
+        );
+    } else {
+        println!("Open upload    : off");
+    }
+    if config.upload_rate_limit == 0 {
+        println!("Write rate     : unlimited");
+    } else {
+        println!(
+            "Write rate     : {} per minute per client (burst {})",
+            config.upload_rate_limit,
+            if config.upload_burst == 0 {
+                config.upload_rate_limit
+            } else {
+                config.upload_burst
+            }
+        );
+    }
     println!("Max file size  : {} bytes", config.max_file_size);
+    println!("Dir form field : {}", config.upload_path_field);
+    println!(
+        "Upload paths   : {}",
+        if config.upload_allowed_paths.is_empty() {
+            "(anywhere)".to_string()
+        } else {
+            config.upload_allowed_paths.join(", ")
+        }
+    );
+    println!(
+        "Missing dirs   : {}",
+        if config.create_missing_dirs {
+            "created"
+        } else {
+            "rejected"
+        }
+    );
+    println!(
+        "Min file size  : {} bytes{}",
+        config.min_file_size,
+        if config.reject_empty_uploads {
+            " (empty rejected)"
+        } else {
+            ""
+        }
+    );
+    println!(
+        "Upload tmp dir : {}",
+        config.upload_tmp_dir(&canonical_root).display()
+    );
     println!("Catalog refresh: {} seconds", config.catalog_refresh_secs);
+    let duration_display = |duration: Duration| {
+        if duration.is_zero() {
+            "off".to_string()
+        } else {
+            format!("{duration:?}")
+        }
+    };
+    let mode_display = |mode: Option<u32>| {
+        mode.map(|mode| format!("{mode:04o}"))
+            .unwrap_or_else(|| "umask".to_string())
+    };
+    println!(
+        "Upload modes   : file {}, dir {}",
+        mode_display(config.upload_file_mode),
+        mode_display(config.upload_dir_mode)
+    );
+    println!(
+        "Bind           : {}",
+        config.bind.as_deref().unwrap_or("(all)")
+    );
+    println!(
+        "Interface      : {}",
+        config.interface.as_deref().unwrap_or("(all)")
+    );
+    match (&config.tls_cert, &config.tls_key) {
+        (Some(cert), Some(key)) => println!(
+            "TLS            : cert {}, key {}",
+            cert.display(),
+            key.display()
+        ),
+        _ if args.run.self_signed => {
+            println!("TLS            : self-signed (generated at startup)")
+        }
+        _ => println!("TLS            : off"),
+    }
+    println!(
+        "Unix socket    : {}",
+        config
+            .unix_socket
+            .as_ref()
+            .map(|path| path.display().to_string())
+            .unwrap_or_else(|| "(none)".to_string())
+    );
+    println!(
+        "Timeouts       : read header {}, read {}, write {}, idle {}",
+        duration_display(config.read_header_timeout),
+        duration_display(config.read_timeout),
+        duration_display(config.write_timeout),
+        duration_display(config.idle_timeout)
+    );
+    println!("Health path    : {}", config.health_path);
+    println!(
+        "Listing cache  : {}",
+        if config.listing_cache_control.is_empty() {
+            "(none)"
+        } else {
+            config.listing_cache_control.as_str()
+        }
+    );
+    if config.listing_page_size == 0 {
+        println!("Listing page   : unpaginated");
+    } else {
+        println!("Listing page   : {} entries", config.listing_page_size);
+    }
+    println!(
+        "Listing order  : {} {}",
+        config.default_sort.as_str(),
+        config
+            .default_order
+            .unwrap_or_else(|| config.default_sort.default_order())
+            .as_str()
+    );
+    println!(
+        "Listings       : {}",
+        if config.disable_listing {
+            "disabled"
+        } else {
+            "enabled"
+        }
+    );
+    println!(
+        "Auto index     : {}",
+        if config.auto_index { "on" } else { "off" }
+    );
+    println!(
+        "SPA fallback   : {}",
+        if config.spa_fallback { "on" } else { "off" }
+    );
+    println!(
+        "404 page       : {}",
+        config.not_found_page.as_deref().map_or_else(
+            || "404.html in root".to_string(),
+            |path| path.display().to_string()
+        )
+    );
+    println!(
+        "Zip archives   : {}, {}",
+        config.zip_compression,
+        match config.zip_workers {
+            0 => "one worker per CPU".to_string(),
+            1 => "no extra workers".to_string(),
+            workers => format!("{workers} workers"),
+        }
+    );
+    match &config.canonical_host {
+        Some(host) => println!(
+            "Canonical host : {}{}",
+            host,
+            if config.canonical_host_exempt_loopback {
+                " (loopback exempt)"
+            } else {
+                ""
+            }
+        ),
+        None => println!("Canonical host : (any)"),
+    }
+    println!(
+        "CORS origins   : {}",
+        if config.cors_origins.is_empty() {
+            "(none)".to_string()
+        } else {
+            config.cors_origins.join(", ")
+        }
+    );
+    println!("Shutdown grace : {} seconds", config.shutdown_grace_secs);
+    match &config.log_file {
+        Some(path) if config.log_max_size_mb > 0 => println!(
+            "Log file       : {} (rotated at {} MiB)",
+            path.display(),
+            config.log_max_size_mb
+        ),
+        Some(path) => println!("Log file       : {}", path.display()),
+        None => println!("Log file       : (stderr)"),
+    }
+    println!(
+        "Maintenance    : {} (sentinel {})",
+        if config.maintenance { "on" } else { "off" },
+        config.maintenance_file().display()
+    );
+    println!(
+        "Idempotency TTL: {}",
+        if config.idempotency_ttl_secs == 0 {
+            "disabled".to_string()
+        } else {
+            format!("{} seconds", config.idempotency_ttl_secs)
+        }
+    );
+    let cidrs = |list: &[cidr::IpCidr], empty: &str| {
+        if list.is_empty() {
+            empty.to_string()
+        } else {
+            list.iter()
+                .map(ToString::to_string)
+                .collect::<Vec<_>>()
+                .join(", ")
+        }
+    };
+    println!("Allowed IPs    : {}", cidrs(&config.allow_cidrs, "all"));
+    println!("Denied IPs     : {}", cidrs(&config.deny_cidrs, "none"));
+    println!(
+        "Trust proxy    : {}",
+        if config.trust_proxy {
+            format!("on ({})", cidrs(&config.trusted_proxies, "any peer"))
+        } else {
+            "off".to_string()
+        }
+    );
+    println!(
+        "Conns per IP   : {}",
+        if config.max_conns_per_ip == 0 {
+            "unlimited".to_string()
+        } else {
+            config.max_conns_per_ip.to_string()
+        }
+    );
+    println!(
+        "Max requests   : {}",
+        if config.max_connections == 0 {
+            "unlimited".to_string()
+        } else {
+            config.max_connections.to_string()
+        }
+    );
+    println!(
+        "Run as         : {}:{}",
+        config.user.as_deref().unwrap_or("<current>"),
+        config.group.as_deref().unwrap_or("<current>")
+    );
+    println!(
+        "Chroot         : {}",
+        if config.chroot { "enabled" } else { "disabled" }
+    );
 
     let mut hidden: Vec<_> = config.blacklisted_files.iter().cloned().collect();
     hidden.sort();
@@ -400,12 +1360,74 @@ fn show_config(args: ShowConfigArgs) -> Result<(), AppError> {
     extensions.sort();
     println!(
         "Allowed ext    : {}",
-        if extensions.is_empty() {
-            "-".to_string()
+        if config.allow_all_extensions || extensions.is_empty() {
+            "(any)".to_string()
         } else {
             extensions.join(", ")
         }
     );
+    let mut inline: Vec<_> = config.inline_extensions.iter().cloned().collect();
+    inline.sort();
+    let mut forced: Vec<_> = config.force_download_extensions.iter().cloned().collect();
+    forced.sort();
+    println!("Force download : {}", forced.join(", "));
+    println!(
+        "File CSP       : {}",
+        if config.file_csp.is_empty() {
+            "(off)"
+        } else {
+            config.file_csp.as_str()
+        }
+    );
+    println!(
+        "Compress max   : {}",
+        if config.compress_max_size == 0 {
+            "(no limit)".to_string()
+        } else {
+            format!("{} bytes", config.compress_max_size)
+        }
+    );
+    println!(
+        "Strong ETags   : {} (up to {} bytes)",
+        if config.strong_etags { "on" } else { "off" },
+        config.strong_etag_max_size
+    );
+    println!(
+        "Inline ext     : {}",
+        if inline.is_empty() {
+            "(any)".to_string()
+        } else {
+            inline.join(", ")
+        }
+    );
+    let mut inline_default: Vec<_> = config.inline_default_extensions.iter().cloned().collect();
+    inline_default.sort();
+    println!(
+        "Inline default : {}",
+        if inline_default.is_empty() {
+            "(none)".to_string()
+        } else {
+            inline_default.join(", ")
+        }
+    );
+    let text_display = |text: &Option<String>| text.clone().unwrap_or_else(|| "(none)".to_string());
+    println!("Site title     : {}", text_display(&config.site_title));
+    println!(
+        "Site header    : {}",
+        if config.site_header_html.is_some() {
+            "(raw HTML)".to_string()
+        } else {
+            text_display(&config.site_header)
+        }
+    );
+    println!("Site footer    : {}", text_display(&config.site_footer));
+    println!("Banner         : {}", text_display(&config.banner));
+
+    println!();
+    println!("Sources:");
+    for (field, source) in &config.sources {
+        println!("  {:<22}: {}", field, source);
+    }
     if !config.upload_token.is_empty() && !args.show_token {
         println!();
         println!("Tip: pass --show-token to display the configured token");
@@ -461,9 +1483,45 @@ pub(crate) fn map_io_error(err: io::Error) -> AppError {
 pub(crate) enum AppError {
     NotFound(String),
     Unauthorized(String),
+    Forbidden(String),
     BadRequest(String),
+    PayloadTooLarge(String),
+    TooManyRequests(String),
+    Conflict(String),
     Internal(String),
     Config(String),
+    /// Any of the above, reported with a more specific code from [`error_codes`].
+    Coded(&'static str, Box<AppError>),
+}
+
+impl AppError {
+    pub(crate) fn with_code(self, code: &'static str) -> Self {
+        match self {
+            AppError::Coded(_, inner) => AppError::Coded(code, inner),
+            other => AppError::Coded(code, Box::new(other)),
+        }
+    }
+
+    pub(crate) fn status_and_code(&self) -> (StatusCode, &'static str) {
+        match self {
+            AppError::NotFound(_) => (StatusCode::NOT_FOUND, error_codes::NOT_FOUND),
+            AppError::Unauthorized(_) => (StatusCode::UNAUTHORIZED, error_codes::UNAUTHORIZED),
+            AppError::Forbidden(_) => (StatusCode::FORBIDDEN, error_codes::FORBIDDEN),
+            AppError::BadRequest(_) => (StatusCode::BAD_REQUEST, error_codes::BAD_REQUEST),
+            AppError::PayloadTooLarge(_) => {
+                (StatusCode::PAYLOAD_TOO_LARGE, error_codes::FILE_TOO_LARGE)
+            }
+            AppError::TooManyRequests(_) => (
+                StatusCode::TOO_MANY_REQUESTS,
+                error_codes::TOO_MANY_REQUESTS,
+            ),
+            AppError::Conflict(_) => (StatusCode::CONFLICT, error_codes::CONFLICT),
+            AppError::Internal(_) | AppError::Config(_) => {
+                (StatusCode::INTERNAL_SERVER_ERROR, error_codes::INTERNAL)
+            }
+            AppError::Coded(code, inner) => (inner.status_and_code().0, code),
+        }
+    }
 }
 
 impl fmt::Display for AppError {
@@ -471,27 +1529,33 @@ impl fmt::Display for AppError {
         match self {
             AppError::NotFound(message)
             | AppError::Unauthorized(message)
+            | AppError::Forbidden(message)
             | AppError::BadRequest(message)
+            | AppError::PayloadTooLarge(message)
+            | AppError::TooManyRequests(message)
+            | AppError::Conflict(message)
             | AppError::Internal(message)
             | AppError::Config(message) => write!(f, "{message}"),
+            AppError::Coded(_, inner) => inner.fmt(f),
         }
     }
 }
 
 impl std::error::Error for AppError {}
 
+/// Code of an error response, left in the response extensions for
+/// [`middleware::json_errors`].
+#[derive(Clone, Copy, Debug)]
+pub(crate) struct ErrorCode(pub(crate) &'static str);
+
 impl IntoResponse for AppError {
     fn into_response(self) -> Response {
-        match self {
-            AppError::NotFound(message) => (StatusCode::NOT_FOUND, message).into_response(),
-            AppError::Unauthorized(message) => (StatusCode::UNAUTHORIZED, message).into_response(),
-            AppError::BadRequest(message) => (StatusCode::BAD_REQUEST, message).into_response(),
-            AppError::Internal(message) => {
-                (StatusCode::INTERNAL_SERVER_ERROR, message).into_response()
-            }
-            AppError::Config(message) => {
-                (StatusCode::INTERNAL_SERVER_ERROR, message).into_response()
-            }
-        }
+        let (status, code) = self.status_and_code();
+        let mut response = (status, self.to_string()).into_response();
+        response
+            .headers_mut()
+            .insert(error_codes::HEADER, HeaderValue::from_static(code));
+        response.extensions_mut().insert(ErrorCode(code));
+        response
     }
 }
@@ -0,0 +1,341 @@
+//! Machine-readable tree for mirroring (`GET /manifest.json`): every file under the root
+//! with its size, modification time and optionally a SHA-256, so a client can diff it
+//! against a local copy. The JSON is written while the tree is walked, so memory stays
+//! flat however large the root is; `?since=` narrows it to recent changes.
+//!
+//! Responses carry `Last-Modified`: the newest mtime of any file or directory in the
+//! tree (directories change when entries are added, removed or renamed). A poll with a
+//! matching `If-Modified-Since` gets `304` after that stat-only pass, without the manifest
+//! being built.
+
+use std::io::{self, Write};
+use std::ops::ControlFlow;
+use std::time::{SystemTime, UNIX_EPOCH};
+
+use axum::body::Body;
+use axum::extract::{Query, State};
+use axum::http::HeaderValue;
+use axum::http::{HeaderMap, StatusCode, header};
+use axum::response::Response;
+use chrono::{DateTime, SecondsFormat, Utc};
+use serde::Deserialize;
+use serde_json::json;
+use tokio_util::sync::CancellationToken;
+
+use crate::archive::{ChannelWriter, blocking_body};
+use crate::http_utils::{auth_token, client_ip, client_user_agent, http_date, not_modified_since};
+use crate::stat::sha256_file;
+use crate::walk::{SymlinkPolicy, WalkOptions, WalkOutcome, walk_within};
+use crate::{AppError, AppState, POWERED_BY};
+
+pub(crate) const MANIFEST_PATH: &str = "/manifest.json";
+
+/// Files listed before the manifest is cut short and marked `truncated`.
+const MAX_MANIFEST_FILES: u64 = 100_000;
+
+#[derive(Deserialize)]
+pub(crate) struct ManifestQuery {
+    /// Unix seconds; only files modified strictly after this are listed.
+    since: Option<i64>,
+    /// Adds a `sha256` to every file, which means reading all of them.
+    #[serde(default)]
+    checksum: bool,
+    /// Levels below the root to descend; 0 or absent means unlimited.
+    #[serde(default)]
+    max_depth: usize,
+}
+
+pub(crate) async fn get_manifest(
+    State(state): State<AppState>,
+    headers: HeaderMap,
+    Query(query): Query<ManifestQuery>,
+) -> Result<Response, AppError> {
+    let provided_token = auth_token(&headers);
+    if provided_token.as_deref() != Some(state.config.upload_token.as_str()) {
+        return Err(AppError::Unauthorized("Unauthorized".to_string()));
+    }
+
+    let last_change = {
+        let state = state.clone();
+        let max_depth = query.max_depth;
+        // Dropped with this future, so a client that goes away stops the scan too.
+        let cancel = CancellationToken::new();
+        let _cancel_on_drop = cancel.clone().drop_guard();
+        tokio::task::spawn_blocking(move || latest_change(&state, max_depth, &cancel))
+            .await
+            .map_err(|err| AppError::Internal(err.to_string()))?
+    };
+    let last_modified = last_change
+        .map(|time| http_date(DateTime::<Utc>::from(time)))
+        .and_then(|value| HeaderValue::from_str(&value).ok());
+    if last_change.is_some_and(|time| not_modified_since(&headers, DateTime::<Utc>::from(time))) {
+        let mut response = Response::builder()
+            .status(StatusCode::NOT_MODIFIED)
+            .header(header::CACHE_CONTROL, "no-cache");
+        if let Some(value) = last_modified {
+            response = response.header(header::LAST_MODIFIED, value);
+        }
+        return response
+            .body(Body::empty())
+            .map_err(|err| AppError::Internal(err.to_string()));
+    }
+
+    tracing::info!(
+        "[manifest] {} - since={} checksum={} - {}",
+        client_ip(&headers),
+        query
+            .since
+            .map_or_else(|| "-".to_string(), |since| since.to_string()),
+        query.checksum,
+        client_user_agent(&headers)
+    );
+
+    let body = blocking_body("manifest".to_string(), move |writer, cancel| {
+        let options = WalkOptions {
+            blacklist: &state.config.blacklisted_files,
+            max_depth: query.max_depth,
+            symlinks: SymlinkPolicy::Follow,
+            cancel: Some(cancel),
+        };
+        write_manifest(&state, &query, &options, writer)
+    });
+
+    let mut response = Response::builder()
+        .status(StatusCode::OK)
+        .header(header::CONTENT_TYPE, "application/json; charset=utf-8")
+        .header(header::CACHE_CONTROL, "no-cache");
+    if let Some(value) = last_modified {
+        response = response.header(header::LAST_MODIFIED, value);
+    }
+    response
+        .body(body)
+        .map_err(|err| AppError::Internal(err.to_string()))
+}
+
+/// Newest modification time among the entries a manifest with this depth would walk,
+/// directories included so that deletions and renames count as changes.
+fn latest_change(
+    state: &AppState,
+    max_depth: usize,
+    cancel: &CancellationToken,
+) -> Option<SystemTime> {
+    let options = WalkOptions {
+        blacklist: &state.config.blacklisted_files,
+        max_depth,
+        symlinks: SymlinkPolicy::Follow,
+        cancel: Some(cancel),
+    };
+    let root = state.canonical_root.as_path();
+    let mut latest = None;
+    walk_within(root, root, &options, |walked| {
+        let modified = walked
+            .entry
+            .metadata()
+            .ok()
+            .and_then(|metadata| metadata.modified().ok());
+        if modified > latest {
+            latest = modified;
+        }
+        ControlFlow::Continue(())
+    });
+    latest
+}
+
+/// Writes `{"generated_at", "since", "files": [...], "file_count", "total_bytes",
+/// "truncated"}`. The summary comes last because it is only known once the walk is done.
+fn write_manifest(
+    state: &AppState,
+    query: &ManifestQuery,
+    options: &WalkOptions<'_>,
+    writer: &mut ChannelWriter,
+) -> io::Result<()> {
+    let header = json!({
+        "generated_at": Utc::now().to_rfc3339_opts(SecondsFormat::Secs, true),
+        "since": query.since,
+        "powered_by": POWERED_BY,
+    });
+    // Reopen the header object so the file list can be streamed into it.
+    let header = header.to_string();
+    writer.write_all(header[..header.len() - 1].as_bytes())?;
+    writer.write_all(b",\"files\":[")?;
+
+    let root = state.canonical_root.as_path();
+    let mut file_count = 0u64;
+    let mut total_bytes = 0u64;
+    let mut truncated = false;
+    let mut failure = None;
+    let outcome = walk_within(root, root, options, |walked| {
+        if !walked.entry.file_type().is_file() {
+            return ControlFlow::Continue(());
+        }
+        let Ok(metadata) = walked.entry.metadata() else {
+            return ControlFlow::Continue(());
+        };
+        let modified_time = metadata.modified().ok();
+        let modified = modified_time
+            .and_then(|time| time.duration_since(UNIX_EPOCH).ok())
+            .map(|elapsed| elapsed.as_secs() as i64);
+        if let Some(since) = query.since {
+            if modified.is_none_or(|modified| modified <= since) {
+                return ControlFlow::Continue(());
+            }
+        }
+        if file_count == MAX_MANIFEST_FILES {
+            truncated = true;
+            return ControlFlow::Break(());
+        }
+
+        let mut file = json!({
+            "path": walked.relative_path,
+            "size_bytes": metadata.len(),
+            "modified": modified,
+            "modified_at": modified_time
+                .map(|time| DateTime::<Utc>::from(time).to_rfc3339_opts(SecondsFormat::Secs, true)),
+        });
+        if query.checksum {
+            match sha256_file(walked.entry.path()) {
+                Ok(digest) => file["sha256"] = digest.into(),
+                Err(err) => {
+                    tracing::warn!("Skipping {} in manifest: {}", walked.relative_path, err);
+                    return ControlFlow::Continue(());
+                }
+            }
+        }
+
+        let separator: &[u8] = if file_count == 0 { b"" } else { b"," };
+        let written = writer
+            .write_all(separator)
+            .and_then(|()| writer.write_all(file.to_string().as_bytes()));
+        if let Err(err) = written {
+            failure = Some(err);
+            return ControlFlow::Break(());
+        }
+        file_count += 1;
+        total_bytes += metadata.len();
+        ControlFlow::Continue(())
+    });
+    if let Some(err) = failure {
+        return Err(err);
+    }
+    if outcome == WalkOutcome::Cancelled {
+        return Err(io::ErrorKind::BrokenPipe.into());
+    }
+
+    let summary = json!({
+        "file_count": file_count,
+        "total_bytes": total_bytes,
+        "truncated": truncated,
+    })
+    .to_string();
+    writer.write_all(b"],")?;
+    writer.write_all(summary[1..].as_bytes())?;
+    writer.flush()
+}
+
+#[cfg(test)]
+mod tests {
+    use std::time::Duration;
+
+    use serde_json::Value;
+
+    use super::*;
+    use crate::test_support::{TempDir, app_state};
+
+    fn write_at(path: &std::path::Path, content: &str, unix: u64) {
+        std::fs::create_dir_all(path.parent().unwrap()).unwrap();
+        std::fs::write(path, content).unwrap();
+        let file = std::fs::File::options().write(true).open(path).unwrap();
+        file.set_modified(UNIX_EPOCH + Duration::from_secs(unix))
+            .unwrap();
+    }
+
+    fn token_headers() -> HeaderMap {
+        let mut headers = HeaderMap::new();
+        headers.insert("X-Serve-Token", HeaderValue::from_static("abogoboga"));
+        headers
+    }
+
+    async fn manifest(state: &AppState, headers: HeaderMap, since: Option<i64>) -> Response {
+        let query = ManifestQuery {
+            since,
+            checksum: true,
+            max_depth: 0,
+        };
+        get_manifest(State(state.clone()), headers, Query(query))
+            .await
+            .unwrap()
+    }
+
+    async fn listed_paths(response: Response) -> Vec<String> {
+        let body = axum::body::to_bytes(response.into_body(), usize::MAX)
+            .await
+            .unwrap();
+        let manifest: Value = serde_json::from_slice(&body).unwrap();
+        let files = manifest["files"].as_array().unwrap();
+        assert_eq!(manifest["file_count"], files.len());
+        assert_eq!(manifest["truncated"], false);
+        let mut paths: Vec<String> = files
+            .iter()
+            .map(|file| {
+                assert_eq!(file["sha256"].as_str().unwrap().len(), 64);
+                file["path"].as_str().unwrap().to_string()
+            })
+            .collect();
+        paths.sort();
+        paths
+    }
+
+    #[tokio::test]
+    async fn full_and_incremental_manifests() {
+        let dir = TempDir::new();
+        let state = app_state(&dir, "").await;
+        let root = state.canonical_root.clone();
+        write_at(&root.join("old.txt"), "old", 1_000);
+        write_at(&root.join("sub/new.txt"), "new", 3_000);
+        write_at(&root.join("utils/hidden.txt"), "hidden", 3_000);
+
+        let full = manifest(&state, token_headers(), None).await;
+        assert_eq!(full.status(), StatusCode::OK);
+        assert_eq!(listed_paths(full).await, ["old.txt", "sub/new.txt"]);
+
+        let delta = manifest(&state, token_headers(), Some(2_000)).await;
+        assert_eq!(listed_paths(delta).await, ["sub/new.txt"]);
+
+        let query = ManifestQuery {
+            since: None,
+            checksum: false,
+            max_depth: 0,
+        };
+        let denied = get_manifest(State(state.clone()), HeaderMap::new(), Query(query)).await;
+        assert_eq!(
+            denied.err().unwrap().status_and_code().0,
+            StatusCode::UNAUTHORIZED
+        );
+    }
+
+    #[tokio::test]
+    async fn unchanged_tree_answers_not_modified() {
+        let dir = TempDir::new();
+        let state = app_state(&dir, "").await;
+        let root = state.canonical_root.clone();
+        write_at(&root.join("a.txt"), "a", 1_000);
+
+        let first = manifest(&state, token_headers(), None).await;
+        let last_modified = first.headers()[header::LAST_MODIFIED].clone();
+        let mut headers = token_headers();
+        headers.insert(header::IF_MODIFIED_SINCE, last_modified.clone());
+
+        let unchanged = manifest(&state, headers.clone(), None).await;
+        assert_eq!(unchanged.status(), StatusCode::NOT_MODIFIED);
+        assert_eq!(unchanged.headers()[header::LAST_MODIFIED], last_modified);
+
+        // Stamped past the directory mtimes, which are all "now".
+        let later = SystemTime::now() + Duration::from_secs(3_600);
+        let later = later.duration_since(UNIX_EPOCH).unwrap().as_secs();
+        write_at(&root.join("b.txt"), "b", later);
+        let changed = manifest(&state, headers, None).await;
+        assert_eq!(changed.status(), StatusCode::OK);
+        assert_ne!(changed.headers()[header::LAST_MODIFIED], last_modified);
+        assert_eq!(listed_paths(changed).await, ["a.txt", "b.txt"]);
+    }
+}
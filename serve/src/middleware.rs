@@ -0,0 +1,1276 @@
+use std::any::Any;
+use std::collections::{HashMap, HashSet};
+use std::net::{IpAddr, SocketAddr};
+use std::panic::AssertUnwindSafe;
+use std::path::{Path, PathBuf};
+use std::pin::Pin;
+use std::sync::{Arc, Mutex};
+use std::task::{Context, Poll};
+
+use axum::body::{Body, Bytes};
+use axum::extract::{ConnectInfo, Request, State};
+use axum::http::{HeaderMap, HeaderValue, Method, StatusCode, header};
+use axum::middleware::Next;
+use axum::response::{IntoResponse, Response};
+use base64::Engine;
+use base64::engine::general_purpose::STANDARD as BASE64;
+use futures_util::FutureExt;
+use http_body::{Body as HttpBody, Frame, SizeHint};
+use sha2::{Digest, Sha256};
+use tokio::sync::Semaphore;
+use ulid::Ulid;
+
+use crate::cidr::IpCidr;
+use crate::config::Config;
+use crate::error_codes;
+use crate::http_utils::{
+    auth_token, client_ip, is_compressible, remote_ip, request_scheme, wants_json,
+};
+use crate::rate_limit::RateLimiter;
+use crate::{AppError, ErrorCode, POWERED_BY};
+
+const REQUEST_ID_HEADER: &str = "X-Request-Id";
+const MAX_ERROR_MESSAGE_BYTES: usize = 64 * 1024;
+const BASIC_AUTH_CHALLENGE: &str = "Basic realm=\"serve\", charset=\"UTF-8\"";
+/// Verified bcrypt credentials remembered before the cache is emptied and refilled.
+const MAX_VERIFIED_CREDENTIALS: usize = 1024;
+const DEFAULT_NOT_FOUND_PAGE: &str = "404.html";
+/// Larger pages are ignored rather than read into memory on every 404.
+const MAX_NOT_FOUND_PAGE_BYTES: u64 = 1024 * 1024;
+
+/// Converts a panicking handler into a 500 response instead of dropping the connection.
+/// The default panic hook has already reported the location (and backtrace when
+/// `RUST_BACKTRACE` is set); this adds the request context to the log.
+pub(crate) async fn recover_panics(request: Request, next: Next) -> Response {
+    let method = request.method().clone();
+    let path = request.uri().path().to_string();
+    let request_id = request_id(request.headers());
+    let json = wants_json(request.headers());
+
+    match AssertUnwindSafe(next.run(request)).catch_unwind().await {
+        Ok(response) => response,
+        Err(panic) => {
+            tracing::error!(
+                "[panic] {} - {} {} - {}",
+                request_id,
+                method,
+                path,
+                panic_message(panic.as_ref())
+            );
+            internal_error_response(json, &request_id)
+        }
+    }
+}
+
+fn request_id(headers: &HeaderMap) -> String {
+    headers
+        .get(REQUEST_ID_HEADER)
+        .and_then(|value| value.to_str().ok())
+        .map(str::trim)
+        .filter(|value| !value.is_empty())
+        .map(|value| value.to_string())
+        .unwrap_or_else(|| Ulid::new().to_string())
+}
+
+fn panic_message(panic: &(dyn Any + Send)) -> String {
+    if let Some(message) = panic.downcast_ref::<&str>() {
+        message.to_string()
+    } else if let Some(message) = panic.downcast_ref::<String>() {
+        message.clone()
+    } else {
+        "unknown panic payload".to_string()
+    }
+}
+
+fn internal_error_response(json: bool, request_id: &str) -> Response {
+    let (content_type, body) = if json {
+        let payload = serde_json::json!({
+            "status": "error",
+            "code": error_codes::INTERNAL,
+            "message": "Internal server error",
+            "request_id": request_id,
+            "powered_by": POWERED_BY,
+        });
+        (
+            "application/json; charset=utf-8",
+            serde_json::to_string_pretty(&payload).unwrap(),
+        )
+    } else {
+        (
+            "text/plain; charset=utf-8",
+            "Internal server error".to_string(),
+        )
+    };
+
+    let mut response = Response::builder()
+        .status(StatusCode::INTERNAL_SERVER_ERROR)
+        .header(header::CONTENT_TYPE, content_type)
+        .header(error_codes::HEADER, error_codes::INTERNAL)
+        .body(Body::from(body))
+        .unwrap();
+    if let Ok(value) = HeaderValue::from_str(request_id) {
+        response.headers_mut().insert(REQUEST_ID_HEADER, value);
+    }
+    response
+}
+
+/// Headers a proxy uses to describe the original client and connection.
+const FORWARDED_HEADERS: [&str; 5] = [
+    "x-forwarded-for",
+    "x-forwarded-proto",
+    "x-real-ip",
+    "cf-connecting-ip",
+    "forwarded",
+];
+
+/// `trust_proxy` and `trusted_proxies` from the config, for [`trust_forwarded_headers`].
+#[derive(Clone)]
+pub(crate) struct ForwardedHeaders {
+    trust: bool,
+    proxies: Arc<[IpCidr]>,
+}
+
+impl ForwardedHeaders {
+    pub(crate) fn from_config(config: &Config) -> Self {
+        Self {
+            trust: config.trust_proxy,
+            proxies: config.trusted_proxies.as_slice().into(),
+        }
+    }
+
+    /// With an empty list any peer is trusted. A Unix socket has no peer address; only a
+    /// local proxy can reach it, so it counts as trusted once `trust_proxy` is on.
+    fn trusts(&self, peer: Option<IpAddr>) -> bool {
+        self.trust
+            && (self.proxies.is_empty()
+                || peer.is_none_or(|ip| self.proxies.iter().any(|cidr| cidr.contains(ip))))
+    }
+
+    fn is_proxy(&self, ip: IpAddr) -> bool {
+        self.proxies.iter().any(|cidr| cidr.contains(ip))
+    }
+}
+
+/// Makes the forwarded headers safe for everything behind it. From an untrusted peer they
+/// are dropped and `X-Forwarded-For` is set to the peer itself, so client addresses come
+/// from the socket and the scheme from the server's own TLS state. From a trusted proxy,
+/// `X-Forwarded-For` is cut down to the client the proxy saw: the right-most entry that is
+/// not itself one of `trusted_proxies`, since anything left of it was sent by the client.
+pub(crate) async fn trust_forwarded_headers(
+    State(forwarded): State<ForwardedHeaders>,
+    mut request: Request,
+    next: Next,
+) -> Response {
+    let peer = request
+        .extensions()
+        .get::<ConnectInfo<SocketAddr>>()
+        .map(|ConnectInfo(addr)| addr.ip());
+    let headers = request.headers_mut();
+
+    if !forwarded.trusts(peer) {
+        for name in FORWARDED_HEADERS {
+            headers.remove(name);
+        }
+        if let Some(ip) = peer {
+            if let Ok(value) = HeaderValue::from_str(&ip.to_string()) {
+                headers.insert("x-forwarded-for", value);
+            }
+        }
+        return next.run(request).await;
+    }
+
+    let hops: Vec<String> = headers
+        .get_all("x-forwarded-for")
+        .iter()
+        .filter_map(|value| value.to_str().ok())
+        .flat_map(|value| value.split(','))
+        .map(str::trim)
+        .filter(|hop| !hop.is_empty())
+        .map(str::to_string)
+        .collect();
+    let client = hops
+        .iter()
+        .rev()
+        .find(|hop| !hop.parse().is_ok_and(|ip| forwarded.is_proxy(ip)))
+        .or(hops.first());
+    if let Some(value) = client.and_then(|client| HeaderValue::from_str(client).ok()) {
+        headers.insert("x-forwarded-for", value);
+    }
+    next.run(request).await
+}
+
+const CORS_ALLOW_METHODS: &str = "GET, HEAD, POST, PUT, DELETE, OPTIONS";
+/// Request headers the API reads, so browser clients may send them cross-origin.
+const CORS_ALLOW_HEADERS: &str = "Authorization, Content-Type, Content-Encoding, Range, \
+If-Range, If-None-Match, If-Modified-Since, Idempotency-Key, X-Request-Id, X-Serve-Client, \
+X-Serve-Token, X-Upload-Path, X-Upload-Dir, X-Upload-Filename, X-Upload-Size, \
+X-Upload-Conflict, X-Allow-No-Ext, X-Allow-All-Ext";
+/// Response headers scripts may read besides the CORS-safelisted ones.
+const CORS_EXPOSE_HEADERS: &str = "Content-Disposition, Content-Length, ETag, Retry-After, \
+X-Error-Code, X-Request-Id";
+/// Seconds a browser may cache a preflight answer.
+const CORS_MAX_AGE_SECS: &str = "600";
+
+/// `cors_origins` from the config, for [`cors`].
+#[derive(Clone)]
+pub(crate) struct Cors {
+    origins: Arc<[String]>,
+    any: bool,
+}
+
+impl Cors {
+    pub(crate) fn from_config(config: &Config) -> Self {
+        Self {
+            origins: config
+                .cors_origins
+                .iter()
+                .filter(|origin| *origin != "*")
+                .cloned()
+                .collect(),
+            any: config.cors_origins.iter().any(|origin| origin == "*"),
+        }
+    }
+
+    /// `Some(true)` for an origin listed by name, `Some(false)` for one only `*` admits.
+    fn admits(&self, origin: &str) -> Option<bool> {
+        if self
+            .origins
+            .iter()
+            .any(|allowed| allowed.eq_ignore_ascii_case(origin))
+        {
+            Some(true)
+        } else {
+            self.any.then_some(false)
+        }
+    }
+}
+
+/// Adds CORS headers for origins in `cors_origins` and answers their preflights with 204
+/// before authentication, which browsers never send on a preflight. The request's origin
+/// is echoed rather than `*`; only origins listed by name may send credentials (Basic
+/// Auth). Without `cors_origins` responses are left untouched.
+pub(crate) async fn cors(State(cors): State<Cors>, request: Request, next: Next) -> Response {
+    if cors.origins.is_empty() && !cors.any {
+        return next.run(request).await;
+    }
+
+    let origin = request.headers().get(header::ORIGIN).cloned();
+    let Some((origin, named)) = origin.and_then(|origin| {
+        let named = cors.admits(origin.to_str().ok()?)?;
+        Some((origin, named))
+    }) else {
+        let mut response = next.run(request).await;
+        response
+            .headers_mut()
+            .append(header::VARY, HeaderValue::from_static("origin"));
+        return response;
+    };
+
+    let preflight = request.method() == Method::OPTIONS
+        && request
+            .headers()
+            .contains_key(header::ACCESS_CONTROL_REQUEST_METHOD);
+    let mut response = if preflight {
+        Response::builder()
+            .status(StatusCode::NO_CONTENT)
+            .header(header::ACCESS_CONTROL_ALLOW_METHODS, CORS_ALLOW_METHODS)
+            .header(header::ACCESS_CONTROL_ALLOW_HEADERS, CORS_ALLOW_HEADERS)
+            .header(header::ACCESS_CONTROL_MAX_AGE, CORS_MAX_AGE_SECS)
+            .body(Body::empty())
+            .unwrap()
+    } else {
+        let mut response = next.run(request).await;
+        response.headers_mut().insert(
+            header::ACCESS_CONTROL_EXPOSE_HEADERS,
+            HeaderValue::from_static(CORS_EXPOSE_HEADERS),
+        );
+        response
+    };
+
+    let headers = response.headers_mut();
+    headers.insert(header::ACCESS_CONTROL_ALLOW_ORIGIN, origin);
+    if named {
+        headers.insert(
+            header::ACCESS_CONTROL_ALLOW_CREDENTIALS,
+            HeaderValue::from_static("true"),
+        );
+    }
+    headers.append(header::VARY, HeaderValue::from_static("origin"));
+    response
+}
+
+/// `allow_cidrs` and `deny_cidrs` from the config, for [`restrict_client_ips`].
+#[derive(Clone)]
+pub(crate) struct AccessList {
+    allow: Arc<[IpCidr]>,
+    deny: Arc<[IpCidr]>,
+}
+
+impl AccessList {
+    pub(crate) fn from_config(config: &Config) -> Self {
+        Self {
+            allow: config.allow_cidrs.as_slice().into(),
+            deny: config.deny_cidrs.as_slice().into(),
+        }
+    }
+
+    /// Deny rules win; an empty allowlist lets in everyone else. A client whose address is
+    /// unknown (a Unix socket without forwarded headers) only gets in without an allowlist.
+    fn permits(&self, ip: Option<IpAddr>) -> bool {
+        match ip {
+            Some(ip) => {
+                !self.deny.iter().any(|cidr| cidr.contains(ip))
+                    && (self.allow.is_empty() || self.allow.iter().any(|cidr| cidr.contains(ip)))
+            }
+            None => self.allow.is_empty(),
+        }
+    }
+}
+
+/// Refuses clients outside `allow_cidrs` or inside `deny_cidrs` with 403 before anything
+/// else runs. The address comes from [`trust_forwarded_headers`], which only keeps a
+/// forwarded one from a trusted proxy. The health probe is routed outside this layer.
+pub(crate) async fn restrict_client_ips(
+    State(access): State<AccessList>,
+    request: Request,
+    next: Next,
+) -> Response {
+    if access.allow.is_empty() && access.deny.is_empty() {
+        return next.run(request).await;
+    }
+
+    let peer = request
+        .extensions()
+        .get::<ConnectInfo<SocketAddr>>()
+        .map(|ConnectInfo(addr)| addr.ip());
+    let ip = client_ip(request.headers()).parse::<IpAddr>().ok().or(peer);
+    if access.permits(ip) {
+        return next.run(request).await;
+    }
+
+    tracing::warn!(
+        "[access] {} - {} {} - blocked by allow_cidrs/deny_cidrs",
+        ip.map_or_else(|| "unknown".to_string(), |ip| ip.to_string()),
+        request.method(),
+        request.uri().path()
+    );
+    AppError::Forbidden("Access denied".to_string()).into_response()
+}
+
+/// Spends one of the client's `upload_rate_limit` tokens on every write that reaches the
+/// upload, delete and move routes. Over the limit the request gets 429 with `Retry-After`;
+/// HEAD and OPTIONS probes are not counted.
+pub(crate) async fn limit_upload_rate(
+    State(limiter): State<RateLimiter>,
+    request: Request,
+    next: Next,
+) -> Response {
+    if !limiter.enabled() || matches!(request.method(), &Method::HEAD | &Method::OPTIONS) {
+        return next.run(request).await;
+    }
+
+    let peer = request
+        .extensions()
+        .get::<ConnectInfo<SocketAddr>>()
+        .map(|ConnectInfo(addr)| *addr);
+    let ip = remote_ip(request.headers(), peer);
+    let Err(wait) = limiter.acquire(&ip) else {
+        return next.run(request).await;
+    };
+
+    tracing::warn!(
+        "[limit] {} - {} {} - upload rate limit",
+        ip,
+        request.method(),
+        request.uri().path()
+    );
+    let mut response =
+        AppError::TooManyRequests("Too many uploads, try again later".to_string()).into_response();
+    // Whole seconds, rounded up so a client that waits as told finds a token.
+    let retry_after = wait.as_secs() + u64::from(wait.subsec_nanos() > 0);
+    response
+        .headers_mut()
+        .insert(header::RETRY_AFTER, HeaderValue::from(retry_after.max(1)));
+    response
+}
+
+/// Counts in-flight requests per client address for `max_conns_per_ip`.
+#[derive(Clone)]
+pub(crate) struct ConnectionLimiter {
+    max_per_ip: usize,
+    active: Arc<Mutex<HashMap<String, usize>>>,
+}
+
+impl ConnectionLimiter {
+    pub(crate) fn new(max_per_ip: usize) -> Self {
+        Self {
+            max_per_ip,
+            active: Arc::new(Mutex::new(HashMap::new())),
+        }
+    }
+
+    fn acquire(&self, ip: &str) -> Option<ConnectionSlot> {
+        let mut active = self.active.lock().unwrap_or_else(|err| err.into_inner());
+        let count = active.entry(ip.to_string()).or_insert(0);
+        if *count >= self.max_per_ip {
+            return None;
+        }
+        *count += 1;
+        Some(ConnectionSlot {
+            ip: ip.to_string(),
+            active: self.active.clone(),
+        })
+    }
+}
+
+struct ConnectionSlot {
+    ip: String,
+    active: Arc<Mutex<HashMap<String, usize>>>,
+}
+
+impl Drop for ConnectionSlot {
+    fn drop(&mut self) {
+        let mut active = self.active.lock().unwrap_or_else(|err| err.into_inner());
+        if let Some(count) = active.get_mut(&self.ip) {
+            *count = count.saturating_sub(1);
+            if *count == 0 {
+                active.remove(&self.ip);
+            }
+        }
+    }
+}
+
+/// Rejects a request with 429 when its client already has `max_conns_per_ip` requests in
+/// flight. A limit of 0 disables the check.
+pub(crate) async fn limit_connections_per_ip(
+    State(limiter): State<ConnectionLimiter>,
+    request: Request,
+    next: Next,
+) -> Response {
+    if limiter.max_per_ip == 0 {
+        return next.run(request).await;
+    }
+
+    let peer = request
+        .extensions()
+        .get::<ConnectInfo<SocketAddr>>()
+        .map(|ConnectInfo(addr)| *addr);
+    let ip = remote_ip(request.headers(), peer);
+    let Some(slot) = limiter.acquire(&ip) else {
+        tracing::warn!(
+            "[limit] {} - {} {} - too many concurrent requests",
+            ip,
+            request.method(),
+            request.uri().path()
+        );
+        return AppError::TooManyRequests(
+            "Too many concurrent requests from this address".to_string(),
+        )
+        .into_response();
+    };
+
+    // Downloads keep streaming after the handler returns, so the slot is released only once
+    // the response body is finished or dropped.
+    hold_until_sent(next.run(request).await, slot)
+}
+
+/// Response body that keeps `_guard` alive until it has been sent or dropped. Length and
+/// end-of-stream are passed through, so `Content-Length` is kept rather than the response
+/// turning chunked.
+struct GuardedBody<G> {
+    inner: Body,
+    _guard: G,
+}
+
+impl<G: Unpin> HttpBody for GuardedBody<G> {
+    type Data = Bytes;
+    type Error = axum::Error;
+
+    fn poll_frame(
+        self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+    ) -> Poll<Option<Result<Frame<Bytes>, axum::Error>>> {
+        Pin::new(&mut self.get_mut().inner).poll_frame(cx)
+    }
+
+    fn is_end_stream(&self) -> bool {
+        self.inner.is_end_stream()
+    }
+
+    fn size_hint(&self) -> SizeHint {
+        self.inner.size_hint()
+    }
+}
+
+fn hold_until_sent<G: Send + Unpin + 'static>(response: Response, guard: G) -> Response {
+    response.map(|inner| {
+        Body::new(GuardedBody {
+            inner,
+            _guard: guard,
+        })
+    })
+}
+
+/// Seconds a client is told to wait when [`limit_connections`] turns it away.
+const BUSY_RETRY_AFTER_SECS: u64 = 5;
+
+/// Permits for `max_connections`, shared by every client.
+#[derive(Clone)]
+pub(crate) struct GlobalLimiter {
+    permits: Option<Arc<Semaphore>>,
+}
+
+impl GlobalLimiter {
+    pub(crate) fn new(max_connections: usize) -> Self {
+        Self {
+            permits: (max_connections > 0).then(|| Arc::new(Semaphore::new(max_connections))),
+        }
+    }
+}
+
+/// Answers 503 with `Retry-After` while `max_connections` requests are already being
+/// served. Like [`limit_connections_per_ip`], a download holds its permit until the body
+/// has finished streaming. The health check is routed outside this layer.
+pub(crate) async fn limit_connections(
+    State(limiter): State<GlobalLimiter>,
+    request: Request,
+    next: Next,
+) -> Response {
+    let Some(permits) = &limiter.permits else {
+        return next.run(request).await;
+    };
+    let Ok(permit) = permits.clone().try_acquire_owned() else {
+        tracing::warn!(
+            "[limit] {} - {} {} - server busy",
+            client_ip(request.headers()),
+            request.method(),
+            request.uri().path()
+        );
+        return server_busy(wants_json(request.headers()));
+    };
+
+    hold_until_sent(next.run(request).await, permit)
+}
+
+/// Built here rather than from an `AppError` because this layer sits outside
+/// [`json_errors`].
+fn server_busy(json: bool) -> Response {
+    let message = "Server busy, please try again shortly";
+    let (content_type, body) = if json {
+        let payload = serde_json::json!({
+            "status": "error",
+            "code": error_codes::SERVER_BUSY,
+            "message": message,
+            "powered_by": POWERED_BY,
+        });
+        (
+            "application/json; charset=utf-8",
+            serde_json::to_string_pretty(&payload).unwrap(),
+        )
+    } else {
+        ("text/plain; charset=utf-8", message.to_string())
+    };
+    Response::builder()
+        .status(StatusCode::SERVICE_UNAVAILABLE)
+        .header(header::CONTENT_TYPE, content_type)
+        .header(error_codes::HEADER, error_codes::SERVER_BUSY)
+        .header(header::RETRY_AFTER, BUSY_RETRY_AFTER_SECS.to_string())
+        .body(Body::from(body))
+        .unwrap()
+}
+
+/// `canonical_host` from the config, for [`redirect_to_canonical_host`].
+#[derive(Clone)]
+pub(crate) struct CanonicalHost {
+    host: Option<Arc<str>>,
+    exempt_loopback: bool,
+}
+
+impl CanonicalHost {
+    pub(crate) fn from_config(config: &Config) -> Self {
+        Self {
+            host: config.canonical_host.as_deref().map(Arc::from),
+            exempt_loopback: config.canonical_host_exempt_loopback,
+        }
+    }
+
+    /// Whether a request addressed to `authority` is already on the canonical host. Without
+    /// a port in `canonical_host` any port matches.
+    fn matches(canonical: &str, authority: &str) -> bool {
+        if authority.eq_ignore_ascii_case(canonical) {
+            return true;
+        }
+        if canonical.ends_with(']') || !canonical.contains(':') {
+            return strip_port(authority).eq_ignore_ascii_case(canonical);
+        }
+        false
+    }
+
+    fn is_loopback(authority: &str) -> bool {
+        let host = strip_port(authority);
+        let host = host.trim_start_matches('[').trim_end_matches(']');
+        host.eq_ignore_ascii_case("localhost")
+            || host
+                .parse::<std::net::IpAddr>()
+                .is_ok_and(|ip| ip.is_loopback())
+    }
+}
+
+fn strip_port(authority: &str) -> &str {
+    match authority.rsplit_once(':') {
+        Some((host, port)) if !host.is_empty() && port.bytes().all(|b| b.is_ascii_digit()) => {
+            // A bare IPv6 address has colons of its own; only `[::1]:port` carries a port.
+            if host.contains(':') && !host.ends_with(']') {
+                authority
+            } else {
+                host
+            }
+        }
+        _ => authority,
+    }
+}
+
+/// Redirects requests whose `Host` is not `canonical_host` to the same path and query on
+/// it: 301 for GET and HEAD, 308 otherwise so the method and body survive.
+pub(crate) async fn redirect_to_canonical_host(
+    State(canonical): State<CanonicalHost>,
+    request: Request,
+    next: Next,
+) -> Response {
+    let Some(host) = canonical.host.as_deref() else {
+        return next.run(request).await;
+    };
+    let authority = request
+        .headers()
+        .get(header::HOST)
+        .and_then(|value| value.to_str().ok())
+        .or_else(|| {
+            request
+                .uri()
+                .authority()
+                .map(|authority| authority.as_str())
+        })
+        .unwrap_or_default()
+        .trim();
+    if CanonicalHost::matches(host, authority)
+        || (canonical.exempt_loopback && CanonicalHost::is_loopback(authority))
+    {
+        return next.run(request).await;
+    }
+
+    let path_and_query = request
+        .uri()
+        .path_and_query()
+        .map(|value| value.as_str())
+        .unwrap_or("/");
+    let location = format!(
+        "{}://{}{}",
+        request_scheme(request.headers()),
+        host,
+        path_and_query
+    );
+    let Ok(location) = HeaderValue::from_str(&location) else {
+        return next.run(request).await;
+    };
+    let status = if matches!(request.method().as_str(), "GET" | "HEAD") {
+        StatusCode::MOVED_PERMANENTLY
+    } else {
+        StatusCode::PERMANENT_REDIRECT
+    };
+    Response::builder()
+        .status(status)
+        .header(header::LOCATION, location)
+        .body(Body::empty())
+        .unwrap()
+}
+
+/// Runs outside the compression layer. Any response whose body may depend on
+/// `Accept-Encoding` carries `Vary: Accept-Encoding` (the compressor only adds it when it
+/// actually encodes), and an encoded body gets its own ETag so caches never hand a gzip
+/// variant to a client that asked for identity.
+pub(crate) async fn vary_by_encoding(request: Request, next: Next) -> Response {
+    let mut response = next.run(request).await;
+    let headers = response.headers_mut();
+
+    let encoding = headers
+        .get(header::CONTENT_ENCODING)
+        .and_then(|value| value.to_str().ok())
+        .map(|value| value.trim().to_ascii_lowercase())
+        .filter(|value| !value.is_empty() && value != "identity");
+    if encoding.is_none() && !is_compressible(headers) {
+        return response;
+    }
+
+    let has_vary = headers
+        .get_all(header::VARY)
+        .iter()
+        .filter_map(|value| value.to_str().ok())
+        .flat_map(|value| value.split(','))
+        .map(str::trim)
+        .any(|value| value == "*" || value.eq_ignore_ascii_case("accept-encoding"));
+    if !has_vary {
+        headers.append(header::VARY, HeaderValue::from_static("accept-encoding"));
+    }
+
+    if let Some(encoding) = encoding {
+        let tagged = headers
+            .get(header::ETAG)
+            .and_then(|value| value.to_str().ok())
+            .and_then(|etag| encoding_etag(etag, &encoding))
+            .and_then(|etag| HeaderValue::from_str(&etag).ok());
+        if let Some(value) = tagged {
+            headers.insert(header::ETAG, value);
+        }
+    }
+
+    response
+}
+
+/// `"abc"` -> `"abc-gzip"`, keeping a weak `W/` prefix. Returns `None` for malformed tags
+/// or tags already suffixed with this encoding.
+fn encoding_etag(etag: &str, encoding: &str) -> Option<String> {
+    let (weak, opaque) = match etag.strip_prefix("W/") {
+        Some(rest) => ("W/", rest),
+        None => ("", etag),
+    };
+    let inner = opaque.strip_prefix('"')?.strip_suffix('"')?;
+    let suffix = format!("-{encoding}");
+    if inner.ends_with(&suffix) {
+        return None;
+    }
+    Some(format!("{weak}\"{inner}{suffix}\""))
+}
+
+/// Maintenance switch: forced on by config, or toggled at runtime by creating/removing the
+/// sentinel file, so no restart or reload is needed.
+#[derive(Clone)]
+pub(crate) struct Maintenance {
+    forced: bool,
+    sentinel: Option<PathBuf>,
+    retry_after_secs: u64,
+}
+
+impl Maintenance {
+    pub(crate) fn new(forced: bool, sentinel: Option<PathBuf>, retry_after_secs: u64) -> Self {
+        Self {
+            forced,
+            sentinel,
+            retry_after_secs,
+        }
+    }
+
+    pub(crate) async fn active(&self) -> bool {
+        if self.forced {
+            return true;
+        }
+        match &self.sentinel {
+            Some(path) => tokio::fs::try_exists(path).await.unwrap_or(false),
+            None => false,
+        }
+    }
+}
+
+/// Answers every request with 503 while maintenance is active. The health check is routed
+/// outside this layer and reports the state itself.
+pub(crate) async fn maintenance_gate(
+    State(maintenance): State<Maintenance>,
+    request: Request,
+    next: Next,
+) -> Response {
+    if !maintenance.active().await {
+        return next.run(request).await;
+    }
+
+    let message = "Down for maintenance, please try again shortly";
+    let (content_type, body) = if wants_json(request.headers()) {
+        let payload = serde_json::json!({
+            "status": "maintenance",
+            "code": error_codes::MAINTENANCE,
+            "message": message,
+            "retry_after": maintenance.retry_after_secs,
+            "powered_by": POWERED_BY,
+        });
+        (
+            "application/json; charset=utf-8",
+            serde_json::to_string_pretty(&payload).unwrap(),
+        )
+    } else {
+        (
+            "text/html; charset=utf-8",
+            format!(
+                "<!DOCTYPE html><html><head><meta charset=\"utf-8\"><title>Maintenance</title>\
+</head><body><h1>Maintenance</h1><p>{message}.</p></body></html>"
+            ),
+        )
+    };
+
+    Response::builder()
+        .status(StatusCode::SERVICE_UNAVAILABLE)
+        .header(header::CONTENT_TYPE, content_type)
+        .header(error_codes::HEADER, error_codes::MAINTENANCE)
+        .header(
+            header::RETRY_AFTER,
+            maintenance.retry_after_secs.to_string(),
+        )
+        .body(Body::from(body))
+        .unwrap()
+}
+
+/// `basic_auth_user`/`basic_auth_pass` from the config, for [`require_basic_auth`].
+#[derive(Clone)]
+pub(crate) struct BasicAuth {
+    credentials: Option<Arc<BasicCredentials>>,
+    upload_token: Option<[u8; 32]>,
+}
+
+struct BasicCredentials {
+    user: [u8; 32],
+    password: StoredPassword,
+    /// Digests of `user:password` pairs that passed a bcrypt check, so browsers, which
+    /// send the header with every request, pay for the hash once.
+    verified: Mutex<HashSet<[u8; 32]>>,
+}
+
+enum StoredPassword {
+    Plain([u8; 32]),
+    Bcrypt(Arc<str>),
+}
+
+impl BasicAuth {
+    pub(crate) fn from_config(config: &Config) -> Self {
+        let credentials = config.basic_auth().ok().flatten().map(|(user, pass)| {
+            let password = if ["$2a$", "$2b$", "$2x$", "$2y$"]
+                .iter()
+                .any(|prefix| pass.starts_with(prefix))
+            {
+                StoredPassword::Bcrypt(Arc::from(pass))
+            } else {
+                StoredPassword::Plain(sha256(pass.as_bytes()))
+            };
+            Arc::new(BasicCredentials {
+                user: sha256(user.as_bytes()),
+                password,
+                verified: Mutex::new(HashSet::new()),
+            })
+        });
+        Self {
+            credentials,
+            upload_token: (!config.upload_token.is_empty())
+                .then(|| sha256(config.upload_token.as_bytes())),
+        }
+    }
+
+    /// Whether the request carries the upload token, which already grants more than
+    /// browsing does.
+    fn has_upload_token(&self, headers: &HeaderMap) -> bool {
+        match (&self.upload_token, auth_token(headers)) {
+            (Some(expected), Some(token)) => digests_equal(expected, &sha256(token.as_bytes())),
+            _ => false,
+        }
+    }
+
+    async fn accepts(&self, credentials: &BasicCredentials, headers: &HeaderMap) -> bool {
+        let Some((user, pass)) = basic_credentials(headers) else {
+            return false;
+        };
+        let user_matches = digests_equal(&credentials.user, &sha256(user.as_bytes()));
+        match &credentials.password {
+            StoredPassword::Plain(expected) => {
+                let pass_matches = digests_equal(expected, &sha256(pass.as_bytes()));
+                user_matches & pass_matches
+            }
+            StoredPassword::Bcrypt(hash) => {
+                let key = sha256(format!("{user}:{pass}").as_bytes());
+                if credentials.verified.lock().unwrap().contains(&key) {
+                    return true;
+                }
+                let hash = Arc::clone(hash);
+                let pass_matches = tokio::task::spawn_blocking(move || bcrypt::verify(pass, &hash))
+                    .await
+                    .is_ok_and(|verified| verified.unwrap_or(false));
+                if !(user_matches & pass_matches) {
+                    return false;
+                }
+                let mut verified = credentials.verified.lock().unwrap();
+                if verified.len() >= MAX_VERIFIED_CREDENTIALS {
+                    verified.clear();
+                }
+                verified.insert(key);
+                true
+            }
+        }
+    }
+}
+
+/// User and password of an `Authorization: Basic` header.
+fn basic_credentials(headers: &HeaderMap) -> Option<(String, String)> {
+    let value = headers.get(header::AUTHORIZATION)?.to_str().ok()?;
+    let (scheme, encoded) = value.trim().split_once(' ')?;
+    if !scheme.eq_ignore_ascii_case("basic") {
+        return None;
+    }
+    let decoded = String::from_utf8(BASE64.decode(encoded.trim()).ok()?).ok()?;
+    let (user, pass) = decoded.split_once(':')?;
+    Some((user.to_string(), pass.to_string()))
+}
+
+fn sha256(bytes: &[u8]) -> [u8; 32] {
+    Sha256::digest(bytes).into()
+}
+
+/// Compares every byte whatever the first difference, so the time taken says nothing
+/// about how much of a guess was right.
+fn digests_equal(a: &[u8; 32], b: &[u8; 32]) -> bool {
+    a.iter().zip(b).fold(0, |diff, (x, y)| diff | (x ^ y)) == 0
+}
+
+/// Asks for Basic credentials before anything is browsed or downloaded. `OPTIONS` stays
+/// open so clients can probe the server, requests with the upload token pass, and the
+/// health probe is routed outside this layer.
+pub(crate) async fn require_basic_auth(
+    State(auth): State<BasicAuth>,
+    request: Request,
+    next: Next,
+) -> Response {
+    let Some(credentials) = auth.credentials.as_deref() else {
+        return next.run(request).await;
+    };
+    if request.method() == axum::http::Method::OPTIONS
+        || auth.has_upload_token(request.headers())
+        || auth.accepts(credentials, request.headers()).await
+    {
+        return next.run(request).await;
+    }
+
+    let mut response =
+        AppError::Unauthorized("Authentication required".to_string()).into_response();
+    response.headers_mut().insert(
+        header::WWW_AUTHENTICATE,
+        HeaderValue::from_static(BASIC_AUTH_CHALLENGE),
+    );
+    response
+}
+
+/// Custom 404 page, read on every use so it can be dropped in or edited without a restart.
+#[derive(Clone)]
+pub(crate) struct NotFoundPage {
+    path: PathBuf,
+    /// `file_csp`, since the page is a file from the served tree like any other.
+    csp: Option<HeaderValue>,
+}
+
+impl NotFoundPage {
+    /// `configured` is relative to the root unless absolute; without it the page is
+    /// `404.html` in the root.
+    pub(crate) fn new(root: &Path, configured: Option<&Path>, file_csp: &str) -> Self {
+        Self {
+            path: root.join(configured.unwrap_or(Path::new(DEFAULT_NOT_FOUND_PAGE))),
+            csp: (!file_csp.is_empty())
+                .then(|| HeaderValue::from_str(file_csp).ok())
+                .flatten(),
+        }
+    }
+
+    async fn load(&self) -> Option<Vec<u8>> {
+        let metadata = tokio::fs::metadata(&self.path).await.ok()?;
+        if !metadata.is_file() || metadata.len() > MAX_NOT_FOUND_PAGE_BYTES {
+            return None;
+        }
+        tokio::fs::read(&self.path).await.ok()
+    }
+}
+
+/// Replaces the body of `AppError` 404s with the custom page for browsers. API clients
+/// keep the plain-text or JSON error, and so does everyone when the page is missing. The
+/// page is sent as is, so it never shows which path was asked for.
+pub(crate) async fn not_found_page(
+    State(page): State<NotFoundPage>,
+    request: Request,
+    next: Next,
+) -> Response {
+    let json = wants_json(request.headers());
+    let response = next.run(request).await;
+    if json
+        || response.status() != StatusCode::NOT_FOUND
+        || response.extensions().get::<ErrorCode>().is_none()
+    {
+        return response;
+    }
+    let Some(html) = page.load().await else {
+        return response;
+    };
+
+    let (mut parts, _) = response.into_parts();
+    parts.headers.insert(
+        header::CONTENT_TYPE,
+        HeaderValue::from_static("text/html; charset=utf-8"),
+    );
+    parts.headers.remove(header::CONTENT_LENGTH);
+    if let Some(csp) = page.csp {
+        parts.headers.insert(header::CONTENT_SECURITY_POLICY, csp);
+    }
+    Response::from_parts(parts, Body::from(html))
+}
+
+/// Error messages are plain text by default; for API clients (see [`wants_json`]) this
+/// rewrites `AppError` responses as `{"status": "error", "code", "message"}`. Must sit
+/// inside the compression layer so it sees the body unencoded.
+pub(crate) async fn json_errors(request: Request, next: Next) -> Response {
+    let json = wants_json(request.headers());
+    let response = next.run(request).await;
+    if !json {
+        return response;
+    }
+    let Some(ErrorCode(code)) = response.extensions().get::<ErrorCode>().copied() else {
+        return response;
+    };
+
+    let (mut parts, body) = response.into_parts();
+    let message = axum::body::to_bytes(body, MAX_ERROR_MESSAGE_BYTES)
+        .await
+        .map(|bytes| String::from_utf8_lossy(&bytes).trim().to_string())
+        .unwrap_or_default();
+    let payload = serde_json::json!({
+        "status": "error",
+        "code": code,
+        "message": message,
+        "powered_by": POWERED_BY,
+    });
+    parts.headers.insert(
+        header::CONTENT_TYPE,
+        HeaderValue::from_static("application/json; charset=utf-8"),
+    );
+    parts.headers.remove(header::CONTENT_LENGTH);
+    Response::from_parts(
+        parts,
+        Body::from(serde_json::to_string_pretty(&payload).unwrap()),
+    )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use axum::Router;
+    use axum::middleware::{from_fn, from_fn_with_state};
+    use axum::routing::get;
+    use tower::ServiceExt;
+
+    use crate::test_support::TempDir;
+
+    #[tokio::test]
+    async fn not_found_page_carries_the_file_csp() {
+        let dir = TempDir::new();
+        std::fs::write(dir.path().join("404.html"), "<p>missing</p>").unwrap();
+        let app = Router::new()
+            .route(
+                "/",
+                get(|| async { AppError::NotFound("File not found".to_string()) }),
+            )
+            .layer(from_fn_with_state(
+                NotFoundPage::new(dir.path(), None, "default-src 'none'"),
+                not_found_page,
+            ));
+
+        let response = app
+            .oneshot(
+                axum::http::Request::builder()
+                    .uri("/")
+                    .body(Body::empty())
+                    .unwrap(),
+            )
+            .await
+            .unwrap();
+        assert_eq!(response.status(), StatusCode::NOT_FOUND);
+        assert_eq!(
+            response.headers()[header::CONTENT_SECURITY_POLICY],
+            "default-src 'none'"
+        );
+    }
+
+    async fn panicking_handler() -> &'static str {
+        panic!("handler failed")
+    }
+
+    #[tokio::test]
+    async fn recover_panics_answers_500() {
+        let app = Router::new()
+            .route("/", get(panicking_handler))
+            .layer(from_fn(recover_panics));
+
+        let response = app
+            .oneshot(
+                axum::http::Request::builder()
+                    .uri("/")
+                    .header(header::ACCEPT, "application/json")
+                    .header(REQUEST_ID_HEADER, "req-1")
+                    .body(Body::empty())
+                    .unwrap(),
+            )
+            .await
+            .unwrap();
+        assert_eq!(response.status(), StatusCode::INTERNAL_SERVER_ERROR);
+        assert_eq!(
+            response.headers()[error_codes::HEADER],
+            error_codes::INTERNAL
+        );
+        assert_eq!(response.headers()[REQUEST_ID_HEADER], "req-1");
+        let body = axum::body::to_bytes(response.into_body(), usize::MAX)
+            .await
+            .unwrap();
+        let payload: serde_json::Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(payload["code"], error_codes::INTERNAL);
+        assert_eq!(payload["request_id"], "req-1");
+    }
+
+    #[test]
+    fn canonical_host_matching() {
+        assert!(CanonicalHost::matches(
+            "files.example.com",
+            "FILES.example.com"
+        ));
+        assert!(CanonicalHost::matches(
+            "files.example.com",
+            "files.example.com:8443"
+        ));
+        assert!(!CanonicalHost::matches(
+            "files.example.com:8443",
+            "files.example.com:80"
+        ));
+        assert!(CanonicalHost::matches("[::1]", "[::1]:8080"));
+        assert!(!CanonicalHost::matches("files.example.com", "example.com"));
+        assert!(CanonicalHost::is_loopback("localhost:8080"));
+        assert!(CanonicalHost::is_loopback("[::1]:8080"));
+        assert!(!CanonicalHost::is_loopback("192.168.1.10"));
+    }
+
+    #[tokio::test]
+    async fn canonical_host_redirects_other_hosts() {
+        let app = Router::new()
+            .route(
+                "/docs",
+                get(|| async { "docs" }).post(|| async { "posted" }),
+            )
+            .layer(from_fn_with_state(
+                CanonicalHost {
+                    host: Some(Arc::from("files.example.com")),
+                    exempt_loopback: true,
+                },
+                redirect_to_canonical_host,
+            ));
+        let send = |method: Method, host: &'static str| {
+            app.clone().oneshot(
+                axum::http::Request::builder()
+                    .method(method)
+                    .uri("/docs?page=2")
+                    .header(header::HOST, host)
+                    .header("X-Forwarded-Proto", "https")
+                    .body(Body::empty())
+                    .unwrap(),
+            )
+        };
+
+        let response = send(Method::GET, "files.example.com:8080").await.unwrap();
+        assert_eq!(response.status(), StatusCode::OK);
+        let response = send(Method::GET, "localhost:8080").await.unwrap();
+        assert_eq!(response.status(), StatusCode::OK);
+
+        let response = send(Method::GET, "old.example.com").await.unwrap();
+        assert_eq!(response.status(), StatusCode::MOVED_PERMANENTLY);
+        assert_eq!(
+            response.headers()[header::LOCATION],
+            "https://files.example.com/docs?page=2"
+        );
+        let response = send(Method::POST, "old.example.com").await.unwrap();
+        assert_eq!(response.status(), StatusCode::PERMANENT_REDIRECT);
+    }
+
+    fn request_from(ip: &str) -> axum::http::Request<Body> {
+        axum::http::Request::builder()
+            .uri("/")
+            .header("X-Forwarded-For", ip)
+            .body(Body::empty())
+            .unwrap()
+    }
+
+    #[tokio::test]
+    async fn per_ip_limit_holds_slots_until_the_body_is_done() {
+        let limiter = ConnectionLimiter::new(2);
+        let app = Router::new()
+            .route("/", get(|| async { "hello" }))
+            .layer(from_fn_with_state(
+                limiter.clone(),
+                limit_connections_per_ip,
+            ));
+
+        let first = app.clone().oneshot(request_from("10.0.0.1")).await.unwrap();
+        let second = app.clone().oneshot(request_from("10.0.0.1")).await.unwrap();
+        assert_eq!(first.status(), StatusCode::OK);
+        assert_eq!(second.status(), StatusCode::OK);
+        // Holding the slot must not turn a sized body into a chunked one.
+        assert_eq!(first.body().size_hint().exact(), Some(5));
+
+        let third = app.clone().oneshot(request_from("10.0.0.1")).await.unwrap();
+        assert_eq!(third.status(), StatusCode::TOO_MANY_REQUESTS);
+        let other = app.clone().oneshot(request_from("10.0.0.2")).await.unwrap();
+        assert_eq!(other.status(), StatusCode::OK);
+
+        let body = axum::body::to_bytes(first.into_body(), usize::MAX)
+            .await
+            .unwrap();
+        assert_eq!(&body[..], b"hello");
+        let retry = app.clone().oneshot(request_from("10.0.0.1")).await.unwrap();
+        assert_eq!(retry.status(), StatusCode::OK);
+
+        drop((second, other, retry));
+        assert!(limiter.active.lock().unwrap().is_empty());
+    }
+
+    #[tokio::test]
+    async fn global_limit_answers_busy_while_permits_are_held() {
+        let app = Router::new()
+            .route("/", get(|| async { "hello" }))
+            .layer(from_fn_with_state(GlobalLimiter::new(1), limit_connections));
+
+        let first = app.clone().oneshot(request_from("10.0.0.1")).await.unwrap();
+        assert_eq!(first.body().size_hint().exact(), Some(5));
+        let busy = app.clone().oneshot(request_from("10.0.0.2")).await.unwrap();
+        assert_eq!(busy.status(), StatusCode::SERVICE_UNAVAILABLE);
+        assert_eq!(
+            busy.headers()[error_codes::HEADER],
+            error_codes::SERVER_BUSY
+        );
+        assert!(busy.headers().contains_key(header::RETRY_AFTER));
+
+        drop(first);
+        let next = app.clone().oneshot(request_from("10.0.0.2")).await.unwrap();
+        assert_eq!(next.status(), StatusCode::OK);
+    }
+
+    #[tokio::test]
+    async fn maintenance_follows_the_sentinel_file() {
+        let dir = TempDir::new();
+        let sentinel = dir.path().join("maintenance");
+        let app = Router::new()
+            .route("/", get(|| async { "hello" }))
+            .layer(from_fn_with_state(
+                Maintenance::new(false, Some(sentinel.clone()), 120),
+                maintenance_gate,
+            ));
+
+        let response = app.clone().oneshot(request_from("10.0.0.1")).await.unwrap();
+        assert_eq!(response.status(), StatusCode::OK);
+
+        std::fs::write(&sentinel, "").unwrap();
+        let response = app.clone().oneshot(request_from("10.0.0.1")).await.unwrap();
+        assert_eq!(response.status(), StatusCode::SERVICE_UNAVAILABLE);
+        assert_eq!(response.headers()[header::RETRY_AFTER], "120");
+        assert_eq!(
+            response.headers()[error_codes::HEADER],
+            error_codes::MAINTENANCE
+        );
+
+        std::fs::remove_file(&sentinel).unwrap();
+        let response = app.oneshot(request_from("10.0.0.1")).await.unwrap();
+        assert_eq!(response.status(), StatusCode::OK);
+    }
+}
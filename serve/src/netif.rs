@@ -0,0 +1,183 @@
+//! Resolves a network interface name (e.g. `tailscale0`) to the address it currently has,
+//! so the server can bind to overlay/VPN networks whose IP is assigned dynamically.
+
+use std::fmt;
+use std::net::IpAddr;
+use std::time::Duration;
+
+/// An interface that exists but has no address yet (VPN still connecting) is polled this
+/// many times, one second apart, before giving up.
+const RESOLVE_ATTEMPTS: u32 = 10;
+
+#[derive(Debug)]
+pub enum InterfaceError {
+    NotFound(String),
+    NoAddress(String),
+    Unsupported,
+    Io(std::io::Error),
+}
+
+impl fmt::Display for InterfaceError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            InterfaceError::NotFound(name) => write!(f, "No network interface named `{name}`"),
+            InterfaceError::NoAddress(name) => write!(
+                f,
+                "Interface `{name}` has no usable IPv4 or global IPv6 address"
+            ),
+            InterfaceError::Unsupported => write!(
+                f,
+                "Binding by interface name is only supported on Unix platforms"
+            ),
+            InterfaceError::Io(err) => write!(f, "Failed to list network interfaces: {err}"),
+        }
+    }
+}
+
+impl std::error::Error for InterfaceError {}
+
+/// Address to bind for `name`: its first IPv4 address, else its first IPv6 address that is
+/// not link-local (those need a scope id to bind). Waits for an address to appear.
+pub async fn resolve_interface_ip(name: &str) -> Result<IpAddr, InterfaceError> {
+    let mut attempt = 1;
+    loop {
+        let addresses = interface_addresses(name)?;
+        if let Some(address) = preferred_address(&addresses) {
+            return Ok(address);
+        }
+        if attempt >= RESOLVE_ATTEMPTS {
+            return Err(InterfaceError::NoAddress(name.to_string()));
+        }
+        tracing::info!(
+            "Interface {} has no address yet; retrying ({}/{})",
+            name,
+            attempt,
+            RESOLVE_ATTEMPTS
+        );
+        attempt += 1;
+        tokio::time::sleep(Duration::from_secs(1)).await;
+    }
+}
+
+fn preferred_address(addresses: &[IpAddr]) -> Option<IpAddr> {
+    addresses
+        .iter()
+        .find(|address| address.is_ipv4())
+        .or_else(|| {
+            addresses.iter().find(|address| match address {
+                IpAddr::V6(v6) => !v6.is_loopback() && (v6.segments()[0] & 0xffc0) != 0xfe80,
+                IpAddr::V4(_) => false,
+            })
+        })
+        .copied()
+}
+
+/// Every non-loopback address on the machine, e.g. for the names a self-signed certificate
+/// should cover.
+pub fn local_addresses() -> Result<Vec<IpAddr>, InterfaceError> {
+    let mut addresses = Vec::new();
+    for_each_address(|_, address| {
+        if let Some(address) = address.filter(|address| !address.is_loopback()) {
+            addresses.push(address);
+        }
+    })?;
+    Ok(addresses)
+}
+
+fn interface_addresses(name: &str) -> Result<Vec<IpAddr>, InterfaceError> {
+    let mut found = false;
+    let mut addresses = Vec::new();
+    for_each_address(|entry_name, address| {
+        if entry_name != name.as_bytes() {
+            return;
+        }
+        found = true;
+        addresses.extend(address);
+    })?;
+
+    if !found {
+        return Err(InterfaceError::NotFound(name.to_string()));
+    }
+    Ok(addresses)
+}
+
+/// Calls `visit` with every interface entry's name and its IP address, if it has one.
+#[cfg(unix)]
+fn for_each_address(mut visit: impl FnMut(&[u8], Option<IpAddr>)) -> Result<(), InterfaceError> {
+    use std::ffi::CStr;
+    use std::net::{Ipv4Addr, Ipv6Addr};
+
+    let mut head: *mut libc::ifaddrs = std::ptr::null_mut();
+    if unsafe { libc::getifaddrs(&mut head) } != 0 {
+        return Err(InterfaceError::Io(std::io::Error::last_os_error()));
+    }
+
+    let mut cursor = head;
+    while !cursor.is_null() {
+        let entry = unsafe { &*cursor };
+        cursor = entry.ifa_next;
+
+        let entry_name = unsafe { CStr::from_ptr(entry.ifa_name) };
+        let address = if entry.ifa_addr.is_null() {
+            None
+        } else {
+            match i32::from(unsafe { (*entry.ifa_addr).sa_family }) {
+                libc::AF_INET => {
+                    let sockaddr = unsafe { &*(entry.ifa_addr as *const libc::sockaddr_in) };
+                    Some(IpAddr::V4(Ipv4Addr::from(u32::from_be(
+                        sockaddr.sin_addr.s_addr,
+                    ))))
+                }
+                libc::AF_INET6 => {
+                    let sockaddr = unsafe { &*(entry.ifa_addr as *const libc::sockaddr_in6) };
+                    Some(IpAddr::V6(Ipv6Addr::from(sockaddr.sin6_addr.s6_addr)))
+                }
+                _ => None,
+            }
+        };
+        visit(entry_name.to_bytes(), address);
+    }
+    unsafe { libc::freeifaddrs(head) };
+    Ok(())
+}
+
+#[cfg(not(unix))]
+fn for_each_address(_visit: impl FnMut(&[u8], Option<IpAddr>)) -> Result<(), InterfaceError> {
+    Err(InterfaceError::Unsupported)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn addresses(list: &[&str]) -> Vec<IpAddr> {
+        list.iter()
+            .map(|address| address.parse().unwrap())
+            .collect()
+    }
+
+    #[test]
+    fn prefers_ipv4_then_routable_ipv6() {
+        let preferred =
+            |list: &[&str]| preferred_address(&addresses(list)).map(|ip| ip.to_string());
+        assert_eq!(
+            preferred(&["fe80::1", "fd7a:115c::5", "100.64.0.5"]).as_deref(),
+            Some("100.64.0.5")
+        );
+        assert_eq!(
+            preferred(&["fe80::1", "fd7a:115c::5"]).as_deref(),
+            Some("fd7a:115c::5")
+        );
+        assert_eq!(preferred(&["fe80::1", "::1"]), None);
+        assert_eq!(preferred(&[]), None);
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn unknown_interface_is_an_error() {
+        assert!(matches!(
+            interface_addresses("serve-test-missing0"),
+            Err(InterfaceError::NotFound(_))
+        ));
+    }
+}
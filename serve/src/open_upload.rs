@@ -0,0 +1,145 @@
+//! Safeguards for `open_upload`, where anyone may upload without the token. Each client
+//! address gets a per-minute upload allowance and a daily byte quota on top of the usual
+//! size and extension checks; token holders are never counted. The quota is charged as
+//! bytes arrive, so neither a large file nor a request with many files can overrun it.
+
+use std::collections::HashMap;
+use std::sync::Mutex;
+use std::time::{Duration, Instant};
+
+use crate::AppError;
+use crate::error_codes;
+
+const RATE_WINDOW: Duration = Duration::from_secs(60);
+const QUOTA_WINDOW: Duration = Duration::from_secs(24 * 60 * 60);
+
+#[derive(Default)]
+struct ClientUsage {
+    /// Start of the current rate window and uploads started in it.
+    rate_started: Option<Instant>,
+    uploads: u32,
+    /// Start of the current quota window and bytes stored in it.
+    quota_started: Option<Instant>,
+    bytes: u64,
+}
+
+pub(crate) struct OpenUploadGuard {
+    rate_per_minute: u32,
+    quota_bytes: u64,
+    clients: Mutex<HashMap<String, ClientUsage>>,
+}
+
+impl OpenUploadGuard {
+    pub(crate) fn new(rate_per_minute: u32, quota_bytes: u64) -> Self {
+        Self {
+            rate_per_minute,
+            quota_bytes,
+            clients: Mutex::new(HashMap::new()),
+        }
+    }
+
+    /// Admits a token-less upload from `ip`, counting it against the rate limit. Fails with
+    /// 429 when the client is over either limit.
+    pub(crate) fn admit(&self, ip: &str) -> Result<(), AppError> {
+        let mut clients = self.clients.lock().unwrap_or_else(|err| err.into_inner());
+        clients.retain(|_, usage| {
+            usage
+                .quota_started
+                .is_some_and(|started| started.elapsed() < QUOTA_WINDOW)
+                || usage
+                    .rate_started
+                    .is_some_and(|started| started.elapsed() < RATE_WINDOW)
+        });
+
+        let now = Instant::now();
+        let usage = clients.entry(ip.to_string()).or_default();
+        if usage
+            .quota_started
+            .is_some_and(|started| started.elapsed() < QUOTA_WINDOW)
+            && usage.bytes >= self.quota_bytes
+        {
+            tracing::warn!("[limit] {} - open upload quota exhausted", ip);
+            return Err(quota_exceeded());
+        }
+
+        if !usage
+            .rate_started
+            .is_some_and(|started| started.elapsed() < RATE_WINDOW)
+        {
+            usage.rate_started = Some(now);
+            usage.uploads = 0;
+        }
+        if usage.uploads >= self.rate_per_minute {
+            tracing::warn!("[limit] {} - open upload rate limit", ip);
+            return Err(AppError::TooManyRequests(
+                "Too many uploads, try again later".to_string(),
+            ));
+        }
+        usage.uploads += 1;
+        Ok(())
+    }
+
+    /// Charges `bytes` just received to the client's daily quota, failing with 429 when
+    /// they would take it over. Bytes of an upload refused part-way stay charged, since
+    /// they were received all the same.
+    pub(crate) fn charge(&self, ip: &str, bytes: u64) -> Result<(), AppError> {
+        let mut clients = self.clients.lock().unwrap_or_else(|err| err.into_inner());
+        let usage = clients.entry(ip.to_string()).or_default();
+        if !usage
+            .quota_started
+            .is_some_and(|started| started.elapsed() < QUOTA_WINDOW)
+        {
+            usage.quota_started = Some(Instant::now());
+            usage.bytes = 0;
+        }
+        let total = usage.bytes.saturating_add(bytes);
+        if total > self.quota_bytes || (bytes == 0 && usage.bytes >= self.quota_bytes) {
+            tracing::warn!("[limit] {} - open upload quota exhausted", ip);
+            return Err(quota_exceeded());
+        }
+        usage.bytes = total;
+        Ok(())
+    }
+}
+
+fn quota_exceeded() -> AppError {
+    AppError::TooManyRequests("Upload quota exceeded for today".to_string())
+        .with_code(error_codes::UPLOAD_QUOTA_EXCEEDED)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn code(err: AppError) -> &'static str {
+        err.status_and_code().1
+    }
+
+    #[test]
+    fn rate_limit_counts_uploads_per_client() {
+        let guard = OpenUploadGuard::new(2, u64::MAX);
+        assert!(guard.admit("192.0.2.1").is_ok());
+        assert!(guard.admit("192.0.2.1").is_ok());
+        let err = guard.admit("192.0.2.1").unwrap_err();
+        assert_eq!(code(err), error_codes::TOO_MANY_REQUESTS);
+        // Another address has its own allowance.
+        assert!(guard.admit("192.0.2.2").is_ok());
+    }
+
+    #[test]
+    fn quota_is_charged_as_bytes_arrive() {
+        let guard = OpenUploadGuard::new(100, 10);
+        guard.admit("192.0.2.1").unwrap();
+        guard.charge("192.0.2.1", 6).unwrap();
+        // A second file in the same request would cross the quota part-way through.
+        let err = guard.charge("192.0.2.1", 6).unwrap_err();
+        assert_eq!(code(err), error_codes::UPLOAD_QUOTA_EXCEEDED);
+        guard.charge("192.0.2.1", 4).unwrap();
+        // Nothing is left, so the next file is refused before any of it is read.
+        let err = guard.charge("192.0.2.1", 0).unwrap_err();
+        assert_eq!(code(err), error_codes::UPLOAD_QUOTA_EXCEEDED);
+        let err = guard.admit("192.0.2.1").unwrap_err();
+        assert_eq!(code(err), error_codes::UPLOAD_QUOTA_EXCEEDED);
+        assert!(guard.charge("192.0.2.2", 10).is_ok());
+    }
+}
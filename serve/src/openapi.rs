@@ -0,0 +1,50 @@
+use axum::{
+    body::Body,
+    extract::State,
+    http::{StatusCode, header},
+    response::Response,
+};
+
+use crate::{AppError, AppState};
+
+/// OpenAPI 3 description of the HTTP API, embedded at build time. Keep it in sync with the
+/// handlers when routes, parameters or response fields change.
+const DOCUMENT: &str = include_str!("../templates/openapi.json");
+
+pub(crate) const OPENAPI_PATH: &str = "/openapi.json";
+
+/// `GET /openapi.json`. Deliberately not logged: generators and API browsers fetch it often.
+pub(crate) async fn get_openapi(State(state): State<AppState>) -> Result<Response, AppError> {
+    Response::builder()
+        .status(StatusCode::OK)
+        .header(header::CONTENT_TYPE, "application/json; charset=utf-8")
+        .body(Body::from(
+            DOCUMENT
+                .replace("{{ version }}", env!("CARGO_PKG_VERSION"))
+                .replace("{{ health_path }}", &state.config.health_path),
+        ))
+        .map_err(|err| AppError::Internal(err.to_string()))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::test_support::{TempDir, app_state};
+
+    #[tokio::test]
+    async fn document_lists_every_route() {
+        let dir = TempDir::new();
+        let state = app_state(&dir, "health_path = \"/livez\"\n").await;
+        let response = get_openapi(State(state)).await.unwrap();
+        let body = axum::body::to_bytes(response.into_body(), usize::MAX)
+            .await
+            .unwrap();
+        let document: serde_json::Value = serde_json::from_slice(&body).unwrap();
+
+        assert_eq!(document["info"]["version"], env!("CARGO_PKG_VERSION"));
+        let paths = document["paths"].as_object().unwrap();
+        for route in crate::ROUTE_PATHS.iter().chain(&["/livez"]) {
+            assert!(paths.contains_key(*route), "{route} is not documented");
+        }
+    }
+}
@@ -0,0 +1,168 @@
+//! Optional privilege dropping for deployments that bind low ports as root.
+//!
+//! The target identity is resolved at startup so a typo in `user`/`group` fails before the
+//! port is bound. The switch itself must happen after the listener exists (binding ports
+//! below 1024 needs root) and before the first request is served.
+//!
+//! The optional chroot follows the same rule: it runs after binding and before the user
+//! switch, because `chroot(2)` itself requires root.
+
+use std::fmt;
+use std::path::Path;
+
+#[derive(Debug, Clone, Copy)]
+pub struct Identity {
+    uid: u32,
+    gid: u32,
+}
+
+#[derive(Debug)]
+pub enum PrivilegeError {
+    UnknownUser(String),
+    UnknownGroup(String),
+    Unsupported,
+    Switch(String),
+    Chroot(String),
+}
+
+impl fmt::Display for PrivilegeError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            PrivilegeError::UnknownUser(name) => write!(f, "Unknown user `{name}`"),
+            PrivilegeError::UnknownGroup(name) => write!(f, "Unknown group `{name}`"),
+            PrivilegeError::Unsupported => write!(
+                f,
+                "Dropping privileges (user/group) is only supported on Unix platforms"
+            ),
+            PrivilegeError::Switch(message) => write!(f, "Failed to drop privileges: {message}"),
+            PrivilegeError::Chroot(message) => write!(f, "Failed to chroot: {message}"),
+        }
+    }
+}
+
+impl std::error::Error for PrivilegeError {}
+
+impl Identity {
+    pub fn uid(&self) -> u32 {
+        self.uid
+    }
+
+    pub fn gid(&self) -> u32 {
+        self.gid
+    }
+}
+
+/// Looks up the configured user/group. Returns `None` when neither is set.
+#[cfg(unix)]
+pub fn resolve(
+    user: Option<&str>,
+    group: Option<&str>,
+) -> Result<Option<Identity>, PrivilegeError> {
+    use std::ffi::CString;
+
+    if user.is_none() && group.is_none() {
+        return Ok(None);
+    }
+
+    let (uid, user_gid) = match user {
+        Some(name) => {
+            let c_name =
+                CString::new(name).map_err(|_| PrivilegeError::UnknownUser(name.to_string()))?;
+            // SAFETY: lookups only happen here during startup, and the returned record is
+            // copied out before the next call can overwrite it.
+            let entry = unsafe { libc::getpwnam(c_name.as_ptr()) };
+            if entry.is_null() {
+                return Err(PrivilegeError::UnknownUser(name.to_string()));
+            }
+            let entry = unsafe { &*entry };
+            (entry.pw_uid as u32, Some(entry.pw_gid as u32))
+        }
+        None => (unsafe { libc::getuid() } as u32, None),
+    };
+
+    let gid = match group {
+        Some(name) => {
+            let c_name =
+                CString::new(name).map_err(|_| PrivilegeError::UnknownGroup(name.to_string()))?;
+            // SAFETY: see getpwnam above.
+            let entry = unsafe { libc::getgrnam(c_name.as_ptr()) };
+            if entry.is_null() {
+                return Err(PrivilegeError::UnknownGroup(name.to_string()));
+            }
+            unsafe { (*entry).gr_gid as u32 }
+        }
+        None => user_gid.unwrap_or_else(|| unsafe { libc::getgid() } as u32),
+    };
+
+    Ok(Some(Identity { uid, gid }))
+}
+
+#[cfg(not(unix))]
+pub fn resolve(
+    user: Option<&str>,
+    group: Option<&str>,
+) -> Result<Option<Identity>, PrivilegeError> {
+    if user.is_none() && group.is_none() {
+        Ok(None)
+    } else {
+        Err(PrivilegeError::Unsupported)
+    }
+}
+
+/// Switches the process to `identity`. Supplementary groups are cleared first and the
+/// group is changed before the user, since a non-root user can no longer change groups.
+#[cfg(unix)]
+pub fn drop_to(identity: Identity) -> Result<(), PrivilegeError> {
+    let gid = identity.gid as libc::gid_t;
+    let uid = identity.uid as libc::uid_t;
+
+    unsafe {
+        if libc::geteuid() == 0 && libc::setgroups(1, &gid) != 0 {
+            return Err(PrivilegeError::Switch(format!(
+                "setgroups: {}",
+                std::io::Error::last_os_error()
+            )));
+        }
+        if libc::setgid(gid) != 0 {
+            return Err(PrivilegeError::Switch(format!(
+                "setgid({gid}): {}",
+                std::io::Error::last_os_error()
+            )));
+        }
+        if libc::setuid(uid) != 0 {
+            return Err(PrivilegeError::Switch(format!(
+                "setuid({uid}): {}",
+                std::io::Error::last_os_error()
+            )));
+        }
+        if uid != 0 && libc::setuid(0) == 0 {
+            return Err(PrivilegeError::Switch(
+                "root privileges could be regained after setuid".to_string(),
+            ));
+        }
+    }
+
+    Ok(())
+}
+
+#[cfg(not(unix))]
+pub fn drop_to(_identity: Identity) -> Result<(), PrivilegeError> {
+    Err(PrivilegeError::Unsupported)
+}
+
+/// Confines the process to `root` and moves the working directory to the new `/`.
+/// Returns `Ok(false)` on platforms without `chroot(2)`, where the caller keeps serving the
+/// original path.
+#[cfg(unix)]
+pub fn chroot_into(root: &Path) -> Result<bool, PrivilegeError> {
+    std::os::unix::fs::chroot(root)
+        .map_err(|err| PrivilegeError::Chroot(format!("{}: {err}", root.display())))?;
+    std::env::set_current_dir("/")
+        .map_err(|err| PrivilegeError::Chroot(format!("chdir(/): {err}")))?;
+    Ok(true)
+}
+
+#[cfg(not(unix))]
+pub fn chroot_into(_root: &Path) -> Result<bool, PrivilegeError> {
+    Ok(false)
+}
@@ -0,0 +1,77 @@
+//! Per-client token buckets for the endpoints that write to the tree (`upload_rate_limit`
+//! and `upload_burst`). Each address starts with a full bucket of `burst` tokens, spends
+//! one per request and earns them back at the configured rate per minute.
+
+use std::collections::HashMap;
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
+
+/// How often idle buckets are swept out of the map.
+const SWEEP_INTERVAL: Duration = Duration::from_secs(60);
+
+struct Bucket {
+    tokens: f64,
+    updated: Instant,
+}
+
+struct Buckets {
+    clients: HashMap<String, Bucket>,
+    swept: Instant,
+}
+
+#[derive(Clone)]
+pub(crate) struct RateLimiter {
+    /// Tokens earned per second; 0 disables the limiter.
+    per_second: f64,
+    burst: f64,
+    buckets: Arc<Mutex<Buckets>>,
+}
+
+impl RateLimiter {
+    /// `per_minute` of 0 disables limiting; a `burst` of 0 allows one minute's worth.
+    pub(crate) fn new(per_minute: u32, burst: u32) -> Self {
+        let burst = if burst == 0 { per_minute } else { burst };
+        Self {
+            per_second: f64::from(per_minute) / 60.0,
+            burst: f64::from(burst.max(1)),
+            buckets: Arc::new(Mutex::new(Buckets {
+                clients: HashMap::new(),
+                swept: Instant::now(),
+            })),
+        }
+    }
+
+    pub(crate) fn enabled(&self) -> bool {
+        self.per_second > 0.0
+    }
+
+    /// Spends a token for `ip`, or says how long until the next one is earned.
+    pub(crate) fn acquire(&self, ip: &str) -> Result<(), Duration> {
+        let now = Instant::now();
+        let mut buckets = self.buckets.lock().unwrap_or_else(|err| err.into_inner());
+        if now.duration_since(buckets.swept) >= SWEEP_INTERVAL {
+            // A bucket that would have refilled by now holds nothing worth keeping.
+            let (per_second, burst) = (self.per_second, self.burst);
+            buckets.clients.retain(|_, bucket| {
+                bucket.tokens + now.duration_since(bucket.updated).as_secs_f64() * per_second
+                    < burst
+            });
+            buckets.swept = now;
+        }
+
+        let bucket = buckets.clients.entry(ip.to_string()).or_insert(Bucket {
+            tokens: self.burst,
+            updated: now,
+        });
+        let earned = now.duration_since(bucket.updated).as_secs_f64() * self.per_second;
+        bucket.tokens = (bucket.tokens + earned).min(self.burst);
+        bucket.updated = now;
+        if bucket.tokens >= 1.0 {
+            bucket.tokens -= 1.0;
+            return Ok(());
+        }
+        Err(Duration::from_secs_f64(
+            (1.0 - bucket.tokens) / self.per_second,
+        ))
+    }
+}
@@ -0,0 +1,193 @@
+//! Recursive name search (`GET /search?q=`) across the whole tree, for finding a file
+//! without descending directory by directory. The walk never follows symlinks, skips
+//! blacklisted entries at every level and stops at the result limit or a visit budget.
+
+use std::collections::HashSet;
+use std::ops::ControlFlow;
+use std::path::Path;
+use std::time::SystemTime;
+
+use axum::extract::{Query, State};
+use axum::http::HeaderMap;
+use chrono::{DateTime, Local};
+use serde::Deserialize;
+use tokio_util::sync::CancellationToken;
+
+use crate::browse::{JsonUtf8, listing_disabled};
+use crate::catalog::EntryInfo;
+use crate::http_utils::{client_ip, client_user_agent};
+use crate::utils::{
+    format_modified_time, format_size, mime_type_for, parent_relative_path, unix_timestamp,
+};
+use crate::walk::{SymlinkPolicy, WalkOptions, walk_within};
+use crate::{AppError, AppState, POWERED_BY};
+
+pub(crate) const SEARCH_PATH: &str = "/search";
+
+const DEFAULT_SEARCH_LIMIT: usize = 100;
+const MAX_SEARCH_LIMIT: usize = 1_000;
+/// Entries looked at before a search gives up, so one request cannot walk a huge tree.
+const MAX_SEARCH_VISITS: usize = 200_000;
+
+#[derive(Debug, Deserialize)]
+pub(crate) struct SearchQuery {
+    #[serde(default)]
+    q: String,
+    /// Comma-separated extensions (`pdf,mp3`); only files with one of them match.
+    #[serde(default)]
+    ext: Option<String>,
+    #[serde(default)]
+    limit: Option<usize>,
+}
+
+struct SearchHit {
+    relative_path: String,
+    name: String,
+    size_bytes: u64,
+    modified: SystemTime,
+}
+
+pub(crate) async fn search(
+    State(state): State<AppState>,
+    headers: HeaderMap,
+    Query(query): Query<SearchQuery>,
+) -> Result<JsonUtf8<serde_json::Value>, AppError> {
+    if state.config.disable_listing {
+        return Err(listing_disabled());
+    }
+    let term = query.q.trim().to_lowercase();
+    if term.is_empty() {
+        return Err(AppError::BadRequest("Missing q parameter".to_string()));
+    }
+    let extensions: HashSet<String> = query
+        .ext
+        .as_deref()
+        .unwrap_or_default()
+        .split(',')
+        .map(|ext| ext.trim().trim_start_matches('.').to_ascii_lowercase())
+        .filter(|ext| !ext.is_empty())
+        .collect();
+    let limit = query
+        .limit
+        .unwrap_or(DEFAULT_SEARCH_LIMIT)
+        .clamp(1, MAX_SEARCH_LIMIT);
+
+    tracing::info!(
+        "[search] {} - {} - {}",
+        client_ip(&headers),
+        query.q.trim(),
+        client_user_agent(&headers)
+    );
+
+    let (hits, truncated) = {
+        let state = state.clone();
+        let extensions = extensions.clone();
+        // Dropped with this future, so a client that goes away stops the walk too.
+        let cancel = CancellationToken::new();
+        let _cancel_on_drop = cancel.clone().drop_guard();
+        tokio::task::spawn_blocking(move || find_files(&state, &term, &extensions, limit, &cancel))
+            .await
+            .map_err(|err| AppError::Internal(err.to_string()))?
+    };
+
+    let mut results = Vec::with_capacity(hits.len());
+    for hit in hits {
+        let mime_type = mime_type_for(Path::new(&hit.name));
+        let modified_ts = unix_timestamp(hit.modified);
+        let id = state
+            .catalog
+            .sync_entry(EntryInfo::new(
+                hit.relative_path.clone(),
+                hit.name.clone(),
+                parent_relative_path(&hit.relative_path),
+                false,
+                hit.size_bytes,
+                mime_type.clone(),
+                modified_ts,
+            ))
+            .await
+            .map_err(|err| AppError::Internal(err.to_string()))?;
+        results.push(serde_json::json!({
+            "id": id,
+            "name": hit.name,
+            "path": format!("/{}", hit.relative_path),
+            "url": format!("/download?id={id}"),
+            "size": format_size(hit.size_bytes),
+            "size_bytes": hit.size_bytes,
+            "modified": format_modified_time(DateTime::<Local>::from(hit.modified)),
+            "mime_type": mime_type,
+        }));
+    }
+
+    let mut extensions: Vec<String> = extensions.into_iter().collect();
+    extensions.sort();
+    Ok(JsonUtf8(serde_json::json!({
+        "query": query.q.trim(),
+        "ext": extensions,
+        "limit": limit,
+        "count": results.len(),
+        "truncated": truncated,
+        "results": results,
+        "powered_by": POWERED_BY,
+    })))
+}
+
+/// Files under the root whose name contains `term` (already lowercased) and, when
+/// `extensions` is not empty, ends in one of them. `truncated` is set when the limit or
+/// the visit budget cut the walk short.
+fn find_files(
+    state: &AppState,
+    term: &str,
+    extensions: &HashSet<String>,
+    limit: usize,
+    cancel: &CancellationToken,
+) -> (Vec<SearchHit>, bool) {
+    let options = WalkOptions {
+        blacklist: &state.config.blacklisted_files,
+        max_depth: 0,
+        // Links are never followed, so a loop cannot keep the walk going.
+        symlinks: SymlinkPolicy::Skip,
+        cancel: Some(cancel),
+    };
+    let root = state.canonical_root.as_path();
+    let mut hits = Vec::new();
+    let mut visits = 0;
+    let mut truncated = false;
+    walk_within(root, root, &options, |walked| {
+        visits += 1;
+        if visits > MAX_SEARCH_VISITS {
+            truncated = true;
+            return ControlFlow::Break(());
+        }
+        if !walked.entry.file_type().is_file() {
+            return ControlFlow::Continue(());
+        }
+        let name = walked.entry.file_name().to_string_lossy();
+        if !name.to_lowercase().contains(term) {
+            return ControlFlow::Continue(());
+        }
+        if !extensions.is_empty() {
+            let extension = Path::new(name.as_ref())
+                .extension()
+                .map(|ext| ext.to_string_lossy().to_ascii_lowercase());
+            if !extension.is_some_and(|ext| extensions.contains(&ext)) {
+                return ControlFlow::Continue(());
+            }
+        }
+        let Ok(metadata) = walked.entry.metadata() else {
+            return ControlFlow::Continue(());
+        };
+        if hits.len() == limit {
+            truncated = true;
+            return ControlFlow::Break(());
+        }
+        hits.push(SearchHit {
+            name: name.into_owned(),
+            relative_path: walked.relative_path,
+            size_bytes: metadata.len(),
+            modified: metadata.modified().unwrap_or(SystemTime::UNIX_EPOCH),
+        });
+        ControlFlow::Continue(())
+    });
+    (hits, truncated)
+}
@@ -0,0 +1,87 @@
+//! Throwaway certificate for `run --self-signed`: quick HTTPS on a LAN without managing
+//! certificate files. Nothing is written to disk; a new certificate is made on every start.
+
+use std::fmt;
+use std::net::{IpAddr, Ipv4Addr, Ipv6Addr};
+
+use rcgen::{CertificateParams, DistinguishedName, DnType, KeyPair, SanType};
+use sha2::{Digest, Sha256};
+
+/// Long enough for a sharing session, short enough that a leaked key soon stops mattering.
+const VALIDITY: time::Duration = time::Duration::hours(24);
+/// Backdated slightly so clients with a lagging clock still accept it.
+const CLOCK_SKEW: time::Duration = time::Duration::minutes(5);
+
+pub struct SelfSigned {
+    pub cert_pem: String,
+    pub key_pem: String,
+    /// SHA-256 of the DER certificate as colon-separated hex, for pinning.
+    pub fingerprint: String,
+    pub names: Vec<String>,
+}
+
+#[derive(Debug)]
+pub struct SelfSignedError(rcgen::Error);
+
+impl fmt::Display for SelfSignedError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "Failed to generate self-signed certificate: {}", self.0)
+    }
+}
+
+impl std::error::Error for SelfSignedError {}
+
+impl From<rcgen::Error> for SelfSignedError {
+    fn from(err: rcgen::Error) -> Self {
+        Self(err)
+    }
+}
+
+/// ECDSA P-256 certificate for `localhost`, the loopback addresses and every LAN address
+/// this machine currently has.
+pub fn generate() -> Result<SelfSigned, SelfSignedError> {
+    let mut ips = vec![
+        IpAddr::V4(Ipv4Addr::LOCALHOST),
+        IpAddr::V6(Ipv6Addr::LOCALHOST),
+    ];
+    match crate::netif::local_addresses() {
+        Ok(addresses) => {
+            for address in addresses {
+                if !ips.contains(&address) {
+                    ips.push(address);
+                }
+            }
+        }
+        Err(err) => tracing::warn!("Self-signed certificate covers localhost only: {}", err),
+    }
+
+    let mut params = CertificateParams::new(vec!["localhost".to_string()])?;
+    params
+        .subject_alt_names
+        .extend(ips.iter().copied().map(SanType::IpAddress));
+    let mut subject = DistinguishedName::new();
+    subject.push(DnType::CommonName, "serve self-signed");
+    params.distinguished_name = subject;
+    let now = time::OffsetDateTime::now_utc();
+    params.not_before = now - CLOCK_SKEW;
+    params.not_after = now + VALIDITY;
+
+    let key = KeyPair::generate_for(&rcgen::PKCS_ECDSA_P256_SHA256)?;
+    let cert = params.self_signed(&key)?;
+
+    let fingerprint = Sha256::digest(cert.der())
+        .iter()
+        .map(|byte| format!("{byte:02X}"))
+        .collect::<Vec<_>>()
+        .join(":");
+    let names = std::iter::once("localhost".to_string())
+        .chain(ips.iter().map(IpAddr::to_string))
+        .collect();
+
+    Ok(SelfSigned {
+        cert_pem: cert.pem(),
+        key_pem: key.serialize_pem(),
+        fingerprint,
+        names,
+    })
+}
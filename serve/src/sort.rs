@@ -0,0 +1,183 @@
+//! Listing order shared by the HTML and JSON directory listings and `serve ls`, so every
+//! view of a directory agrees on what comes first.
+
+use std::cmp::Ordering;
+
+use clap::ValueEnum;
+use serde::{Deserialize, Serialize};
+
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq, Serialize, Deserialize, ValueEnum)]
+#[serde(rename_all = "lowercase")]
+pub(crate) enum ListSort {
+    #[default]
+    Name,
+    Size,
+    Modified,
+}
+
+impl ListSort {
+    /// Direction used when none is given: names A-Z, sizes and times largest/newest first.
+    pub(crate) fn default_order(self) -> SortOrder {
+        match self {
+            ListSort::Name => SortOrder::Asc,
+            ListSort::Size | ListSort::Modified => SortOrder::Desc,
+        }
+    }
+
+    pub(crate) fn as_str(self) -> &'static str {
+        match self {
+            ListSort::Name => "name",
+            ListSort::Size => "size",
+            ListSort::Modified => "modified",
+        }
+    }
+}
+
+#[derive(Clone, Copy, Debug, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub(crate) enum SortOrder {
+    Asc,
+    Desc,
+}
+
+impl SortOrder {
+    pub(crate) fn as_str(self) -> &'static str {
+        match self {
+            SortOrder::Asc => "asc",
+            SortOrder::Desc => "desc",
+        }
+    }
+}
+
+/// Fields a listing entry exposes for sorting.
+pub(crate) trait SortKey {
+    fn sort_name(&self) -> &str;
+    fn sort_size(&self) -> u64;
+    fn sort_modified(&self) -> i64;
+    fn sort_is_dir(&self) -> bool;
+}
+
+/// `?sort=`, `?order=` and `?group_dirs=` as one value. The default (name ascending,
+/// directories mixed in) is the order listings have always had.
+#[derive(Clone, Copy, Debug, Default)]
+pub(crate) struct ListingOrder {
+    pub(crate) sort: ListSort,
+    pub(crate) order: Option<SortOrder>,
+    pub(crate) group_dirs: bool,
+}
+
+impl ListingOrder {
+    pub(crate) fn order(&self) -> SortOrder {
+        self.order.unwrap_or_else(|| self.sort.default_order())
+    }
+
+    /// Sorts in place. Ties fall back to the name, so equal sizes or times keep a stable,
+    /// predictable order across requests.
+    pub(crate) fn apply<T: SortKey>(&self, entries: &mut [T]) {
+        entries.sort_by(|a, b| self.compare(a, b));
+    }
+
+    /// Where `a` goes relative to `b` in this order. Only entries with the same name
+    /// compare equal.
+    pub(crate) fn compare<A: SortKey, B: SortKey>(&self, a: &A, b: &B) -> Ordering {
+        let by_key = match self.sort {
+            ListSort::Name => compare_names(a, b),
+            ListSort::Size => a.sort_size().cmp(&b.sort_size()),
+            ListSort::Modified => a.sort_modified().cmp(&b.sort_modified()),
+        };
+        let by_key = match self.order() {
+            SortOrder::Asc => by_key,
+            SortOrder::Desc => by_key.reverse(),
+        };
+        let grouped = if self.group_dirs {
+            b.sort_is_dir().cmp(&a.sort_is_dir())
+        } else {
+            Ordering::Equal
+        };
+        grouped.then(by_key).then_with(|| compare_names(a, b))
+    }
+}
+
+/// `?cursor=` of a listing: the order a page was sent in and the sort key of its last
+/// entry. The next page starts right after that key, so entries added or removed before
+/// it neither repeat nor skip anything, which `?page=` cannot promise for a directory
+/// that changes between requests.
+#[derive(Clone, Debug, Serialize, Deserialize)]
+pub(crate) struct ListingCursor {
+    sort: ListSort,
+    order: SortOrder,
+    group_dirs: bool,
+    name: String,
+    size: u64,
+    modified: i64,
+    is_dir: bool,
+}
+
+impl ListingCursor {
+    /// Cursor for the page that follows `last` in `order`.
+    pub(crate) fn after<T: SortKey>(order: &ListingOrder, last: &T) -> Self {
+        Self {
+            sort: order.sort,
+            order: order.order(),
+            group_dirs: order.group_dirs,
+            name: last.sort_name().to_string(),
+            size: last.sort_size(),
+            modified: last.sort_modified(),
+            is_dir: last.sort_is_dir(),
+        }
+    }
+
+    /// Opaque token for URLs: the cursor as JSON, hex-encoded.
+    pub(crate) fn encode(&self) -> String {
+        serde_json::to_vec(self)
+            .unwrap_or_default()
+            .iter()
+            .map(|byte| format!("{byte:02x}"))
+            .collect()
+    }
+
+    pub(crate) fn decode(token: &str) -> Option<Self> {
+        let token = token.trim();
+        if token.len() % 2 != 0 || !token.is_ascii() {
+            return None;
+        }
+        let bytes = (0..token.len())
+            .step_by(2)
+            .map(|start| u8::from_str_radix(&token[start..start + 2], 16).ok())
+            .collect::<Option<Vec<u8>>>()?;
+        serde_json::from_slice(&bytes).ok()
+    }
+
+    /// Whether the cursor was taken from a listing in `order`; positions are meaningless
+    /// in any other.
+    pub(crate) fn fits(&self, order: &ListingOrder) -> bool {
+        self.sort == order.sort
+            && self.order == order.order()
+            && self.group_dirs == order.group_dirs
+    }
+}
+
+impl SortKey for ListingCursor {
+    fn sort_name(&self) -> &str {
+        &self.name
+    }
+
+    fn sort_size(&self) -> u64 {
+        self.size
+    }
+
+    fn sort_modified(&self) -> i64 {
+        self.modified
+    }
+
+    fn sort_is_dir(&self) -> bool {
+        self.is_dir
+    }
+}
+
+fn compare_names<A: SortKey, B: SortKey>(a: &A, b: &B) -> Ordering {
+    a.sort_name()
+        .to_lowercase()
+        .cmp(&b.sort_name().to_lowercase())
+        .then_with(|| a.sort_name().cmp(b.sort_name()))
+}
@@ -0,0 +1,231 @@
+use std::fs;
+use std::io::{self, Read};
+use std::path::{Path, PathBuf};
+
+use chrono::{DateTime, Local};
+use serde::Serialize;
+use sha2::{Digest, Sha256};
+
+use crate::config::Config;
+use crate::error_codes;
+use crate::sort::{ListSort, ListingOrder, SortKey};
+use crate::utils::{
+    format_modified_time, format_size, is_blacklisted, mime_type_for, path_id,
+    relative_path_string, resolve_within_root, unix_timestamp,
+};
+use crate::{AppError, NOT_FOUND_MESSAGE, STREAM_BUFFER_BYTES, map_io_error};
+
+/// Local metadata for `serve stat`; field names follow the `/info` payload.
+#[derive(Debug, Serialize)]
+pub(crate) struct StatPayload {
+    pub(crate) name: String,
+    pub(crate) path: String,
+    pub(crate) mime_type: String,
+    pub(crate) is_dir: bool,
+    pub(crate) size_bytes: u64,
+    pub(crate) size_display: String,
+    pub(crate) modified: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub(crate) sha256: Option<String>,
+}
+
+#[derive(Debug, Serialize)]
+pub(crate) struct ListingPayload {
+    pub(crate) path: String,
+    pub(crate) entries: Vec<ListingEntry>,
+}
+
+#[derive(Debug, Serialize)]
+pub(crate) struct ListingEntry {
+    pub(crate) index: usize,
+    pub(crate) path_id: String,
+    pub(crate) name: String,
+    pub(crate) size: String,
+    pub(crate) size_bytes: u64,
+    pub(crate) modified: String,
+    pub(crate) path: String,
+    pub(crate) is_dir: bool,
+    pub(crate) mime_type: String,
+    #[serde(skip_serializing_if = "std::ops::Not::not")]
+    pub(crate) hidden: bool,
+    #[serde(skip)]
+    modified_ts: i64,
+}
+
+impl SortKey for ListingEntry {
+    fn sort_name(&self) -> &str {
+        &self.name
+    }
+
+    fn sort_size(&self) -> u64 {
+        self.size_bytes
+    }
+
+    fn sort_modified(&self) -> i64 {
+        self.modified_ts
+    }
+
+    fn sort_is_dir(&self) -> bool {
+        self.is_dir
+    }
+}
+
+/// Stats `requested_path` under `root` without starting the server.
+pub(crate) fn stat_path(
+    config: &Config,
+    root: &Path,
+    requested_path: &str,
+    checksum: bool,
+) -> Result<StatPayload, AppError> {
+    let full_path = resolve_local(config, root, requested_path)?;
+    let metadata = fs::metadata(&full_path).map_err(map_io_error)?;
+    let relative_path = relative_path_string(root, &full_path)
+        .ok_or_else(|| AppError::NotFound(NOT_FOUND_MESSAGE.to_string()))?;
+    let name = full_path
+        .file_name()
+        .and_then(|value| value.to_str())
+        .map(|value| value.to_string())
+        .unwrap_or_else(|| "/".to_string());
+    let is_dir = metadata.is_dir();
+    let mime_type = mime_for(&full_path, is_dir);
+    let size_bytes = if is_dir { 0 } else { metadata.len() };
+    let modified = modified_display(&metadata);
+    let sha256 = if checksum && !is_dir {
+        Some(sha256_file(&full_path).map_err(map_io_error)?)
+    } else {
+        None
+    };
+
+    Ok(StatPayload {
+        name,
+        path: format!("/{relative_path}"),
+        mime_type,
+        is_dir,
+        size_bytes,
+        size_display: format_size(size_bytes),
+        modified,
+        sha256,
+    })
+}
+
+/// Offline counterpart of the directory listing for `serve ls`. Entries use the same field
+/// names as the `serve-cli` JSON listing minus the server-assigned ids and URLs. With
+/// `include_hidden`, blacklisted entries are listed too and flagged `hidden`.
+pub(crate) fn list_path(
+    config: &Config,
+    root: &Path,
+    requested_path: &str,
+    sort: ListSort,
+    include_hidden: bool,
+) -> Result<ListingPayload, AppError> {
+    let directory = resolve_local(config, root, requested_path)?;
+    if !directory.is_dir() {
+        return Err(
+            AppError::BadRequest(format!("{requested_path} is not a directory"))
+                .with_code(error_codes::NOT_A_DIRECTORY),
+        );
+    }
+
+    let mut entries = Vec::new();
+    for entry in fs::read_dir(&directory).map_err(map_io_error)? {
+        let entry = entry.map_err(map_io_error)?;
+        let Some(name) = entry.file_name().to_str().map(|name| name.to_string()) else {
+            continue;
+        };
+        let child_path = entry.path();
+        let hidden = is_blacklisted(&child_path, root, &config.blacklisted_files);
+        if hidden && !include_hidden {
+            continue;
+        }
+        let Ok(metadata) = entry.metadata() else {
+            continue;
+        };
+        let Some(relative_path) = relative_path_string(root, &child_path) else {
+            continue;
+        };
+        let is_dir = metadata.is_dir();
+        let size_bytes = if is_dir { 0 } else { metadata.len() };
+        entries.push(ListingEntry {
+            index: 0,
+            path_id: path_id(&relative_path),
+            mime_type: mime_for(&child_path, is_dir),
+            modified: modified_display(&metadata),
+            modified_ts: metadata.modified().ok().map(unix_timestamp).unwrap_or(0),
+            name,
+            size: if is_dir {
+                "-".to_string()
+            } else {
+                format_size(size_bytes)
+            },
+            size_bytes,
+            path: relative_path,
+            is_dir,
+            hidden,
+        });
+    }
+
+    ListingOrder {
+        sort,
+        ..ListingOrder::default()
+    }
+    .apply(&mut entries);
+    for (idx, entry) in entries.iter_mut().enumerate() {
+        entry.index = idx + 1;
+    }
+
+    let relative = relative_path_string(root, &directory).unwrap_or_default();
+    let path = if relative.is_empty() {
+        "/".to_string()
+    } else {
+        format!("/{relative}/")
+    };
+    Ok(ListingPayload { path, entries })
+}
+
+/// Resolves a user-supplied path against the root, rejecting anything that climbs out of it
+/// (`..` or a symlink pointing elsewhere). Blacklisted entries read as missing.
+fn resolve_local(config: &Config, root: &Path, requested_path: &str) -> Result<PathBuf, AppError> {
+    let escapes = || {
+        AppError::BadRequest(format!("{requested_path} is outside the served root"))
+            .with_code(error_codes::INVALID_PATH)
+    };
+
+    let full_path = resolve_within_root(root, requested_path).ok_or_else(escapes)?;
+    let full_path = full_path.canonicalize().map_err(map_io_error)?;
+    if !full_path.starts_with(root) {
+        return Err(escapes());
+    }
+    if is_blacklisted(&full_path, root, &config.blacklisted_files) {
+        return Err(AppError::NotFound(NOT_FOUND_MESSAGE.to_string()));
+    }
+    Ok(full_path)
+}
+
+fn mime_for(path: &Path, is_dir: bool) -> String {
+    if is_dir {
+        "inode/directory".to_string()
+    } else {
+        mime_type_for(path)
+    }
+}
+
+fn modified_display(metadata: &fs::Metadata) -> String {
+    metadata
+        .modified()
+        .map(|time| format_modified_time(DateTime::<Local>::from(time)))
+        .unwrap_or_else(|_| "-".to_string())
+}
+
+pub(crate) fn sha256_file(path: &Path) -> io::Result<String> {
+    let mut file = fs::File::open(path)?;
+    let mut hasher = Sha256::new();
+    let mut buffer = vec![0u8; STREAM_BUFFER_BYTES];
+    loop {
+        let read = file.read(&mut buffer)?;
+        if read == 0 {
+            break;
+        }
+        hasher.update(&buffer[..read]);
+    }
+    Ok(format!("{:x}", hasher.finalize()))
+}
@@ -1,16 +1,97 @@
+use html_escape::{encode_double_quoted_attribute, encode_text};
+
+use crate::config::Config;
+
 const TEMPLATE: &str = include_str!("../templates/template.html");
 
+/// Listing page text from `site_title`, `site_header`/`site_header_html` and `site_footer`.
+/// Unset fields keep the directory-based defaults.
+#[derive(Default)]
+pub struct Branding<'a> {
+    pub title: Option<&'a str>,
+    pub header: Option<&'a str>,
+    /// Trusted HTML inserted as-is; wins over `header`.
+    pub header_html: Option<&'a str>,
+    pub footer: Option<&'a str>,
+    /// Operator notice from `banner`, shown above everything else.
+    pub banner: Option<&'a str>,
+}
+
+impl<'a> Branding<'a> {
+    pub fn from_config(config: &'a Config) -> Self {
+        Self {
+            title: config.site_title.as_deref(),
+            header: config.site_header.as_deref(),
+            header_html: config.site_header_html.as_deref(),
+            footer: config.site_footer.as_deref(),
+            banner: config.banner.as_deref(),
+        }
+    }
+}
+
+/// Header cells of the sortable columns, built by the listing handler so they can link to
+/// the same directory in another order.
+pub struct SortColumns {
+    pub name: String,
+    pub size: String,
+    pub modified: String,
+    /// Current order in words, for the table caption.
+    pub description: String,
+}
+
+/// `path` is the root-relative directory, posted back by "Download selected".
 pub fn render_directory_page(
     directory: &str,
+    path: &str,
     rows: &str,
+    filter: &str,
+    pager: &str,
+    columns: &SortColumns,
     year: i32,
     host: &str,
     disk_usage: &str,
     total_files: usize,
+    branding: &Branding,
 ) -> String {
+    let (title, heading) = match branding.title {
+        Some(title) => {
+            let title = encode_text(title);
+            (format!("{title} - {directory}"), title.into_owned())
+        }
+        None => (
+            format!("Directory Listing of {directory}"),
+            format!("Index of {directory}"),
+        ),
+    };
+    let site_header = match (branding.header_html, branding.header) {
+        (Some(html), _) => format!(r#"<div class="site-header">{html}</div>"#),
+        (None, Some(text)) => format!(r#"<p class="site-header">{}</p>"#, encode_text(text)),
+        (None, None) => String::new(),
+    };
+    let banner = branding
+        .banner
+        .map(|text| format!(r#"<p class="banner" role="note">{}</p>"#, encode_text(text)))
+        .unwrap_or_default();
+    let site_footer = branding
+        .footer
+        .map(|text| format!(r#"<p class="site-footer">{}</p>"#, encode_text(text)))
+        .unwrap_or_default();
+
     TEMPLATE
+        .replace("{{ title }}", &title)
+        .replace("{{ heading }}", &heading)
+        .replace("{{ banner }}", &banner)
+        .replace("{{ site_header }}", &site_header)
+        .replace("{{ site_footer }}", &site_footer)
         .replace("{{ directory }}", directory)
+        .replace("{{ path }}", &encode_double_quoted_attribute(path))
+        .replace("{{ name_column }}", &columns.name)
+        .replace("{{ size_column }}", &columns.size)
+        .replace("{{ modified_column }}", &columns.modified)
+        .replace("{{ sort_description }}", &columns.description)
         .replace("{{ rows }}", rows)
+        .replace("{{ filter }}", filter)
+        .replace("{{ pager }}", pager)
         .replace("{{ year }}", &year.to_string())
         .replace("{{ host }}", host)
         .replace("{{ disk_usage }}", disk_usage)
@@ -0,0 +1,91 @@
+//! Fixtures for the unit tests: a scratch directory removed on drop, and an [`AppState`]
+//! serving a `root/` inside it the way `run_server` would.
+
+use std::env;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, Mutex};
+
+use tokio::sync::mpsc;
+use ulid::Ulid;
+
+use crate::AppState;
+use crate::catalog::Catalog;
+use crate::config::Config;
+use crate::etags::ContentEtags;
+use crate::idempotency::IdempotencyCache;
+use crate::middleware::Maintenance;
+use crate::open_upload::OpenUploadGuard;
+use crate::utils;
+
+/// Held while `SERVE_*` variables are changed or read, since the environment is shared by
+/// every test in the process.
+pub(crate) static ENV_LOCK: Mutex<()> = Mutex::new(());
+
+pub(crate) struct TempDir {
+    path: PathBuf,
+}
+
+impl TempDir {
+    pub(crate) fn new() -> Self {
+        let path = env::temp_dir().join(format!("serve-test-{}", Ulid::new()));
+        fs::create_dir_all(&path).expect("create scratch directory");
+        Self { path }
+    }
+
+    pub(crate) fn path(&self) -> &Path {
+        &self.path
+    }
+}
+
+impl Drop for TempDir {
+    fn drop(&mut self) {
+        let _ = fs::remove_dir_all(&self.path);
+    }
+}
+
+/// State for a server whose root is `<dir>/root` and whose config file holds `config`
+/// (TOML, without `root`). The catalog lives next to the config, outside the root.
+pub(crate) async fn app_state(dir: &TempDir, config: &str) -> AppState {
+    let root = dir.path().join("root");
+    fs::create_dir_all(&root).expect("create root");
+    let config_path = dir.path().join("config.toml");
+    let root_line = format!("root = {:?}\n", root.display().to_string());
+    fs::write(&config_path, root_line + config).expect("write config");
+
+    let mut config = {
+        let _env = ENV_LOCK.lock().unwrap_or_else(|err| err.into_inner());
+        Config::load(Some(&config_path)).expect("load config")
+    };
+    let canonical_root = root.canonicalize().expect("canonical root");
+    let upload_tmp_dir = config.upload_tmp_dir(&canonical_root);
+    if let Some(relative) = utils::relative_path_string(&canonical_root, &upload_tmp_dir) {
+        if !relative.is_empty() {
+            config.blacklisted_files.insert(relative);
+        }
+    }
+    let catalog = Catalog::new(&dir.path().join("catalog.db"))
+        .await
+        .expect("open catalog");
+    // Nothing listens for refresh requests; sends are best effort everywhere.
+    let (catalog_events, _) = mpsc::channel(8);
+
+    AppState {
+        upload_keys: Arc::new(IdempotencyCache::new(config.idempotency_ttl_secs)),
+        file_etags: Arc::new(ContentEtags::new(
+            config.strong_etags,
+            config.strong_etag_max_size,
+        )),
+        open_uploads: config.open_upload.then(|| {
+            Arc::new(OpenUploadGuard::new(
+                config.open_upload_rate,
+                config.open_upload_quota,
+            ))
+        }),
+        maintenance: Maintenance::new(config.maintenance, None, config.maintenance_retry_after),
+        config: Arc::new(config),
+        canonical_root: Arc::new(canonical_root),
+        catalog: Arc::new(catalog),
+        catalog_events,
+    }
+}
@@ -0,0 +1,161 @@
+//! Connection timeouts (`read_header_timeout`, `read_timeout`, `write_timeout`,
+//! `idle_timeout`). Header and body reads are bounded by hyper and tower-http; write and
+//! idle limits need to watch the socket itself, so accepted streams are wrapped in
+//! [`TimedIo`].
+
+use std::future::{Ready, ready};
+use std::io;
+use std::pin::Pin;
+use std::task::{Context, Poll};
+use std::time::Duration;
+
+use axum_server::accept::Accept;
+use hyper_util::rt::{TokioExecutor, TokioTimer};
+use hyper_util::server::conn::auto::Builder;
+use tokio::io::{AsyncRead, AsyncWrite, ReadBuf};
+use tokio::time::{Instant, Sleep, sleep};
+
+use crate::config::Config;
+
+/// The configured limits; `None` means no limit.
+#[derive(Clone, Copy, Debug)]
+pub(crate) struct Timeouts {
+    pub(crate) read_header: Option<Duration>,
+    pub(crate) read: Option<Duration>,
+    pub(crate) write: Option<Duration>,
+    pub(crate) idle: Option<Duration>,
+}
+
+impl Timeouts {
+    pub(crate) fn from_config(config: &Config) -> Self {
+        let limit = |duration: Duration| (!duration.is_zero()).then_some(duration);
+        Self {
+            read_header: limit(config.read_header_timeout),
+            read: limit(config.read_timeout),
+            write: limit(config.write_timeout),
+            idle: limit(config.idle_timeout),
+        }
+    }
+
+    /// Applies the header read limit to a connection builder.
+    pub(crate) fn configure(&self, builder: &mut Builder<TokioExecutor>) {
+        builder
+            .http1()
+            .timer(TokioTimer::new())
+            .header_read_timeout(self.read_header);
+    }
+
+    pub(crate) fn wrap<S>(&self, stream: S) -> TimedIo<S> {
+        TimedIo {
+            inner: stream,
+            idle: self.idle,
+            idle_deadline: self.idle.map(|idle| Box::pin(sleep(idle))),
+            write: self.write,
+            write_deadline: None,
+        }
+    }
+}
+
+/// Wraps each accepted TCP stream in [`TimedIo`] before TLS (if any) and HTTP see it.
+#[derive(Clone, Copy, Debug)]
+pub(crate) struct TimedAcceptor(pub(crate) Timeouts);
+
+impl<I, S> Accept<I, S> for TimedAcceptor {
+    type Stream = TimedIo<I>;
+    type Service = S;
+    type Future = Ready<io::Result<(Self::Stream, Self::Service)>>;
+
+    fn accept(&self, stream: I, service: S) -> Self::Future {
+        ready(Ok((self.0.wrap(stream), service)))
+    }
+}
+
+/// Fails reads and writes with `TimedOut` once the connection has carried no data in
+/// either direction for `idle`, or a single write has been blocked (the client stopped
+/// reading) for `write`.
+pub(crate) struct TimedIo<S> {
+    inner: S,
+    idle: Option<Duration>,
+    idle_deadline: Option<Pin<Box<Sleep>>>,
+    write: Option<Duration>,
+    write_deadline: Option<Pin<Box<Sleep>>>,
+}
+
+impl<S> TimedIo<S> {
+    fn touch(&mut self) {
+        if let (Some(idle), Some(deadline)) = (self.idle, self.idle_deadline.as_mut()) {
+            deadline.as_mut().reset(Instant::now() + idle);
+        }
+    }
+
+    fn idle_expired(&mut self, cx: &mut Context<'_>) -> bool {
+        match self.idle_deadline.as_mut() {
+            Some(deadline) => deadline.as_mut().poll(cx).is_ready(),
+            None => false,
+        }
+    }
+}
+
+fn timed_out(what: &str) -> io::Error {
+    io::Error::new(
+        io::ErrorKind::TimedOut,
+        format!("connection {what} timed out"),
+    )
+}
+
+impl<S: AsyncRead + Unpin> AsyncRead for TimedIo<S> {
+    fn poll_read(
+        mut self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+        buf: &mut ReadBuf<'_>,
+    ) -> Poll<io::Result<()>> {
+        let this = &mut *self;
+        match Pin::new(&mut this.inner).poll_read(cx, buf) {
+            Poll::Ready(result) => {
+                this.touch();
+                Poll::Ready(result)
+            }
+            Poll::Pending if this.idle_expired(cx) => Poll::Ready(Err(timed_out("idle"))),
+            Poll::Pending => Poll::Pending,
+        }
+    }
+}
+
+impl<S: AsyncWrite + Unpin> AsyncWrite for TimedIo<S> {
+    fn poll_write(
+        mut self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+        buf: &[u8],
+    ) -> Poll<io::Result<usize>> {
+        let this = &mut *self;
+        match Pin::new(&mut this.inner).poll_write(cx, buf) {
+            Poll::Ready(result) => {
+                this.write_deadline = None;
+                this.touch();
+                Poll::Ready(result)
+            }
+            Poll::Pending => {
+                if let Some(write) = this.write {
+                    let deadline = this
+                        .write_deadline
+                        .get_or_insert_with(|| Box::pin(sleep(write)));
+                    if deadline.as_mut().poll(cx).is_ready() {
+                        return Poll::Ready(Err(timed_out("write")));
+                    }
+                }
+                if this.idle_expired(cx) {
+                    return Poll::Ready(Err(timed_out("idle")));
+                }
+                Poll::Pending
+            }
+        }
+    }
+
+    fn poll_flush(mut self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<io::Result<()>> {
+        Pin::new(&mut self.inner).poll_flush(cx)
+    }
+
+    fn poll_shutdown(mut self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<io::Result<()>> {
+        Pin::new(&mut self.inner).poll_shutdown(cx)
+    }
+}
@@ -0,0 +1,99 @@
+//! Serving over a Unix domain socket (`unix_socket`), for running behind a reverse proxy
+//! on the same host. axum's `serve` only accepts TCP listeners, so connections are driven
+//! with hyper directly.
+
+use std::io;
+use std::os::unix::fs::{FileTypeExt, PermissionsExt};
+use std::path::Path;
+
+use axum::Router;
+use hyper_util::rt::{TokioExecutor, TokioIo};
+use hyper_util::server::conn::auto::Builder;
+use hyper_util::service::TowerToHyperService;
+use tokio::net::UnixListener;
+use tokio_util::sync::CancellationToken;
+use tokio_util::task::TaskTracker;
+
+use crate::privileges::Identity;
+use crate::timeouts::Timeouts;
+
+/// Group-writable so a proxy in the socket's group can connect.
+const SOCKET_MODE: u32 = 0o660;
+
+/// Binds `path`, replacing a socket left behind by an earlier run. Anything at `path` that
+/// is not a socket is left alone and reported as an error.
+pub(crate) fn bind(path: &Path, owner: Option<&Identity>) -> io::Result<UnixListener> {
+    match std::fs::symlink_metadata(path) {
+        Ok(metadata) if metadata.file_type().is_socket() => std::fs::remove_file(path)?,
+        Ok(_) => {
+            return Err(io::Error::new(
+                io::ErrorKind::AlreadyExists,
+                format!("{} exists and is not a socket", path.display()),
+            ));
+        }
+        Err(err) if err.kind() == io::ErrorKind::NotFound => {}
+        Err(err) => return Err(err),
+    }
+
+    let listener = UnixListener::bind(path)?;
+    std::fs::set_permissions(path, std::fs::Permissions::from_mode(SOCKET_MODE))?;
+    if let Some(identity) = owner {
+        std::os::unix::fs::chown(path, Some(identity.uid()), Some(identity.gid()))?;
+    }
+    Ok(listener)
+}
+
+/// Accepts connections until `shutdown` fires, then lets open connections finish their
+/// current requests. The caller bounds how long that may take.
+pub(crate) async fn serve(
+    listener: UnixListener,
+    router: Router,
+    timeouts: Timeouts,
+    shutdown: CancellationToken,
+) -> io::Result<()> {
+    let connections = TaskTracker::new();
+    loop {
+        let stream = tokio::select! {
+            accepted = listener.accept() => match accepted {
+                Ok((stream, _)) => stream,
+                Err(err) => {
+                    tracing::warn!("Failed to accept Unix socket connection: {}", err);
+                    continue;
+                }
+            },
+            _ = shutdown.cancelled() => break,
+        };
+
+        let service = TowerToHyperService::new(router.clone());
+        let shutdown = shutdown.clone();
+        connections.spawn(async move {
+            let mut builder = Builder::new(TokioExecutor::new());
+            timeouts.configure(&mut builder);
+            let connection = builder
+                .serve_connection_with_upgrades(TokioIo::new(timeouts.wrap(stream)), service);
+            tokio::pin!(connection);
+            let result = tokio::select! {
+                result = connection.as_mut() => result,
+                _ = shutdown.cancelled() => {
+                    connection.as_mut().graceful_shutdown();
+                    connection.await
+                }
+            };
+            if let Err(err) = result {
+                tracing::debug!("Unix socket connection ended with error: {}", err);
+            }
+        });
+    }
+
+    connections.close();
+    connections.wait().await;
+    Ok(())
+}
+
+/// Removes the socket file on shutdown so a stale socket does not linger. Under chroot the
+/// path is outside the jail; the next start replaces it instead.
+pub(crate) fn remove(path: &Path) {
+    if let Err(err) = std::fs::remove_file(path) {
+        tracing::debug!("Could not remove socket {}: {}", path.display(), err);
+    }
+}
@@ -1,29 +1,66 @@
+use std::io;
+use std::net::SocketAddr;
 use std::path::{Path as StdPath, PathBuf};
+use std::sync::Arc;
+use std::sync::atomic::{AtomicU64, Ordering};
 
 use axum::body::Body;
-use axum::extract::{Multipart, Query, State, multipart::MultipartError};
-use axum::http::{HeaderMap, StatusCode};
-use axum::response::Response;
-use chrono::{Local, Utc};
+use axum::extract::multipart::{Field, MultipartError, MultipartRejection};
+use axum::extract::{ConnectInfo, Extension, Multipart, Query, Request, State};
+use axum::http::{HeaderMap, HeaderValue, StatusCode, header};
+use axum::middleware::Next;
+use axum::response::{IntoResponse, Response};
+use chrono::{DateTime, Local, SecondsFormat, Utc};
 use futures_util::StreamExt;
-use mime_guess::MimeGuess;
 use pathdiff::diff_paths;
 use serde::Deserialize;
+use sha2::{Digest, Sha256};
 use tokio::fs;
 use tokio::io::AsyncWriteExt;
+use tower_http::decompression::RequestDecompressionLayer;
+use ulid::Ulid;
 
 use crate::catalog::{CatalogCommand, EntryInfo};
-use crate::http_utils::{auth_token, build_base_url, client_ip, client_user_agent};
+use crate::config::Config;
+use crate::error_codes;
+use crate::http_utils::{
+    auth_token, build_base_url, client_ip, client_user_agent, http_date, remote_ip,
+};
+use crate::idempotency::idempotency_key;
 use crate::map_io_error;
 use crate::utils::{
-    format_modified_time, is_allowed_file, parent_relative_path, secure_filename, unix_timestamp,
+    format_modified_time, glob_match, is_allowed_file, mime_type_for, parent_relative_path,
+    relative_path_string, secure_filename, unix_timestamp,
 };
 use crate::{AppError, AppState, NOT_FOUND_MESSAGE, POWERED_BY};
 
+pub(crate) const SIDECAR_SUFFIX: &str = ".meta";
+
+/// Highest decompressed-to-wire ratio accepted for a `Content-Encoding: gzip` upload.
+/// Ordinary text and logs stay well below this; runs of zeros crafted as bombs reach ~1000.
+const MAX_COMPRESSION_RATIO: u64 = 250;
+/// Output allowed before the ratio check kicks in, so tiny highly-compressible files pass.
+const RATIO_GRACE_BYTES: u64 = 1024 * 1024;
+/// Room for boundaries and part headers when judging a multipart body by its length.
+const MULTIPART_OVERHEAD_BYTES: u64 = 64 * 1024;
+/// Numbered names `rename` tries after the original before giving up with 409.
+const MAX_RENAME_ATTEMPTS: u32 = 1000;
+/// Multipart field names `/upload` stores; repeat any of them to send several files.
+const FILE_FIELDS: [&str; 3] = ["file", "files", "files[]"];
+
 #[derive(Debug, Deserialize)]
 pub(crate) struct UploadQuery {
     #[serde(default)]
     pub(crate) dir: Option<String>,
+    /// Dry run: check `name`/`size` against the upload policy without sending the file.
+    #[serde(default)]
+    pub(crate) validate: Option<bool>,
+    #[serde(default)]
+    pub(crate) name: Option<String>,
+    #[serde(default)]
+    pub(crate) size: Option<u64>,
+    #[serde(default)]
+    pub(crate) conflict: Option<String>,
 }
 
 #[derive(Deserialize)]
@@ -34,23 +71,39 @@ pub(crate) struct UploadStreamQuery {
     pub(crate) name: Option<String>,
     #[serde(default)]
     pub(crate) allow_no_ext: Option<bool>,
+    #[serde(default)]
+    pub(crate) conflict: Option<String>,
 }
 
 pub(crate) async fn handle_upload(
     State(state): State<AppState>,
     headers: HeaderMap,
     Query(query): Query<UploadQuery>,
-    mut multipart: Multipart,
+    wire: Option<Extension<WireBytes>>,
+    connect_info: Option<ConnectInfo<SocketAddr>>,
+    multipart: Result<Multipart, MultipartRejection>,
 ) -> Result<Response, AppError> {
-    let provided_token = auth_token(&headers);
-    if provided_token.as_deref() != Some(state.config.upload_token.as_str()) {
-        return Err(AppError::Unauthorized("Unauthorized".to_string()));
+    let uploader = authorize_upload(&state, &headers, connect_info)?;
+    if query.validate == Some(true) {
+        return validate_upload(&state, &headers, query, &uploader).await;
     }
+    check_content_length(&state.config, &headers, MULTIPART_OVERHEAD_BYTES)?;
+    let mut multipart = match multipart {
+        Ok(multipart) => multipart,
+        Err(rejection) => return Ok(rejection.into_response()),
+    };
 
-    let dir_id = extract_dir_id(&headers, query.dir);
-    let (target_dir, resolved_dir_id) = resolve_target_directory(&state, dir_id).await?;
+    let idempotency_key = idempotency_key(&headers);
+    if let Some(key) = &idempotency_key {
+        if let Some(body) = state.upload_keys.get(&uploader.scope(&state), key) {
+            tracing::info!("[upload-replay] {} - {}", client_ip(&headers), key);
+            return Ok(upload_response(body, true));
+        }
+    }
 
-    let mut saved_file = None;
+    let mut dir_id = extract_dir_id(&headers, query.dir);
+    let mut conflict = UploadConflict::requested(&headers, query.conflict.as_deref(), &uploader)?;
+    let mut results = Vec::new();
 
     loop {
         let mut field = match multipart.next_field().await {
@@ -66,264 +119,334 @@ pub(crate) async fn handle_upload(
                         .unwrap());
                 }
                 tracing::error!("Multipart parsing error: {}", err);
-                return Err(AppError::BadRequest(
-                    "Invalid multipart payload".to_string(),
-                ));
+                return Err(
+                    AppError::BadRequest("Invalid multipart payload".to_string())
+                        .with_code(error_codes::INVALID_MULTIPART),
+                );
             }
         };
 
-        if field.name() != Some("file") {
+        // Without ?dir or X-Upload-Dir, a form field ahead of the file may name the directory.
+        if dir_id.is_none() && field.name() == Some(state.config.upload_path_field.as_str()) {
+            let value = field.text().await.map_err(|err| {
+                tracing::error!(
+                    "Failed to read {} field: {}",
+                    state.config.upload_path_field,
+                    err
+                );
+                AppError::BadRequest("Invalid multipart payload".to_string())
+                    .with_code(error_codes::INVALID_MULTIPART)
+            })?;
+            dir_id = Some(value.trim().to_string()).filter(|value| !value.is_empty());
             continue;
         }
 
-        let file_name = field
-            .file_name()
-            .map(|name| name.to_string())
-            .unwrap_or_default();
+        // Likewise a `conflict` field, when neither ?conflict nor X-Upload-Conflict is sent.
+        if conflict.is_none() && field.name() == Some("conflict") {
+            let value = field.text().await.map_err(|err| {
+                tracing::error!("Failed to read conflict field: {}", err);
+                AppError::BadRequest("Invalid multipart payload".to_string())
+                    .with_code(error_codes::INVALID_MULTIPART)
+            })?;
+            conflict = uploader.permit_conflict(UploadConflict::parse(&value)?)?;
+            continue;
+        }
 
-        if file_name.is_empty() {
-            return Err(AppError::BadRequest(
-                "No selected file or file type not allowed".to_string(),
-            ));
+        if !field.name().is_some_and(|name| FILE_FIELDS.contains(&name)) {
+            continue;
         }
 
-        let allow_missing_extension = headers
-            .get("X-Allow-No-Ext")
-            .and_then(|value| value.to_str().ok())
-            .map(|value| matches!(value.to_ascii_lowercase().as_str(), "1" | "true" | "yes"))
-            .unwrap_or(false);
-        let allow_any_extension = headers
-            .get("X-Allow-All-Ext")
-            .and_then(|value| value.to_str().ok())
-            .map(|value| matches!(value.to_ascii_lowercase().as_str(), "1" | "true" | "yes"))
-            .unwrap_or(false);
+        // An explicit X-Upload-Filename wins over the first part's filename; both go through
+        // the same sanitising and extension checks.
+        let file_name = upload_filename_header(&headers)
+            .filter(|_| results.is_empty())
+            .or_else(|| field.file_name().map(|name| name.to_string()))
+            .unwrap_or_default();
 
-        let clean_name = StdPath::new(&file_name)
-            .file_name()
-            .and_then(|name| name.to_str())
-            .ok_or_else(|| {
-                AppError::BadRequest("No selected file or file type not allowed".to_string())
-            })?;
+        let result = store_multipart_file(
+            &state,
+            &headers,
+            &uploader,
+            dir_id.clone(),
+            conflict.unwrap_or_default(),
+            &file_name,
+            &mut field,
+            wire.as_deref(),
+        )
+        .await;
+        match result {
+            Ok(saved) => {
+                tracing::info!(
+                    "[uploading] {} - {} - {} - {}",
+                    client_ip(&headers),
+                    saved.name,
+                    saved.relative_path,
+                    client_user_agent(&headers)
+                );
+                results.push(Ok(saved));
+            }
+            // Server-side failures and compression bombs end the whole request; anything
+            // else only rejects this file.
+            Err(err)
+                if err.status_and_code().0.is_server_error()
+                    || err.status_and_code().1 == error_codes::COMPRESSION_RATIO =>
+            {
+                return Err(err);
+            }
+            Err(err) => {
+                tracing::warn!(
+                    "[upload] {} - {} rejected: {}",
+                    client_ip(&headers),
+                    file_name,
+                    err
+                );
+                results.push(Err((file_name, err)));
+            }
+        }
+    }
 
-        let has_extension = StdPath::new(clean_name).extension().is_some();
-        let extension_allowed = is_allowed_file(clean_name, &state.config.allowed_extensions);
+    if results.iter().any(Result::is_ok) {
+        let _ = state.catalog_events.try_send(CatalogCommand::RefreshAll);
+    }
 
-        if !allow_any_extension && !extension_allowed {
-            if !(allow_missing_extension && !has_extension) {
-                return Err(AppError::BadRequest(
-                    "No selected file or file type not allowed".to_string(),
-                ));
-            }
+    // A single file keeps the plain response (and plain errors) from before batch uploads.
+    let mut payload = match results.len() {
+        0 => {
+            return Err(AppError::BadRequest("No file to upload".to_string())
+                .with_code(error_codes::MISSING_FILE));
         }
+        1 => match results.pop().unwrap() {
+            Ok(saved) => saved.payload(),
+            Err((_, err)) => return Err(err),
+        },
+        _ => batch_payload(results),
+    };
+    payload["banner"] = state.config.banner.clone().into();
+
+    let body = serde_json::to_string_pretty(&payload).unwrap();
+    if payload["status"] == "error" {
+        return Ok(Response::builder()
+            .status(StatusCode::BAD_REQUEST)
+            .header(header::CONTENT_TYPE, "application/json; charset=utf-8")
+            .body(Body::from(body))
+            .unwrap());
+    }
+    if let Some(key) = &idempotency_key {
+        state
+            .upload_keys
+            .insert(&uploader.scope(&state), key, body.clone());
+    }
+    Ok(upload_response(body, false))
+}
 
-        let safe_name = secure_filename(clean_name).ok_or_else(|| {
+/// Stores one file part of a `/upload` request: name and path checks, then the body is
+/// staged and moved into place. `file_name` is the name as sent by the client.
+async fn store_multipart_file(
+    state: &AppState,
+    headers: &HeaderMap,
+    uploader: &Uploader,
+    dir_id: Option<String>,
+    conflict: UploadConflict,
+    file_name: &str,
+    field: &mut Field<'_>,
+    wire: Option<&WireBytes>,
+) -> Result<UploadResponse, AppError> {
+    let conflict = uploader.conflict(conflict);
+    if file_name.is_empty() {
+        return Err(
             AppError::BadRequest("No selected file or file type not allowed".to_string())
-        })?;
-
-        fs::create_dir_all(&target_dir)
-            .await
-            .map_err(map_io_error)?;
+                .with_code(error_codes::MISSING_FILE),
+        );
+    }
 
-        let destination_path = target_dir.join(&safe_name);
+    let (target_dir, resolved_dir_id) = resolve_target_directory(state, dir_id).await?;
+    let safe_name = checked_file_name(state, headers, uploader, file_name, None)?;
+    let destination_path = target_dir.join(&safe_name);
+    check_upload_path(state, &destination_path)?;
+    conflict.check(&destination_path).await?;
 
-        let mut output = fs::File::create(&destination_path)
-            .await
-            .map_err(map_io_error)?;
+    prepare_target_dir(state, &target_dir).await?;
 
-        let mut total_bytes = 0u64;
+    // An earlier file in the same request may have used up the quota.
+    uploader.charge(state, 0)?;
+    let mut pending =
+        PendingUpload::create(&state.config.upload_tmp_dir(&state.canonical_root)).await?;
 
-        while let Some(chunk) = field.chunk().await.map_err(|err| {
-            tracing::error!("Failed to read upload chunk: {}", err);
-            AppError::Internal("Internal server error".to_string())
-        })? {
-            total_bytes += chunk.len() as u64;
-            if total_bytes > state.config.max_file_size {
-                return Err(AppError::BadRequest("File too large".to_string()));
-            }
-            output.write_all(&chunk).await.map_err(map_io_error)?;
-        }
+    let mut total_bytes = 0u64;
 
-        let mime_type = field
-            .content_type()
-            .map(|m| m.to_string())
-            .unwrap_or_else(|| "application/octet-stream".to_string());
+    while let Some(chunk) = field.chunk().await.map_err(|err| {
+        tracing::error!("Failed to read upload chunk: {}", err);
+        AppError::Internal("Internal server error".to_string())
+    })? {
+        total_bytes += chunk.len() as u64;
+        check_max_size(&state.config, total_bytes, wire)?;
+        uploader.charge(state, chunk.len() as u64)?;
+        pending.write(&chunk).await?;
+    }
 
-        let relative_path = diff_paths(&destination_path, &*state.canonical_root)
-            .unwrap_or_else(|| PathBuf::from(&safe_name));
+    check_min_size(&state.config, total_bytes)?;
+    let (destination_path, sha256) = pending
+        .commit(&destination_path, state.config.upload_file_mode, conflict)
+        .await?;
+    let safe_name = stored_name(&destination_path);
+    if state.config.upload_sidecar {
+        write_sidecar(
+            &destination_path,
+            file_name,
+            &safe_name,
+            total_bytes,
+            state.config.upload_file_mode,
+        )
+        .await;
+    }
 
-        let relative_str = relative_path
-            .to_string_lossy()
-            .replace(std::path::MAIN_SEPARATOR, "/");
+    let mime_type = field
+        .content_type()
+        .map(|m| m.to_string())
+        .unwrap_or_else(|| "application/octet-stream".to_string());
 
-        let metadata = fs::metadata(&destination_path)
-            .await
-            .map_err(map_io_error)?;
-        let modified_ts = metadata.modified().ok().map(unix_timestamp).unwrap_or(0);
-        let entry_info = EntryInfo::new(
-            relative_str.clone(),
-            safe_name.clone(),
-            parent_relative_path(&relative_str),
-            false,
-            total_bytes,
-            mime_type.clone(),
-            modified_ts,
-        );
-        let entry_id = state
-            .catalog
-            .sync_entry(entry_info)
-            .await
-            .map_err(|err| AppError::Internal(err.to_string()))?;
+    let relative_path = diff_paths(&destination_path, &*state.canonical_root)
+        .unwrap_or_else(|| PathBuf::from(&safe_name));
 
-        let base_url = build_base_url(&headers);
-        let (download_url, list_url) = upload_links(&base_url, &entry_id, &resolved_dir_id);
+    let relative_str = relative_path
+        .to_string_lossy()
+        .replace(std::path::MAIN_SEPARATOR, "/");
 
-        let created_date = format_modified_time(Utc::now().with_timezone(&Local));
-        saved_file = Some(UploadResponse {
-            name: safe_name,
-            size_bytes: total_bytes,
-            mime_type,
-            created_date,
-            id: entry_id,
-            dir_id: resolved_dir_id.clone(),
-            download_url,
-            list_url,
-            relative_path: relative_str.clone(),
-        });
+    let metadata = fs::metadata(&destination_path)
+        .await
+        .map_err(map_io_error)?;
+    let modified_ts = metadata.modified().ok().map(unix_timestamp).unwrap_or(0);
+    let modified = metadata.modified().ok().map(rfc3339_utc);
+    let entry_info = EntryInfo::new(
+        relative_str.clone(),
+        safe_name.clone(),
+        parent_relative_path(&relative_str),
+        false,
+        total_bytes,
+        mime_type.clone(),
+        modified_ts,
+    );
+    let entry_id = state
+        .catalog
+        .sync_entry(entry_info)
+        .await
+        .map_err(|err| AppError::Internal(err.to_string()))?;
 
-        break;
-    }
+    let base_url = build_base_url(headers);
+    let (download_url, list_url) = upload_links(&base_url, &entry_id, &resolved_dir_id);
 
-    let saved = saved_file.ok_or_else(|| AppError::BadRequest("No file to upload".to_string()))?;
-    let UploadResponse {
-        name,
-        size_bytes,
+    let created_date = format_modified_time(Utc::now().with_timezone(&Local));
+    Ok(UploadResponse {
+        name: safe_name,
+        original_name: file_name.to_string(),
+        size_bytes: total_bytes,
         mime_type,
         created_date,
-        id,
-        dir_id: response_dir_id,
+        modified,
+        id: entry_id,
+        dir_id: resolved_dir_id,
         download_url,
         list_url,
-        relative_path,
-    } = saved;
-
-    tracing::info!(
-        "[uploading] {} - {} - {} - {}",
-        client_ip(&headers),
-        name,
-        relative_path,
-        client_user_agent(&headers)
-    );
-
-    let _ = state.catalog_events.try_send(CatalogCommand::RefreshAll);
+        relative_path: relative_str,
+        sha256,
+    })
+}
 
-    let payload = serde_json::json!({
-        "status": "success",
-        "name": name,
-        "id": id,
-        "dir_id": response_dir_id,
-        "size_bytes": size_bytes,
-        "created_date": created_date,
-        "mime_type": mime_type,
-        "download_url": download_url,
-        "list_url": list_url,
+/// Response for a request carrying several files: one entry per file part in order, and an
+/// overall `status` of `success`, `partial` or `error` (nothing was stored).
+fn batch_payload(results: Vec<Result<UploadResponse, (String, AppError)>>) -> serde_json::Value {
+    let uploaded = results.iter().filter(|result| result.is_ok()).count();
+    let failed = results.len() - uploaded;
+    let files: Vec<_> = results
+        .into_iter()
+        .map(|result| match result {
+            Ok(saved) => {
+                let mut entry = saved.payload();
+                if let Some(entry) = entry.as_object_mut() {
+                    entry.remove("powered_by");
+                }
+                entry
+            }
+            Err((original_name, err)) => serde_json::json!({
+                "status": "error",
+                "original_name": original_name,
+                "code": err.status_and_code().1,
+                "message": err.to_string(),
+            }),
+        })
+        .collect();
+    let status = match (uploaded, failed) {
+        (_, 0) => "success",
+        (0, _) => "error",
+        _ => "partial",
+    };
+    serde_json::json!({
+        "status": status,
+        "uploaded": uploaded,
+        "failed": failed,
+        "files": files,
         "powered_by": POWERED_BY,
-    });
-
-    let mut response = Response::builder()
-        .status(StatusCode::OK)
-        .header(
-            axum::http::header::CONTENT_TYPE,
-            "application/json; charset=utf-8",
-        )
-        .body(Body::from(serde_json::to_string_pretty(&payload).unwrap()))
-        .unwrap();
-    response.headers_mut().insert(
-        "X-Upload-Server",
-        axum::http::HeaderValue::from_static(POWERED_BY),
-    );
-    Ok(response)
+    })
 }
 
 pub(crate) async fn handle_upload_stream(
     State(state): State<AppState>,
     headers: HeaderMap,
     Query(query): Query<UploadStreamQuery>,
+    wire: Option<Extension<WireBytes>>,
+    connect_info: Option<ConnectInfo<SocketAddr>>,
     body: Body,
 ) -> Result<Response, AppError> {
-    let provided_token = auth_token(&headers);
-    if provided_token.as_deref() != Some(state.config.upload_token.as_str()) {
-        return Err(AppError::Unauthorized("Unauthorized".to_string()));
+    let uploader = authorize_upload(&state, &headers, connect_info)?;
+    check_content_length(&state.config, &headers, 0)?;
+
+    let idempotency_key = idempotency_key(&headers);
+    if let Some(key) = &idempotency_key {
+        if let Some(body) = state.upload_keys.get(&uploader.scope(&state), key) {
+            tracing::info!("[upload-replay] {} - {}", client_ip(&headers), key);
+            return Ok(upload_response(body, true));
+        }
     }
 
     let UploadStreamQuery {
         dir,
         name,
         allow_no_ext,
+        conflict,
     } = query;
+    let conflict = uploader.conflict(
+        UploadConflict::requested(&headers, conflict.as_deref(), &uploader)?.unwrap_or_default(),
+    );
 
     let dir_id = extract_dir_id(&headers, dir);
     let (target_dir, resolved_dir_id) = resolve_target_directory(&state, dir_id).await?;
 
     let mut file_name = name.unwrap_or_default();
     if file_name.is_empty() {
-        if let Some(header_name) = headers
-            .get("X-Upload-Filename")
-            .and_then(|value| value.to_str().ok())
-            .map(str::trim)
-            .filter(|value| !value.is_empty())
-        {
-            file_name = header_name.to_string();
+        if let Some(header_name) = upload_filename_header(&headers) {
+            file_name = header_name;
         }
     }
 
     if file_name.is_empty() {
-        return Err(AppError::BadRequest("Missing file name".to_string()));
+        return Err(AppError::BadRequest("Missing file name".to_string())
+            .with_code(error_codes::MISSING_FILE));
     }
 
-    let allow_missing_extension = headers
-        .get("X-Allow-No-Ext")
-        .and_then(|value| value.to_str().ok())
-        .map(|value| matches!(value.to_ascii_lowercase().as_str(), "1" | "true" | "yes"))
-        .unwrap_or_else(|| allow_no_ext.unwrap_or(false));
-    let allow_any_extension = headers
-        .get("X-Allow-All-Ext")
-        .and_then(|value| value.to_str().ok())
-        .map(|value| matches!(value.to_ascii_lowercase().as_str(), "1" | "true" | "yes"))
-        .unwrap_or(false);
-
-    let clean_name = StdPath::new(&file_name)
-        .file_name()
-        .and_then(|name| name.to_str())
-        .ok_or_else(|| {
-            AppError::BadRequest("No selected file or file type not allowed".to_string())
-        })?;
-
-    let has_extension = StdPath::new(clean_name).extension().is_some();
-    let extension_allowed = is_allowed_file(clean_name, &state.config.allowed_extensions);
-
-    if !allow_any_extension && !extension_allowed && !(allow_missing_extension && !has_extension) {
-        return Err(AppError::BadRequest(
-            "No selected file or file type not allowed".to_string(),
-        ));
-    }
-
-    let safe_name = secure_filename(clean_name).ok_or_else(|| {
-        AppError::BadRequest("No selected file or file type not allowed".to_string())
-    })?;
-
-    fs::create_dir_all(&target_dir)
-        .await
-        .map_err(map_io_error)?;
-
+    let safe_name = checked_file_name(&state, &headers, &uploader, &file_name, allow_no_ext)?;
     let destination_path = target_dir.join(&safe_name);
 
     if !destination_path.starts_with(&*state.canonical_root) {
-        return Err(AppError::BadRequest("Invalid directory path".to_string()));
+        return Err(AppError::BadRequest("Invalid directory path".to_string())
+            .with_code(error_codes::INVALID_PATH));
     }
+    check_upload_path(&state, &destination_path)?;
+    conflict.check(&destination_path).await?;
 
-    let mut output = fs::File::create(&destination_path)
-        .await
-        .map_err(map_io_error)?;
+    prepare_target_dir(&state, &target_dir).await?;
+
+    let mut pending =
+        PendingUpload::create(&state.config.upload_tmp_dir(&state.canonical_root)).await?;
 
     let mut total_bytes = 0u64;
     let mut stream = body.into_data_stream();
@@ -339,22 +462,29 @@ pub(crate) async fn handle_upload_stream(
         }
 
         total_bytes += chunk.len() as u64;
-        if total_bytes > state.config.max_file_size {
-            return Err(AppError::BadRequest("File too large".to_string()));
-        }
+        check_max_size(&state.config, total_bytes, wire.as_deref())?;
+        uploader.charge(&state, chunk.len() as u64)?;
 
-        output
-            .write_all(chunk.as_ref())
-            .await
-            .map_err(map_io_error)?;
+        pending.write(chunk.as_ref()).await?;
     }
 
-    output.flush().await.map_err(map_io_error)?;
+    check_min_size(&state.config, total_bytes)?;
+    let (destination_path, sha256) = pending
+        .commit(&destination_path, state.config.upload_file_mode, conflict)
+        .await?;
+    let safe_name = stored_name(&destination_path);
+    if state.config.upload_sidecar {
+        write_sidecar(
+            &destination_path,
+            &file_name,
+            &safe_name,
+            total_bytes,
+            state.config.upload_file_mode,
+        )
+        .await;
+    }
 
-    let mime_type = MimeGuess::from_path(&safe_name)
-        .first_raw()
-        .unwrap_or("application/octet-stream")
-        .to_string();
+    let mime_type = mime_type_for(StdPath::new(&safe_name));
 
     let relative_path = diff_paths(&destination_path, &*state.canonical_root)
         .unwrap_or_else(|| PathBuf::from(&safe_name));
@@ -367,6 +497,7 @@ pub(crate) async fn handle_upload_stream(
         .await
         .map_err(map_io_error)?;
     let modified_ts = metadata.modified().ok().map(unix_timestamp).unwrap_or(0);
+    let modified = metadata.modified().ok().map(rfc3339_utc);
     let entry_info = EntryInfo::new(
         relative_str.clone(),
         safe_name.clone(),
@@ -388,14 +519,17 @@ pub(crate) async fn handle_upload_stream(
     let created_date = format_modified_time(Utc::now().with_timezone(&Local));
     let saved = UploadResponse {
         name: safe_name,
+        original_name: file_name.clone(),
         size_bytes: total_bytes,
         mime_type,
         created_date,
+        modified,
         id: entry_id,
         dir_id: resolved_dir_id.clone(),
         download_url,
         list_url,
         relative_path: relative_str.clone(),
+        sha256,
     };
 
     tracing::info!(
@@ -411,29 +545,735 @@ pub(crate) async fn handle_upload_stream(
     let payload = serde_json::json!({
         "status": "success",
         "name": saved.name,
+        "original_name": saved.original_name,
         "id": saved.id,
         "dir_id": saved.dir_id,
         "size_bytes": saved.size_bytes,
         "created_date": saved.created_date,
+        "modified": saved.modified,
         "mime_type": saved.mime_type,
         "download_url": saved.download_url,
         "list_url": saved.list_url,
+        "sha256": saved.sha256,
+        "banner": state.config.banner,
         "powered_by": POWERED_BY,
     });
 
+    let body = serde_json::to_string_pretty(&payload).unwrap();
+    if let Some(key) = &idempotency_key {
+        state
+            .upload_keys
+            .insert(&uploader.scope(&state), key, body.clone());
+    }
+    Ok(upload_response(body, false))
+}
+
+/// `POST /upload?validate=true`: runs the checks an upload would (name and extension,
+/// target directory, size limits) for `name` and `size`, or `X-Upload-Filename` and
+/// `X-Upload-Size`, and reports where the file would be stored. No body is read and nothing
+/// is written. Without a size the size checks are skipped.
+async fn validate_upload(
+    state: &AppState,
+    headers: &HeaderMap,
+    query: UploadQuery,
+    uploader: &Uploader,
+) -> Result<Response, AppError> {
+    let file_name = query
+        .name
+        .map(|name| name.trim().to_string())
+        .filter(|name| !name.is_empty())
+        .or_else(|| upload_filename_header(headers))
+        .ok_or_else(|| {
+            AppError::BadRequest("Missing file name".to_string())
+                .with_code(error_codes::MISSING_FILE)
+        })?;
+    let size = match query.size {
+        Some(size) => Some(size),
+        None => headers
+            .get("X-Upload-Size")
+            .and_then(|value| value.to_str().ok())
+            .map(|value| {
+                value.trim().parse::<u64>().map_err(|_| {
+                    AppError::BadRequest("X-Upload-Size must be a byte count".to_string())
+                })
+            })
+            .transpose()?,
+    };
+
+    let dir_id = extract_dir_id(headers, query.dir);
+    let (target_dir, resolved_dir_id) = resolve_target_directory(state, dir_id).await?;
+    let safe_name = checked_file_name(state, headers, uploader, &file_name, None)?;
+    let destination_path = target_dir.join(&safe_name);
+    if !destination_path.starts_with(&*state.canonical_root) {
+        return Err(AppError::BadRequest("Invalid directory path".to_string())
+            .with_code(error_codes::INVALID_PATH));
+    }
+    check_upload_path(state, &destination_path)?;
+    uploader
+        .conflict(
+            UploadConflict::requested(headers, query.conflict.as_deref(), uploader)?
+                .unwrap_or_default(),
+        )
+        .check(&destination_path)
+        .await?;
+    if !state.config.create_missing_dirs {
+        require_existing_dir(&target_dir).await?;
+    }
+    if let Some(size) = size {
+        check_max_size(&state.config, size, None)?;
+        check_min_size(&state.config, size)?;
+    }
+
+    let relative_path = diff_paths(&destination_path, &*state.canonical_root)
+        .unwrap_or_else(|| PathBuf::from(&safe_name))
+        .to_string_lossy()
+        .replace(std::path::MAIN_SEPARATOR, "/");
+    let payload = serde_json::json!({
+        "status": "ok",
+        "name": safe_name,
+        "original_name": file_name,
+        "dir_id": resolved_dir_id,
+        "path": relative_path,
+        "size_bytes": size,
+        "max_file_size": state.config.max_file_size,
+        "banner": state.config.banner,
+        "powered_by": POWERED_BY,
+    });
+    let body = serde_json::to_string_pretty(&payload)
+        .map_err(|err| AppError::Internal(err.to_string()))?;
+    Response::builder()
+        .status(StatusCode::OK)
+        .header(header::CONTENT_TYPE, "application/json; charset=utf-8")
+        .body(Body::from(body))
+        .map_err(|err| AppError::Internal(err.to_string()))
+}
+
+/// Who is sending an upload: the token holder, or with `open_upload` anyone else, keyed by
+/// client address for the open-upload limits.
+enum Uploader {
+    Token,
+    Open(String),
+}
+
+impl Uploader {
+    /// Idempotency keys are scoped per uploader so open clients never see each other's
+    /// responses.
+    fn scope(&self, state: &AppState) -> String {
+        match self {
+            Uploader::Token => state.config.upload_token.clone(),
+            Uploader::Open(ip) => format!("open:{ip}"),
+        }
+    }
+
+    /// Counts received bytes against an open client's daily quota, so one request carrying
+    /// many files cannot run far past it. Token holders are never counted.
+    fn charge(&self, state: &AppState, bytes: u64) -> Result<(), AppError> {
+        match (self, &state.open_uploads) {
+            (Uploader::Open(ip), Some(guard)) => guard.charge(ip, bytes),
+            _ => Ok(()),
+        }
+    }
+
+    /// `overwrite` is for token holders only, like the header relaxations in
+    /// [`checked_file_name`]; an open upload asking for it is refused with 403.
+    fn permit_conflict(
+        &self,
+        requested: Option<UploadConflict>,
+    ) -> Result<Option<UploadConflict>, AppError> {
+        if matches!(self, Uploader::Open(_)) && requested == Some(UploadConflict::Overwrite) {
+            return Err(AppError::Forbidden(
+                "Overwriting files requires the upload token".to_string(),
+            ));
+        }
+        Ok(requested)
+    }
+
+    /// Open uploads never replace an existing file, whatever mode was asked for; they are
+    /// refused with `DESTINATION_EXISTS` instead.
+    fn conflict(&self, requested: UploadConflict) -> UploadConflict {
+        match (self, requested) {
+            (Uploader::Open(_), UploadConflict::Overwrite) => UploadConflict::Reject,
+            _ => requested,
+        }
+    }
+}
+
+/// Token holders always pass. Without the token the upload is refused with 401, unless
+/// `open_upload` is on and the client is still within its rate limit and quota.
+fn authorize_upload(
+    state: &AppState,
+    headers: &HeaderMap,
+    connect_info: Option<ConnectInfo<SocketAddr>>,
+) -> Result<Uploader, AppError> {
+    let provided_token = auth_token(headers);
+    if provided_token.as_deref() == Some(state.config.upload_token.as_str()) {
+        return Ok(Uploader::Token);
+    }
+    let Some(guard) = &state.open_uploads else {
+        return Err(AppError::Unauthorized("Unauthorized".to_string()));
+    };
+    let ip = remote_ip(headers, connect_info.map(|ConnectInfo(addr)| addr));
+    guard.admit(&ip)?;
+    Ok(Uploader::Open(ip))
+}
+
+/// Extension and name checks shared by both upload endpoints and `?validate=true`; returns
+/// the sanitised name the file is stored under. `X-Allow-No-Ext` (or the stream endpoint's
+/// `allow_no_ext`) and `X-Allow-All-Ext` relax the check for token holders only; open
+/// uploads are always held to `allowed_extensions`.
+fn checked_file_name(
+    state: &AppState,
+    headers: &HeaderMap,
+    uploader: &Uploader,
+    file_name: &str,
+    allow_no_ext: Option<bool>,
+) -> Result<String, AppError> {
+    let trusted = matches!(uploader, Uploader::Token);
+    let header_flag = |name: &str| {
+        headers
+            .get(name)
+            .and_then(|value| value.to_str().ok())
+            .map(|value| matches!(value.to_ascii_lowercase().as_str(), "1" | "true" | "yes"))
+    };
+    let allow_missing_extension =
+        trusted && header_flag("X-Allow-No-Ext").unwrap_or_else(|| allow_no_ext.unwrap_or(false));
+    let allow_any_extension = state.config.allow_all_extensions
+        || (trusted && header_flag("X-Allow-All-Ext").unwrap_or(false));
+
+    let clean_name = StdPath::new(file_name)
+        .file_name()
+        .and_then(|name| name.to_str())
+        .ok_or_else(|| {
+            AppError::BadRequest("No selected file or file type not allowed".to_string())
+                .with_code(error_codes::INVALID_FILENAME)
+        })?;
+
+    let has_extension = StdPath::new(clean_name).extension().is_some();
+    let extension_allowed = is_allowed_file(clean_name, &state.config.allowed_extensions);
+
+    if !allow_any_extension && !extension_allowed && !(allow_missing_extension && !has_extension) {
+        return Err(
+            AppError::BadRequest("No selected file or file type not allowed".to_string())
+                .with_code(error_codes::EXT_NOT_ALLOWED),
+        );
+    }
+
+    secure_filename(clean_name).ok_or_else(|| {
+        AppError::BadRequest("No selected file or file type not allowed".to_string())
+            .with_code(error_codes::INVALID_FILENAME)
+    })
+}
+
+/// Lets clients send `Content-Encoding: gzip` upload bodies. Handlers only ever see the
+/// decompressed stream, so size limits apply to the stored content; any other encoding is
+/// rejected with 415.
+pub(crate) fn request_decompression() -> RequestDecompressionLayer {
+    RequestDecompressionLayer::new()
+        .gzip(true)
+        .deflate(false)
+        .br(false)
+        .zstd(false)
+}
+
+/// Success response shared by both upload endpoints; `replayed` marks a response served
+/// from the idempotency cache. `Last-Modified` mirrors the body's `modified`, so replays
+/// carry it too.
+fn upload_response(body: String, replayed: bool) -> Response {
+    let last_modified = serde_json::from_str::<serde_json::Value>(&body)
+        .ok()
+        .and_then(|payload| {
+            let modified = payload.get("modified")?.as_str()?;
+            DateTime::parse_from_rfc3339(modified).ok()
+        })
+        .map(|modified| http_date(modified.with_timezone(&Utc)));
     let mut response = Response::builder()
         .status(StatusCode::OK)
         .header(
             axum::http::header::CONTENT_TYPE,
             "application/json; charset=utf-8",
         )
-        .body(Body::from(serde_json::to_string_pretty(&payload).unwrap()))
+        .body(Body::from(body))
         .unwrap();
     response.headers_mut().insert(
         "X-Upload-Server",
         axum::http::HeaderValue::from_static(POWERED_BY),
     );
-    Ok(response)
+    if let Some(value) = last_modified.and_then(|date| HeaderValue::from_str(&date).ok()) {
+        response.headers_mut().insert(header::LAST_MODIFIED, value);
+    }
+    if replayed {
+        response.headers_mut().insert(
+            "Idempotent-Replayed",
+            axum::http::HeaderValue::from_static("true"),
+        );
+    }
+    response
+}
+
+/// Compressed bytes received so far for a gzip upload, counted before decompression.
+#[derive(Clone, Default)]
+pub(crate) struct WireBytes(Arc<AtomicU64>);
+
+impl WireBytes {
+    fn get(&self) -> u64 {
+        self.0.load(Ordering::Relaxed)
+    }
+}
+
+/// Sits outside [`request_decompression`] and counts the encoded body as it arrives, so
+/// the handlers can compare it with what decompression produces.
+pub(crate) async fn count_wire_bytes(request: Request, next: Next) -> Response {
+    let compressed = request
+        .headers()
+        .get(header::CONTENT_ENCODING)
+        .and_then(|value| value.to_str().ok())
+        .is_some_and(|value| !value.trim().eq_ignore_ascii_case("identity"));
+    if !compressed {
+        return next.run(request).await;
+    }
+
+    let wire = WireBytes::default();
+    let counter = wire.0.clone();
+    let (mut parts, body) = request.into_parts();
+    parts.extensions.insert(wire);
+    let body = Body::from_stream(body.into_data_stream().inspect(move |chunk| {
+        if let Ok(chunk) = chunk {
+            counter.fetch_add(chunk.len() as u64, Ordering::Relaxed);
+        }
+    }));
+    next.run(Request::from_parts(parts, body)).await
+}
+
+/// Refuses a body whose declared `Content-Length` already exceeds `max_file_size` (plus
+/// `overhead` for framing) before any of it is read. Chunked bodies have no length and
+/// compressed ones lose it to decompression; [`check_max_size`] still covers those.
+fn check_content_length(
+    config: &Config,
+    headers: &HeaderMap,
+    overhead: u64,
+) -> Result<(), AppError> {
+    let Some(length) = headers
+        .get(header::CONTENT_LENGTH)
+        .and_then(|value| value.to_str().ok())
+        .and_then(|value| value.trim().parse::<u64>().ok())
+    else {
+        return Ok(());
+    };
+    if length > config.max_file_size.saturating_add(overhead) {
+        tracing::warn!(
+            "[upload] {} - rejected before reading: Content-Length {} over limit {}",
+            client_ip(headers),
+            length,
+            config.max_file_size
+        );
+        return Err(AppError::PayloadTooLarge(format!(
+            "File too large: Content-Length {} exceeds the {} byte limit",
+            length, config.max_file_size
+        )));
+    }
+    Ok(())
+}
+
+/// Checked after every chunk written, on decompressed bytes. Besides the configured limit,
+/// compressed uploads must stay under [`MAX_COMPRESSION_RATIO`] so a small bomb is cut off
+/// early even when `max_file_size` is generous. Failing drops the staged file.
+fn check_max_size(
+    config: &Config,
+    total_bytes: u64,
+    wire: Option<&WireBytes>,
+) -> Result<(), AppError> {
+    if total_bytes > config.max_file_size {
+        return Err(AppError::PayloadTooLarge("File too large".to_string()));
+    }
+    if let Some(wire) = wire {
+        if total_bytes > RATIO_GRACE_BYTES
+            && total_bytes / wire.get().max(1) > MAX_COMPRESSION_RATIO
+        {
+            tracing::warn!(
+                "Rejecting compressed upload: {} bytes from {} on the wire",
+                total_bytes,
+                wire.get()
+            );
+            return Err(
+                AppError::PayloadTooLarge("Compressed upload expands too far".to_string())
+                    .with_code(error_codes::COMPRESSION_RATIO),
+            );
+        }
+    }
+    Ok(())
+}
+
+/// Runs once the full body has been received; rejecting here drops the staged file, so
+/// nothing reaches the destination.
+fn check_min_size(config: &Config, total_bytes: u64) -> Result<(), AppError> {
+    if total_bytes == 0 && config.reject_empty_uploads {
+        return Err(
+            AppError::BadRequest("Empty uploads are not allowed".to_string())
+                .with_code(error_codes::EMPTY_FILE),
+        );
+    }
+    if total_bytes < config.min_file_size {
+        return Err(AppError::BadRequest(format!(
+            "File too small; minimum size is {} bytes",
+            config.min_file_size
+        ))
+        .with_code(error_codes::FILE_TOO_SMALL));
+    }
+    Ok(())
+}
+
+/// Records the name as received next to the stored file (`<name>.meta`), since
+/// `secure_filename` may have rewritten it. Best effort: a failure is logged and the upload
+/// still succeeds.
+async fn write_sidecar(
+    destination: &StdPath,
+    original_name: &str,
+    stored_name: &str,
+    size: u64,
+    mode: Option<u32>,
+) {
+    let mut sidecar = destination.as_os_str().to_owned();
+    sidecar.push(SIDECAR_SUFFIX);
+    let payload = serde_json::json!({
+        "original_name": original_name,
+        "stored_name": stored_name,
+        "size_bytes": size,
+        "uploaded_at": Utc::now().to_rfc3339(),
+    });
+    let body = serde_json::to_string_pretty(&payload).unwrap();
+    let sidecar = PathBuf::from(sidecar);
+    let written = match fs::write(&sidecar, body).await {
+        Ok(()) => set_mode(&sidecar, mode).await,
+        Err(err) => Err(err),
+    };
+    if let Err(err) = written {
+        tracing::warn!(
+            "Failed to write upload sidecar {}: {}",
+            sidecar.display(),
+            err
+        );
+    }
+}
+
+/// Applies `upload_allowed_paths`: the file's root-relative path or one of its directories
+/// must match a pattern, whoever is uploading.
+fn check_upload_path(state: &AppState, destination: &StdPath) -> Result<(), AppError> {
+    let patterns = &state.config.upload_allowed_paths;
+    if patterns.is_empty() {
+        return Ok(());
+    }
+    let relative = relative_path_string(&state.canonical_root, destination).unwrap_or_default();
+    let mut candidate = Some(relative.as_str());
+    while let Some(path) = candidate.filter(|path| !path.is_empty()) {
+        if patterns.iter().any(|pattern| glob_match(pattern, path)) {
+            return Ok(());
+        }
+        candidate = path.rsplit_once('/').map(|(parent, _)| parent);
+    }
+    tracing::warn!("[upload] /{} is outside upload_allowed_paths", relative);
+    Err(
+        AppError::Forbidden(format!("Uploads are not allowed at /{relative}"))
+            .with_code(error_codes::PATH_NOT_ALLOWED),
+    )
+}
+
+/// Makes sure the upload's directory exists: recreated when `create_missing_dirs` is on,
+/// otherwise a missing one is a 404.
+async fn prepare_target_dir(state: &AppState, target_dir: &StdPath) -> Result<(), AppError> {
+    if state.config.create_missing_dirs {
+        create_upload_dir(target_dir, state.config.upload_dir_mode).await
+    } else {
+        require_existing_dir(target_dir).await
+    }
+}
+
+async fn require_existing_dir(dir: &StdPath) -> Result<(), AppError> {
+    match fs::metadata(dir).await {
+        Ok(metadata) if metadata.is_dir() => Ok(()),
+        _ => Err(
+            AppError::NotFound("Upload directory does not exist".to_string())
+                .with_code(error_codes::DIR_NOT_FOUND),
+        ),
+    }
+}
+
+/// `create_dir_all` that also applies `mode` to every directory it had to create.
+pub(crate) async fn create_upload_dir(dir: &StdPath, mode: Option<u32>) -> Result<(), AppError> {
+    let mut missing = Vec::new();
+    let mut current = Some(dir);
+    while let Some(path) = current {
+        if fs::try_exists(path).await.unwrap_or(false) {
+            break;
+        }
+        missing.push(path.to_path_buf());
+        current = path.parent();
+    }
+
+    fs::create_dir_all(dir).await.map_err(map_write_error)?;
+    for created in missing.iter().rev() {
+        set_mode(created, mode).await.map_err(map_write_error)?;
+    }
+    Ok(())
+}
+
+/// Like [`map_io_error`], but a permission problem while storing an upload is a server
+/// misconfiguration rather than a missing file, so it gets its own code and a hint.
+fn map_write_error(err: io::Error) -> AppError {
+    match err.kind() {
+        io::ErrorKind::PermissionDenied | io::ErrorKind::ReadOnlyFilesystem => {
+            tracing::error!("Upload target not writable: {}", err);
+            AppError::Internal(
+                "Upload target is not writable; check the permissions of the served directory"
+                    .to_string(),
+            )
+            .with_code(error_codes::TARGET_NOT_WRITABLE)
+        }
+        _ => map_io_error(err),
+    }
+}
+
+/// Creates and removes a scratch file in `dir`, to find out at startup whether uploads
+/// into it can work.
+pub(crate) fn probe_writable(dir: &StdPath) -> io::Result<()> {
+    let probe = dir.join(format!(".serve-write-check-{}", Ulid::new()));
+    std::fs::OpenOptions::new()
+        .write(true)
+        .create_new(true)
+        .open(&probe)?;
+    std::fs::remove_file(&probe)
+}
+
+/// Applies a configured permission mode explicitly, bypassing the umask. No-op when unset
+/// or on platforms without Unix permissions.
+async fn set_mode(path: &StdPath, mode: Option<u32>) -> io::Result<()> {
+    #[cfg(unix)]
+    if let Some(mode) = mode {
+        use std::os::unix::fs::PermissionsExt;
+        fs::set_permissions(path, std::fs::Permissions::from_mode(mode)).await?;
+    }
+    #[cfg(not(unix))]
+    let _ = (path, mode);
+    Ok(())
+}
+
+/// What an upload does when its target name is taken, from `X-Upload-Conflict`,
+/// `?conflict` or a `conflict` form field.
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq)]
+enum UploadConflict {
+    /// Replace the existing file.
+    Overwrite,
+    /// Refuse with 409 `DESTINATION_EXISTS`.
+    Reject,
+    /// Store as `name-1.ext`, `name-2.ext`, ... whichever is free first.
+    #[default]
+    Rename,
+}
+
+impl UploadConflict {
+    fn parse(value: &str) -> Result<Option<Self>, AppError> {
+        match value.trim().to_ascii_lowercase().as_str() {
+            "" => Ok(None),
+            "overwrite" => Ok(Some(Self::Overwrite)),
+            "reject" => Ok(Some(Self::Reject)),
+            "rename" => Ok(Some(Self::Rename)),
+            other => Err(AppError::BadRequest(format!(
+                "Unknown conflict mode '{other}'; expected overwrite, reject or rename"
+            ))),
+        }
+    }
+
+    /// The query parameter wins over the header, as for `dir`.
+    fn requested(
+        headers: &HeaderMap,
+        query: Option<&str>,
+        uploader: &Uploader,
+    ) -> Result<Option<Self>, AppError> {
+        let mode = match query.map(Self::parse).transpose()?.flatten() {
+            Some(mode) => Some(mode),
+            None => headers
+                .get("X-Upload-Conflict")
+                .and_then(|value| value.to_str().ok())
+                .map(Self::parse)
+                .transpose()?
+                .flatten(),
+        };
+        uploader.permit_conflict(mode)
+    }
+
+    /// Early refusal for `reject`, before the body is read. [`PendingUpload::commit`]
+    /// checks again atomically, so a file appearing meanwhile is still not replaced.
+    async fn check(self, destination: &StdPath) -> Result<(), AppError> {
+        if self == Self::Reject && fs::symlink_metadata(destination).await.is_ok() {
+            return Err(destination_exists());
+        }
+        Ok(())
+    }
+}
+
+fn destination_exists() -> AppError {
+    AppError::Conflict("A file with that name already exists".to_string())
+        .with_code(error_codes::DESTINATION_EXISTS)
+}
+
+/// `report.pdf` with `n` = 2 becomes `report-2.pdf`; `n` = 0 leaves the name alone.
+fn numbered_path(path: &StdPath, n: u32) -> PathBuf {
+    if n == 0 {
+        return path.to_path_buf();
+    }
+    let stem = path
+        .file_stem()
+        .map(|stem| stem.to_string_lossy().into_owned())
+        .unwrap_or_default();
+    let name = match path.extension() {
+        Some(ext) => format!("{stem}-{n}.{}", ext.to_string_lossy()),
+        None => format!("{stem}-{n}"),
+    };
+    path.with_file_name(name)
+}
+
+fn stored_name(path: &StdPath) -> String {
+    path.file_name()
+        .map(|name| name.to_string_lossy().into_owned())
+        .unwrap_or_default()
+}
+
+/// Upload body staged in the temp directory until it is complete. Dropping it without
+/// committing removes the partial file.
+struct PendingUpload {
+    path: PathBuf,
+    file: Option<fs::File>,
+    hasher: Sha256,
+    committed: bool,
+}
+
+impl PendingUpload {
+    async fn create(tmp_dir: &StdPath) -> Result<Self, AppError> {
+        fs::create_dir_all(tmp_dir).await.map_err(map_write_error)?;
+        let path = tmp_dir.join(format!("{}.part", Ulid::new()));
+        let file = fs::File::create(&path).await.map_err(map_write_error)?;
+        Ok(Self {
+            path,
+            file: Some(file),
+            hasher: Sha256::new(),
+            committed: false,
+        })
+    }
+
+    /// Appends `chunk` to the staged file, hashing it on the way.
+    async fn write(&mut self, chunk: &[u8]) -> Result<(), AppError> {
+        self.hasher.update(chunk);
+        self.file
+            .as_mut()
+            .expect("pending upload file is open until commit")
+            .write_all(chunk)
+            .await
+            .map_err(map_io_error)
+    }
+
+    /// Moves the staged file into place, setting `mode` first so the file never appears
+    /// with umask-derived permissions. An existing file at `destination` is handled as
+    /// `conflict` says. Returns where the file ended up and the hex SHA-256 of what was
+    /// written.
+    async fn commit(
+        mut self,
+        destination: &StdPath,
+        mode: Option<u32>,
+        conflict: UploadConflict,
+    ) -> Result<(PathBuf, String), AppError> {
+        if let Some(mut file) = self.file.take() {
+            file.flush().await.map_err(map_io_error)?;
+        }
+        set_mode(&self.path, mode).await.map_err(map_write_error)?;
+
+        let stored = match conflict {
+            UploadConflict::Overwrite => {
+                self.replace(destination).await.map_err(map_write_error)?;
+                destination.to_path_buf()
+            }
+            UploadConflict::Reject => {
+                if !self.place_new(destination, mode).await? {
+                    return Err(destination_exists());
+                }
+                destination.to_path_buf()
+            }
+            UploadConflict::Rename => {
+                let mut stored = None;
+                for attempt in 0..=MAX_RENAME_ATTEMPTS {
+                    let candidate = numbered_path(destination, attempt);
+                    if self.place_new(&candidate, mode).await? {
+                        stored = Some(candidate);
+                        break;
+                    }
+                }
+                stored.ok_or_else(destination_exists)?
+            }
+        };
+
+        self.committed = true;
+        let _ = fs::remove_file(&self.path).await;
+        Ok((
+            stored,
+            format!("{:x}", std::mem::take(&mut self.hasher).finalize()),
+        ))
+    }
+
+    async fn replace(&self, destination: &StdPath) -> io::Result<()> {
+        match fs::rename(&self.path, destination).await {
+            Err(err) if err.kind() == io::ErrorKind::CrossesDevices => {
+                fs::copy(&self.path, destination).await.map(|_| ())
+            }
+            result => result,
+        }
+    }
+
+    /// Puts the staged file at `destination` only if nothing is there yet, atomically: a
+    /// hard link, or where links are not possible a copy into a file opened with
+    /// `create_new`. Returns false when the name is taken.
+    async fn place_new(&self, destination: &StdPath, mode: Option<u32>) -> Result<bool, AppError> {
+        let err = match fs::hard_link(&self.path, destination).await {
+            Ok(()) => return Ok(true),
+            Err(err) => err,
+        };
+        if err.kind() == io::ErrorKind::AlreadyExists {
+            return Ok(false);
+        }
+        tracing::debug!(
+            "Hard link to {} failed ({}), copying instead",
+            destination.display(),
+            err
+        );
+        let mut target = match fs::OpenOptions::new()
+            .write(true)
+            .create_new(true)
+            .open(destination)
+            .await
+        {
+            Ok(target) => target,
+            Err(err) if err.kind() == io::ErrorKind::AlreadyExists => return Ok(false),
+            Err(err) => return Err(map_write_error(err)),
+        };
+        let copied = async {
+            let mut source = fs::File::open(&self.path).await?;
+            tokio::io::copy(&mut source, &mut target).await?;
+            target.flush().await?;
+            set_mode(destination, mode).await
+        }
+        .await;
+        if let Err(err) = copied {
+            let _ = fs::remove_file(destination).await;
+            return Err(map_write_error(err));
+        }
+        Ok(true)
+    }
+}
+
+impl Drop for PendingUpload {
+    fn drop(&mut self) {
+        if !self.committed {
+            drop(self.file.take());
+            let _ = std::fs::remove_file(&self.path);
+        }
+    }
 }
 
 fn is_upload_cancelled(err: &MultipartError) -> bool {
@@ -446,14 +1286,53 @@ fn is_upload_cancelled(err: &MultipartError) -> bool {
 #[derive(Debug)]
 struct UploadResponse {
     name: String,
+    original_name: String,
     size_bytes: u64,
     mime_type: String,
     created_date: String,
+    /// Stored file's mtime as read back after writing, RFC 3339 in UTC.
+    modified: Option<String>,
     id: String,
     dir_id: String,
     download_url: String,
     list_url: String,
     relative_path: String,
+    /// Hex SHA-256 of the stored content, hashed as it was written.
+    sha256: String,
+}
+
+impl UploadResponse {
+    /// The JSON body `/upload` answers with for a single stored file.
+    fn payload(&self) -> serde_json::Value {
+        serde_json::json!({
+            "status": "success",
+            "name": self.name,
+            "original_name": self.original_name,
+            "id": self.id,
+            "dir_id": self.dir_id,
+            "size_bytes": self.size_bytes,
+            "created_date": self.created_date,
+            "modified": self.modified,
+            "mime_type": self.mime_type,
+            "download_url": self.download_url,
+            "list_url": self.list_url,
+            "sha256": self.sha256,
+            "powered_by": POWERED_BY,
+        })
+    }
+}
+
+fn rfc3339_utc(time: std::time::SystemTime) -> String {
+    DateTime::<Utc>::from(time).to_rfc3339_opts(SecondsFormat::Secs, true)
+}
+
+fn upload_filename_header(headers: &HeaderMap) -> Option<String> {
+    headers
+        .get("X-Upload-Filename")
+        .and_then(|value| value.to_str().ok())
+        .map(str::trim)
+        .filter(|value| !value.is_empty())
+        .map(|value| value.to_string())
 }
 
 fn extract_dir_id(headers: &HeaderMap, query_dir: Option<String>) -> Option<String> {
@@ -483,9 +1362,10 @@ async fn resolve_target_directory(
     let requested = dir_id.unwrap_or_else(|| "root".to_string());
     let trimmed = requested.trim();
     if trimmed.is_empty() {
-        return Err(AppError::BadRequest(
-            "Directory id cannot be empty".to_string(),
-        ));
+        return Err(
+            AppError::BadRequest("Directory id cannot be empty".to_string())
+                .with_code(error_codes::MISSING_ID),
+        );
     }
 
     if trimmed.eq_ignore_ascii_case("root") {
@@ -500,9 +1380,10 @@ async fn resolve_target_directory(
         .ok_or_else(|| AppError::NotFound(NOT_FOUND_MESSAGE.to_string()))?;
 
     if !entry.is_dir {
-        return Err(AppError::BadRequest(
-            "Directory id must reference a directory".to_string(),
-        ));
+        return Err(
+            AppError::BadRequest("Directory id must reference a directory".to_string())
+                .with_code(error_codes::NOT_A_DIRECTORY),
+        );
     }
 
     let full_path = if entry.relative_path.is_empty() {
@@ -521,3 +1402,617 @@ fn upload_links(base_url: &str, file_id: &str, dir_id: &str) -> (String, String)
         format!("{}/list?id={}", trimmed, dir_id),
     )
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use axum::extract::FromRequest;
+
+    use crate::test_support::{TempDir, app_state};
+
+    fn token_headers() -> HeaderMap {
+        let mut headers = HeaderMap::new();
+        headers.insert("X-Serve-Token", HeaderValue::from_static("abogoboga"));
+        headers
+    }
+
+    async fn stream_upload(
+        state: &AppState,
+        headers: HeaderMap,
+        name: &str,
+        body: &'static [u8],
+    ) -> Result<serde_json::Value, AppError> {
+        let query = UploadStreamQuery {
+            dir: None,
+            name: Some(name.to_string()),
+            allow_no_ext: None,
+            conflict: None,
+        };
+        let response = handle_upload_stream(
+            State(state.clone()),
+            headers,
+            Query(query),
+            None,
+            None,
+            Body::from(body),
+        )
+        .await?;
+        let body = axum::body::to_bytes(response.into_body(), usize::MAX)
+            .await
+            .unwrap();
+        Ok(serde_json::from_slice(&body).unwrap())
+    }
+
+    /// `/upload` with one part per `(field, filename, content)`.
+    async fn multipart_upload(
+        state: &AppState,
+        headers: HeaderMap,
+        parts: &[(&str, &str, &str)],
+    ) -> Result<serde_json::Value, AppError> {
+        const BOUNDARY: &str = "serve-test-boundary";
+        let mut body = String::new();
+        for (field, filename, content) in parts {
+            body.push_str(&format!(
+                "--{BOUNDARY}\r\nContent-Disposition: form-data; name=\"{field}\"; \
+                 filename=\"{filename}\"\r\n\r\n{content}\r\n"
+            ));
+        }
+        body.push_str(&format!("--{BOUNDARY}--\r\n"));
+        let request = axum::http::Request::builder()
+            .header(
+                header::CONTENT_TYPE,
+                format!("multipart/form-data; boundary={BOUNDARY}"),
+            )
+            .body(Body::from(body))
+            .unwrap();
+        let multipart = Multipart::from_request(request, &()).await;
+        let query = UploadQuery {
+            dir: None,
+            validate: None,
+            name: None,
+            size: None,
+            conflict: None,
+        };
+        let response = handle_upload(
+            State(state.clone()),
+            headers,
+            Query(query),
+            None,
+            None,
+            multipart,
+        )
+        .await?;
+        let body = axum::body::to_bytes(response.into_body(), usize::MAX)
+            .await
+            .unwrap();
+        Ok(serde_json::from_slice(&body).unwrap())
+    }
+
+    #[test]
+    fn upload_response_declares_utf8() {
+        let response = upload_response("{}".to_string(), false);
+        assert_eq!(
+            response.headers()[header::CONTENT_TYPE],
+            "application/json; charset=utf-8"
+        );
+    }
+
+    fn error_code(result: Result<serde_json::Value, AppError>) -> &'static str {
+        result
+            .err()
+            .expect("upload should fail")
+            .status_and_code()
+            .1
+    }
+
+    #[tokio::test]
+    async fn empty_and_undersized_uploads() {
+        let dir = TempDir::new();
+        let state = app_state(&dir, "reject_empty_uploads = true\nmin_file_size = 4\n").await;
+        assert_eq!(
+            error_code(stream_upload(&state, token_headers(), "empty.txt", b"").await),
+            error_codes::EMPTY_FILE
+        );
+        assert_eq!(
+            error_code(stream_upload(&state, token_headers(), "short.txt", b"abc").await),
+            error_codes::FILE_TOO_SMALL
+        );
+        stream_upload(&state, token_headers(), "exact.txt", b"abcd")
+            .await
+            .unwrap();
+        assert!(!state.canonical_root.join("empty.txt").exists());
+        assert!(!state.canonical_root.join("short.txt").exists());
+
+        let dir = TempDir::new();
+        let state = app_state(&dir, "").await;
+        let saved = stream_upload(&state, token_headers(), "empty.txt", b"")
+            .await
+            .unwrap();
+        assert_eq!(saved["size_bytes"], 0);
+    }
+
+    #[tokio::test]
+    async fn allow_all_extensions_accepts_any_type() {
+        let dir = TempDir::new();
+        let state = app_state(&dir, "allow_all_extensions = true\n").await;
+        let saved = stream_upload(&state, token_headers(), "model.glb", b"glTF")
+            .await
+            .unwrap();
+        assert_eq!(saved["name"], "model.glb");
+
+        let dir = TempDir::new();
+        let state = app_state(&dir, "").await;
+        assert_eq!(
+            error_code(stream_upload(&state, token_headers(), "model.glb", b"glTF").await),
+            error_codes::EXT_NOT_ALLOWED
+        );
+    }
+
+    #[tokio::test]
+    async fn oversized_content_length_is_refused_up_front() {
+        let dir = TempDir::new();
+        let state = app_state(&dir, "max_file_size = 8\n").await;
+        let mut headers = token_headers();
+        headers.insert(header::CONTENT_LENGTH, HeaderValue::from_static("4096"));
+        let err = stream_upload(&state, headers, "big.txt", b"tiny")
+            .await
+            .err()
+            .unwrap();
+        assert_eq!(err.status_and_code().0, StatusCode::PAYLOAD_TOO_LARGE);
+        assert!(err.to_string().contains("4096"), "{err}");
+
+        let err = stream_upload(&state, token_headers(), "big.txt", b"more than eight")
+            .await
+            .err()
+            .unwrap();
+        assert_eq!(err.status_and_code().0, StatusCode::PAYLOAD_TOO_LARGE);
+        assert!(!state.canonical_root.join("big.txt").exists());
+    }
+
+    #[tokio::test]
+    async fn repeated_idempotency_key_replays_the_first_upload() {
+        let dir = TempDir::new();
+        let state = app_state(&dir, "").await;
+        let mut headers = token_headers();
+        headers.insert("Idempotency-Key", HeaderValue::from_static("retry-1"));
+
+        let first = stream_upload(&state, headers.clone(), "report.txt", b"v1")
+            .await
+            .unwrap();
+        let second = stream_upload(&state, headers, "report.txt", b"v1")
+            .await
+            .unwrap();
+        assert_eq!(first, second);
+        assert_eq!(second["name"], "report.txt");
+        assert!(!state.canonical_root.join("report-1.txt").exists());
+
+        let other = stream_upload(&state, token_headers(), "report.txt", b"v2")
+            .await
+            .unwrap();
+        assert_eq!(other["name"], "report-1.txt");
+    }
+
+    #[tokio::test]
+    async fn upload_allowed_paths_match_the_target_or_a_parent() {
+        let dir = TempDir::new();
+        let state = app_state(
+            &dir,
+            "upload_allowed_paths = [\"incoming\", \"users/*/drop\"]\n",
+        )
+        .await;
+        let allowed =
+            |relative: &str| check_upload_path(&state, &state.canonical_root.join(relative));
+
+        assert!(allowed("incoming/a.txt").is_ok());
+        assert!(allowed("incoming/nested/a.txt").is_ok());
+        assert!(allowed("users/alice/drop/a.txt").is_ok());
+        assert!(allowed("users/alice/a.txt").is_err());
+        assert!(allowed("incoming.txt").is_err());
+        assert_eq!(
+            error_code(stream_upload(&state, token_headers(), "a.txt", b"a").await),
+            error_codes::PATH_NOT_ALLOWED
+        );
+    }
+
+    fn open_headers(ip: &'static str) -> HeaderMap {
+        let mut headers = HeaderMap::new();
+        headers.insert("X-Forwarded-For", HeaderValue::from_static(ip));
+        headers
+    }
+
+    #[tokio::test]
+    async fn open_uploads_are_limited_and_never_overwrite() {
+        let dir = TempDir::new();
+        let state = app_state(
+            &dir,
+            "open_upload = true\nopen_upload_rate = 3\nopen_upload_quota = 16\n",
+        )
+        .await;
+
+        let first = stream_upload(&state, open_headers("203.0.113.7"), "a.txt", b"first")
+            .await
+            .unwrap();
+        assert_eq!(first["name"], "a.txt");
+        let second = stream_upload(&state, open_headers("203.0.113.7"), "a.txt", b"2nd")
+            .await
+            .unwrap();
+        assert_eq!(second["name"], "a-1.txt");
+        assert_eq!(
+            std::fs::read(state.canonical_root.join("a.txt")).unwrap(),
+            b"first"
+        );
+
+        let mut overwrite = open_headers("203.0.113.7");
+        overwrite.insert("X-Upload-Conflict", HeaderValue::from_static("overwrite"));
+        let err = stream_upload(&state, overwrite, "a.txt", b"x")
+            .await
+            .err()
+            .unwrap();
+        assert_eq!(err.status_and_code().0, StatusCode::FORBIDDEN);
+
+        // Three uploads a minute, the refused one included.
+        assert_eq!(
+            error_code(stream_upload(&state, open_headers("203.0.113.7"), "b.txt", b"b").await),
+            error_codes::TOO_MANY_REQUESTS
+        );
+        // Token holders are not counted.
+        stream_upload(&state, token_headers(), "b.txt", b"b")
+            .await
+            .unwrap();
+
+        // The quota is charged as bytes arrive.
+        assert_eq!(
+            error_code(
+                stream_upload(
+                    &state,
+                    open_headers("203.0.113.8"),
+                    "c.txt",
+                    b"far too large for it"
+                )
+                .await
+            ),
+            error_codes::UPLOAD_QUOTA_EXCEEDED
+        );
+        assert!(!state.canonical_root.join("c.txt").exists());
+    }
+
+    #[tokio::test]
+    async fn filename_header_overrides_the_part_name() {
+        let dir = TempDir::new();
+        let state = app_state(&dir, "").await;
+        let mut headers = token_headers();
+        headers.insert("X-Upload-Filename", HeaderValue::from_static("right.txt"));
+        let saved = multipart_upload(&state, headers, &[("file", "wrong.txt", "hello")])
+            .await
+            .unwrap();
+        assert_eq!(saved["name"], "right.txt");
+        assert!(state.canonical_root.join("right.txt").exists());
+        assert!(!state.canonical_root.join("wrong.txt").exists());
+    }
+
+    #[tokio::test]
+    async fn original_name_survives_sanitising() {
+        let dir = TempDir::new();
+        let state = app_state(&dir, "upload_sidecar = true\n").await;
+        let saved = multipart_upload(
+            &state,
+            token_headers(),
+            &[("file", "reports/Q1 summary.txt", "figures")],
+        )
+        .await
+        .unwrap();
+        assert_eq!(saved["name"], "Q1_summary.txt");
+        assert_eq!(saved["original_name"], "reports/Q1 summary.txt");
+
+        let sidecar = state
+            .canonical_root
+            .join(format!("Q1_summary.txt{SIDECAR_SUFFIX}"));
+        let meta: serde_json::Value =
+            serde_json::from_slice(&std::fs::read(sidecar).unwrap()).unwrap();
+        assert_eq!(meta["original_name"], "reports/Q1 summary.txt");
+    }
+
+    /// Catalog id for a directory at `relative`, whether or not it exists on disk; a
+    /// missing one is what remains when someone deletes it behind the server's back.
+    async fn catalog_dir(state: &AppState, relative: &str) -> HeaderValue {
+        let id = state
+            .catalog
+            .sync_entry(EntryInfo::new(
+                relative.to_string(),
+                relative.to_string(),
+                None,
+                true,
+                0,
+                "inode/directory".to_string(),
+                0,
+            ))
+            .await
+            .unwrap();
+        HeaderValue::from_str(&id).unwrap()
+    }
+
+    #[tokio::test]
+    async fn missing_target_directory_per_create_missing_dirs() {
+        let dir = TempDir::new();
+        let state = app_state(&dir, "create_missing_dirs = false\n").await;
+        let mut headers = token_headers();
+        headers.insert("X-Upload-Dir", catalog_dir(&state, "inbox").await);
+        assert_eq!(
+            error_code(stream_upload(&state, headers, "a.txt", b"a").await),
+            error_codes::DIR_NOT_FOUND
+        );
+        assert!(!state.canonical_root.join("inbox").exists());
+
+        let dir = TempDir::new();
+        let state = app_state(&dir, "create_missing_dirs = true\n").await;
+        let mut headers = token_headers();
+        headers.insert("X-Upload-Dir", catalog_dir(&state, "inbox").await);
+        stream_upload(&state, headers, "a.txt", b"a").await.unwrap();
+        assert!(state.canonical_root.join("inbox/a.txt").is_file());
+    }
+
+    #[cfg(unix)]
+    #[tokio::test]
+    async fn uploads_take_the_configured_modes() {
+        use std::os::unix::fs::PermissionsExt;
+
+        let dir = TempDir::new();
+        let state = app_state(
+            &dir,
+            "upload_file_mode = \"0640\"\nupload_dir_mode = \"0750\"\n",
+        )
+        .await;
+        let mut headers = token_headers();
+        headers.insert("X-Upload-Dir", catalog_dir(&state, "new").await);
+        stream_upload(&state, headers, "a.txt", b"a").await.unwrap();
+
+        let mode = |path: &str| {
+            std::fs::metadata(state.canonical_root.join(path))
+                .unwrap()
+                .permissions()
+                .mode()
+                & 0o777
+        };
+        assert_eq!(mode("new/a.txt"), 0o640);
+        assert_eq!(mode("new"), 0o750);
+    }
+
+    #[tokio::test]
+    async fn upload_reports_the_stored_mtime() {
+        let dir = TempDir::new();
+        let state = app_state(&dir, "").await;
+        let query = UploadStreamQuery {
+            dir: None,
+            name: Some("a.txt".to_string()),
+            allow_no_ext: None,
+            conflict: None,
+        };
+        let response = handle_upload_stream(
+            State(state.clone()),
+            token_headers(),
+            Query(query),
+            None,
+            None,
+            Body::from("a"),
+        )
+        .await
+        .unwrap();
+
+        let stored = std::fs::metadata(state.canonical_root.join("a.txt"))
+            .unwrap()
+            .modified()
+            .unwrap();
+        assert_eq!(
+            response.headers()[header::LAST_MODIFIED],
+            http_date(DateTime::<Utc>::from(stored)).as_str()
+        );
+        let body = axum::body::to_bytes(response.into_body(), usize::MAX)
+            .await
+            .unwrap();
+        let saved: serde_json::Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(saved["modified"], rfc3339_utc(stored));
+    }
+
+    #[tokio::test]
+    async fn validate_runs_the_upload_checks_without_writing() {
+        let dir = TempDir::new();
+        let state = app_state(&dir, "max_file_size = 100\nmin_file_size = 2\n").await;
+        std::fs::write(state.canonical_root.join("taken.txt"), "x").unwrap();
+        let validate = |headers: HeaderMap, name: Option<&str>, size: Option<u64>| {
+            let query = UploadQuery {
+                dir: None,
+                validate: Some(true),
+                name: name.map(str::to_string),
+                size,
+                conflict: Some("reject".to_string()),
+            };
+            let state = state.clone();
+            async move {
+                // Validation never reads the body, so a request without one will do.
+                let multipart =
+                    Multipart::from_request(axum::http::Request::new(Body::empty()), &()).await;
+                handle_upload(State(state), headers, Query(query), None, None, multipart).await
+            }
+        };
+        let code = |result: Result<Response, AppError>| result.err().unwrap().status_and_code().1;
+
+        let response = validate(token_headers(), Some("notes.txt"), Some(10))
+            .await
+            .unwrap();
+        let body = axum::body::to_bytes(response.into_body(), usize::MAX)
+            .await
+            .unwrap();
+        let payload: serde_json::Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(payload["status"], "ok");
+        assert_eq!(payload["path"], "notes.txt");
+
+        assert_eq!(
+            code(validate(HeaderMap::new(), Some("notes.txt"), None).await),
+            error_codes::UNAUTHORIZED
+        );
+        assert_eq!(
+            code(validate(token_headers(), None, None).await),
+            error_codes::MISSING_FILE
+        );
+        assert_eq!(
+            code(validate(token_headers(), Some("tool.xyz"), None).await),
+            error_codes::EXT_NOT_ALLOWED
+        );
+        assert_eq!(
+            code(validate(token_headers(), Some("taken.txt"), None).await),
+            error_codes::DESTINATION_EXISTS
+        );
+        assert_eq!(
+            code(validate(token_headers(), Some("notes.txt"), Some(101)).await),
+            error_codes::FILE_TOO_LARGE
+        );
+        assert_eq!(
+            code(validate(token_headers(), Some("notes.txt"), Some(1)).await),
+            error_codes::FILE_TOO_SMALL
+        );
+        assert!(!state.canonical_root.join("notes.txt").exists());
+    }
+
+    #[tokio::test]
+    async fn directory_comes_from_the_configured_form_field() {
+        let dir = TempDir::new();
+        let state = app_state(&dir, "upload_path_field = \"folder\"\n").await;
+        std::fs::create_dir(state.canonical_root.join("docs")).unwrap();
+        let docs = catalog_dir(&state, "docs").await;
+        let docs = docs.to_str().unwrap();
+
+        let saved = multipart_upload(
+            &state,
+            token_headers(),
+            &[("folder", "", docs), ("file", "a.txt", "x")],
+        )
+        .await
+        .unwrap();
+        assert_eq!(saved["dir_id"], docs);
+        assert!(state.canonical_root.join("docs/a.txt").is_file());
+    }
+
+    #[cfg(unix)]
+    #[tokio::test]
+    async fn read_only_target_is_not_writable() {
+        use std::os::unix::fs::PermissionsExt;
+
+        // Root ignores directory permissions, so there is nothing to observe.
+        if unsafe { libc::geteuid() } == 0 {
+            return;
+        }
+        let dir = TempDir::new();
+        let state = app_state(&dir, "").await;
+        let locked = state.canonical_root.join("locked");
+        std::fs::create_dir(&locked).unwrap();
+        let mut headers = token_headers();
+        headers.insert("X-Upload-Dir", catalog_dir(&state, "locked").await);
+        std::fs::set_permissions(&locked, std::fs::Permissions::from_mode(0o555)).unwrap();
+
+        let result = stream_upload(&state, headers, "a.txt", b"a").await;
+        std::fs::set_permissions(&locked, std::fs::Permissions::from_mode(0o755)).unwrap();
+        assert_eq!(error_code(result), error_codes::TARGET_NOT_WRITABLE);
+        assert!(!locked.join("a.txt").exists());
+    }
+
+    /// `PUT /upload-stream?name=<name>` behind the same decompression layers as the router.
+    async fn encoded_upload(
+        state: &AppState,
+        name: &str,
+        encoding: &'static str,
+        body: Vec<u8>,
+    ) -> Response {
+        use tower::ServiceExt;
+
+        let router = axum::Router::new()
+            .route(
+                "/upload-stream",
+                axum::routing::put(handle_upload_stream)
+                    .layer(request_decompression())
+                    .layer(axum::middleware::from_fn(count_wire_bytes)),
+            )
+            .with_state(state.clone());
+        let request = axum::http::Request::builder()
+            .method("PUT")
+            .uri(format!("/upload-stream?name={name}"))
+            .header("X-Serve-Token", "abogoboga")
+            .header(header::CONTENT_ENCODING, encoding)
+            .body(Body::from(body))
+            .unwrap();
+        router.oneshot(request).await.unwrap()
+    }
+
+    fn gzip(content: &[u8]) -> Vec<u8> {
+        use std::io::Write;
+
+        let mut encoder = flate2::write::GzEncoder::new(Vec::new(), flate2::Compression::default());
+        encoder.write_all(content).unwrap();
+        encoder.finish().unwrap()
+    }
+
+    #[tokio::test]
+    async fn gzip_bodies_are_stored_decompressed() {
+        let dir = TempDir::new();
+        let state = app_state(&dir, "max_file_size = 4096\n").await;
+        let content = "a line of the log\n".repeat(100);
+        let response = encoded_upload(&state, "log.txt", "gzip", gzip(content.as_bytes())).await;
+        assert_eq!(response.status(), StatusCode::OK);
+        let stored = std::fs::read_to_string(state.canonical_root.join("log.txt")).unwrap();
+        assert_eq!(stored, content);
+
+        // The limit applies to what decompression produces, not to the wire size.
+        let large = "a line of the log\n".repeat(300);
+        let response = encoded_upload(&state, "large.txt", "gzip", gzip(large.as_bytes())).await;
+        assert_eq!(response.status(), StatusCode::PAYLOAD_TOO_LARGE);
+        assert!(!state.canonical_root.join("large.txt").exists());
+
+        let response = encoded_upload(&state, "a.txt", "br", b"abc".to_vec()).await;
+        assert_eq!(response.status(), StatusCode::UNSUPPORTED_MEDIA_TYPE);
+    }
+
+    #[tokio::test]
+    async fn decompression_bombs_are_cut_off() {
+        let dir = TempDir::new();
+        let state = app_state(&dir, "").await;
+        let zeros = vec![0u8; 8 * 1024 * 1024];
+        let response = encoded_upload(&state, "bomb.txt", "gzip", gzip(&zeros)).await;
+        assert_eq!(response.status(), StatusCode::PAYLOAD_TOO_LARGE);
+        assert_eq!(
+            response.headers()[error_codes::HEADER],
+            error_codes::COMPRESSION_RATIO
+        );
+        assert!(!state.canonical_root.join("bomb.txt").exists());
+    }
+
+    #[tokio::test]
+    async fn upload_failures_carry_their_codes() {
+        let dir = TempDir::new();
+        let state = app_state(&dir, "max_file_size = 4\n").await;
+        let status_and_code = |result: Result<serde_json::Value, AppError>| {
+            result.err().expect("upload should fail").status_and_code()
+        };
+
+        assert_eq!(
+            status_and_code(stream_upload(&state, HeaderMap::new(), "a.txt", b"a").await),
+            (StatusCode::UNAUTHORIZED, error_codes::UNAUTHORIZED)
+        );
+        assert_eq!(
+            status_and_code(stream_upload(&state, token_headers(), "", b"a").await),
+            (StatusCode::BAD_REQUEST, error_codes::MISSING_FILE)
+        );
+        assert_eq!(
+            status_and_code(stream_upload(&state, token_headers(), "tool.xyz", b"a").await),
+            (StatusCode::BAD_REQUEST, error_codes::EXT_NOT_ALLOWED)
+        );
+        assert_eq!(
+            status_and_code(stream_upload(&state, token_headers(), "a.txt", b"too long").await),
+            (StatusCode::PAYLOAD_TOO_LARGE, error_codes::FILE_TOO_LARGE)
+        );
+        let mut headers = token_headers();
+        headers.insert("X-Upload-Dir", HeaderValue::from_static("no-such-id"));
+        assert_eq!(
+            status_and_code(stream_upload(&state, headers, "a.txt", b"a").await),
+            (StatusCode::NOT_FOUND, error_codes::NOT_FOUND)
+        );
+    }
+}
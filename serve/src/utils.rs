@@ -1,5 +1,7 @@
 use chrono::{DateTime, Local};
+use mime_guess::MimeGuess;
 use pathdiff::diff_paths;
+use sha2::{Digest, Sha256};
 use std::collections::HashSet;
 use std::ffi::OsStr;
 use std::path::{Component, Path, PathBuf};
@@ -22,12 +24,43 @@ pub fn format_size(size_bytes: u64) -> String {
     format!("{size:.2} {}", units[unit_index])
 }
 
+/// Entries are plain extensions (`mp4`) or MIME patterns (`image/*`, `application/pdf`)
+/// checked against the type looked up from the extension. An empty list (only reachable by
+/// clearing it explicitly) places no restriction.
 pub fn is_allowed_file(filename: &str, allowed_extensions: &HashSet<String>) -> bool {
-    Path::new(filename)
-        .extension()
-        .and_then(OsStr::to_str)
-        .map(|ext| allowed_extensions.contains(&ext.to_ascii_lowercase()))
-        .unwrap_or(false)
+    allowed_extensions.is_empty() || matches_type_list(filename, allowed_extensions)
+}
+
+/// Whether `filename` matches an entry of a type list written like `allowed_extensions`;
+/// an empty list matches nothing.
+pub fn matches_type_list(filename: &str, allowed_extensions: &HashSet<String>) -> bool {
+    if allowed_extensions.is_empty() {
+        return false;
+    }
+    let Some(ext) = Path::new(filename).extension().and_then(OsStr::to_str) else {
+        return false;
+    };
+    if allowed_extensions.contains(&ext.to_ascii_lowercase()) {
+        return true;
+    }
+
+    let mut patterns = allowed_extensions
+        .iter()
+        .filter(|entry| entry.contains('/'))
+        .peekable();
+    if patterns.peek().is_none() {
+        return false;
+    }
+    let mime = mime_type_for(Path::new(filename)).to_ascii_lowercase();
+    if mime == "application/octet-stream" {
+        return false;
+    }
+    patterns.any(|pattern| match pattern.strip_suffix("/*") {
+        Some(category) => mime
+            .split_once('/')
+            .is_some_and(|(kind, _)| kind == category),
+        None => *pattern == mime,
+    })
 }
 
 pub fn secure_filename(name: &str) -> Option<String> {
@@ -54,6 +87,73 @@ pub fn secure_filename(name: &str) -> Option<String> {
     }
 }
 
+/// Shortens `name` to at most `max` characters by replacing the middle with an ellipsis,
+/// keeping the extension visible. A `max` of 0 leaves the name untouched.
+pub fn truncate_middle(name: &str, max: usize) -> String {
+    let chars: Vec<char> = name.chars().collect();
+    if max == 0 || chars.len() <= max {
+        return name.to_string();
+    }
+
+    let ext_len = name
+        .rfind('.')
+        .filter(|&idx| idx > 0)
+        .map(|idx| name[idx..].chars().count())
+        .unwrap_or(0);
+    // Keep at least two stem characters around the ellipsis; otherwise give up on the
+    // extension and cut the whole name.
+    let (stem_len, ext_len) = if max >= ext_len + 3 {
+        (chars.len() - ext_len, ext_len)
+    } else {
+        (chars.len(), 0)
+    };
+
+    let keep = max.saturating_sub(ext_len + 1);
+    let front = keep.div_ceil(2);
+    let back = keep - front;
+
+    let mut out = String::with_capacity(max * 4);
+    out.extend(&chars[..front]);
+    out.push('…');
+    out.extend(&chars[stem_len - back..]);
+    out
+}
+
+/// Types pinned regardless of what the bundled `mime_guess` table says, so listings and
+/// downloads agree on modern web/media formats across releases of that crate.
+const PINNED_MIME_TYPES: &[(&str, &str)] = &[
+    ("avif", "image/avif"),
+    ("flac", "audio/flac"),
+    ("heic", "image/heic"),
+    ("js", "text/javascript"),
+    ("m4a", "audio/mp4"),
+    ("md", "text/markdown"),
+    ("mjs", "text/javascript"),
+    ("mkv", "video/x-matroska"),
+    ("opus", "audio/ogg"),
+    ("svg", "image/svg+xml"),
+    ("wasm", "application/wasm"),
+    ("webmanifest", "application/manifest+json"),
+    ("webm", "video/webm"),
+    ("webp", "image/webp"),
+];
+
+pub fn mime_type_for(path: &Path) -> String {
+    let pinned = path.extension().and_then(OsStr::to_str).and_then(|ext| {
+        PINNED_MIME_TYPES
+            .iter()
+            .find(|(known, _)| known.eq_ignore_ascii_case(ext))
+            .map(|(_, mime)| *mime)
+    });
+    pinned
+        .unwrap_or_else(|| {
+            MimeGuess::from_path(path)
+                .first_raw()
+                .unwrap_or("application/octet-stream")
+        })
+        .to_string()
+}
+
 pub fn format_modified_time(time: DateTime<Local>) -> String {
     time.format("%Y-%m-%d %H:%M:%S").to_string()
 }
@@ -84,11 +184,20 @@ pub fn resolve_within_root(root: &Path, requested_path: &str) -> Option<PathBuf>
     Some(candidate)
 }
 
+/// Entries match a file name, a root-relative path prefix, or a `*.suffix` name pattern.
 pub fn is_blacklisted(full_path: &Path, root: &Path, blacklisted: &HashSet<String>) -> bool {
     if let Some(name) = full_path.file_name().and_then(|s| s.to_str()) {
         if blacklisted.contains(name) {
             return true;
         }
+        let suffix_match = blacklisted.iter().any(|entry| {
+            entry
+                .strip_prefix('*')
+                .is_some_and(|suffix| !suffix.is_empty() && name.ends_with(suffix))
+        });
+        if suffix_match {
+            return true;
+        }
     }
 
     for entry in blacklisted {
@@ -101,6 +210,116 @@ pub fn is_blacklisted(full_path: &Path, root: &Path, blacklisted: &HashSet<Strin
     false
 }
 
+/// Shell-style match of a whole `/`-separated path, like Go's `filepath.Match`: `*` and `?`
+/// never cross a `/`, `[...]` is a character class (`[^...]` or `[!...]` negates, `a-z`
+/// ranges) and `\` escapes the next character. A malformed pattern matches nothing.
+pub fn glob_match(pattern: &str, name: &str) -> bool {
+    let pattern: Vec<char> = pattern.chars().collect();
+    let name: Vec<char> = name.chars().collect();
+    glob_match_chars(&pattern, &name).unwrap_or(false)
+}
+
+/// Whether every class in `pattern` is closed and no escape is left dangling.
+pub fn is_valid_glob(pattern: &str) -> bool {
+    let pattern: Vec<char> = pattern.chars().collect();
+    let mut i = 0;
+    while i < pattern.len() {
+        i = match pattern[i] {
+            '\\' if i + 1 < pattern.len() => i + 2,
+            '\\' => return false,
+            '[' => match glob_class(&pattern, i + 1, '\0') {
+                Some((_, next)) => next,
+                None => return false,
+            },
+            _ => i + 1,
+        };
+    }
+    true
+}
+
+/// `None` for a malformed pattern.
+fn glob_match_chars(pattern: &[char], name: &[char]) -> Option<bool> {
+    let (mut p, mut n) = (0, 0);
+    // Where to retry after a mismatch: the pattern just past the last `*`, and the first
+    // name character that `*` has not swallowed yet.
+    let mut star: Option<(usize, usize)> = None;
+    while n < name.len() {
+        if p < pattern.len() {
+            let next = match pattern[p] {
+                '*' => {
+                    p += 1;
+                    star = Some((p, n));
+                    continue;
+                }
+                '?' => (name[n] != '/').then_some(p + 1),
+                '[' => {
+                    let (matched, next) = glob_class(pattern, p + 1, name[n])?;
+                    (matched && name[n] != '/').then_some(next)
+                }
+                '\\' => {
+                    let literal = *pattern.get(p + 1)?;
+                    (literal == name[n]).then_some(p + 2)
+                }
+                literal => (literal == name[n]).then_some(p + 1),
+            };
+            if let Some(next) = next {
+                p = next;
+                n += 1;
+                continue;
+            }
+        }
+        match star {
+            Some((resume, swallowed)) if name[swallowed] != '/' => {
+                star = Some((resume, swallowed + 1));
+                p = resume;
+                n = swallowed + 1;
+            }
+            _ => return Some(false),
+        }
+    }
+    while pattern.get(p) == Some(&'*') {
+        p += 1;
+    }
+    Some(p == pattern.len())
+}
+
+/// Matches `c` against the class starting at `start` (just past `[`). Returns whether it
+/// matched and the index after the closing `]`, or `None` if the class never closes.
+fn glob_class(pattern: &[char], start: usize, c: char) -> Option<(bool, usize)> {
+    let mut i = start;
+    let negated = matches!(pattern.get(i), Some('^' | '!'));
+    if negated {
+        i += 1;
+    }
+    let mut matched = false;
+    let mut first = true;
+    loop {
+        let mut lo = *pattern.get(i)?;
+        if lo == ']' && !first {
+            return Some((matched != negated, i + 1));
+        }
+        first = false;
+        if lo == '\\' {
+            i += 1;
+            lo = *pattern.get(i)?;
+        }
+        i += 1;
+        let mut hi = lo;
+        if pattern.get(i) == Some(&'-') && pattern.get(i + 1).is_some_and(|&ch| ch != ']') {
+            i += 1;
+            hi = *pattern.get(i)?;
+            if hi == '\\' {
+                i += 1;
+                hi = *pattern.get(i)?;
+            }
+            i += 1;
+        }
+        if lo <= c && c <= hi {
+            matched = true;
+        }
+    }
+}
+
 pub fn relative_path_string(root: &Path, target: &Path) -> Option<String> {
     let relative = diff_paths(target, root)?;
     if relative.components().next().is_none() {
@@ -121,6 +340,16 @@ pub fn relative_path_string(root: &Path, target: &Path) -> Option<String> {
     Some(parts.join("/"))
 }
 
+/// Deterministic listing id: the first 16 hex digits of the SHA-256 of the root-relative
+/// path. Unlike catalog ids it survives a catalog rebuild, so clients can diff listings.
+pub fn path_id(relative_path: &str) -> String {
+    let digest = Sha256::digest(relative_path.trim_matches('/').as_bytes());
+    digest[..8]
+        .iter()
+        .map(|byte| format!("{byte:02x}"))
+        .collect()
+}
+
 pub fn parent_relative_path(path: &str) -> Option<String> {
     let trimmed = path.trim_matches('/');
     if trimmed.is_empty() {
@@ -139,3 +368,93 @@ pub fn unix_timestamp(time: SystemTime) -> i64 {
         .unwrap_or(Duration::from_secs(0))
         .as_secs() as i64
 }
+
+/// Go-style duration such as `"30s"`, `"1h30m"` or `"1.5d"`: numbers with `ms`, `s`, `m`,
+/// `h` or `d` units, run together. A bare `"0"` is zero.
+pub fn parse_duration(value: &str) -> Option<Duration> {
+    let trimmed = value.trim();
+    if trimmed == "0" {
+        return Some(Duration::ZERO);
+    }
+    if trimmed.is_empty() {
+        return None;
+    }
+
+    let mut total = Duration::ZERO;
+    let mut rest = trimmed;
+    while !rest.is_empty() {
+        let digits = rest.find(|c: char| !c.is_ascii_digit() && c != '.')?;
+        let amount: f64 = rest[..digits].parse().ok()?;
+        rest = &rest[digits..];
+        let unit_len = rest
+            .find(|c: char| c.is_ascii_digit() || c == '.')
+            .unwrap_or(rest.len());
+        let unit_secs = match &rest[..unit_len] {
+            "ms" => 0.001,
+            "s" => 1.0,
+            "m" => 60.0,
+            "h" => 3600.0,
+            "d" => 86_400.0,
+            _ => return None,
+        };
+        rest = &rest[unit_len..];
+        total += Duration::try_from_secs_f64(amount * unit_secs).ok()?;
+    }
+    Some(total)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn truncate_middle_keeps_the_extension() {
+        assert_eq!(truncate_middle("holiday-photo.jpeg", 12), "hol…oto.jpeg");
+        assert_eq!(truncate_middle("a.txt", 10), "a.txt");
+        assert_eq!(
+            truncate_middle("holiday-photo.jpeg", 0),
+            "holiday-photo.jpeg"
+        );
+    }
+
+    #[test]
+    fn truncate_middle_counts_characters() {
+        let name = "日本語のファイル名.txt";
+        let short = truncate_middle(name, 10);
+        assert_eq!(short, "日本語…ル名.txt");
+        assert_eq!(short.chars().count(), 10);
+    }
+
+    #[test]
+    fn truncate_middle_drops_an_extension_that_does_not_fit() {
+        assert_eq!(truncate_middle("report.longextension", 8), "repo…ion");
+    }
+
+    #[test]
+    fn allowed_extensions_mix_names_and_mime_patterns() {
+        let allowed: HashSet<String> = ["mp4", "image/*", "application/pdf"]
+            .into_iter()
+            .map(str::to_string)
+            .collect();
+        assert!(is_allowed_file("clip.mp4", &allowed));
+        assert!(is_allowed_file("CLIP.MP4", &allowed));
+        assert!(is_allowed_file("photo.png", &allowed));
+        assert!(is_allowed_file("scan.jpeg", &allowed));
+        assert!(is_allowed_file("paper.pdf", &allowed));
+        assert!(!is_allowed_file("notes.txt", &allowed));
+        assert!(!is_allowed_file("archive.zip", &allowed));
+        assert!(!is_allowed_file("README", &allowed));
+        assert!(is_allowed_file("anything.bin", &HashSet::new()));
+    }
+
+    #[test]
+    fn web_types_resolve_to_pinned_mime_types() {
+        assert_eq!(mime_type_for(Path::new("hero.webp")), "image/webp");
+        assert_eq!(mime_type_for(Path::new("logo.SVG")), "image/svg+xml");
+        assert_eq!(mime_type_for(Path::new("app.mjs")), "text/javascript");
+        assert_eq!(
+            mime_type_for(Path::new("unknown.zzz")),
+            "application/octet-stream"
+        );
+    }
+}
@@ -0,0 +1,234 @@
+//! Bounded directory walks shared by every recursive feature (catalog scans, archives,
+//! search, size totals) so root confinement, the blacklist, depth limits and cancellation
+//! live in one place.
+
+use std::collections::HashSet;
+use std::ops::ControlFlow;
+use std::path::Path;
+
+use tokio_util::sync::CancellationToken;
+use walkdir::{DirEntry, WalkDir};
+
+use crate::utils::{is_blacklisted, relative_path_string};
+
+/// What to do with symbolic links met during a walk.
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub(crate) enum SymlinkPolicy {
+    /// Leave links out entirely.
+    Skip,
+    /// Report the link itself but never descend through it.
+    Include,
+    /// Descend through links whose target stays inside the root; others are skipped.
+    Follow,
+}
+
+pub(crate) struct WalkOptions<'a> {
+    pub(crate) blacklist: &'a HashSet<String>,
+    /// Levels below the starting directory to visit; 0 means unlimited.
+    pub(crate) max_depth: usize,
+    pub(crate) symlinks: SymlinkPolicy,
+    pub(crate) cancel: Option<&'a CancellationToken>,
+}
+
+pub(crate) struct WalkedEntry<'a> {
+    pub(crate) entry: &'a DirEntry,
+    /// Path relative to the root, `/`-separated; empty for the root itself.
+    pub(crate) relative_path: String,
+}
+
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub(crate) enum WalkOutcome {
+    Completed,
+    /// The visitor returned `ControlFlow::Break`.
+    Stopped,
+    Cancelled,
+}
+
+/// Walks `start` (which must lie under `root`) and calls `visit` for each entry, starting
+/// with `start` itself. Unreadable entries are logged and skipped rather than aborting.
+pub(crate) fn walk_within<F>(
+    root: &Path,
+    start: &Path,
+    options: &WalkOptions<'_>,
+    mut visit: F,
+) -> WalkOutcome
+where
+    F: FnMut(WalkedEntry<'_>) -> ControlFlow<()>,
+{
+    let mut walker = WalkDir::new(start).follow_links(options.symlinks == SymlinkPolicy::Follow);
+    if options.max_depth > 0 {
+        walker = walker.max_depth(options.max_depth);
+    }
+
+    let mut iter = walker.into_iter();
+    while let Some(entry) = iter.next() {
+        if options.cancel.is_some_and(|cancel| cancel.is_cancelled()) {
+            return WalkOutcome::Cancelled;
+        }
+
+        let entry = match entry {
+            Ok(entry) => entry,
+            Err(err) => {
+                tracing::warn!("Walk error: {}", err);
+                continue;
+            }
+        };
+
+        let path = entry.path();
+        let is_dir = entry.file_type().is_dir();
+        let skip = is_blacklisted(path, root, options.blacklist)
+            || (entry.path_is_symlink() && !symlink_allowed(root, path, options.symlinks));
+        if skip {
+            if is_dir {
+                iter.skip_current_dir();
+            }
+            continue;
+        }
+
+        let Some(relative_path) = relative_path_string(root, path) else {
+            if is_dir {
+                iter.skip_current_dir();
+            }
+            continue;
+        };
+
+        if visit(WalkedEntry {
+            entry: &entry,
+            relative_path,
+        })
+        .is_break()
+        {
+            return WalkOutcome::Stopped;
+        }
+    }
+
+    WalkOutcome::Completed
+}
+
+fn symlink_allowed(root: &Path, path: &Path, policy: SymlinkPolicy) -> bool {
+    match policy {
+        SymlinkPolicy::Skip => false,
+        SymlinkPolicy::Include => true,
+        SymlinkPolicy::Follow => path
+            .canonicalize()
+            .map(|target| target.starts_with(root))
+            .unwrap_or(false),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::path::PathBuf;
+
+    use super::*;
+    use crate::test_support::TempDir;
+
+    /// `root/{a.txt, sub/b.txt, sub/deep/c.txt, utils/secret.txt}` next to `outside/d.txt`.
+    fn tree(dir: &TempDir) -> PathBuf {
+        let root = dir.path().join("root");
+        std::fs::create_dir_all(root.join("sub/deep")).unwrap();
+        std::fs::create_dir_all(root.join("utils")).unwrap();
+        std::fs::create_dir_all(dir.path().join("outside")).unwrap();
+        for file in ["a.txt", "sub/b.txt", "sub/deep/c.txt", "utils/secret.txt"] {
+            std::fs::write(root.join(file), file).unwrap();
+        }
+        std::fs::write(dir.path().join("outside/d.txt"), "d").unwrap();
+        root.canonicalize().unwrap()
+    }
+
+    fn walked(root: &Path, max_depth: usize, symlinks: SymlinkPolicy) -> Vec<String> {
+        let blacklist = HashSet::from(["utils".to_string()]);
+        let options = WalkOptions {
+            blacklist: &blacklist,
+            max_depth,
+            symlinks,
+            cancel: None,
+        };
+        let mut paths = Vec::new();
+        let outcome = walk_within(root, root, &options, |walked| {
+            paths.push(walked.relative_path);
+            ControlFlow::Continue(())
+        });
+        assert_eq!(outcome, WalkOutcome::Completed);
+        paths.sort();
+        paths
+    }
+
+    #[test]
+    fn depth_limits_and_the_blacklist() {
+        let dir = TempDir::new();
+        let root = tree(&dir);
+        assert_eq!(walked(&root, 1, SymlinkPolicy::Skip), ["", "a.txt", "sub"]);
+        assert_eq!(
+            walked(&root, 2, SymlinkPolicy::Skip),
+            ["", "a.txt", "sub", "sub/b.txt", "sub/deep"]
+        );
+        assert_eq!(
+            walked(&root, 0, SymlinkPolicy::Skip),
+            [
+                "",
+                "a.txt",
+                "sub",
+                "sub/b.txt",
+                "sub/deep",
+                "sub/deep/c.txt"
+            ]
+        );
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn symlink_policies() {
+        use std::os::unix::fs::symlink;
+
+        let dir = TempDir::new();
+        let root = tree(&dir);
+        std::fs::remove_dir_all(root.join("sub/deep")).unwrap();
+        symlink(root.join("sub"), root.join("inner")).unwrap();
+        symlink(dir.path().join("outside"), root.join("escape")).unwrap();
+
+        assert_eq!(
+            walked(&root, 0, SymlinkPolicy::Skip),
+            ["", "a.txt", "sub", "sub/b.txt"]
+        );
+        assert_eq!(
+            walked(&root, 0, SymlinkPolicy::Include),
+            ["", "a.txt", "escape", "inner", "sub", "sub/b.txt"]
+        );
+        assert_eq!(
+            walked(&root, 0, SymlinkPolicy::Follow),
+            ["", "a.txt", "inner", "inner/b.txt", "sub", "sub/b.txt"]
+        );
+    }
+
+    #[test]
+    fn visitors_can_stop_and_tokens_cancel() {
+        let dir = TempDir::new();
+        let root = tree(&dir);
+        let blacklist = HashSet::new();
+        let cancel = CancellationToken::new();
+        let options = WalkOptions {
+            blacklist: &blacklist,
+            max_depth: 0,
+            symlinks: SymlinkPolicy::Skip,
+            cancel: Some(&cancel),
+        };
+
+        let mut visited = 0;
+        let outcome = walk_within(&root, &root, &options, |_| {
+            visited += 1;
+            if visited == 2 {
+                ControlFlow::Break(())
+            } else {
+                ControlFlow::Continue(())
+            }
+        });
+        assert_eq!((outcome, visited), (WalkOutcome::Stopped, 2));
+
+        cancel.cancel();
+        let outcome = walk_within(&root, &root, &options, |_| {
+            panic!("cancelled walks visit nothing")
+        });
+        assert_eq!(outcome, WalkOutcome::Cancelled);
+    }
+}